@@ -2,11 +2,12 @@ package main
 
 import (
 	"database/sql"
-	"encoding/csv"
+	"flag"
 	"fmt"
-	"io"
-	"log"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"       // 数値変換のため追加
 	"time"          // 日付変換のため追加
 
@@ -15,234 +16,461 @@ import (
 
 const dsn = "user:password@tcp(db:3306)/appdb?parseTime=true"
 
+// -null-prices の設定値
+const (
+	NULL_PRICES_REPORT = "report" // price が NULL の基準価額を一覧表示する (インポートは行わない)
+	NULL_PRICES_DELETE = "delete" // price が NULL の基準価額を削除する (インポートは行わない)
+)
+
+// インポートするCSVファイル名 (TRADE_CSV, PRICES_CSV のデフォルト。DATA_DIR のデフォルトは importer.go)
+const (
+	DEFAULT_TRADE_CSV  = "trade_history.csv"
+	DEFAULT_PRICES_CSV = "reference_prices.csv"
+)
+
 func main() {
+	// go run db_init.go importer.go version でビルド情報を表示して終了する
+	if len(os.Args) > 1 && os.Args[1] == "version" {
+		fmt.Println(buildInfo())
+		return
+	}
+
+	checkRefs := flag.String("check-refs", CHECK_REFS_OFF, "取引のfund_idに基準価額が存在するかのチェック (off, warn, error)")
+	workers := flag.Int("workers", 1, "取引履歴を挿入するワーカー数。2以上の場合はバッチごとに別トランザクションで並列に挿入する")
+	appendTrades := flag.Bool("append", false, "trade_histories に既にデータがある場合も取引履歴を追加でインポートする")
+	maxImports := flag.Int("max-imports", 1, "同じデータベースに対して同時に実行できるインポートの数")
+	columnsSpec := flag.String("columns", "", "trade_history.csv の各項目の列番号 (0始まり)。例: user_id=0,fund_id=2,quantity=1,trade_date=3。未指定の場合は標準の順序")
+	lockTimeout := flag.Duration("lock-timeout", 0, "実行中のインポートが上限に達している場合に空きを待つ時間。0 の場合は待たずに失敗する")
+	dryRun := flag.Bool("dry-run", false, "基準価額と取引履歴のCSVをパース・検証して挿入まで行い、最後にロールバックする (データは書き込まれない)")
+	nullPrices := flag.String("null-prices", "", "price が NULL の基準価額を確認する。report は一覧を表示し、delete は削除する (いずれもインポートは行わない)")
+	flag.Parse()
+	// LOG_LEVEL 未満のログは出力しない (未設定の場合は info)
+	logLevel, err := parseLogLevel(os.Getenv("LOG_LEVEL"))
+	if err != nil {
+		fatal("環境変数の読み込みに失敗しました", "error", err)
+	}
+	slog.SetDefault(slog.New(newLogHandler(logLevel)))
+	slog.Info("インポートツールを起動します", "version", Version, "commit", Commit, "build_date", BuildDate)
+	if *nullPrices != "" && *nullPrices != NULL_PRICES_REPORT && *nullPrices != NULL_PRICES_DELETE {
+		fatal(fmt.Sprintf("-null-prices には %s または %s を指定してください", NULL_PRICES_REPORT, NULL_PRICES_DELETE), "value", *nullPrices)
+	}
+	if *checkRefs != CHECK_REFS_OFF && *checkRefs != CHECK_REFS_WARN && *checkRefs != CHECK_REFS_ERROR {
+		fatal(fmt.Sprintf("-check-refs には %s, %s, %s のいずれかを指定してください", CHECK_REFS_OFF, CHECK_REFS_WARN, CHECK_REFS_ERROR), "value", *checkRefs)
+	}
+	columns, err := parseTradeColumns(*columnsSpec)
+	if err != nil {
+		fatal("-columns の指定が不正です", "error", err)
+	}
+	if *workers < 1 {
+		fatal("-workers には1以上を指定してください", "value", *workers)
+	}
+	if *maxImports < 1 {
+		fatal("-max-imports には1以上を指定してください", "value", *maxImports)
+	}
+	// 並列インポートはバッチごとにコミットするため、ロールバックで取り消すドライランはできない
+	if *workers > 1 && *dryRun {
+		fatal("-dry-run は -workers=1 の場合のみ指定できます")
+	}
+	// 並列インポートはバッチごとにコミットするため、チェック結果でインポート全体を取り消すことができない
+	if *workers > 1 && *checkRefs == CHECK_REFS_ERROR {
+		fatal(fmt.Sprintf("-check-refs=%s は -workers=1 の場合のみ指定できます", CHECK_REFS_ERROR))
+	}
+
+	// 取引履歴のインポートで1つの INSERT 文にまとめる行数
+	if v := os.Getenv("IMPORT_BATCH_SIZE"); v != "" {
+		importBatchSize, err = strconv.Atoi(v)
+		if err != nil || importBatchSize <= 0 || importBatchSize > MAX_IMPORT_BATCH_SIZE {
+			fatal(fmt.Sprintf("IMPORT_BATCH_SIZE は1以上%d以下の整数で指定してください", MAX_IMPORT_BATCH_SIZE), "value", v)
+		}
+	}
+
+	// 取引履歴の不正な行を最初の1件で止めずにまとめて報告するか
+	if v := os.Getenv("IMPORT_COLLECT_ERRORS"); v != "" {
+		importCollectErrors, err = strconv.ParseBool(v)
+		if err != nil {
+			fatal("IMPORT_COLLECT_ERRORS は true または false で指定してください", "value", v)
+		}
+	}
+	// 並列インポートは不正な行を見つけた時点で挿入済みのバッチが残るため、まとめて報告して何も挿入しない動作にできない
+	if *workers > 1 && importCollectErrors {
+		fatal("IMPORT_COLLECT_ERRORS=true は -workers=1 の場合のみ指定できます")
+	}
+
+	// CSVファイルの区切り文字 (タブ区切りのファイルは \t を指定する)
+	if v := os.Getenv("IMPORT_DELIMITER"); v != "" {
+		importDelimiter, err = parseImportDelimiter(v)
+		if err != nil {
+			fatal("環境変数の読み込みに失敗しました", "error", err)
+		}
+	}
+
+	// 取引日の基準価額が無い取引が残る場合に、警告ではなくエラーにしてロールバックするか
+	if v := os.Getenv("IMPORT_STRICT"); v != "" {
+		importStrict, err = strconv.ParseBool(v)
+		if err != nil {
+			fatal("IMPORT_STRICT は true または false で指定してください", "value", v)
+		}
+	}
+	// 並列インポートはバッチごとにコミットするため、基準価額の無い取引が見つかってもインポート全体をロールバックできない
+	if *workers > 1 && importStrict {
+		fatal("IMPORT_STRICT=true は -workers=1 の場合のみ指定できます")
+	}
+
+	// 基準価額を LOAD DATA LOCAL INFILE で一括して取り込むか
+	if v := os.Getenv("IMPORT_FAST"); v != "" {
+		importFast, err = strconv.ParseBool(v)
+		if err != nil {
+			fatal("IMPORT_FAST は true または false で指定してください", "value", v)
+		}
+	}
+
+	// 既に同じファンド・日付の基準価額がある場合に、エラーにせず価格を更新するか
+	if v := os.Getenv("IMPORT_UPSERT"); v != "" {
+		importUpsert, err = strconv.ParseBool(v)
+		if err != nil {
+			fatal("IMPORT_UPSERT は true または false で指定してください", "value", v)
+		}
+	}
+
 	db, err := sql.Open("mysql", dsn)
 	if err != nil {
-		log.Fatalf("データベースへの接続に失敗しました: %v", err)
+		fatal("データベースへの接続に失敗しました", "error", err)
 	}
 	defer db.Close()
 
 	// データベース接続の確認とリトライ
-	for i := 0; i < 10; i++ { // あなたの以前のコードから追加
-		err = db.Ping()
-		if err == nil {
-			log.Println("データベースに正常に接続しました。")
-			break
+	retryAttempts := DEFAULT_DB_RETRY_ATTEMPTS
+	if v := os.Getenv("DB_RETRY_ATTEMPTS"); v != "" {
+		retryAttempts, err = strconv.Atoi(v)
+		if err != nil || retryAttempts <= 0 {
+			fatal("DB_RETRY_ATTEMPTS は1以上の整数で指定してください", "value", v)
 		}
-		log.Printf("データベースへの接続確認 (Ping) に失敗しました (試行 %d/10): %v", i+1, err)
-		time.Sleep(2 * time.Second)
 	}
+	retryInterval := DEFAULT_DB_RETRY_INTERVAL
+	if v := os.Getenv("DB_RETRY_INTERVAL"); v != "" {
+		retryInterval, err = time.ParseDuration(v)
+		if err != nil || retryInterval < 0 {
+			fatal("DB_RETRY_INTERVAL は 2s のような時間で指定してください", "value", v)
+		}
+	}
+	err = waitForDB(db, retryAttempts, retryInterval)
+	if err != nil {
+		fatal("データベースが準備できませんでした", "error", err)
+	}
+
+	// 大きなトランザクションが重なって MySQL に負荷がかからないよう、同時に実行するインポートの数を制限する
+	releaseImportSlot, err := acquireImportSlot(db, *maxImports, *lockTimeout)
 	if err != nil {
-		log.Fatalf("データベースが準備できませんでした: %v", err)
+		fatal("インポートを開始できませんでした", "error", err)
 	}
+	defer releaseImportSlot()
 
 	// --- ここからテーブル作成ロジック ---
-	log.Println("Creating tables if they do not exist...")
+	slog.Info("テーブルが存在しない場合は作成します...")
 
 	createTradeHistoriesSQL := `
     CREATE TABLE IF NOT EXISTS trade_histories (
+        id BIGINT NOT NULL AUTO_INCREMENT,
         user_id VARCHAR(255) NOT NULL,
         fund_id INT NOT NULL,
         quantity INT NOT NULL,
         trade_date DATE NOT NULL,
-        PRIMARY KEY (user_id, fund_id, trade_date)
+        PRIMARY KEY (id),
+        INDEX idx_user_fund_date (user_id, fund_id, trade_date)
     );`
 
-	createReferencePricesSQL := `
+	// 基準価額の精度は APIサーバーと同じく PRICE_PRECISION / PRICE_SCALE で変更できる
+	pricePrecision, priceScale, err := priceColumnType()
+	if err != nil {
+		fatal("基準価額の列の型の設定が不正です", "error", err)
+	}
+	createReferencePricesSQL := fmt.Sprintf(`
     CREATE TABLE IF NOT EXISTS reference_prices (
         fund_id INT NOT NULL,
-        price DECIMAL(10, 2) NOT NULL,
+        price DECIMAL(%d, %d) NOT NULL,
         price_date DATE NOT NULL,
         PRIMARY KEY (fund_id, price_date)
+    );`, pricePrecision, priceScale)
+
+	// インポートの最終実行時刻 (APIサーバーの Last-Modified 判定に使用)
+	createImportMetadataSQL := `
+    CREATE TABLE IF NOT EXISTS import_metadata (
+        table_name VARCHAR(64) NOT NULL,
+        imported_at DATETIME NOT NULL,
+        PRIMARY KEY (table_name)
+    );`
+
+	// 基準価額のインポートバッチと、バッチごとに取り込んだ基準価額のスナップショット
+	// (APIサーバーで priceVersion を指定して評価する際に使用)
+	createPriceImportBatchesSQL := `
+    CREATE TABLE IF NOT EXISTS price_import_batches (
+        id BIGINT NOT NULL AUTO_INCREMENT,
+        source VARCHAR(255) NOT NULL,
+        imported_at DATETIME NOT NULL,
+        PRIMARY KEY (id)
+    );`
+
+	createReferencePriceVersionsSQL := fmt.Sprintf(`
+    CREATE TABLE IF NOT EXISTS reference_price_versions (
+        import_batch BIGINT NOT NULL,
+        fund_id INT NOT NULL,
+        price DECIMAL(%d, %d) NOT NULL,
+        price_date DATE NOT NULL,
+        PRIMARY KEY (import_batch, fund_id, price_date),
+        INDEX idx_fund_date (fund_id, price_date)
+    );`, pricePrecision, priceScale)
+
+	// 分配金 (APIサーバーで評価損益を基準価額の変動と分配金に分ける際に使用)
+	createDistributionsSQL := `
+    CREATE TABLE IF NOT EXISTS distributions (
+        user_id VARCHAR(255) NOT NULL,
+        fund_id INT NOT NULL,
+        amount DECIMAL(18, 2) NOT NULL,
+        distribution_date DATE NOT NULL,
+        PRIMARY KEY (user_id, fund_id, distribution_date)
+    );`
+
+	// 他の口座からの移管 (APIサーバーで移管元での取得価額のまま保有口数に含める)
+	createTransfersSQL := `
+    CREATE TABLE IF NOT EXISTS transfers (
+        id BIGINT NOT NULL AUTO_INCREMENT,
+        user_id VARCHAR(255) NOT NULL,
+        fund_id INT NOT NULL,
+        quantity INT NOT NULL,
+        cost_basis DECIMAL(18, 2) NOT NULL,
+        transfer_date DATE NOT NULL,
+        PRIMARY KEY (id),
+        INDEX idx_user_fund_date (user_id, fund_id, transfer_date)
     );`
 
 	_, err = db.Exec(createTradeHistoriesSQL)
 	if err != nil {
-		log.Fatalf("Failed to create trade_histories table: %v", err)
+		fatal("trade_histories テーブルの作成に失敗しました", "error", err)
 	}
-	log.Println("trade_histories table created or already exists.")
+	slog.Info("trade_histories テーブルは作成済み、または既に存在します。")
 
-	_, err = db.Exec(createReferencePricesSQL)
+	// 以前の (user_id, fund_id, trade_date) の主キーのテーブルでは同じ日の取引を複数登録できないため、id 列を追加する
+	err = migrateTradeHistoriesID(db)
 	if err != nil {
-		log.Fatalf("Failed to create reference_prices table: %v", err)
+		fatal("trade_histories.id 列の移行に失敗しました", "error", err)
 	}
-	log.Println("reference_prices table created or already exists.")
 
-	log.Println("All necessary tables are ensured.")
-	// --- テーブル作成ロジックここまで ---
-
-	// --- ここからデータのインポート ---
-	// /app/data/ にCSVファイルがあることを想定
-	err = importTradeHistories(db, "/app/data/trade_history.csv")
+	_, err = db.Exec(createReferencePricesSQL)
 	if err != nil {
-		log.Fatalf("trade_history.csv のインポートに失敗しました: %v", err)
+		fatal("reference_prices テーブルの作成に失敗しました", "error", err)
 	}
-	fmt.Println("trade_history.csv のインポートが完了しました。")
+	slog.Info("reference_prices テーブルは作成済み、または既に存在します。")
 
-	err = importReferencePrices(db, "/app/data/reference_prices.csv")
+	// 以前の DECIMAL(10, 2) のテーブルに小数4桁の価格を入れると丸められるため、インポート前に列を広げる
+	err = migratePriceColumn(db, pricePrecision, priceScale)
 	if err != nil {
-		log.Fatalf("reference_prices.csv のインポートに失敗しました: %v", err)
+		fatal("reference_prices.price 列の型の変更に失敗しました", "error", err)
 	}
-	fmt.Println("reference_prices.csv のインポートが完了しました。")
-	// --- データのインポートここまで ---
-}
 
-// importTradeHistories は trade_history.csv を読み込み、trade_histories テーブルに挿入します
-func importTradeHistories(db *sql.DB, csvFilePath string) error {
-	fmt.Printf("trade_histories のインポートを開始: %s\n", csvFilePath)
-
-	file, err := os.Open(csvFilePath)
+	_, err = db.Exec(createImportMetadataSQL)
 	if err != nil {
-		return fmt.Errorf("CSVファイル '%s' を開けませんでした: %w", csvFilePath, err)
+		fatal("import_metadata テーブルの作成に失敗しました", "error", err)
 	}
-	defer file.Close()
-
-	reader := csv.NewReader(file)
-	reader.FieldsPerRecord = -1 // レコードごとにフィールド数が異なることを許容
-	reader.TrimLeadingSpace = true // フィールドの先頭/末尾の空白をトリム
+	slog.Info("import_metadata テーブルは作成済み、または既に存在します。")
 
-	// ヘッダー行をスキップ
-	_, err = reader.Read()
+	_, err = db.Exec(createPriceImportBatchesSQL)
 	if err != nil {
-		if err == io.EOF {
-			return fmt.Errorf("trade_history.csv が空です")
-		}
-		return fmt.Errorf("trade_history.csv のヘッダー読み込みに失敗: %w", err)
+		fatal("price_import_batches テーブルの作成に失敗しました", "error", err)
 	}
+	slog.Info("price_import_batches テーブルは作成済み、または既に存在します。")
 
-	tx, err := db.Begin() // トランザクションを開始
+	_, err = db.Exec(createReferencePriceVersionsSQL)
 	if err != nil {
-		return fmt.Errorf("トランザクションの開始に失敗しました: %w", err)
+		fatal("reference_price_versions テーブルの作成に失敗しました", "error", err)
 	}
-	// エラー発生時にロールバック、成功時にコミット
-	defer func() {
-		if r := recover(); r != nil {
-			tx.Rollback()
-			panic(r) // 再パニック
-		} else if err != nil {
-			tx.Rollback() // エラーがあればロールバック
-		} else {
-			err = tx.Commit() // エラーがなければコミット
-		}
-	}()
+	slog.Info("reference_price_versions テーブルは作成済み、または既に存在します。")
 
-	stmt, err := tx.Prepare("INSERT INTO trade_histories (user_id, fund_id, quantity, trade_date) VALUES (?, ?, ?, ?)")
+	_, err = db.Exec(createDistributionsSQL)
 	if err != nil {
-		return fmt.Errorf("trade_histories のプリペアドステートメント準備に失敗: %w", err)
+		fatal("distributions テーブルの作成に失敗しました", "error", err)
 	}
-	defer stmt.Close()
-
-	recordsInserted := 0
-	for {
-		record, err := reader.Read()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return fmt.Errorf("trade_history.csv のレコード読み込みに失敗: %w", err)
-		}
+	slog.Info("distributions テーブルは作成済み、または既に存在します。")
 
-		if len(record) != 4 {
-			return fmt.Errorf("trade_history.csv の行の列数が不正です（期待:4, 実際:%d）: %v", len(record), record)
-		}
+	_, err = db.Exec(createTransfersSQL)
+	if err != nil {
+		fatal("transfers テーブルの作成に失敗しました", "error", err)
+	}
+	slog.Info("transfers テーブルは作成済み、または既に存在します。")
 
-		// データ型の変換
-		userID := record[0]
-		fundID, err := strconv.Atoi(record[1])
-		if err != nil { return fmt.Errorf("trade_history: fund_id '%s' の変換に失敗: %w", record[1], err) }
-		quantity, err := strconv.Atoi(record[2])
-		if err != nil { return fmt.Errorf("trade_history: quantity '%s' の変換に失敗: %w", record[2], err) }
-		
-		// 日付形式 "YYYY-MM-DD" を time.Time にパース
-		tradeDate, err := time.Parse("2006-01-02", record[3])
-		if err != nil { return fmt.Errorf("trade_history: trade_date '%s' のパースに失敗: %w", record[3], err) }
+	slog.Info("必要なテーブルはすべて存在します。")
+	// --- テーブル作成ロジックここまで ---
 
-		_, err = stmt.Exec(userID, fundID, quantity, tradeDate)
+	// 以前のインポートで取り込まれた price が NULL の基準価額の確認・削除のみを行う
+	if *nullPrices != "" {
+		err = cleanupNullPrices(db, *nullPrices == NULL_PRICES_DELETE)
 		if err != nil {
-			return fmt.Errorf("trade_histories へのデータ挿入に失敗しました（レコード: %v）: %w", record, err)
+			fatal("NULL の基準価額の確認に失敗しました", "error", err)
 		}
-		recordsInserted++
+		return
 	}
 
-	fmt.Printf("trade_histories に %d 件のレコードが挿入されました。\n", recordsInserted)
-	return nil
-}
-
-// importReferencePrices は reference_prices.csv を読み込み、reference_prices テーブルに挿入します
-func importReferencePrices(db *sql.DB, csvFilePath string) error {
-	fmt.Printf("reference_prices のインポートを開始: %s\n", csvFilePath)
+	// --- ここからデータのインポート ---
+	// DATA_DIR (デフォルトは /app/data) にCSVファイルがあることを想定
+	dataDir := os.Getenv("DATA_DIR")
+	if dataDir == "" {
+		dataDir = DEFAULT_DATA_DIR
+	}
+	tradeCSV := dataFilePath(dataDir, os.Getenv("TRADE_CSV"), DEFAULT_TRADE_CSV)
+	pricesCSV := dataFilePath(dataDir, os.Getenv("PRICES_CSV"), DEFAULT_PRICES_CSV)
+	distributionsCSV := filepath.Join(dataDir, "distributions.csv")
+	transfersCSV := filepath.Join(dataDir, "transfers.csv")
 
-	file, err := os.Open(csvFilePath)
+	// TRADE_CSV には trade_history_*.csv のようなパターンも指定でき、一致した全てのファイルを名前順にインポートする
+	tradeFiles, err := filepath.Glob(tradeCSV)
 	if err != nil {
-		return fmt.Errorf("CSVファイル '%s' を開けませんでした: %w", csvFilePath, err)
+		fatal("TRADE_CSV のパターンが不正です", "value", tradeCSV, "error", err)
 	}
-	defer file.Close()
+	sort.Strings(tradeFiles)
 
-	reader := csv.NewReader(file)
-	reader.FieldsPerRecord = -1
-	reader.TrimLeadingSpace = true
+	// 必須のCSVファイルが無い場合は、何もインポートせずに探した場所を表示して終了する
+	var missing []string
+	if _, statErr := os.Stat(pricesCSV); statErr != nil {
+		missing = append(missing, pricesCSV)
+	}
+	if len(tradeFiles) == 0 {
+		missing = append(missing, tradeCSV)
+	}
+	if len(missing) > 0 {
+		fatal("インポートするCSVファイルが見つかりません", "missing", missing, "data_dir", dataDir, "prices_csv", pricesCSV, "trade_csv", tradeCSV)
+	}
 
-	// ヘッダー行をスキップ
-	_, err = reader.Read()
-	if err != nil {
-		if err == io.EOF {
-			return fmt.Errorf("reference_prices.csv が空です")
+	// 主キーが id になり同じ取引を再度インポートしてもエラーにならないため、二重に取り込まないよう確認する
+	// 基準価額をインポートする前に確認し、途中で中止して基準価額だけが取り込まれることが無いようにする
+	if !*appendTrades {
+		err = checkTradeHistoriesEmpty(db)
+		if err != nil {
+			fatal("trade_history.csv のインポートを中止しました (追加でインポートする場合は -append を指定してください)", "error", err)
 		}
-		return fmt.Errorf("reference_prices.csv のヘッダー読み込みに失敗: %w", err)
 	}
 
-	tx, err := db.Begin()
+	// -check-refs で取引と基準価額の整合性を確認できるよう、基準価額を先にインポートする
+	_, err = importReferencePrices(db, pricesCSV, *dryRun)
 	if err != nil {
-		return fmt.Errorf("トランザクションの開始に失敗しました: %w", err)
+		fatal("reference_prices.csv のインポートに失敗しました", "error", err)
 	}
-	defer func() {
-		if r := recover(); r != nil {
-			tx.Rollback()
-			panic(r)
-		} else if err != nil {
-			tx.Rollback()
-		} else {
-			err = tx.Commit()
+	slog.Info("reference_prices.csv のインポートが完了しました。")
+
+	if *workers > 1 {
+		// 並列インポートはバッチごとにコミットするため、ファイルごとに順に取り込む
+		for _, tradeFile := range tradeFiles {
+			err = importTradeHistoriesParallel(db, tradeFile, *checkRefs, columns, *workers)
+			if err != nil {
+				break
+			}
 		}
-	}()
-
-	stmt, err := tx.Prepare("INSERT INTO reference_prices (fund_id, price, price_date) VALUES (?, ?, ?)")
+	} else {
+		// 全てのファイルを1トランザクションで取り込み、いずれかで失敗した場合は全てロールバックする
+		_, err = importTradeHistoryFiles(db, tradeFiles, *checkRefs, columns, *dryRun)
+	}
 	if err != nil {
-		return fmt.Errorf("reference_prices のプリペアドステートメント準備に失敗: %w", err)
+		fatal("trade_history.csv のインポートに失敗しました", "error", err)
 	}
-	defer stmt.Close()
+	slog.Info("trade_history.csv のインポートが完了しました。")
 
-	recordsInserted := 0
-	for {
-		record, err := reader.Read()
-		if err == io.EOF {
-			break
+	// ドライランでは基準価額と取引履歴の検証のみを行う
+	if *dryRun {
+		slog.Info("【ドライラン】のため、distributions.csv と transfers.csv のインポートは行いません。データベースには何も書き込まれていません。")
+		return
+	}
+
+	// 分配金のCSVは任意。存在する場合のみインポートする
+	if _, statErr := os.Stat(distributionsCSV); statErr == nil {
+		err = importDistributions(db, distributionsCSV)
+		if err != nil {
+			fatal("distributions.csv のインポートに失敗しました", "error", err)
 		}
+		slog.Info("distributions.csv のインポートが完了しました。")
+	} else {
+		slog.Info("distributions.csv が無いため、分配金のインポートをスキップしました。")
+	}
+
+	// 移管のCSVも任意。存在する場合のみインポートする
+	if _, statErr := os.Stat(transfersCSV); statErr == nil {
+		err = importTransfers(db, transfersCSV)
 		if err != nil {
-			return fmt.Errorf("reference_prices.csv のレコード読み込みに失敗: %w", err)
+			fatal("transfers.csv のインポートに失敗しました", "error", err)
 		}
+		slog.Info("transfers.csv のインポートが完了しました。")
+	} else {
+		slog.Info("transfers.csv が無いため、移管のインポートをスキップしました。")
+	}
+	// --- データのインポートここまで ---
+}
 
-		if len(record) != 3 {
-			return fmt.Errorf("reference_prices.csv の行の列数が不正です（期待:3, 実際:%d）: %v", len(record), record)
+// dataFilePath はインポートするCSVファイルのパスを返します
+// name が未指定の場合は defaultName を使い、相対パスの場合は dataDir からのパスとします
+func dataFilePath(dataDir string, name string, defaultName string) string {
+	if name == "" {
+		name = defaultName
+	}
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(dataDir, name)
+}
+
+// priceColumnType は環境変数 PRICE_PRECISION / PRICE_SCALE から基準価額の列の精度とスケールを返します
+func priceColumnType() (precision int, scale int, err error) {
+	precision, scale = 18, 4 // デフォルトは DECIMAL(18, 4)
+	if v := os.Getenv("PRICE_PRECISION"); v != "" {
+		precision, err = strconv.Atoi(v)
+		if err != nil || precision <= 0 || precision > 65 {
+			return 0, 0, fmt.Errorf("PRICE_PRECISION は 1〜65 の整数で指定してください（指定値: %q）", v)
+		}
+	}
+	if v := os.Getenv("PRICE_SCALE"); v != "" {
+		scale, err = strconv.Atoi(v)
+		if err != nil || scale <= 0 || scale > 30 {
+			return 0, 0, fmt.Errorf("PRICE_SCALE は 1〜30 の整数で指定してください（指定値: %q）", v)
 		}
+	}
+	if scale > precision {
+		return 0, 0, fmt.Errorf("PRICE_SCALE (%d) は PRICE_PRECISION (%d) 以下にしてください", scale, precision)
+	}
+	return precision, scale, nil
+}
 
-		// データ型の変換
-		fundID, err := strconv.Atoi(record[0])
-		if err != nil { return fmt.Errorf("reference_prices: fund_id '%s' の変換に失敗: %w", record[0], err) }
-		
-		// price は DECIMAL(10,2) なので、Goではstringのまま渡すのが最も安全（精度を保つため）
-		price := record[1] 
-		
-		priceDate, err := time.Parse("2006-01-02", record[2])
-		if err != nil { return fmt.Errorf("reference_prices: price_date '%s' のパースに失敗: %w", record[2], err) }
+// cleanupNullPrices は reference_prices と reference_price_versions から price が NULL の行を探して一覧を出力します
+// 現在のテーブル定義では price は NOT NULL ですが、制約を付ける前に作成したテーブルには NULL が残っている可能性があります
+// remove が true の場合は見つかった行を削除します
+func cleanupNullPrices(db *sql.DB, remove bool) error {
+	for _, table := range []string{"reference_prices", "reference_price_versions"} {
+		rows, err := db.Query(fmt.Sprintf("SELECT fund_id, price_date FROM %s WHERE price IS NULL ORDER BY fund_id, price_date", table))
+		if err != nil {
+			return fmt.Errorf("%s の確認に失敗しました: %w", table, err)
+		}
+		count := 0
+		for rows.Next() {
+			var fundID int
+			var priceDate time.Time
+			if err := rows.Scan(&fundID, &priceDate); err != nil {
+				rows.Close()
+				return fmt.Errorf("%s の行のスキャンに失敗しました: %w", table, err)
+			}
+			slog.Warn("price が NULL の行があります", "table", table, "fund_id", fundID, "price_date", priceDate.Format("2006-01-02"))
+			count++
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return fmt.Errorf("%s の行のイテレーションに失敗しました: %w", table, err)
+		}
 
-		_, err = stmt.Exec(fundID, price, priceDate)
+		if !remove || count == 0 {
+			slog.Info("price が NULL の行の件数です", "table", table, "count", count)
+			continue
+		}
+		result, err := db.Exec(fmt.Sprintf("DELETE FROM %s WHERE price IS NULL", table))
 		if err != nil {
-			return fmt.Errorf("reference_prices へのデータ挿入に失敗しました（レコード: %v）: %w", record, err)
+			return fmt.Errorf("%s の NULL の行の削除に失敗しました: %w", table, err)
 		}
-		recordsInserted++
+		deleted, _ := result.RowsAffected()
+		slog.Info("price が NULL の行を削除しました", "table", table, "count", deleted)
 	}
-
-	fmt.Printf("reference_prices に %d 件のレコードが挿入されました。\n", recordsInserted)
 	return nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,1389 @@
+package main
+
+// CSVインポートの処理
+// db_init.go (コマンドラインからのインポート) と server.go (POST /admin/import) の両方から使うため、
+// どちらも go run /app/db_init.go /app/importer.go のようにこのファイルと一緒にビルドする
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// -check-refs の設定値
+const (
+	CHECK_REFS_OFF   = "off"   // 参照整合性をチェックしない (デフォルト)
+	CHECK_REFS_WARN  = "warn"  // 基準価額の無いファンドの取引があれば警告を出す
+	CHECK_REFS_ERROR = "error" // 基準価額の無いファンドの取引があればインポートを失敗させる
+
+	CHECK_REFS_SAMPLE_LINES = 10 // ファンドごとに報告する行番号の最大数
+
+	IMPORT_WORKER_BATCH_SIZE = 500 // 並列インポートで1ワーカーが1トランザクションで挿入する行数
+
+	IMPORT_LOCK_POLL_INTERVAL = 1 * time.Second // インポートの実行枠の空きを確認する間隔
+
+	DEFAULT_IMPORT_BATCH_SIZE = 500   // 取引履歴のインポートで1つの INSERT 文にまとめる行数 (IMPORT_BATCH_SIZE のデフォルト)
+	MAX_IMPORT_BATCH_SIZE     = 16383 // 1行あたり4つのプレースホルダーで MySQL の上限 (65535個) を超えない最大の行数
+
+	IMPORT_MAX_REPORTED_ERRORS = 100 // IMPORT_COLLECT_ERRORS=true の場合に報告する不正な行の最大数
+)
+
+// インポートするCSVファイルのディレクトリ (DATA_DIR のデフォルト)
+// db_init.go と POST /admin/import で同じディレクトリを使うため、共有しているこのファイルに置きます
+const DEFAULT_DATA_DIR = "/app/data"
+
+// DB接続のリトライ (DB_RETRY_ATTEMPTS, DB_RETRY_INTERVAL のデフォルト)
+const (
+	DEFAULT_DB_RETRY_ATTEMPTS = 10              // DB接続リトライ回数
+	DEFAULT_DB_RETRY_INTERVAL = 2 * time.Second // DB接続リトライ間隔
+)
+
+// --- ビルド情報 ---
+// go build -ldflags "-X main.Version=v1.2.0 -X main.Commit=$(git rev-parse --short HEAD) -X main.BuildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)" のように埋め込む
+// server.go (GET /version) と db_init.go (version サブコマンド) の両方で表示するため、共有しているこのファイルに置く
+var (
+	Version   = "dev"
+	Commit    = "unknown"
+	BuildDate = "unknown"
+)
+
+// buildInfo はビルド情報を1行の文字列にして返します
+func buildInfo() string {
+	return fmt.Sprintf("version=%s commit=%s build_date=%s", Version, Commit, BuildDate)
+}
+
+// --- ログ ---
+// server.go と db_init.go の両方で LOG_LEVEL に従った JSON のログを出力するため、共有しているこのファイルに置く
+
+// parseLogLevel は LOG_LEVEL の値 (debug, info, warn, error) を slog のレベルに変換します。未設定の場合は info です
+func parseLogLevel(v string) (slog.Level, error) {
+	if v == "" {
+		return slog.LevelInfo, nil
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(v)); err != nil {
+		return 0, fmt.Errorf("LOG_LEVEL は debug, info, warn, error のいずれかで指定してください（指定値: %q）", v)
+	}
+	return level, nil
+}
+
+// newLogHandler は level 以上のログを標準エラー出力に JSON で1行ずつ出力するハンドラーを返します
+func newLogHandler(level slog.Level) slog.Handler {
+	return slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level})
+}
+
+// fatal はエラーのログを出力して終了します (起動時の設定エラーなど、続行できない場合に使う log.Fatal の代わり)
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// importBatchSize は取引履歴のインポートで1つの INSERT 文にまとめる行数 (IMPORT_BATCH_SIZE)
+// db_init.go と server.go の main で環境変数から設定する
+var importBatchSize = DEFAULT_IMPORT_BATCH_SIZE
+
+// importCollectErrors が true の場合、取引履歴のインポートで不正な行があっても最後までパースを続け、
+// 全ての不正な行をまとめて報告します (IMPORT_COLLECT_ERRORS)。いずれの場合も不正な行があればロールバックします
+var importCollectErrors bool
+
+// importUpsert が true の場合、基準価額のインポートで既に同じファンド・日付の基準価額があれば
+// エラーにせず価格を更新します (IMPORT_UPSERT)。false の場合は挿入のみで、重複はエラーになります
+// trade_histories は主キーが id で重複を判定するキーが無いため対象外です (再インポートは -append の確認で防ぐ)
+var importUpsert bool
+
+// importStrict が true の場合、取引履歴のインポート後に取引日の基準価額が無い取引が残っていればエラーにしてロールバックします (IMPORT_STRICT)
+// false の場合は警告を出すだけです。該当する取引は /{user_id}/assets の買付金額の計算から漏れるため、インポート時に気付けるようにする
+var importStrict bool
+
+// importFast が true の場合、基準価額のインポートに LOAD DATA LOCAL INFILE を使います (IMPORT_FAST)
+// MySQL サーバー側で local_infile が無効な場合は、通常の1行ずつの INSERT に切り替えます
+var importFast bool
+
+// errLocalInfileDisabled は MySQL サーバーが LOAD DATA LOCAL INFILE を受け付けない場合のエラー
+var errLocalInfileDisabled = errors.New("MySQL サーバーで local_infile が有効になっていません")
+
+// importDelimiter はインポートするCSVファイルの区切り文字 (IMPORT_DELIMITER)
+// db_init.go と server.go の main で環境変数から設定する
+var importDelimiter = ','
+
+// parseImportDelimiter は IMPORT_DELIMITER の値を区切り文字に変換します
+// 環境変数にタブ文字を書きにくいため、\t と書いた場合もタブとして扱います
+func parseImportDelimiter(v string) (rune, error) {
+	if v == `\t` {
+		return '\t', nil
+	}
+	r, size := utf8.DecodeRuneInString(v)
+	if size == 0 || size != len(v) || r == utf8.RuneError {
+		return 0, fmt.Errorf("IMPORT_DELIMITER は1文字で指定してください（指定値: %q）", v)
+	}
+	if r == '"' || r == '\r' || r == '\n' {
+		return 0, fmt.Errorf("IMPORT_DELIMITER に %q は使えません", v)
+	}
+	return r, nil
+}
+
+// newCSVReader はインポート用の csv.Reader を作成します
+// Excel などで保存したCSVの先頭に付く UTF-8 の BOM は、最初の列の値に混ざらないよう読み飛ばします
+func newCSVReader(file io.Reader) *csv.Reader {
+	br := bufio.NewReader(file)
+	if bom, err := br.Peek(3); err == nil && string(bom) == "\xef\xbb\xbf" {
+		br.Discard(3)
+	}
+
+	reader := csv.NewReader(br)
+	reader.Comma = importDelimiter
+	reader.FieldsPerRecord = -1 // レコードごとにフィールド数が異なることを許容
+	// 区切り文字がタブなどの空白文字の場合、先頭の空白を読み飛ばすと空のフィールドが詰められてしまうため読み飛ばさない
+	reader.TrimLeadingSpace = !unicode.IsSpace(importDelimiter) // フィールドの先頭の空白をトリム
+	return reader
+}
+
+// waitForDB はデータベースに接続できるまで、interval の間隔で最大 attempts 回 Ping を試します
+// コンテナを同時に起動した場合に MySQL の準備ができるのを待つため、server.go と db_init.go の main で使います
+// 全ての試行に失敗した場合は最後の Ping のエラーを返します
+func waitForDB(db *sql.DB, attempts int, interval time.Duration) error {
+	var err error
+	for i := 0; i < attempts; i++ {
+		err = db.Ping()
+		if err == nil {
+			slog.Info("データベースに正常に接続しました。")
+			return nil
+		}
+		slog.Warn("データベースの準備を待機中", "attempt", i+1, "max_attempts", attempts, "error", err)
+		if i < attempts-1 {
+			time.Sleep(interval)
+		}
+	}
+	return err
+}
+
+// errImportBusy は同時に実行できるインポートの数の上限に達している場合のエラー
+var errImportBusy = errors.New("他のインポートが実行中のため開始できません")
+
+// errTradesAlreadyImported は trade_histories に既にデータがある場合のエラー
+var errTradesAlreadyImported = errors.New("trade_histories には既にデータがあります")
+
+// migratePriceColumn は reference_prices.price の精度・スケールが指定より狭い場合に列を広げます
+// 整数部と小数部の桁数がどちらも減らない場合のみ変更するため、既存の価格が丸められることはありません
+// db_init.go のテーブル作成時と APIサーバーの起動時の両方から呼ばれます
+func migratePriceColumn(db *sql.DB, pricePrecision int, priceScale int) error {
+	var precision, scale int
+	err := db.QueryRow(`
+		SELECT NUMERIC_PRECISION, NUMERIC_SCALE FROM information_schema.columns
+		WHERE table_schema = DATABASE() AND table_name = 'reference_prices' AND column_name = 'price'
+	`).Scan(&precision, &scale)
+	if err != nil {
+		return fmt.Errorf("reference_prices.price の型の取得に失敗しました: %w", err)
+	}
+	if precision == pricePrecision && scale == priceScale {
+		return nil
+	}
+	if pricePrecision-priceScale < precision-scale || priceScale < scale {
+		// 列を狭めると既存の価格が丸められたり溢れたりするため、自動では行わない
+		slog.Warn("reference_prices.price の桁数が減るため、列の型を変更しません。", "current", fmt.Sprintf("DECIMAL(%d, %d)", precision, scale), "configured", fmt.Sprintf("DECIMAL(%d, %d)", pricePrecision, priceScale))
+		return nil
+	}
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE reference_prices MODIFY price DECIMAL(%d, %d) NOT NULL", pricePrecision, priceScale))
+	if err != nil {
+		return fmt.Errorf("reference_prices.price の DECIMAL(%d, %d) への変更に失敗しました: %w", pricePrecision, priceScale, err)
+	}
+	slog.Info("reference_prices.price の列の型を変更しました。", "from", fmt.Sprintf("DECIMAL(%d, %d)", precision, scale), "to", fmt.Sprintf("DECIMAL(%d, %d)", pricePrecision, priceScale))
+	return nil
+}
+
+// migrateTradeHistoriesID は trade_histories に id 列が無い場合に追加し、主キーを id に変更します
+// 以前の主キー (user_id, fund_id, trade_date) では同じ日に同じファンドを複数回取引できないため、一意でないインデックスにします
+// 既存の行には現在の主キーの順に id が振られます
+// migratePriceColumn と同じく、db_init.go のテーブル作成時と APIサーバーの起動時の両方から呼ばれます
+func migrateTradeHistoriesID(db *sql.DB) error {
+	var count int
+	err := db.QueryRow(`
+		SELECT COUNT(*) FROM information_schema.columns
+		WHERE table_schema = DATABASE() AND table_name = 'trade_histories' AND column_name = 'id'
+	`).Scan(&count)
+	if err != nil {
+		return fmt.Errorf("trade_histories.id の確認に失敗しました: %w", err)
+	}
+	if count > 0 {
+		return nil
+	}
+
+	_, err = db.Exec(`
+		ALTER TABLE trade_histories
+			DROP PRIMARY KEY,
+			ADD COLUMN id BIGINT NOT NULL AUTO_INCREMENT FIRST,
+			ADD PRIMARY KEY (id),
+			ADD INDEX idx_user_fund_date (user_id, fund_id, trade_date)`)
+	if err != nil {
+		return fmt.Errorf("trade_histories への id 列の追加に失敗しました: %w", err)
+	}
+	slog.Info("trade_histories に id 列を追加し、主キーを id に変更しました。")
+	return nil
+}
+
+// acquireImportSlot は MySQL の名前付きロック (GET_LOCK) を使って、同じデータベースに対して
+// 同時に実行できるインポートの数を maxImports 個に制限します
+// 空きが無い場合は timeout まで待ち、それでも空かなければ errImportBusy を返します
+// ロックは接続に紐づくため、返した関数でロックを解放するまで専用の接続を保持します
+func acquireImportSlot(db *sql.DB, maxImports int, timeout time.Duration) (release func(), err error) {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("ロック用の接続の取得に失敗しました: %w", err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		for slot := 0; slot < maxImports; slot++ {
+			// ロック名はサーバー全体で共有されるため、データベース名を含める
+			var acquired sql.NullInt64
+			err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(CONCAT(DATABASE(), '.import_slot_', ?), 0)", slot).Scan(&acquired)
+			if err != nil {
+				conn.Close()
+				return nil, fmt.Errorf("インポートのロックの取得に失敗しました: %w", err)
+			}
+			if acquired.Valid && acquired.Int64 == 1 {
+				slog.Info("インポートの実行枠を確保しました。", "slot", slot+1, "max_imports", maxImports)
+				return func() {
+					if _, err := conn.ExecContext(ctx, "SELECT RELEASE_LOCK(CONCAT(DATABASE(), '.import_slot_', ?))", slot); err != nil {
+						slog.Error("インポートのロックの解放に失敗しました", "error", err)
+					}
+					conn.Close()
+				}, nil
+			}
+		}
+
+		if !time.Now().Before(deadline) {
+			conn.Close()
+			return nil, fmt.Errorf("%w（同時に実行できるインポートの数: %d）", errImportBusy, maxImports)
+		}
+		slog.Info("他のインポートが終わるのを待機中...")
+		time.Sleep(IMPORT_LOCK_POLL_INTERVAL)
+	}
+}
+
+// checkTradeHistoriesEmpty は trade_histories にデータがある場合に errTradesAlreadyImported を返します
+// trade_histories の主キーは id のため、同じCSVを再度インポートすると取引が重複して登録されます。
+// 意図しない二重インポートを防ぐため、追加でインポートする場合以外はインポート前にこれを確認します
+func checkTradeHistoriesEmpty(db *sql.DB) error {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM trade_histories)").Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("trade_histories の確認に失敗しました: %w", err)
+	}
+	if exists {
+		return errTradesAlreadyImported
+	}
+	return nil
+}
+
+// importTradeHistories は trade_history.csv を読み込み、trade_histories テーブルに挿入します
+// 1ファイル分の importTradeHistoryFiles です
+func importTradeHistories(db *sql.DB, csvFilePath string, checkRefs string, columns tradeColumns, dryRun bool) (int, error) {
+	return importTradeHistoryFiles(db, []string{csvFilePath}, checkRefs, columns, dryRun)
+}
+
+// importTradeHistoryFiles は複数の取引履歴のCSVファイルを指定した順に読み込み、1つのトランザクションで trade_histories テーブルに挿入します
+// いずれかのファイルでエラーになった場合は、それまでのファイルの分も含めて全てロールバックします
+// checkRefs が off 以外の場合、基準価額が1件も存在しないファンドの取引を検出して報告します
+// columns で各項目が何列目にあるかを指定します (標準の順序の場合は defaultTradeColumns)
+// dryRun が true の場合は、挿入まで行ったうえで最後にロールバックします (実際のインポートと同じエラーを確認できます)
+// 挿入した件数の合計 (dryRun の場合は挿入される予定の件数) を返します
+// 戻り値を名前付きにしているのは、ループ内で返したエラーでも defer でロールバックされるようにするため
+func importTradeHistoryFiles(db *sql.DB, csvFilePaths []string, checkRefs string, columns tradeColumns, dryRun bool) (inserted int, err error) {
+	tx, err := db.Begin() // トランザクションを開始
+	if err != nil {
+		return 0, fmt.Errorf("トランザクションの開始に失敗しました: %w", err)
+	}
+	// エラー発生時とドライランの場合はロールバック、成功時にコミット
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+			panic(r) // 再パニック
+		} else if err != nil || dryRun {
+			tx.Rollback() // エラーがあればロールバック
+		} else {
+			err = tx.Commit() // エラーがなければコミット
+		}
+	}()
+
+	// 基準価額が存在するファンドIDの一覧 (-check-refs 用)
+	var pricedFunds map[int]bool
+	if checkRefs != CHECK_REFS_OFF {
+		pricedFunds, err = loadPricedFunds(tx)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	recordsInserted := 0
+	for _, csvFilePath := range csvFilePaths {
+		slog.Info("trade_histories のインポートを開始します", "file", csvFilePath)
+		count, err := importTradeHistoryFile(tx, csvFilePath, checkRefs, pricedFunds, columns)
+		if err != nil {
+			// 複数のファイルの場合は、どのファイルで失敗したかが分かるようにする
+			if len(csvFilePaths) > 1 {
+				return 0, fmt.Errorf("%s のインポートに失敗しました: %w", csvFilePath, err)
+			}
+			return 0, err
+		}
+		if len(csvFilePaths) > 1 {
+			slog.Info("ファイルのインポートが完了しました", "file", csvFilePath, "count", count)
+		}
+		recordsInserted += count
+	}
+
+	// 取引日の基準価額が無い取引は買付金額の計算から漏れるため、インポート後のテーブル全体で確認する
+	unpricedTotal, unpricedSamples, err := findUnpricedTrades(tx, IMPORT_MAX_REPORTED_ERRORS)
+	if err != nil {
+		return 0, err
+	}
+	if unpricedTotal > 0 {
+		summary := strings.Join(unpricedSamples, ", ")
+		if unpricedTotal > len(unpricedSamples) {
+			summary += fmt.Sprintf(", ... 他 %d 件", unpricedTotal-len(unpricedSamples))
+		}
+		if importStrict {
+			return 0, fmt.Errorf("取引日の基準価額が無い取引が %d 件 (ファンド・日付の組) あります: %s", unpricedTotal, summary)
+		}
+		slog.Warn("取引日の基準価額が無い取引があります（買付金額の計算から除外されます）", "count", unpricedTotal, "trades", summary)
+	}
+
+	err = recordImportTime(tx, "trade_histories")
+	if err != nil {
+		return 0, err
+	}
+
+	if dryRun {
+		slog.Info("【ドライラン】trade_histories に挿入される予定のレコード数です。ロールバックしたため、データは書き込まれていません。", "count", recordsInserted, "files", len(csvFilePaths))
+		return recordsInserted, nil
+	}
+	slog.Info("trade_histories にレコードが挿入されました", "count", recordsInserted, "files", len(csvFilePaths))
+	return recordsInserted, nil
+}
+
+// importTradeHistoryFile は取引履歴のCSVファイルを1つ開き、importTradeRows で tx に挿入します
+func importTradeHistoryFile(tx *sql.Tx, csvFilePath string, checkRefs string, pricedFunds map[int]bool, columns tradeColumns) (int, error) {
+	file, err := os.Open(csvFilePath)
+	if err != nil {
+		return 0, fmt.Errorf("CSVファイル '%s' を開けませんでした: %w", csvFilePath, err)
+	}
+	defer file.Close()
+	return importTradeRows(tx, file, filepath.Base(csvFilePath), checkRefs, pricedFunds, columns)
+}
+
+// importTradeRows は取引履歴のCSVを r から読み込み、tx に挿入して挿入した件数を返します
+// name はエラーメッセージに表示するファイル名です
+// トランザクションのコミット・ロールバックと、インポート時刻の記録は呼び出し元で行います
+func importTradeRows(tx *sql.Tx, r io.Reader, name string, checkRefs string, pricedFunds map[int]bool, columns tradeColumns) (int, error) {
+	reader := newCSVReader(r)
+
+	// ヘッダー行をスキップ
+	_, err := reader.Read()
+	if err != nil {
+		if err == io.EOF {
+			return 0, fmt.Errorf("%s が空です", name)
+		}
+		return 0, fmt.Errorf("%s のヘッダー読み込みに失敗: %w", name, err)
+	}
+
+	missingRefs := newMissingRefReport()
+
+	// リモートの MySQL でも1行ずつの往復にならないよう、importBatchSize 行ずつ複数行の INSERT で挿入する
+	recordsInserted := 0
+	var batch []tradeRecord
+	batchFirstLine := 0
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := insertTradeRows(tx, batch); err != nil {
+			return fmt.Errorf("trade_histories へのデータ挿入に失敗しました（%s の %d 行目から %d 件）: %w", name, batchFirstLine, len(batch), err)
+		}
+		recordsInserted += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+	rowErrors := &importErrorReport{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// 引用符の不整合などの行単位のエラーは、その行を飛ばして続きを読める
+			var parseErr *csv.ParseError
+			if importCollectErrors && errors.As(err, &parseErr) {
+				rowErrors.add(fmt.Errorf("%s のレコード読み込みに失敗: %w", name, err))
+				continue
+			}
+			return 0, fmt.Errorf("%s のレコード読み込みに失敗: %w", name, err)
+		}
+
+		line, _ := reader.FieldPos(0)
+		trade, err := parseTradeRecord(record, line, columns)
+		if err != nil {
+			if importCollectErrors {
+				rowErrors.add(err)
+				continue
+			}
+			return 0, err
+		}
+		// 不正な行が見つかった時点でロールバックが確定するため、以降は検証のみ行う
+		if rowErrors.total > 0 {
+			continue
+		}
+		if checkRefs != CHECK_REFS_OFF && !pricedFunds[trade.FundID] {
+			missingRefs.add(trade.FundID, line)
+		}
+
+		if len(batch) == 0 {
+			batchFirstLine = line
+		}
+		batch = append(batch, trade)
+		if len(batch) >= importBatchSize {
+			if err := flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if rowErrors.total > 0 {
+		return 0, rowErrors.err(name)
+	}
+	// 最後の半端な行もコミット前に挿入する
+	if err := flush(); err != nil {
+		return 0, err
+	}
+
+	if missingRefs.total > 0 {
+		summary := missingRefs.summary()
+		if checkRefs == CHECK_REFS_ERROR {
+			return 0, fmt.Errorf("%s に基準価額が存在しないファンドの取引が %d 件あります: %s", name, missingRefs.total, summary)
+		}
+		slog.Warn("基準価額が存在しないファンドの取引があります（評価対象外になります）", "file", name, "count", missingRefs.total, "funds", summary)
+	}
+	return recordsInserted, nil
+}
+
+// importErrorReport は IMPORT_COLLECT_ERRORS=true の場合に不正な行のエラーを集めます
+// 全ての件数を数えますが、エラーの内容は最大 IMPORT_MAX_REPORTED_ERRORS 件まで保持します
+type importErrorReport struct {
+	total  int
+	errors []error
+}
+
+func (r *importErrorReport) add(err error) {
+	r.total++
+	if len(r.errors) < IMPORT_MAX_REPORTED_ERRORS {
+		r.errors = append(r.errors, err)
+	}
+}
+
+// err は集めたエラーを1つのエラーにまとめます (エラーは行番号を含むため、そのまま1行ずつ並べます)
+func (r *importErrorReport) err(fileName string) error {
+	messages := make([]string, 0, len(r.errors)+1)
+	for _, err := range r.errors {
+		messages = append(messages, err.Error())
+	}
+	if r.total > len(r.errors) {
+		messages = append(messages, fmt.Sprintf("（他 %d 件は省略）", r.total-len(r.errors)))
+	}
+	return fmt.Errorf("%s に不正な行が %d 件あります:\n%s", fileName, r.total, strings.Join(messages, "\n"))
+}
+
+// tradeRecord は trade_history.csv の1行をパースしたものです
+type tradeRecord struct {
+	UserID    string
+	FundID    int
+	Quantity  int
+	TradeDate time.Time
+}
+
+// tradeColumns は trade_history.csv の各項目が何列目 (0始まり) にあるかを表します (-columns)
+type tradeColumns struct {
+	UserID    int
+	FundID    int
+	Quantity  int
+	TradeDate int
+}
+
+// defaultTradeColumns は trade_history.csv の標準の列の順序 (user_id, fund_id, quantity, trade_date) です
+var defaultTradeColumns = tradeColumns{UserID: 0, FundID: 1, Quantity: 2, TradeDate: 3}
+
+// parseTradeColumns は "user_id=0,fund_id=2,quantity=1,trade_date=3" の形式の列の対応を読み込みます
+// 空文字列の場合は defaultTradeColumns を返します。全ての項目が1回ずつ、別々の列に対応している必要があります
+func parseTradeColumns(spec string) (tradeColumns, error) {
+	if spec == "" {
+		return defaultTradeColumns, nil
+	}
+
+	indexes := make(map[string]int)
+	used := make(map[int]string)
+	for _, pair := range strings.Split(spec, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return tradeColumns{}, fmt.Errorf("列の指定 '%s' は 項目名=列番号 の形式で指定してください", pair)
+		}
+		switch name {
+		case "user_id", "fund_id", "quantity", "trade_date":
+		default:
+			return tradeColumns{}, fmt.Errorf("不明な項目名 '%s' です (user_id, fund_id, quantity, trade_date のいずれかを指定してください)", name)
+		}
+		if _, dup := indexes[name]; dup {
+			return tradeColumns{}, fmt.Errorf("項目 %s が複数回指定されています", name)
+		}
+		index, err := strconv.Atoi(value)
+		if err != nil || index < 0 {
+			return tradeColumns{}, fmt.Errorf("項目 %s の列番号 '%s' には0以上の整数を指定してください", name, value)
+		}
+		if other, dup := used[index]; dup {
+			return tradeColumns{}, fmt.Errorf("項目 %s と %s が同じ列 %d に指定されています", other, name, index)
+		}
+		indexes[name] = index
+		used[index] = name
+	}
+
+	for _, name := range []string{"user_id", "fund_id", "quantity", "trade_date"} {
+		if _, ok := indexes[name]; !ok {
+			return tradeColumns{}, fmt.Errorf("項目 %s の列が指定されていません", name)
+		}
+	}
+	return tradeColumns{
+		UserID:    indexes["user_id"],
+		FundID:    indexes["fund_id"],
+		Quantity:  indexes["quantity"],
+		TradeDate: indexes["trade_date"],
+	}, nil
+}
+
+// minFields は行に最低限必要な列数 (最も右の項目の列番号 + 1) を返します
+func (c tradeColumns) minFields() int {
+	n := c.UserID
+	for _, index := range []int{c.FundID, c.Quantity, c.TradeDate} {
+		if index > n {
+			n = index
+		}
+	}
+	return n + 1
+}
+
+// parseTradeRecord は trade_history.csv の1行 (line はCSV上の行番号) を検証して tradeRecord に変換します
+// 標準の列の順序の場合は列数がちょうど4であることを確認し、
+// -columns で列の対応を指定した場合は使わない列があっても許容します
+func parseTradeRecord(record []string, line int, columns tradeColumns) (tradeRecord, error) {
+	if columns == defaultTradeColumns && len(record) != 4 {
+		return tradeRecord{}, fmt.Errorf("trade_history.csv の %d 行目の列数が不正です（期待:4, 実際:%d）: %v", line, len(record), record)
+	}
+	if len(record) < columns.minFields() {
+		return tradeRecord{}, fmt.Errorf("trade_history.csv の %d 行目の列数が不足しています（期待:%d 以上, 実際:%d）: %v", line, columns.minFields(), len(record), record)
+	}
+
+	// データ型の変換
+	userID := record[columns.UserID]
+	fundID, err := strconv.Atoi(record[columns.FundID])
+	if err != nil {
+		return tradeRecord{}, fmt.Errorf("trade_history: %d 行目の fund_id '%s' の変換に失敗: %w", line, record[columns.FundID], err)
+	}
+	quantity, err := strconv.Atoi(record[columns.Quantity])
+	if err != nil {
+		return tradeRecord{}, fmt.Errorf("trade_history: %d 行目の quantity '%s' の変換に失敗: %w", line, record[columns.Quantity], err)
+	}
+
+	// 日付形式 "YYYY-MM-DD" を time.Time にパース
+	tradeDate, err := time.Parse("2006-01-02", record[columns.TradeDate])
+	if err != nil {
+		return tradeRecord{}, fmt.Errorf("trade_history: %d 行目の trade_date '%s' のパースに失敗: %w", line, record[columns.TradeDate], err)
+	}
+
+	return tradeRecord{UserID: userID, FundID: fundID, Quantity: quantity, TradeDate: tradeDate}, nil
+}
+
+// insertTradeRows は取引をまとめて1つの INSERT 文 (VALUES (?, ?, ?, ?), (?, ?, ?, ?), ...) で挿入します
+func insertTradeRows(tx *sql.Tx, trades []tradeRecord) error {
+	placeholders := make([]string, 0, len(trades))
+	args := make([]interface{}, 0, len(trades)*4)
+	for _, trade := range trades {
+		placeholders = append(placeholders, "(?, ?, ?, ?)")
+		args = append(args, trade.UserID, trade.FundID, trade.Quantity, trade.TradeDate)
+	}
+	result, err := tx.Exec("INSERT INTO trade_histories (user_id, fund_id, quantity, trade_date) VALUES "+strings.Join(placeholders, ", "), args...)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n != int64(len(trades)) {
+		return fmt.Errorf("挿入された件数が一致しません（期待:%d, 実際:%d）", len(trades), n)
+	}
+	return nil
+}
+
+// tradeBatch は並列インポートで1つのワーカーが1トランザクションで挿入する取引のまとまりです
+type tradeBatch struct {
+	Number    int // 何番目のバッチか (1始まり)
+	FirstLine int // バッチ先頭の行番号
+	LastLine  int // バッチ末尾の行番号
+	Trades    []tradeRecord
+}
+
+// importTradeHistoriesParallel は trade_history.csv を読み込み、workers 個のワーカーで並列に挿入します
+// 呼び出し元のゴルーチンがCSVのパースと検証を行い、IMPORT_WORKER_BATCH_SIZE 件ずつのバッチを
+// ワーカーに渡します。各ワーカーはバッチごとに別のトランザクションで挿入します。
+// いずれかのバッチが失敗した場合は残りのバッチの挿入を中止しますが、
+// コミット済みのバッチは取り消せないため、全体を1トランザクションで行う importTradeHistories と違い原子性はありません
+func importTradeHistoriesParallel(db *sql.DB, csvFilePath string, checkRefs string, columns tradeColumns, workers int) error {
+	slog.Info("trade_histories の並列インポートを開始します", "file", csvFilePath, "workers", workers)
+
+	file, err := os.Open(csvFilePath)
+	if err != nil {
+		return fmt.Errorf("CSVファイル '%s' を開けませんでした: %w", csvFilePath, err)
+	}
+	defer file.Close()
+
+	reader := newCSVReader(file)
+
+	// ヘッダー行をスキップ
+	_, err = reader.Read()
+	if err != nil {
+		if err == io.EOF {
+			return fmt.Errorf("trade_history.csv が空です")
+		}
+		return fmt.Errorf("trade_history.csv のヘッダー読み込みに失敗: %w", err)
+	}
+
+	var pricedFunds map[int]bool
+	missingRefs := newMissingRefReport()
+	if checkRefs != CHECK_REFS_OFF {
+		pricedFunds, err = loadPricedFunds(db)
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// 最初に失敗したバッチのエラーだけを記録し、他のワーカーを止める
+	var errOnce sync.Once
+	var workerErr error
+	var recordsInserted int64
+	batches := make(chan tradeBatch)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				if ctx.Err() != nil {
+					continue // 中止済みの場合は残りのバッチを読み捨てる
+				}
+				if err := insertTradeBatch(ctx, db, batch.Trades); err != nil {
+					errOnce.Do(func() {
+						workerErr = fmt.Errorf("バッチ %d (%d〜%d 行目) の挿入に失敗しました: %w", batch.Number, batch.FirstLine, batch.LastLine, err)
+						cancel()
+					})
+					continue
+				}
+				atomic.AddInt64(&recordsInserted, int64(len(batch.Trades)))
+			}
+		}()
+	}
+
+	// パースしたバッチをワーカーに渡す。ワーカーが失敗した場合はパースも中止する
+	parseErr := func() error {
+		batch := tradeBatch{Number: 1}
+		send := func() bool {
+			select {
+			case batches <- batch:
+				batch = tradeBatch{Number: batch.Number + 1}
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		for {
+			record, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("trade_history.csv のレコード読み込みに失敗: %w", err)
+			}
+			line, _ := reader.FieldPos(0)
+			trade, err := parseTradeRecord(record, line, columns)
+			if err != nil {
+				return err
+			}
+			if checkRefs != CHECK_REFS_OFF && !pricedFunds[trade.FundID] {
+				missingRefs.add(trade.FundID, line)
+			}
+
+			if len(batch.Trades) == 0 {
+				batch.FirstLine = line
+			}
+			batch.LastLine = line
+			batch.Trades = append(batch.Trades, trade)
+			if len(batch.Trades) >= IMPORT_WORKER_BATCH_SIZE && !send() {
+				return nil
+			}
+		}
+		if len(batch.Trades) > 0 {
+			send()
+		}
+		return nil
+	}()
+	if parseErr != nil {
+		cancel()
+	}
+	close(batches)
+	wg.Wait()
+
+	if parseErr != nil {
+		return fmt.Errorf("%w（%d 件は挿入済みです）", parseErr, recordsInserted)
+	}
+	if workerErr != nil {
+		return fmt.Errorf("%w（%d 件は挿入済みです）", workerErr, recordsInserted)
+	}
+
+	if missingRefs.total > 0 {
+		slog.Warn("基準価額が存在しないファンドの取引があります（評価対象外になります）", "count", missingRefs.total, "funds", missingRefs.summary())
+	}
+
+	err = recordImportTime(db, "trade_histories")
+	if err != nil {
+		return err
+	}
+
+	slog.Info("trade_histories にレコードが挿入されました", "count", recordsInserted)
+	return nil
+}
+
+// insertTradeBatch は1バッチ分の取引を1つのトランザクションで挿入します
+// 1トランザクションでのインポートと同じく、importBatchSize 行ずつ複数行の INSERT で挿入します
+func insertTradeBatch(ctx context.Context, db *sql.DB, trades []tradeRecord) (err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("トランザクションの開始に失敗しました: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	for start := 0; start < len(trades); start += importBatchSize {
+		end := min(start+importBatchSize, len(trades))
+		if err = insertTradeRows(tx, trades[start:end]); err != nil {
+			return fmt.Errorf("trade_histories へのデータ挿入に失敗しました: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// importReferencePrices は reference_prices.csv を読み込み、reference_prices テーブルに挿入します
+// 同時に新しいインポートバッチを作成し、取り込んだ基準価額を reference_price_versions にも記録します
+// dryRun が true の場合は、importTradeHistories と同じく最後にロールバックします
+// 挿入した件数 (dryRun の場合は挿入される予定の件数) を返します
+func importReferencePrices(db *sql.DB, csvFilePath string, dryRun bool) (inserted int, err error) {
+	if importFast {
+		inserted, err = importReferencePricesFast(db, csvFilePath, dryRun)
+		if !errors.Is(err, errLocalInfileDisabled) {
+			return inserted, err
+		}
+		slog.Warn("LOAD DATA LOCAL INFILE が使えないため、1行ずつ挿入します", "error", err)
+	}
+
+	slog.Info("reference_prices のインポートを開始します", "file", csvFilePath)
+
+	file, err := os.Open(csvFilePath)
+	if err != nil {
+		return 0, fmt.Errorf("CSVファイル '%s' を開けませんでした: %w", csvFilePath, err)
+	}
+	defer file.Close()
+
+	reader := newCSVReader(file)
+
+	// ヘッダー行をスキップ
+	_, err = reader.Read()
+	if err != nil {
+		if err == io.EOF {
+			return 0, fmt.Errorf("reference_prices.csv が空です")
+		}
+		return 0, fmt.Errorf("reference_prices.csv のヘッダー読み込みに失敗: %w", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("トランザクションの開始に失敗しました: %w", err)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+			panic(r)
+		} else if err != nil || dryRun {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	insertSQL := "INSERT INTO reference_prices (fund_id, price, price_date) VALUES (?, ?, ?)"
+	if importUpsert {
+		insertSQL += " ON DUPLICATE KEY UPDATE price = VALUES(price)"
+	}
+	stmt, err := tx.Prepare(insertSQL)
+	if err != nil {
+		return 0, fmt.Errorf("reference_prices のプリペアドステートメント準備に失敗: %w", err)
+	}
+	defer stmt.Close()
+
+	// このインポートのバッチIDを採番する (APIの priceVersion に対応)
+	result, err := tx.Exec("INSERT INTO price_import_batches (source, imported_at) VALUES (?, UTC_TIMESTAMP())", csvFilePath)
+	if err != nil {
+		return 0, fmt.Errorf("インポートバッチの作成に失敗しました: %w", err)
+	}
+	importBatch, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("インポートバッチIDの取得に失敗しました: %w", err)
+	}
+
+	// 同じCSVに同じファンド・日付の行が複数ある場合は、reference_prices と同じく後の行の価格にする
+	versionSQL := "INSERT INTO reference_price_versions (import_batch, fund_id, price, price_date) VALUES (?, ?, ?, ?)"
+	if importUpsert {
+		versionSQL += " ON DUPLICATE KEY UPDATE price = VALUES(price)"
+	}
+	versionStmt, err := tx.Prepare(versionSQL)
+	if err != nil {
+		return 0, fmt.Errorf("reference_price_versions のプリペアドステートメント準備に失敗: %w", err)
+	}
+	defer versionStmt.Close()
+
+	recordsInserted := 0
+	var updated, unchanged int // IMPORT_UPSERT の場合に、既存の基準価額を更新した件数と同じ価格だった件数
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("reference_prices.csv のレコード読み込みに失敗: %w", err)
+		}
+
+		if len(record) != 3 {
+			return 0, fmt.Errorf("reference_prices.csv の行の列数が不正です（期待:3, 実際:%d）: %v", len(record), record)
+		}
+
+		// データ型の変換
+		fundID, err := strconv.Atoi(record[0])
+		if err != nil {
+			return 0, fmt.Errorf("reference_prices: fund_id '%s' の変換に失敗: %w", record[0], err)
+		}
+
+		// price は DECIMAL なので、Goではstringのまま渡すのが最も安全（精度を保つため）
+		price := record[1]
+
+		priceDate, err := time.Parse("2006-01-02", record[2])
+		if err != nil {
+			return 0, fmt.Errorf("reference_prices: price_date '%s' のパースに失敗: %w", record[2], err)
+		}
+
+		result, err := stmt.Exec(fundID, price, priceDate)
+		if err != nil {
+			return 0, fmt.Errorf("reference_prices へのデータ挿入に失敗しました（レコード: %v）: %w", record, err)
+		}
+		// ON DUPLICATE KEY UPDATE の影響行数は、挿入なら1、更新なら2、値が同じで更新しなかった場合は0になる
+		if importUpsert {
+			switch affected, _ := result.RowsAffected(); affected {
+			case 0:
+				unchanged++
+			case 2:
+				updated++
+			}
+		}
+		_, err = versionStmt.Exec(importBatch, fundID, price, priceDate)
+		if err != nil {
+			return 0, fmt.Errorf("reference_price_versions へのデータ挿入に失敗しました（レコード: %v）: %w", record, err)
+		}
+		recordsInserted++
+	}
+
+	err = recordImportTime(tx, "reference_prices")
+	if err != nil {
+		return 0, err
+	}
+
+	if dryRun {
+		slog.Info("【ドライラン】reference_prices に挿入される予定のレコード数です。ロールバックしたため、データは書き込まれていません。", "count", recordsInserted)
+		return recordsInserted, nil
+	}
+	if importUpsert {
+		slog.Info("reference_prices にレコードを取り込みました", "count", recordsInserted,
+			"inserted", recordsInserted-updated-unchanged, "updated", updated, "unchanged", unchanged, "import_batch", importBatch)
+		return recordsInserted, nil
+	}
+	slog.Info("reference_prices にレコードが挿入されました", "count", recordsInserted, "import_batch", importBatch)
+	return recordsInserted, nil
+}
+
+// importReferencePricesFast は importReferencePrices と同じ内容を LOAD DATA LOCAL INFILE で一括して取り込みます (IMPORT_FAST)
+// CSVを一時テーブルに読み込んでから検証し、INSERT ... SELECT で reference_prices と reference_price_versions に挿入するため、
+// 不正な行がある場合や IMPORT_UPSERT の扱いは1行ずつ挿入する場合と同じです
+//
+// LOAD DATA LOCAL INFILE を使うには以下が必要です
+//   - クライアント側: ファイルを mysql.RegisterLocalFile で登録する (この関数で行うため、DSN に allowAllFiles=true は不要)
+//   - サーバー側: local_infile が有効であること (MySQL 8.0 のデフォルトは無効。mysqld の --local-infile=1 などで有効にする)
+//
+// サーバー側で無効な場合は errLocalInfileDisabled を返し、呼び出し元で1行ずつの挿入に切り替えます
+func importReferencePricesFast(db *sql.DB, csvFilePath string, dryRun bool) (inserted int, err error) {
+	slog.Info("reference_prices の一括インポート (LOAD DATA LOCAL INFILE) を開始します", "file", csvFilePath)
+
+	if _, err := os.Stat(csvFilePath); err != nil {
+		return 0, fmt.Errorf("CSVファイル '%s' を開けませんでした: %w", csvFilePath, err)
+	}
+
+	var localInfile bool
+	err = db.QueryRow("SELECT @@GLOBAL.local_infile").Scan(&localInfile)
+	if err != nil {
+		return 0, fmt.Errorf("local_infile の設定の確認に失敗しました: %w", err)
+	}
+	if !localInfile {
+		return 0, errLocalInfileDisabled
+	}
+
+	mysql.RegisterLocalFile(csvFilePath)
+	defer mysql.DeregisterLocalFile(csvFilePath)
+
+	// 一時テーブルは接続ごとのため、読み込みから挿入までを1つのトランザクション (同じ接続) で行う
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("トランザクションの開始に失敗しました: %w", err)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+			panic(r)
+		} else if err != nil || dryRun {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	// 不正な値が黙って0や NULL に変換されないよう、文字列のまま読み込んで後から検証する
+	// line_no は読み込んだ順に採番されるため、エラーの行番号の表示に使う
+	_, err = tx.Exec(`
+		CREATE TEMPORARY TABLE reference_prices_load (
+			line_no INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+			fund_id VARCHAR(255),
+			price VARCHAR(255),
+			price_date VARCHAR(255)
+		)`)
+	if err != nil {
+		return 0, fmt.Errorf("一時テーブルの作成に失敗しました: %w", err)
+	}
+	defer tx.Exec("DROP TEMPORARY TABLE IF EXISTS reference_prices_load")
+
+	// LOAD DATA はプレースホルダーを使えないため、ファイルパスと区切り文字は文字列リテラルとしてエスケープして埋め込む
+	result, err := tx.Exec(fmt.Sprintf(`
+		LOAD DATA LOCAL INFILE %s INTO TABLE reference_prices_load
+		CHARACTER SET utf8mb4
+		FIELDS TERMINATED BY %s OPTIONALLY ENCLOSED BY '"'
+		LINES TERMINATED BY '\n'
+		IGNORE 1 LINES
+		(@fund_id, @price, @price_date)
+		SET fund_id = TRIM(@fund_id), price = TRIM(@price), price_date = TRIM(TRAILING '\r' FROM TRIM(@price_date))`,
+		sqlStringLiteral(csvFilePath), sqlStringLiteral(string(importDelimiter))))
+	if err != nil {
+		var mysqlErr *mysql.MySQLError
+		// 1148: LOAD DATA LOCAL が許可されていない, 3948: サーバー側で local_infile が無効
+		if errors.As(err, &mysqlErr) && (mysqlErr.Number == 1148 || mysqlErr.Number == 3948) {
+			return 0, fmt.Errorf("%w: %v", errLocalInfileDisabled, err)
+		}
+		return 0, fmt.Errorf("reference_prices.csv の読み込みに失敗しました: %w", err)
+	}
+	loaded, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("読み込んだ件数の取得に失敗しました: %w", err)
+	}
+
+	// 1行ずつ挿入する場合と同じく、不正な行が1件でもあれば何も挿入しない
+	var lineNo int
+	var fundID, price, priceDate sql.NullString
+	err = tx.QueryRow(`
+		SELECT line_no, fund_id, price, price_date FROM reference_prices_load
+		WHERE NOT (
+			COALESCE(fund_id, '') REGEXP '^[0-9]+$'
+			AND COALESCE(price, '') REGEXP '^-?[0-9]+(\\.[0-9]+)?$'
+			AND COALESCE(price_date, '') REGEXP '^[0-9]{4}-[0-9]{2}-[0-9]{2}$'
+			AND STR_TO_DATE(price_date, '%Y-%m-%d') IS NOT NULL
+		)
+		ORDER BY line_no
+		LIMIT 1`).Scan(&lineNo, &fundID, &price, &priceDate)
+	if err == nil {
+		return 0, fmt.Errorf("reference_prices.csv の %d 行目が不正です（fund_id: %q, price: %q, price_date: %q）", lineNo+1, fundID.String, price.String, priceDate.String)
+	}
+	if err != sql.ErrNoRows {
+		return 0, fmt.Errorf("reference_prices.csv の検証に失敗しました: %w", err)
+	}
+
+	// 同じCSVに同じファンド・日付の行が複数ある場合は、1行ずつ挿入する場合と同じく後の行の価格にする
+	upsert := ""
+	if importUpsert {
+		upsert = " ON DUPLICATE KEY UPDATE price = VALUES(price)"
+	}
+	_, err = tx.Exec(`
+		INSERT INTO reference_prices (fund_id, price, price_date)
+		SELECT fund_id, price, price_date FROM reference_prices_load ORDER BY line_no` + upsert)
+	if err != nil {
+		return 0, fmt.Errorf("reference_prices へのデータ挿入に失敗しました: %w", err)
+	}
+
+	// このインポートのバッチIDを採番する (APIの priceVersion に対応)
+	result, err = tx.Exec("INSERT INTO price_import_batches (source, imported_at) VALUES (?, UTC_TIMESTAMP())", csvFilePath)
+	if err != nil {
+		return 0, fmt.Errorf("インポートバッチの作成に失敗しました: %w", err)
+	}
+	importBatch, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("インポートバッチIDの取得に失敗しました: %w", err)
+	}
+	_, err = tx.Exec(`
+		INSERT INTO reference_price_versions (import_batch, fund_id, price, price_date)
+		SELECT ?, fund_id, price, price_date FROM reference_prices_load ORDER BY line_no`+upsert, importBatch)
+	if err != nil {
+		return 0, fmt.Errorf("reference_price_versions へのデータ挿入に失敗しました: %w", err)
+	}
+
+	err = recordImportTime(tx, "reference_prices")
+	if err != nil {
+		return 0, err
+	}
+
+	if dryRun {
+		slog.Info("【ドライラン】reference_prices に挿入される予定のレコード数です。ロールバックしたため、データは書き込まれていません。", "count", loaded)
+		return int(loaded), nil
+	}
+	slog.Info("reference_prices にレコードを一括で取り込みました", "count", loaded, "import_batch", importBatch)
+	return int(loaded), nil
+}
+
+// sqlStringLiteral は文字列を MySQL の文字列リテラル ('...') にします
+// プレースホルダーを使えない LOAD DATA の文でのみ使います
+func sqlStringLiteral(v string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `'`, `\'`, "\t", `\t`, "\n", `\n`, "\r", `\r`, "\x00", `\0`)
+	return "'" + replacer.Replace(v) + "'"
+}
+
+// queryer は *sql.DB と *sql.Tx のどちらでもクエリを実行できるようにするためのインターフェースです
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// importDistributions は distributions.csv (user_id,fund_id,amount,distribution_date) を読み込み、
+// distributions テーブルに挿入します
+func importDistributions(db *sql.DB, csvFilePath string) (err error) {
+	slog.Info("distributions のインポートを開始します", "file", csvFilePath)
+
+	file, err := os.Open(csvFilePath)
+	if err != nil {
+		return fmt.Errorf("CSVファイル '%s' を開けませんでした: %w", csvFilePath, err)
+	}
+	defer file.Close()
+
+	reader := newCSVReader(file)
+
+	// ヘッダー行をスキップ
+	_, err = reader.Read()
+	if err != nil {
+		if err == io.EOF {
+			return fmt.Errorf("distributions.csv が空です")
+		}
+		return fmt.Errorf("distributions.csv のヘッダー読み込みに失敗: %w", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("トランザクションの開始に失敗しました: %w", err)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+			panic(r)
+		} else if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	stmt, err := tx.Prepare("INSERT INTO distributions (user_id, fund_id, amount, distribution_date) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		return fmt.Errorf("distributions のプリペアドステートメント準備に失敗: %w", err)
+	}
+	defer stmt.Close()
+
+	recordsInserted := 0
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("distributions.csv のレコード読み込みに失敗: %w", err)
+		}
+
+		if len(record) != 4 {
+			return fmt.Errorf("distributions.csv の行の列数が不正です（期待:4, 実際:%d）: %v", len(record), record)
+		}
+
+		// データ型の変換
+		userID := record[0]
+		fundID, err := strconv.Atoi(record[1])
+		if err != nil {
+			return fmt.Errorf("distributions: fund_id '%s' の変換に失敗: %w", record[1], err)
+		}
+
+		// amount は DECIMAL なので、price と同じく精度を保つため文字列のまま渡す
+		amount := record[2]
+
+		distributionDate, err := time.Parse("2006-01-02", record[3])
+		if err != nil {
+			return fmt.Errorf("distributions: distribution_date '%s' のパースに失敗: %w", record[3], err)
+		}
+
+		_, err = stmt.Exec(userID, fundID, amount, distributionDate)
+		if err != nil {
+			return fmt.Errorf("distributions へのデータ挿入に失敗しました（レコード: %v）: %w", record, err)
+		}
+		recordsInserted++
+	}
+
+	err = recordImportTime(tx, "distributions")
+	if err != nil {
+		return err
+	}
+
+	slog.Info("distributions にレコードが挿入されました", "count", recordsInserted)
+	return nil
+}
+
+// importTransfers は transfers.csv (user_id, fund_id, quantity, cost_basis, transfer_date) を読み込み、
+// transfers テーブルに挿入します。cost_basis は移管した口数全体の移管元での取得価額 (円) です
+// 移管は保有口数を増やすもののみを扱うため、quantity は正の整数である必要があります
+func importTransfers(db *sql.DB, csvFilePath string) (err error) {
+	slog.Info("transfers のインポートを開始します", "file", csvFilePath)
+
+	file, err := os.Open(csvFilePath)
+	if err != nil {
+		return fmt.Errorf("CSVファイル '%s' を開けませんでした: %w", csvFilePath, err)
+	}
+	defer file.Close()
+
+	reader := newCSVReader(file)
+
+	// ヘッダー行をスキップ
+	_, err = reader.Read()
+	if err != nil {
+		if err == io.EOF {
+			return fmt.Errorf("transfers.csv が空です")
+		}
+		return fmt.Errorf("transfers.csv のヘッダー読み込みに失敗: %w", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("トランザクションの開始に失敗しました: %w", err)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+			panic(r)
+		} else if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	stmt, err := tx.Prepare("INSERT INTO transfers (user_id, fund_id, quantity, cost_basis, transfer_date) VALUES (?, ?, ?, ?, ?)")
+	if err != nil {
+		return fmt.Errorf("transfers のプリペアドステートメント準備に失敗: %w", err)
+	}
+	defer stmt.Close()
+
+	recordsInserted := 0
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("transfers.csv のレコード読み込みに失敗: %w", err)
+		}
+
+		line, _ := reader.FieldPos(0)
+		if len(record) != 5 {
+			return fmt.Errorf("transfers.csv の %d 行目の列数が不正です（期待:5, 実際:%d）: %v", line, len(record), record)
+		}
+
+		// データ型の変換
+		userID := record[0]
+		fundID, err := strconv.Atoi(record[1])
+		if err != nil {
+			return fmt.Errorf("transfers: %d 行目の fund_id '%s' の変換に失敗: %w", line, record[1], err)
+		}
+		quantity, err := strconv.Atoi(record[2])
+		if err != nil {
+			return fmt.Errorf("transfers: %d 行目の quantity '%s' の変換に失敗: %w", line, record[2], err)
+		}
+		if quantity <= 0 {
+			return fmt.Errorf("transfers: %d 行目の quantity には正の整数を指定してください（指定値: %d）", line, quantity)
+		}
+
+		// cost_basis は DECIMAL なので、price と同じく精度を保つため文字列のまま渡す
+		costBasis := record[3]
+		if _, err := strconv.ParseFloat(costBasis, 64); err != nil {
+			return fmt.Errorf("transfers: %d 行目の cost_basis '%s' の変換に失敗: %w", line, costBasis, err)
+		}
+
+		transferDate, err := time.Parse("2006-01-02", record[4])
+		if err != nil {
+			return fmt.Errorf("transfers: %d 行目の transfer_date '%s' のパースに失敗: %w", line, record[4], err)
+		}
+
+		_, err = stmt.Exec(userID, fundID, quantity, costBasis, transferDate)
+		if err != nil {
+			return fmt.Errorf("transfers へのデータ挿入に失敗しました（レコード: %v）: %w", record, err)
+		}
+		recordsInserted++
+	}
+
+	err = recordImportTime(tx, "transfers")
+	if err != nil {
+		return err
+	}
+
+	slog.Info("transfers にレコードが挿入されました", "count", recordsInserted)
+	return nil
+}
+
+// loadPricedFunds は reference_prices に1件以上の基準価額を持つファンドIDの一覧を返します
+func loadPricedFunds(q queryer) (map[int]bool, error) {
+	rows, err := q.Query("SELECT DISTINCT fund_id FROM reference_prices")
+	if err != nil {
+		return nil, fmt.Errorf("基準価額のあるファンドIDの取得に失敗しました: %w", err)
+	}
+	defer rows.Close()
+
+	pricedFunds := make(map[int]bool)
+	for rows.Next() {
+		var fundID int
+		if err := rows.Scan(&fundID); err != nil {
+			return nil, fmt.Errorf("ファンドIDのスキャンに失敗しました: %w", err)
+		}
+		pricedFunds[fundID] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ファンドIDの行イテレーションに失敗しました: %w", err)
+	}
+	return pricedFunds, nil
+}
+
+// missingRefReport は基準価額が存在しないファンドの取引をファンドごとに集計します
+type missingRefReport struct {
+	total   int
+	counts  map[int]int   // ファンドIDごとの件数
+	samples map[int][]int // ファンドIDごとの行番号 (最大 CHECK_REFS_SAMPLE_LINES 件)
+	order   []int         // 最初に検出した順のファンドID
+}
+
+func newMissingRefReport() *missingRefReport {
+	return &missingRefReport{
+		counts:  make(map[int]int),
+		samples: make(map[int][]int),
+	}
+}
+
+// add は基準価額が存在しないファンドの取引を1件記録します
+func (m *missingRefReport) add(fundID int, line int) {
+	if m.counts[fundID] == 0 {
+		m.order = append(m.order, fundID)
+	}
+	m.total++
+	m.counts[fundID]++
+	if len(m.samples[fundID]) < CHECK_REFS_SAMPLE_LINES {
+		m.samples[fundID] = append(m.samples[fundID], line)
+	}
+}
+
+// summary はファンドごとの件数と行番号のサンプルを1行の文字列にまとめます
+func (m *missingRefReport) summary() string {
+	var parts []string
+	for _, fundID := range m.order {
+		parts = append(parts, fmt.Sprintf("fund_id=%d %d件 (行: %v)", fundID, m.counts[fundID], m.samples[fundID]))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// findUnpricedTrades は trade_histories のうち、取引日の基準価額が reference_prices に無いファンド・日付の組の数と、
+// そのうち先頭の limit 件を "fund_id=1 2024-01-01 (2件)" の形式で返します
+func findUnpricedTrades(q queryer, limit int) (total int, samples []string, err error) {
+	rows, err := q.Query(`
+		SELECT th.fund_id, th.trade_date, COUNT(*)
+		FROM trade_histories th
+		WHERE NOT EXISTS (
+			SELECT 1 FROM reference_prices rp
+			WHERE rp.fund_id = th.fund_id AND rp.price_date = th.trade_date AND rp.price IS NOT NULL
+		)
+		GROUP BY th.fund_id, th.trade_date
+		ORDER BY th.fund_id, th.trade_date`)
+	if err != nil {
+		return 0, nil, fmt.Errorf("取引日の基準価額が無い取引の確認に失敗しました: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var fundID, count int
+		var tradeDate time.Time
+		if err := rows.Scan(&fundID, &tradeDate, &count); err != nil {
+			return 0, nil, fmt.Errorf("取引日の基準価額が無い取引の読み込みに失敗しました: %w", err)
+		}
+		total++
+		if len(samples) < limit {
+			samples = append(samples, fmt.Sprintf("fund_id=%d %s (%d件)", fundID, tradeDate.Format("2006-01-02"), count))
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, nil, fmt.Errorf("取引日の基準価額が無い取引の読み込みに失敗しました: %w", err)
+	}
+	return total, samples, nil
+}
+
+// recordImportTime は import_metadata にテーブルの最終インポート時刻を記録します
+// 通常はインポートと同じトランザクション内で実行し、ロールバック時には記録も取り消されるようにする
+func recordImportTime(q queryer, tableName string) error {
+	_, err := q.Exec(`
+		INSERT INTO import_metadata (table_name, imported_at) VALUES (?, UTC_TIMESTAMP())
+		ON DUPLICATE KEY UPDATE imported_at = VALUES(imported_at)`, tableName)
+	if err != nil {
+		return fmt.Errorf("%s のインポート時刻の記録に失敗しました: %w", tableName, err)
+	}
+	return nil
+}
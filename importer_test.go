@@ -0,0 +1,323 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// --- 取引履歴のインポート ---
+
+// TestImportTradeRowsCollectErrors: IMPORT_COLLECT_ERRORS=true の場合、不正な行が3件あれば3件とも行番号付きで報告し、何も挿入しない
+func TestImportTradeRowsCollectErrors(t *testing.T) {
+	original := importCollectErrors
+	importCollectErrors = true
+	t.Cleanup(func() { importCollectErrors = original })
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// INSERT を期待しないため、挿入しようとすると sqlmock がエラーを返す
+	mock.ExpectBegin()
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 行番号はヘッダー行を含めた CSV の行番号 (ヘッダーが1行目)
+	csvData := strings.Join([]string{
+		"user_id,fund_id,quantity,trade_date",
+		"A1B2C3D4E5,123456,10,2024-01-04",
+		"A1B2C3D4E5,abc,10,2024-01-05",     // 3行目: fund_id が数値でない
+		"A1B2C3D4E5,123456,ten,2024-01-06", // 4行目: quantity が数値でない
+		"A1B2C3D4E5,123456,10,2024/01/07",  // 5行目: trade_date の形式が不正
+		"A1B2C3D4E5,123456,20,2024-01-08",
+	}, "\n")
+
+	inserted, err := importTradeRows(tx, strings.NewReader(csvData), "trade_history.csv", CHECK_REFS_OFF, nil, defaultTradeColumns)
+	if err == nil {
+		t.Fatal("不正な行があるのにエラーになりませんでした")
+	}
+	if inserted != 0 {
+		t.Errorf("inserted = %d, want 0", inserted)
+	}
+	message := err.Error()
+	if !strings.Contains(message, "不正な行が 3 件あります") {
+		t.Errorf("エラーに件数が含まれていません: %s", message)
+	}
+	for _, want := range []string{"3 行目の fund_id", "4 行目の quantity", "5 行目の trade_date"} {
+		if !strings.Contains(message, want) {
+			t.Errorf("エラーに %q が含まれていません: %s", want, message)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestImportTradeHistoriesCheckRefs: -check-refs が off の場合は基準価額を確認せず、warn の場合は警告だけ出してコミットし、
+// error の場合は基準価額の無いファンドの取引をファンドごとに行番号付きで報告してロールバックする
+func TestImportTradeHistoriesCheckRefs(t *testing.T) {
+	csvData := strings.Join([]string{
+		"user_id,fund_id,quantity,trade_date",
+		"A1B2C3D4E5,1,10,2024-01-04",
+		"A1B2C3D4E5,2,10,2024-01-04", // 3行目: ファンド2には基準価額が無い
+		"A1B2C3D4E5,2,-5,2024-01-05", // 4行目
+	}, "\n")
+	csvFile := filepath.Join(t.TempDir(), "trade_history.csv")
+	if err := os.WriteFile(csvFile, []byte(csvData), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		checkRefs string
+		wantErr   string
+	}{
+		{CHECK_REFS_OFF, ""},
+		{CHECK_REFS_WARN, ""},
+		{CHECK_REFS_ERROR, "fund_id=2 2件 (行: [3 4])"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.checkRefs, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			mock.ExpectBegin()
+			if tt.checkRefs != CHECK_REFS_OFF {
+				mock.ExpectQuery("SELECT DISTINCT fund_id FROM reference_prices").
+					WillReturnRows(sqlmock.NewRows([]string{"fund_id"}).AddRow(1))
+			}
+			mock.ExpectExec("INSERT INTO trade_histories").WillReturnResult(sqlmock.NewResult(0, 3))
+			if tt.wantErr != "" {
+				mock.ExpectRollback()
+			} else {
+				mock.ExpectQuery("NOT EXISTS").WillReturnRows(sqlmock.NewRows([]string{"fund_id", "trade_date", "count"}))
+				mock.ExpectExec("INSERT INTO import_metadata").WithArgs("trade_histories").WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			}
+
+			inserted, err := importTradeHistories(db, csvFile, tt.checkRefs, defaultTradeColumns, false)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if inserted != 3 {
+					t.Errorf("inserted = %d, want 3", inserted)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error = %v, want %q を含むエラー", err, tt.wantErr)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// --- reference_prices.price の列の型 ---
+
+// TestMigratePriceColumn: 整数部と小数部の桁数がどちらも減らない場合だけ列を広げ、既存の価格が丸められる変更は行わない
+func TestMigratePriceColumn(t *testing.T) {
+	tests := []struct {
+		name             string
+		precision, scale int // 現在の列の型
+		wantAlter        string
+	}{
+		{"変更なし", 20, 8, ""},
+		{"以前の DECIMAL(10, 2) を広げる", 10, 2, "DECIMAL(20, 8)"},
+		{"整数部だけ広げる", 18, 8, "DECIMAL(20, 8)"},
+		{"小数部が減るため変更しない", 20, 10, ""},
+		{"整数部が減るため変更しない", 24, 8, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			mock.ExpectQuery("FROM information_schema.columns").
+				WillReturnRows(sqlmock.NewRows([]string{"NUMERIC_PRECISION", "NUMERIC_SCALE"}).AddRow(tt.precision, tt.scale))
+			if tt.wantAlter != "" {
+				mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE reference_prices MODIFY price " + tt.wantAlter)).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+			}
+
+			if err := migratePriceColumn(db, 20, 8); err != nil {
+				t.Fatal(err)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// --- インポートの同時実行数 (GET_LOCK) ---
+
+// TestAcquireImportSlot: 空いている最初の枠の名前付きロックを取得して解放時に RELEASE_LOCK し、
+// 全ての枠が使用中のまま timeout を過ぎた場合は errImportBusy を返す
+func TestAcquireImportSlot(t *testing.T) {
+	tests := []struct {
+		name     string
+		results  []interface{} // 枠 0 から順に GET_LOCK が返す値 (NULL はエラーで取得できなかった場合)
+		wantSlot int           // 取得する枠 (-1 なら取得できない)
+	}{
+		{"最初の枠が空いている", []interface{}{1}, 0},
+		{"最初の枠が使用中", []interface{}{0, 1}, 1},
+		{"NULL は取得できなかったものとして扱う", []interface{}{nil, 1}, 1},
+		{"全ての枠が使用中", []interface{}{0, 0}, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			for slot, result := range tt.results {
+				mock.ExpectQuery(regexp.QuoteMeta("SELECT GET_LOCK(CONCAT(DATABASE(), '.import_slot_', ?), 0)")).
+					WithArgs(slot).
+					WillReturnRows(sqlmock.NewRows([]string{"acquired"}).AddRow(result))
+			}
+			if tt.wantSlot >= 0 {
+				mock.ExpectExec(regexp.QuoteMeta("SELECT RELEASE_LOCK(CONCAT(DATABASE(), '.import_slot_', ?))")).
+					WithArgs(tt.wantSlot).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+			}
+
+			release, err := acquireImportSlot(db, 2, 0)
+			if tt.wantSlot < 0 {
+				if !errors.Is(err, errImportBusy) {
+					t.Fatalf("err = %v, want errImportBusy", err)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				release()
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// --- 並列インポート ---
+
+// TestImportTradeHistoriesParallelStopsOnFirstError: バッチの挿入に失敗すると残りのバッチは挿入せず、
+// 最初に失敗したバッチの行の範囲と、それまでに挿入済みの件数を報告する
+func TestImportTradeHistoriesParallelStopsOnFirstError(t *testing.T) {
+	// ワーカー1つで IMPORT_WORKER_BATCH_SIZE 件ずつ3バッチ分の行
+	lines := []string{"user_id,fund_id,quantity,trade_date"}
+	for i := 0; i < IMPORT_WORKER_BATCH_SIZE*3; i++ {
+		lines = append(lines, "A1B2C3D4E5,1,10,2024-01-04")
+	}
+	csvFile := filepath.Join(t.TempDir(), "trade_history.csv")
+	if err := os.WriteFile(csvFile, []byte(strings.Join(lines, "\n")), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// バッチ1は挿入に成功し、バッチ2で失敗する。バッチ3の挿入とインポート時刻の記録は期待しない
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO trade_histories").WillReturnResult(sqlmock.NewResult(0, IMPORT_WORKER_BATCH_SIZE))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO trade_histories").WillReturnError(errors.New("deadlock"))
+	mock.ExpectRollback()
+
+	err = importTradeHistoriesParallel(db, csvFile, CHECK_REFS_OFF, defaultTradeColumns, 1)
+	if err == nil {
+		t.Fatal("挿入に失敗したのにエラーになりませんでした")
+	}
+	// 行番号はヘッダー行を含めた CSV の行番号
+	for _, want := range []string{"バッチ 2 (502〜1001 行目)", "deadlock", "500 件は挿入済みです"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("エラーに %q が含まれていません: %v", want, err)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// --- CSV の読み込み (IMPORT_DELIMITER) ---
+
+// TestParseImportDelimiter: IMPORT_DELIMITER は1文字で、\t と書いた場合はタブとして扱い、CSV の引用符や改行は使えない
+func TestParseImportDelimiter(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    rune
+		wantErr bool
+	}{
+		{",", ',', false},
+		{";", ';', false},
+		{`\t`, '\t', false},
+		{"\t", '\t', false},
+		{"、", '、', false},
+		{"", 0, true},
+		{",,", 0, true},
+		{`"`, 0, true},
+		{"\r", 0, true},
+		{"\n", 0, true},
+		{"\xff", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseImportDelimiter(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseImportDelimiter(%q) err = %v, wantErr %v", tt.value, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseImportDelimiter(%q) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestNewCSVReader: 先頭の UTF-8 の BOM を読み飛ばし、IMPORT_DELIMITER の区切り文字で列を分ける
+// 区切り文字がタブの場合は、空の列が詰められないよう先頭の空白を残す
+func TestNewCSVReader(t *testing.T) {
+	tests := []struct {
+		name      string
+		delimiter rune
+		input     string
+		want      [][]string
+	}{
+		{"BOM 付き", ',', "\xef\xbb\xbfid,user_id\n1,U1\n", [][]string{{"id", "user_id"}, {"1", "U1"}}},
+		{"BOM なし", ',', "id,user_id\n1, U1\n", [][]string{{"id", "user_id"}, {"1", "U1"}}},
+		{"セミコロン", ';', "\xef\xbb\xbfid;price\n1;10000,5\n", [][]string{{"id", "price"}, {"1", "10000,5"}}},
+		{"タブ", '\t', "id\tuser_id\tfund_id\n1\t\t 3\n", [][]string{{"id", "user_id", "fund_id"}, {"1", "", " 3"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(v rune) { importDelimiter = v }(importDelimiter)
+			importDelimiter = tt.delimiter
+
+			got, err := newCSVReader(strings.NewReader(tt.input)).ReadAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", tt.want) {
+				t.Errorf("records = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,335 @@
+//go:build integration
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/modules/mysql"
+)
+
+// MySQL を使った結合テスト
+// testcontainers-go で MySQL のコンテナを起動し、testdata/integration の CSV をインポートしてから API を呼び出す
+// 実行: make test/integration (Docker が必要)
+// TEST_MYSQL_DSN を指定した場合はコンテナを起動せず、その (空の) データベースを使う
+
+// --- テスト用データベース ---
+
+const (
+	INTEGRATION_MYSQL_IMAGE = "mysql:8.0"
+	INTEGRATION_DATA_DIR    = "testdata/integration"
+)
+
+var (
+	integrationDSN    string           // テスト用データベースの DSN (TestMain で初期化)
+	integrationDB     *sql.DB          // テスト用データベースへの接続 (TestMain で初期化)
+	integrationServer *httptest.Server // integrationDB を使う API サーバー
+)
+
+func TestMain(m *testing.M) {
+	os.Exit(runIntegrationTests(m))
+}
+
+// runIntegrationTests はデータベースを準備してテストを実行し、終了コードを返す
+// defer でコンテナを確実に停止するため、TestMain から分けている
+func runIntegrationTests(m *testing.M) int {
+	ctx := context.Background()
+
+	dsn := os.Getenv("TEST_MYSQL_DSN")
+	if dsn == "" {
+		container, err := mysql.RunContainer(ctx,
+			testcontainers.WithImage(INTEGRATION_MYSQL_IMAGE),
+			mysql.WithDatabase("appdb"),
+			mysql.WithUsername("user"),
+			mysql.WithPassword("password"),
+		)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "MySQL コンテナの起動に失敗しました: %v\n", err)
+			return 1
+		}
+		defer container.Terminate(ctx)
+
+		dsn, err = container.ConnectionString(ctx, "parseTime=true")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "MySQL コンテナの接続先の取得に失敗しました: %v\n", err)
+			return 1
+		}
+	}
+
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "データベース接続のオープンに失敗しました: %v\n", err)
+		return 1
+	}
+	defer db.Close()
+	integrationDSN = dsn
+
+	if err := setupIntegrationDB(db); err != nil {
+		fmt.Fprintf(os.Stderr, "テスト用データベースの準備に失敗しました: %v\n", err)
+		return 1
+	}
+	integrationDB = db
+	integrationServer = httptest.NewServer(newRouter(&Server{db: db}))
+	defer integrationServer.Close()
+
+	return m.Run()
+}
+
+// setupIntegrationDB はテーブルを作成し、testdata/integration の基準価額と取引履歴をインポートする
+func setupIntegrationDB(db *sql.DB) error {
+	if err := waitForDB(db, 10, 2*time.Second); err != nil {
+		return err
+	}
+	if err := checkTimeScanning(db); err != nil {
+		return err
+	}
+	if err := setupDatabaseTables(db); err != nil {
+		return err
+	}
+	if _, err := importReferencePrices(db, filepath.Join(INTEGRATION_DATA_DIR, "reference_prices.csv"), false); err != nil {
+		return err
+	}
+	if _, err := importTradeHistories(db, filepath.Join(INTEGRATION_DATA_DIR, "trade_history.csv"), CHECK_REFS_OFF, defaultTradeColumns, false); err != nil {
+		return err
+	}
+	return nil
+}
+
+// getJSON は integrationServer に GET リクエストを送り、ステータスコードを確認してレスポンスを v にデコードする
+func getJSON(t *testing.T, path string, wantStatus int, v interface{}) {
+	t.Helper()
+	resp, err := http.Get(integrationServer.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != wantStatus {
+		t.Fatalf("GET %s: status = %d, want %d", path, resp.StatusCode, wantStatus)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("GET %s: レスポンスが JSON ではありません: %v", path, err)
+	}
+}
+
+// newPoolLimitedServer はコネクションプールの上限を maxOpen にした API サーバーを起動する
+// 1つのリクエストが同時に複数の接続を使うと、上限に達したまま待ち続けてデッドロックする
+func newPoolLimitedServer(t *testing.T, maxOpen int) *httptest.Server {
+	t.Helper()
+	db, err := sql.Open("mysql", integrationDSN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(maxOpen)
+	server := httptest.NewServer(newRouter(&Server{db: db}))
+	t.Cleanup(func() {
+		server.Close()
+		db.Close()
+	})
+	return server
+}
+
+// getWithTimeout は server に GET リクエストを送り、デッドロックした場合もテストが止まらないよう timeout で打ち切る
+func getWithTimeout(t *testing.T, server *httptest.Server, path string, timeout time.Duration) *http.Response {
+	t.Helper()
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(server.URL + path)
+	if err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// --- 取引回数 ---
+
+func TestIntegrationTradesCount(t *testing.T) {
+	var got TradesResponse
+	getJSON(t, "/INTEGU0001/trades", http.StatusOK, &got)
+
+	want := TradesResponse{Count: 4, BuyCount: 3, SellCount: 1}
+	if got != want {
+		t.Errorf("trades = %+v, want %+v", got, want)
+	}
+}
+
+// TestIntegrationSameDayTrades: 同じ日に同じファンドを同じ口数で取引した2行は重複として除外せず、2件とも取り込む
+func TestIntegrationSameDayTrades(t *testing.T) {
+	inserted, err := importTradeHistories(integrationDB, filepath.Join(INTEGRATION_DATA_DIR, "same_day_trades.csv"), CHECK_REFS_OFF, defaultTradeColumns, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inserted != 2 {
+		t.Errorf("inserted = %d, want 2", inserted)
+	}
+
+	var rows int
+	err = integrationDB.QueryRow("SELECT COUNT(*) FROM trade_histories WHERE user_id = ? AND fund_id = ? AND trade_date = ?", "INTEGU0003", 1001, "2024-01-05").Scan(&rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows != 2 {
+		t.Errorf("trade_histories の行数 = %d, want 2", rows)
+	}
+
+	var got TradesResponse
+	getJSON(t, "/INTEGU0003/trades", http.StatusOK, &got)
+	if got.Count != 2 {
+		t.Errorf("count = %d, want 2", got.Count)
+	}
+}
+
+// --- 資産評価額 ---
+
+// TestIntegrationOversellWithSingleConnection: 保有口数を超える売却の確認 (resolveOversell) は
+// ポジションの行を読み終えてから行うため、接続が1本しかなくてもデッドロックしない
+func TestIntegrationOversellWithSingleConnection(t *testing.T) {
+	server := newPoolLimitedServer(t, 1)
+	for _, path := range []string{"/INTEGU0005/positions?date=2024-01-09", "/INTEGU0005/assets?date=2024-01-09"} {
+		resp := getWithTimeout(t, server, path, 5*time.Second)
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("GET %s: status = %d, want %d", path, resp.StatusCode, http.StatusOK)
+		}
+	}
+}
+
+// TestIntegrationSellOnUnpricedDate: 基準価額が無い日 (2024-01-06) の売却も保有口数から差し引く
+// 2024-01-09 時点: 1001 を 60口保有し、60口 * 11000 = 66 (買付金額 100 * 60 / 100 = 60)
+func TestIntegrationSellOnUnpricedDate(t *testing.T) {
+	var assets AssetData
+	getJSON(t, "/INTEGU0004/assets?date=2024-01-09", http.StatusOK, &assets)
+	if assets.CurrentValue != 66 || assets.CurrentPL != 6 {
+		t.Errorf("assets = (%d, %d), want (66, 6)", assets.CurrentValue, assets.CurrentPL)
+	}
+
+	var byYear AssetsByYearResponse
+	getJSON(t, "/INTEGU0004/assets/byYear?date=2024-01-09", http.StatusOK, &byYear)
+	if len(byYear.Assets) != 1 || byYear.Assets[0].CurrentValue != 66 || byYear.Assets[0].CurrentPL != 6 {
+		t.Errorf("byYear assets = %+v, want [{2024 66 6}]", byYear.Assets)
+	}
+
+	var costBasis CostBasisResponse
+	getJSON(t, "/INTEGU0004/funds/1001/costbasis?date=2024-01-09", http.StatusOK, &costBasis)
+	if costBasis.TotalQuantity != 60 || costBasis.TotalBuyCost != 60 || costBasis.UnpricedBuys != 0 {
+		t.Errorf("costbasis = {total_quantity: %d, total_buy_cost: %d, unpriced_buys: %d}, want {60, 60, 0}",
+			costBasis.TotalQuantity, costBasis.TotalBuyCost, costBasis.UnpricedBuys)
+	}
+
+	var positions PositionsResponse
+	getJSON(t, "/INTEGU0004/positions?date=2024-01-09", http.StatusOK, &positions)
+	if len(positions.Positions) != 1 || positions.Positions[0].NetQuantity != 60 {
+		t.Errorf("positions = %+v, want [{1001 60}]", positions.Positions)
+	}
+}
+
+// 基準価額は 10000口あたりのため、100口 * 10000 = 100円
+// 2024-01-09 時点: 1001 は 150口 * 11000 = 165 (買付金額 (100 + 105) * 150 / 200 = 153.75)、1002 は 10口 * 19000 = 19 (買付金額 20)
+func TestIntegrationAssets(t *testing.T) {
+	tests := []struct {
+		name      string
+		date      string
+		wantValue int64
+		wantPL    int64
+	}{
+		{"買付のみ", "2024-01-05", 230, 5},      // 1001: 200口 * 10500 = 210 (買付金額 205)、1002: 10口 * 20000 = 20 (買付金額 20)
+		{"一部を売却した後", "2024-01-09", 184, 10}, // 165 + 19 = 184、184 - (153.75 + 20) = 10.25 を切り捨て
+		{"最初の買付の前日", "2024-01-03", 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got AssetData
+			getJSON(t, "/INTEGU0001/assets?date="+tt.date, http.StatusOK, &got)
+
+			if got.Date != tt.date {
+				t.Errorf("date = %q, want %q", got.Date, tt.date)
+			}
+			if got.CurrentValue != tt.wantValue || got.CurrentPL != tt.wantPL {
+				t.Errorf("assets = (%d, %d), want (%d, %d)", got.CurrentValue, got.CurrentPL, tt.wantValue, tt.wantPL)
+			}
+		})
+	}
+}
+
+// TestIntegrationAssetsBatchSmallPool: 評価するユーザー数よりプールの最大接続数が少なくても、一括評価が完了する
+func TestIntegrationAssetsBatchSmallPool(t *testing.T) {
+	server := newPoolLimitedServer(t, 2)
+	body := `{"user_ids": ["INTEGU0001", "INTEGU0002", "INTEGU0003", "INTEGU0004", "INTEGU0005"], "date": "2024-01-09"}`
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Post(server.URL+"/assets/batch", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	var got AssetsBatchResponse
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Results) != 5 {
+		t.Fatalf("len(results) = %d, want 5", len(got.Results))
+	}
+	if first := got.Results[0]; first.UserID != "INTEGU0001" || first.CurrentValue != 184 || first.CurrentPL != 10 {
+		t.Errorf("results[0] = %+v, want {INTEGU0001 184 10}", first)
+	}
+}
+
+func TestIntegrationAssetsInvalidDate(t *testing.T) {
+	var got ErrorResponse
+	getJSON(t, "/INTEGU0001/assets?date=not-a-date", http.StatusBadRequest, &got)
+
+	if got.Error.Code != "invalid_date" {
+		t.Errorf("error.code = %q, want invalid_date", got.Error.Code)
+	}
+}
+
+// TestIntegrationAssetsByYear: 年ごとの資産評価額と、explain=true の内訳の合計が一致する
+func TestIntegrationAssetsByYear(t *testing.T) {
+	var got AssetsByYearResponse
+	getJSON(t, "/INTEGU0001/assets/byYear?date=2024-01-09&explain=true", http.StatusOK, &got)
+
+	if len(got.Assets) != 1 {
+		t.Fatalf("len(assets) = %d, want 1", len(got.Assets))
+	}
+	year := got.Assets[0]
+	if year.Year != 2024 || year.CurrentValue != 184 || year.CurrentPL != 10 {
+		t.Errorf("assets[0] = {year: %d, current_value: %d, current_pl: %d}, want {2024, 184, 10}", year.Year, year.CurrentValue, year.CurrentPL)
+	}
+	if len(year.Funds) != 2 {
+		t.Fatalf("len(funds) = %d, want 2", len(year.Funds))
+	}
+
+	totalValue, totalCost := decimal.Zero, decimal.Zero
+	for _, fund := range year.Funds {
+		value, err := decimal.NewFromString(fund.CurrentValue)
+		if err != nil {
+			t.Fatalf("fund %d の current_value %q が数値ではありません: %v", fund.FundID, fund.CurrentValue, err)
+		}
+		cost, err := decimal.NewFromString(fund.BuyCost)
+		if err != nil {
+			t.Fatalf("fund %d の buy_cost %q が数値ではありません: %v", fund.FundID, fund.BuyCost, err)
+		}
+		totalValue = totalValue.Add(value)
+		totalCost = totalCost.Add(cost)
+	}
+	if v := floorToInt64(totalValue); v != year.CurrentValue {
+		t.Errorf("内訳の current_value の合計 = %d, want %d", v, year.CurrentValue)
+	}
+	if pl := floorToInt64(totalValue.Sub(totalCost)); pl != year.CurrentPL {
+		t.Errorf("内訳から計算した current_pl = %d, want %d", pl, year.CurrentPL)
+	}
+}
@@ -1,28 +1,100 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
 	"database/sql"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"math" // math.Floor のために追加
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"sort"   // スライスソートのために追加
-	// "strconv" // 文字列と数値の変換のために追加
+	"strconv" // 文字列と数値の変換のために追加
+	"strings"
+	"sync"
 	"syscall"
 	"time"
+	_ "time/tzdata" // タイムゾーンのデータが無いコンテナでも APP_TIMEZONE を読み込めるよう埋め込む
 
-	_ "github.com/go-sql-driver/mysql" // MySQL ドライバーのインポート
+	"github.com/go-sql-driver/mysql" // MySQL ドライバー (DSN の組み立てにも使用)
 	"github.com/gorilla/mux"           // ルーティングのために追加
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/shopspring/decimal" // 評価額・買付金額を誤差なく計算するため
 )
 
 // --- 定数 ---
 const (
 	UNIT_PER_PRICE_BASE = 10000.0 // 基準価額あたりの口数 (計算のためにfloat64)
-	DB_RETRY_ATTEMPTS   = 10      // DB接続リトライ回数
-	DB_RETRY_INTERVAL   = 2 * time.Second // DB接続リトライ間隔
+	HEALTHZ_PING_TIMEOUT = 2 * time.Second // /healthz でDBの応答を待つ時間
+	GZIP_MIN_SIZE = 1024 // この大きさ (バイト) 以上のレスポンスのみ gzip で圧縮する
+
+	RAW_VALUE_SCALE = 4 // raw=true で返す切り捨て前の評価額・評価損益の小数点以下の桁数
+
+	USER_ID_MAX_LENGTH = 255 // user_id の最大の長さ (trade_histories.user_id の VARCHAR(255) に合わせる)
+
+	REQUEST_ID_HEADER     = "X-Request-ID" // リクエストIDを受け取り・返すヘッダー
+	REQUEST_ID_MAX_LENGTH = 128            // クライアントから受け取るリクエストIDの最大の長さ
+	ETAG_HASH_BYTES       = 16             // ETag に使うハッシュ (SHA-256) の先頭のバイト数
+	DEFAULT_PRICE_MAX_AGE_DAYS = 30 // 評価日より何日以上古い基準価額を古すぎるとみなすか (PRICE_MAX_AGE_DAYS のデフォルト)
+	DEFAULT_APP_TIMEZONE = "Asia/Tokyo"    // 評価日のデフォルト (今日) を決めるタイムゾーン (APP_TIMEZONE のデフォルト)
+	DEFAULT_DB_QUERY_TIMEOUT = 5 * time.Second // 1リクエストのDBクエリを打ち切るまでの時間 (DB_QUERY_TIMEOUT のデフォルト)
+	DEFAULT_MAX_QUERY_LENGTH = 2048            // クエリ文字列の最大の長さ (MAX_QUERY_LENGTH のデフォルト)
+	DEFAULT_MAX_BODY_BYTES   = 1 << 20         // リクエストボディの最大の大きさ (MAX_BODY_BYTES のデフォルト)
+
+	DEFAULT_BATCH_MAX_WORKERS = 10 // 一括評価の同時実行数 (DBの最大接続数が無制限の場合)
+
+	// コネクションプールの設定 (DB_MAX_OPEN_CONNS, DB_MAX_IDLE_CONNS, DB_CONN_MAX_LIFETIME_SECONDS) のデフォルト
+	DEFAULT_DB_MAX_OPEN_CONNS            = 25
+	DEFAULT_DB_MAX_IDLE_CONNS            = 5
+	DEFAULT_DB_CONN_MAX_LIFETIME_SECONDS = 300
+
+	DEFAULT_HTTP_PORT = "8080" // APIサーバーが待ち受けるポート (HTTP_PORT のデフォルト)
+
+	DEFAULT_SHUTDOWN_TIMEOUT_SECONDS = 10 // 終了シグナルを受信してから処理中のリクエストの完了を待つ秒数 (SHUTDOWN_TIMEOUT_SECONDS のデフォルト)
+
+	DEFAULT_PAGE_SIZE_VALUE = 50  // ページングするエンドポイントの limit 未指定時の件数 (DEFAULT_PAGE_SIZE のデフォルト)
+	MAX_PAGE_SIZE_VALUE     = 500 // ページングするエンドポイントの limit の上限 (MAX_PAGE_SIZE のデフォルト)
+
+	// 評価額・評価損益の集計順序 (ASSETS_ROUNDING_ORDER)
+	ROUNDING_SUM_THEN_FLOOR = "sum_then_floor" // 全ファンドを合計してから切り捨て (デフォルト)
+	ROUNDING_FLOOR_THEN_SUM = "floor_then_sum" // ファンドごとに切り捨ててから合計
+
+	LATEST_PRICE_VERSION = 0 // priceVersion 未指定 (最新の基準価額で評価する)
+
+	// 保有口数を超える売却 (正味の保有口数がマイナス) の扱い (OVERSELL_MODE)
+	OVERSELL_CLAMP          = "clamp"          // 保有口数0として扱う (デフォルト)
+	OVERSELL_REJECT         = "reject"         // エラーとして 422 を返す
+	OVERSELL_ALLOW_NEGATIVE = "allow_negative" // マイナスの保有口数のまま評価する
+
+	// 同じ日の取引を先入先出で突き合わせる際の順序 (LOT_SAME_DAY_ORDER)
+	LOT_ORDER_BUYS_FIRST  = "buys_first"  // 買付を先に数える (デフォルト)
+	LOT_ORDER_SELLS_FIRST = "sells_first" // 売却を先に数える
+	LOT_ORDER_INSERTION   = "insertion"   // 登録された順 (id の昇順) に数える
+
+	DEFAULT_PRICE_PRECISION = 18 // 基準価額の列の全体の桁数 (DECIMAL の精度)
+	DEFAULT_PRICE_SCALE     = 4  // 基準価額の列の小数部の桁数 (DECIMAL のスケール)
+
+	ANCHOR_LAST_BUSINESS_DAY = "lastBusinessDay" // 評価日を直近の営業日にする anchor パラメータ
+	ANCHOR_MONTH_END         = "monthEnd"        // 評価日を指定した月の最後の基準価額のある日にする anchor パラメータ
+	HOLIDAY_LOOKBACK_DAYS    = 31                // 直近の営業日を探す際に遡る最大日数
+
+	GAPS_MAX_RANGE_DAYS    = 3660 // 基準価額の欠損日を調べる期間の最大日数 (約10年)
+	HISTORY_MAX_RANGE_DAYS = 366  // 資産推移を計算する期間の最大日数 (日ごとに評価するため1年分まで)
 )
 
 // --- 設定構造体 ---
@@ -32,10 +104,55 @@ type Config struct {
 	DBHost     string
 	DBPort     string
 	DBName     string
+
+	// 以下は任意 (未設定の場合はドライバーのデフォルト)
+	DBTLS         string // TLS の使用 (true, false, skip-verify)
+	DBTimeout     string // 接続のタイムアウト (例: 5s)
+	DBReadTimeout string // 読み込みのタイムアウト (例: 30s)
 }
 
-// --- グローバルなDB接続変数 ---
-var db *sql.DB
+// --- APIサーバー ---
+
+// Server はハンドラーが使うDB接続を保持する
+// ハンドラーとDBを参照するヘルパーはすべて Server のメソッドにし、パッケージ変数の DB 接続を参照しない
+// (別々のDBに接続した Server を並行して動かせるようにするため)
+type Server struct {
+	db *sql.DB
+}
+
+// --- チューニング用の設定値 (main で環境変数から読み込む) ---
+var assetsBatchMaxWorkers int // 一括評価の同時実行数 (0 の場合はDBの最大接続数に合わせる)
+var roundingOrder = ROUNDING_SUM_THEN_FLOOR // 評価額・評価損益の集計順序
+var autoSetup = true                        // 起動時にテーブルを自動作成するか (false の場合は存在確認のみ)
+var maxResponseElements int                 // レスポンスの配列の最大要素数 (0 の場合は無制限)
+var pricePrecision = DEFAULT_PRICE_PRECISION // reference_prices.price の DECIMAL の精度
+var priceScale = DEFAULT_PRICE_SCALE         // reference_prices.price の DECIMAL のスケール
+var httpAddr = ":" + DEFAULT_HTTP_PORT      // APIサーバーが待ち受けるアドレス (HTTP_HOST と HTTP_PORT から組み立てる)
+var tlsCertFile, tlsKeyFile string           // TLS の証明書と秘密鍵 (両方設定されている場合のみ HTTPS で待ち受ける)
+var tlsMinVersion uint16 = tls.VersionTLS12  // 受け付ける最小の TLS バージョン
+var debugEndpoints bool                      // /debug/ 以下の診断用エンドポイントを公開するか
+var oversellMode = OVERSELL_CLAMP            // 保有口数を超える売却の扱い
+var lotSameDayOrder = LOT_ORDER_BUYS_FIRST   // 同じ日の取引の突き合わせ順序
+var excludeUnpricedBuys bool                 // 買付時の基準価額が無いファンドを評価損益の合計から除外するか
+var defaultPageSize = DEFAULT_PAGE_SIZE_VALUE // limit 未指定時の1ページの件数
+var maxPageSize = MAX_PAGE_SIZE_VALUE         // limit に指定できる最大の件数
+var adminToken string                         // /admin/ 以下のエンドポイントの Bearer トークン (未設定の場合はエンドポイントを公開しない)
+var maxConcurrentImports = 1                  // POST /admin/import を含め、同時に実行できるインポートの数
+var importDataDir = DEFAULT_DATA_DIR          // POST /admin/import でインポートできるCSVファイルのディレクトリ (DATA_DIR)
+var dbMaxOpenConns = DEFAULT_DB_MAX_OPEN_CONNS                              // DBの最大接続数
+var dbMaxIdleConns = DEFAULT_DB_MAX_IDLE_CONNS                              // DBの最大アイドル接続数
+var dbConnMaxLifetime = DEFAULT_DB_CONN_MAX_LIFETIME_SECONDS * time.Second // DB接続を再利用する最大の時間
+var shutdownTimeout = DEFAULT_SHUTDOWN_TIMEOUT_SECONDS * time.Second // 終了時に処理中のリクエストの完了を待つ時間
+var appLocation = time.FixedZone("JST", 9*60*60) // 評価日のデフォルト (今日) を決めるタイムゾーン (main で APP_TIMEZONE から読み込む)
+var priceMaxAgeDays = DEFAULT_PRICE_MAX_AGE_DAYS // 評価に使う基準価額の古さの上限 (日)。0 の場合は制限しない
+var dbRetryAttempts = DEFAULT_DB_RETRY_ATTEMPTS // 起動時にDBへの接続を試す回数
+var dbRetryInterval = DEFAULT_DB_RETRY_INTERVAL // 起動時にDBへの接続を試す間隔
+var dbQueryTimeout = DEFAULT_DB_QUERY_TIMEOUT //  1リクエストのDBクエリを打ち切るまでの時間
+var maxQueryLength = DEFAULT_MAX_QUERY_LENGTH // クエリ文字列の最大の長さ (超えた場合は 414)
+var maxBodyBytes = DEFAULT_MAX_BODY_BYTES     // リクエストボディの最大の大きさ (超えた場合は 413)
+
+// errOversell は OVERSELL_MODE=reject で保有口数を超える売却が見つかった場合のエラー
+var errOversell = errors.New("保有口数を超える売却があります")
 
 // --- データ構造体 (内部使用) ---
 // TradeHistory はAPIからは直接使われないが、DBからの取得やロジックで利用する
@@ -56,16 +173,105 @@ type ReferencePrice struct {
 // Position はユーザーの特定のファンドの保有状況を表す
 type Position struct {
 	FundID        int
-	TotalQuantity int       // 総保有口数
-	TotalBuyCost  float64   // 総買付金額 (正確な計算のためfloat64)
-	TradeDate     time.Time // 取引日（年ごとの集計で使用）
+	TotalQuantity int             // 総保有口数
+	TotalBuyCost  decimal.Decimal // 保有口数に対する買付金額 (総平均法。切り捨て前に誤差が出ないよう10進数で保持)
+	NetInvested   decimal.Decimal // 買付金額から売却日の基準価額による売却金額を引いた正味の投資額
+	TradeDate     time.Time       // 取引日（年ごとの集計で使用）
+}
+
+// fundValuation は評価日時点の1ファンド分の保有状況と評価額
+type fundValuation struct {
+	Position
+	CurrentPrice decimal.Decimal // 評価に使用した基準価額
+	CurrentValue decimal.Decimal // 資産評価額 (切り捨て前)
+
+	// 買付時の基準価額が見つからない取引がある、または保有口数があるのに買付金額が0 (EXCLUDE_UNPRICED_BUYS=true の場合のみ判定する)
+	MissingBuyPrice bool
+}
+
+// valuationTotals は複数ファンドの評価額と買付金額を集計する
+// roundingOrder に応じて「合計してから切り捨て」と「ファンドごとに切り捨ててから合計」を切り替える
+type valuationTotals struct {
+	CurrentValueSum decimal.Decimal // 評価額の合計 (切り捨て前)
+	BuyAmountSum    decimal.Decimal // 買付金額の合計 (切り捨て前)
+	FlooredValueSum int64           // ファンドごとに切り捨てた評価額の合計
+	FlooredPLSum    int64           // ファンドごとに切り捨てた評価損益の合計
+}
+
+// add は1ファンド分の評価額と買付金額を加算する
+func (t *valuationTotals) add(currentValue, buyCost decimal.Decimal) {
+	t.CurrentValueSum = t.CurrentValueSum.Add(currentValue)
+	t.BuyAmountSum = t.BuyAmountSum.Add(buyCost)
+	t.FlooredValueSum += floorToInt64(currentValue)
+	t.FlooredPLSum += floorToInt64(currentValue.Sub(buyCost))
+}
+
+// result は集計順序の設定に従って整数化した評価額と評価損益を返す
+func (t valuationTotals) result() (currentValue int64, currentPL int64) {
+	if roundingOrder == ROUNDING_FLOOR_THEN_SUM {
+		return t.FlooredValueSum, t.FlooredPLSum
+	}
+	return floorToInt64(t.CurrentValueSum), floorToInt64(t.CurrentValueSum.Sub(t.BuyAmountSum))
+}
+
+// unitPerPriceBase は UNIT_PER_PRICE_BASE を10進数の計算で使うための値
+var unitPerPriceBase = decimal.NewFromInt(int64(UNIT_PER_PRICE_BASE))
+
+// marketValue: 基準価額と保有口数から資産評価額 (基準価額 * 保有口数 / 基準価額あたりの口数) を計算する
+// 基準価額は小数4桁までのため、10進数で計算すれば切り捨て前の値に誤差は出ない
+func marketValue(price decimal.Decimal, quantity int) decimal.Decimal {
+	return price.Mul(decimal.NewFromInt(int64(quantity))).Div(unitPerPriceBase)
+}
+
+// floorToInt64: 金額を整数に切り捨てる
+func floorToInt64(d decimal.Decimal) int64 {
+	return d.Floor().IntPart()
 }
 
 // --- APIレスポンス構造体 ---
 
+// ErrorResponse は writeJSONError で返すエラーのレスポンス
+type ErrorResponse struct {
+	Error ErrorDetail `json:"error"`
+}
+
+// ErrorDetail はエラーの種類と内容
+type ErrorDetail struct {
+	Code    string `json:"code"`    // 機械的に判定するためのエラーコード
+	Message string `json:"message"` // エラーの内容 (日本語)
+	// サーバーのログと突き合わせるためのリクエストID (X-Request-ID)
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// VersionResponse は GET /version のレスポンス
+type VersionResponse struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+}
+
 // TradesResponse はStep 3のレスポンス
 type TradesResponse struct {
-	Count int `json:"count"`
+	Count     int `json:"count"`      // 取引の総数
+	BuyCount  int `json:"buy_count"`  // 買付 (口数がプラス) の取引数
+	SellCount int `json:"sell_count"` // 売却 (口数がマイナス) の取引数
+}
+
+// TradesListResponse はユーザーの取引一覧のレスポンス
+type TradesListResponse struct {
+	Trades    []TradeItem `json:"trades"`
+	Total     int         `json:"total"` // ページングする前の取引の件数
+	Limit     int         `json:"limit"`
+	Offset    int         `json:"offset"`
+	Truncated bool        `json:"truncated,omitempty"` // MAX_RESPONSE_ELEMENTS により配列が切り詰められた場合に true
+}
+
+// TradeItem は取引一覧の1件
+type TradeItem struct {
+	ID        int64  `json:"id"`
+	FundID    int    `json:"fund_id"`
+	Quantity  int    `json:"quantity"`
+	TradeDate string `json:"trade_date"`
 }
 
 // AssetData はStep 4, 5, 6の資産評価額と評価損益のレスポンス
@@ -73,12 +279,36 @@ type AssetData struct {
 	Date        string `json:"date"`
 	CurrentValue int64 `json:"current_value"` // 整数に切り捨て
 	CurrentPL    int64 `json:"current_pl"`    // 整数に切り捨て
+
+	// 切り捨て前の値 (exact=true を指定した場合のみ返す)
+	ExactCurrentValue string `json:"exact_current_value,omitempty"`
+	ExactCurrentPL    string `json:"exact_current_pl,omitempty"`
+
+	// 切り捨て前の値を小数点以下 RAW_VALUE_SCALE 桁に揃えた文字列 (raw=true を指定した場合のみ返す)
+	// 突き合わせで端数処理を確認するためのもの。exact_* と違い桁数が常に同じになる
+	CurrentValueRaw string `json:"current_value_raw,omitempty"`
+	CurrentPLRaw    string `json:"current_pl_raw,omitempty"`
+
+	// 評価に使った基準価額のインポートバッチ (priceVersion を指定した場合のみ返す)
+	PriceVersion int64 `json:"price_version,omitempty"`
+
+	// 評価損益の内訳 (distributions=true を指定した場合のみ返す)
+	// current_pl = price_pl + distribution_income となる
+	PricePL            *int64 `json:"price_pl,omitempty"`            // 基準価額の変動による評価損益
+	DistributionIncome *int64 `json:"distribution_income,omitempty"` // 受け取った分配金の合計
+
+	// 買付時の基準価額が無いため合計から除外したファンド (EXCLUDE_UNPRICED_BUYS=true の場合のみ)
+	ExcludedFunds []int `json:"excluded_funds,omitempty"`
+
+	// 金額を丸めた単位 (roundTo を指定した場合のみ返す)
+	RoundTo int64 `json:"round_to,omitempty"`
 }
 
 // AssetsByYearResponse はStep 6の買付年ごとの評価額・評価損益のレスポンス
 type AssetsByYearResponse struct {
-	Date   string        `json:"date"`
-	Assets []YearlyAsset `json:"assets"`
+	Date      string        `json:"date"`
+	Assets    []YearlyAsset `json:"assets"`
+	Truncated bool          `json:"truncated,omitempty"` // MAX_RESPONSE_ELEMENTS により配列が切り詰められた場合に true
 }
 
 // YearlyAsset はStep 6の年ごとの資産評価額・評価損益の詳細
@@ -86,377 +316,4586 @@ type YearlyAsset struct {
 	Year        int   `json:"year"`
 	CurrentValue int64 `json:"current_value"`
 	CurrentPL    int64 `json:"current_pl"`
-}
-
-// --- メイン関数 ---
-func main() {
-	// --- データベース接続設定 ---
-	cfg := Config{
-		DBUser:     os.Getenv("DB_USER"),
-		DBPassword: os.Getenv("DB_PASSWORD"),
-		DBHost:     os.Getenv("DB_HOST"),
-		DBPort:     os.Getenv("DB_PORT"),
-		DBName:     os.Getenv("DB_NAME"),
-	}
-
-	if cfg.DBUser == "" || cfg.DBPassword == "" || cfg.DBHost == "" || cfg.DBPort == "" || cfg.DBName == "" {
-		log.Fatal("環境変数の読み込みに失敗しました: DB_USER, DB_PASSWORD, DB_HOST, DB_PORT, DB_NAME が設定されている必要があります。")
-	}
-
-	// parseTime=true は MySQL ドライバーで time.Time 型を正しく扱うために重要
-	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true", cfg.DBUser, cfg.DBPassword, cfg.DBHost, cfg.DBPort, cfg.DBName)
-	log.Printf("データベースに接続を試行中: %s", cfg.DBHost)
 
-	var err error
-	db, err = sql.Open("mysql", dsn)
-	if err != nil {
-		log.Fatalf("データベース接続のオープンに失敗しました: %v", err)
-	}
-	defer db.Close() // 関数終了時にDB接続を閉じる
+	// explain=true の場合のみ、その年の集計に使ったファンドごとの内訳 (ファンドIDの昇順)
+	Funds []YearlyFundDetail `json:"funds,omitempty"`
+}
 
-	// データベース接続のリトライロジック
-	for i := 0; i < DB_RETRY_ATTEMPTS; i++ {
-		err = db.Ping()
-		if err == nil {
-			log.Println("データベースに正常に接続しました！")
-			break
-		}
-		log.Printf("データベースの準備を待機中 (試行 %d/%d): %v", i+1, DB_RETRY_ATTEMPTS, err)
-		time.Sleep(DB_RETRY_INTERVAL)
-	}
-	if err != nil {
-		log.Fatalf("リトライ後もデータベースが準備できませんでした: %v", err)
-	}
+// YearlyFundDetail は年別集計の1ファンド分の内訳
+// 値は切り捨て前のもので、合計して ASSETS_ROUNDING_ORDER に従って切り捨てると年の合計に一致する
+// 合計しても誤差が出ないよう、金額は float ではなく10進数の文字列で返す
+type YearlyFundDetail struct {
+	FundID       int    `json:"fund_id"`
+	Quantity     int    `json:"quantity"`      // その年に買付した口数 (売却を差し引いたもの)
+	CurrentPrice string `json:"current_price"` // 評価に使用した基準価額
+	BuyCost      string `json:"buy_cost"`      // 買付金額
+	CurrentValue string `json:"current_value"` // 資産評価額
+}
 
-	// --- データベーステーブルの初期化 ---
-	// CSVインポートをしない場合でも、テーブル構造は必要なのでこの処理は残します。
-	log.Println("データベーステーブルが存在することを確認しています...")
-	err = setupDatabaseTables(db)
-	if err != nil {
-		log.Fatalf("データベーステーブルの設定に失敗しました: %v", err)
-	}
-	log.Println("データベーステーブルは準備完了です。")
+// FundAsset はファンドごとの資産評価額と評価損益
+type FundAsset struct {
+	FundID       int   `json:"fund_id"`
+	CurrentValue int64 `json:"current_value"` // 整数に切り捨て
+	CurrentPL    int64 `json:"current_pl"`    // 整数に切り捨て
+	// 損益分岐となる基準価額: 評価額 (基準価額 * 保有口数 / 基準価額あたりの口数) が買付金額と等しくなる基準価額
+	// = 買付金額 * 基準価額あたりの口数 / 保有口数
+	BreakEvenPrice float64 `json:"break_even_price"`
+	// 保有中のロット (先入先出で売却を差し引いた買付) の買付日を口数で加重平均した日付
+	// 保有中のロットが無い場合は省略する
+	AverageEntryDate string `json:"average_entry_date,omitempty"`
+}
 
-	// --- APIサーバー設定 ---
-	router := mux.NewRouter()
+// AssetHistoryPoint は資産推移の1日分の資産評価額と評価損益
+type AssetHistoryPoint struct {
+	Date         string `json:"date"`
+	CurrentValue int64  `json:"current_value"` // 整数に切り捨て
+	CurrentPL    int64  `json:"current_pl"`    // 整数に切り捨て
+}
 
-	// 基本的なヘルスチェック
-	router.HandleFunc("/hello", helloHandler).Methods("GET")
+// DrawdownResponse は期間中で資産評価額が前日から最も大きく下落した日
+// 期間中に下落した日が無い場合、date は省略し amount は0になる
+type DrawdownResponse struct {
+	From    string   `json:"from"`
+	To      string   `json:"to"`
+	Date    string   `json:"date,omitempty"`    // 下落額が最大の日
+	Amount  int64    `json:"amount"`            // 前日の評価額からの下落額
+	Percent *float64 `json:"percent,omitempty"` // 前日の評価額に対する下落率 (%)。前日の評価額が0の場合は省略する
+}
 
-	// Step 3: ユーザーの取引回数を取得
-	router.HandleFunc("/{user_id}/trades", getTradesCountHandler).Methods("GET")
+// RealizedGainsResponse は指定した年に売却した分の実現損益
+type RealizedGainsResponse struct {
+	Year            int                `json:"year"`
+	TotalRealizedPL int64              `json:"total_realized_pl"` // funds の realized_pl の合計
+	Funds           []FundRealizedGain `json:"funds"`
+}
 
-	// Step 4 & 5: ユーザーの資産評価額と評価損益を取得 (オプションの日付パラメータあり)
-	router.HandleFunc("/{user_id}/assets", getAssetsHandler).Methods("GET")
+// FundRealizedGain は1ファンドの実現損益 (金額はいずれも整数に切り捨て)
+// realized_pl = proceeds - cost (切り捨て前の値で計算してから切り捨てる)
+type FundRealizedGain struct {
+	FundID        int   `json:"fund_id"`
+	Quantity      int   `json:"quantity"`                 // 売却した口数
+	Proceeds      int64 `json:"proceeds"`                 // 売却日の基準価額による売却金額
+	Cost          int64 `json:"cost"`                     // 先入先出で突き合わせた買付金額
+	RealizedPL    int64 `json:"realized_pl"`              // 実現損益
+	UnpricedSales int   `json:"unpriced_sales,omitempty"` // 基準価額が無いため実現損益に含めなかった売却の件数
+}
 
-	// Step 6: ユーザーの資産評価額と評価損益を年ごとに取得
-	router.HandleFunc("/{user_id}/assets/byYear", getAssetsByYearHandler).Methods("GET")
+// DCAResponse はファンドの積立 (定期的な買付) の分析結果
+// 買付が無い場合は buy_count=0 で、日付と平均値は省略する
+type DCAResponse struct {
+	FundID              int      `json:"fund_id"`
+	BuyCount            int      `json:"buy_count"`                       // 買付の回数
+	FirstBuyDate        string   `json:"first_buy_date,omitempty"`        // 最初の買付日
+	LastBuyDate         string   `json:"last_buy_date,omitempty"`         // 最後の買付日
+	AverageIntervalDays *float64 `json:"average_interval_days,omitempty"` // 買付日の平均の間隔 (日)。買付日が1日だけの場合は省略
+	AverageBuyPrice     *float64 `json:"average_buy_price,omitempty"`     // 口数で加重平均した買付時の基準価額 (平均取得単価)
+	PeriodAveragePrice  *float64 `json:"period_average_price,omitempty"`  // 最初の買付日から最後の買付日までの基準価額の単純平均
+	DifferencePercent   *float64 `json:"difference_percent,omitempty"`    // 平均取得単価の単純平均に対する差 (%)。マイナスなら単純平均より安く買えている
+	UnpricedBuys        int      `json:"unpriced_buys,omitempty"`         // 買付日の基準価額が無いため平均取得単価に含めなかった買付の件数
+}
 
-	// HTTPサーバーを起動
-	port := "8080"
-	fmt.Printf("APIサーバー :https://localhost:%s で起動中\n", port)
+// CostBasisResponse はファンドの買付金額 (取得価額) の内訳
+// total_buy_cost は /{user_id}/assets と同じく総平均法で計算した保有口数分の買付金額
+type CostBasisResponse struct {
+	FundID          int            `json:"fund_id"`
+	Date            string         `json:"date"`
+	TotalQuantity   int            `json:"total_quantity"`          // 保有口数
+	TotalBuyCost    int64          `json:"total_buy_cost"`          // 保有口数に対する買付金額 (整数に切り捨て)
+	AverageUnitCost float64        `json:"average_unit_cost"`       // 平均取得単価 (基準価額と同じく UNIT_PER_PRICE_BASE 口あたり)
+	Buys            []CostBasisBuy `json:"buys"`                    // 平均取得単価の計算に使った買付と移管 (日付順)
+	UnpricedBuys    int            `json:"unpriced_buys,omitempty"` // 買付日の基準価額が無いため計算に含めなかった買付の件数
+}
 
-	// サーバーを起動し、エラーがあればログに出力して終了
-	go func() {
-		log.Fatal(http.ListenAndServe(":"+port, router))
-	}()
+// CostBasisBuy は買付金額の計算に使った1件分の買付または移管
+type CostBasisBuy struct {
+	Date     string   `json:"date"`
+	Source   string   `json:"source"`          // trade (買付) または transfer (他の口座からの移管)
+	Quantity int      `json:"quantity"`        // 口数
+	Price    *float64 `json:"price,omitempty"` // 買付日の基準価額 (移管の場合は省略)
+	Cost     float64  `json:"cost"`            // 買付金額 (移管の場合は移管元での取得価額)
+}
 
-	// --- コンテナを起動し続けるための処理 ---
-	fmt.Println("APIサーバーが起動しました。終了シグナルを待機中...")
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM) // Ctrl+C や docker stop を捕捉
-	<-sigs                                               // シグナルが来るまでブロック
-	fmt.Println("終了シグナルを受信しました。アプリケーションを終了します。")
-	fmt.Println("Application exiting.")
+// PositionsResponse はユーザーのファンドごとの保有口数のレスポンス
+type PositionsResponse struct {
+	Date      string        `json:"date"`
+	Positions []NetPosition `json:"positions"`
+	Limit     int           `json:"limit"`
+	Offset    int           `json:"offset"`
+	Truncated bool          `json:"truncated,omitempty"` // MAX_RESPONSE_ELEMENTS により配列が切り詰められた場合に true
 }
 
-// --- ヘルパー関数: データベーステーブルのセットアップ ---
-// CSVインポートが行われない場合でも、APIがDBを参照するためにテーブルは必要なので残します。
-func setupDatabaseTables(db *sql.DB) error {
-	createTradeHistoriesSQL := `
-	CREATE TABLE IF NOT EXISTS trade_histories (
-		user_id VARCHAR(255) NOT NULL,
-		fund_id INT NOT NULL,
-		quantity INT NOT NULL,
-		trade_date DATE NOT NULL,
-		PRIMARY KEY (user_id, fund_id, trade_date)
-	);`
+// NetPosition はファンドごとの正味の保有口数 (売却を含む取引口数の合計)
+type NetPosition struct {
+	FundID      int `json:"fund_id"`
+	NetQuantity int `json:"net_quantity"`
+}
 
-	createReferencePricesSQL := `
-	CREATE TABLE IF NOT EXISTS reference_prices (
-		fund_id INT NOT NULL,
-		price DECIMAL(10, 2) NOT NULL,
-		price_date DATE NOT NULL,
-		PRIMARY KEY (fund_id, price_date)
-	);`
+// AttributionResponse は期間中の評価損益の変化をファンドごとに分解したレスポンス
+type AttributionResponse struct {
+	From          string            `json:"from"`
+	To            string            `json:"to"`
+	TotalPLChange int64             `json:"total_pl_change"` // funds の pl_change の合計
+	Funds         []FundAttribution `json:"funds"`
+}
 
-	_, err := db.Exec(createTradeHistoriesSQL)
-	if err != nil {
-		return fmt.Errorf("trade_histories テーブルの作成に失敗しました: %w", err)
-	}
-	log.Println("trade_histories テーブルは作成済み、または既に存在します。")
+// FundAttribution は1ファンドの評価損益の変化への寄与
+// pl_change = value_change - net_investment (いずれも整数に切り捨て)
+type FundAttribution struct {
+	FundID        int   `json:"fund_id"`
+	ValueChange   int64 `json:"value_change"`   // 評価額の変化
+	NetInvestment int64 `json:"net_investment"` // 期間中の買付金額から売却金額を引いたもの
+	PLChange      int64 `json:"pl_change"`      // 評価損益の変化 (売却による実現損益を含む)
+}
 
-	_, err = db.Exec(createReferencePricesSQL)
-	if err != nil {
-		return fmt.Errorf("reference_prices テーブルの作成に失敗しました: %w", err)
-	}
-	log.Println("reference_prices テーブルは作成済み、または既に存在します。")
-	return nil
+// DormantFundsResponse は保有者が1人もいないファンドの一覧のレスポンス
+type DormantFundsResponse struct {
+	Date      string        `json:"date"`
+	Funds     []DormantFund `json:"funds"`
+	Truncated bool          `json:"truncated,omitempty"` // MAX_RESPONSE_ELEMENTS により配列が切り詰められた場合に true
 }
 
-// --- APIハンドラ ---
+// DormantFund は保有者が1人もいないファンド
+type DormantFund struct {
+	FundID     int  `json:"fund_id"`
+	EverTraded bool `json:"ever_traded"` // 評価日以前に取引されたことがあるか (false なら基準価額のみ存在する)
+}
 
-// helloHandler: 基本的なヘルスチェック
-func helloHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"message": "Hello from Go API!"})
+// AssetsBatchRequest は複数ユーザーの一括評価のリクエスト
+type AssetsBatchRequest struct {
+	UserIDs []string `json:"user_ids"`
+	Date    string   `json:"date"` // 省略時は現在の日付
 }
 
-// getTradesCountHandler: Step 3 - 特定のuser_idの取引回数を取得
-func getTradesCountHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	userID := vars["user_id"]
+// AssetsWhatIfRequest は基準価額を差し替えた評価のリクエスト
+type AssetsWhatIfRequest struct {
+	Date   string          `json:"date"`   // 省略時は現在の日付
+	Prices map[int]json.Number `json:"prices"` // ファンドIDごとの仮の基準価額 (例: {"1": 12000})。float64 を経由せず decimal で読み込む
+}
 
-	var count int
-	// user_idごとのtrade_dateのユニークな数を数える
-	// もし「取引を行った回数」が `trade_histories` テーブルの行数と等しいなら COUNT(*) でOK
-	// 厳密に「取引を行った日」のユニーク数を数えるなら DISTINCT trade_date を使う
-	query := "SELECT COUNT(*) FROM trade_histories WHERE user_id = ?"
-	err := db.QueryRow(query, userID).Scan(&count)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("取引回数の取得に失敗しました: %v", err), http.StatusInternalServerError)
-		return
-	}
+// AssetsBatchResponse は複数ユーザーの一括評価のレスポンス
+type AssetsBatchResponse struct {
+	Date    string          `json:"date"`
+	Results []UserAssetData `json:"results"`
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(TradesResponse{Count: count})
+// UserAssetData は一括評価におけるユーザーごとの資産評価額・評価損益
+type UserAssetData struct {
+	UserID       string `json:"user_id"`
+	CurrentValue int64  `json:"current_value"`
+	CurrentPL    int64  `json:"current_pl"`
 }
 
-// getAssetsHandler: Step 4 & 5 - ユーザーの資産評価額と評価損益を取得 (オプションの日付パラメータあり)
-func getAssetsHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	userID := vars["user_id"]
-	dateStr := r.URL.Query().Get("date") // クエリパラメータからdateを取得
+// ActiveUsersResponse は取引の多いユーザーのランキング
+type ActiveUsersResponse struct {
+	From   string       `json:"from,omitempty"` // 期間を指定した場合のみ
+	To     string       `json:"to,omitempty"`
+	By     string       `json:"by"` // 並び順の基準 (trades または days)
+	Users  []ActiveUser `json:"users"`
+	Limit  int          `json:"limit"`
+	Offset int          `json:"offset"`
+}
 
-	var targetDate time.Time
-	if dateStr != "" {
-		// 指定された日付を使用
-		parsedDate, err := time.Parse("2006-01-02", dateStr)
-		if err != nil {
-			http.Error(w, "日付フォーマットが不正です。YYYY-MM-DD 形式を使用してください。", http.StatusBadRequest)
-			return
-		}
-		targetDate = parsedDate
-	} else {
-		// 日付が指定されていない場合は現在の日付を使用
-		// Goのtime.Now()はタイムゾーン情報を持つため、DBのDATE型に合わせるために日付部分のみにする
-		targetDate = time.Now().In(time.Local) // 日本のタイムゾーンで現在時刻を取得
-		targetDate = time.Date(targetDate.Year(), targetDate.Month(), targetDate.Day(), 0, 0, 0, 0, time.Local)
-	}
+// ActiveUser はランキングの1ユーザー分
+type ActiveUser struct {
+	UserID     string `json:"user_id"`
+	TradeCount int    `json:"trade_count"` // 取引の件数
+	TradeDays  int    `json:"trade_days"`  // 取引のあった日数
+}
 
-	// 資産評価額と買付金額の合計を計算するためのSQLクエリ
-	// 各ファンドIDごとの最終的な保有口数と、その口数に対する買付金額の合計を算出
-	// 指定された日付以前の取引のみを考慮する
-	rows, err := db.Query(`
-		SELECT
-			th.fund_id,
-			SUM(th.quantity) AS total_quantity,
-			-- 買付金額の合計: (買付時の基準価額 / 基準価額あたりの口数 * 買付口数) を合計
-			-- MySQLのDECIMAL型はそのままfloat64にスキャンされる
-			SUM(th.quantity * rp_buy.price / ?) AS total_buy_cost
-		FROM
-			trade_histories th
-		JOIN
-			reference_prices rp_buy ON th.fund_id = rp_buy.fund_id AND th.trade_date = rp_buy.price_date
-		WHERE
-			th.user_id = ? AND th.trade_date <= ?
-		GROUP BY
-			th.fund_id
-		HAVING
-			total_quantity > 0;
-	`, UNIT_PER_PRICE_BASE, userID, targetDate.Format("2006-01-02")) // DATE型に合わせるためフォーマット
-	if err != nil {
-		log.Printf("ユーザー %s のポジション取得中にエラーが発生しました（日付 %s）: %v", userID, targetDate.Format("2006-01-02"), err)
-		http.Error(w, "資産データの取得に失敗しました。", http.StatusInternalServerError)
-		return
-	}
-	defer rows.Close()
+// PriceGapsResponse はファンドの基準価額が存在しない日付の一覧
+type PriceGapsResponse struct {
+	FundID    int      `json:"fund_id"`
+	From      string   `json:"from"`
+	To        string   `json:"to"`
+	Count     int      `json:"count"` // 欠損日の数 (dates が切り詰められた場合も全件の数)
+	Dates     []string `json:"dates"`
+	Truncated bool     `json:"truncated,omitempty"` // MAX_RESPONSE_ELEMENTS により配列が切り詰められた場合に true
+}
 
-	// 各ファンドIDごとの保有状況と買付金額を格納
-	positions := make(map[int]Position)
-	for rows.Next() {
-		var fundID int
-		var totalQuantity int
-		var totalBuyCost float64
-		err := rows.Scan(&fundID, &totalQuantity, &totalBuyCost)
-		if err != nil {
-			log.Printf("ポジション行のスキャン中にエラーが発生しました: %v", err)
-			continue
-		}
-		positions[fundID] = Position{
-			FundID:        fundID,
-			TotalQuantity: totalQuantity,
-			TotalBuyCost:  totalBuyCost,
-		}
-	}
-	if rows.Err() != nil {
-		log.Printf("行のイテレーション中にエラーが発生しました: %v", rows.Err())
-	}
+// PriceUpdateRequest は基準価額の部分更新のリクエスト
+// price は精度を保つため、JSON の文字列 ("12345.6789") でも数値でも書かれたままの値を使う
+type PriceUpdateRequest struct {
+	Price json.Number `json:"price"`
+}
 
-	var totalCurrentValue float64 = 0
-	var totalBuyAmount float64 = 0
+// PriceUpsertRequest は基準価額の登録・上書きのリクエスト
+// price は PriceUpdateRequest と同様に、書かれたままの値を使う
+type PriceUpsertRequest struct {
+	Price     json.Number `json:"price"`
+	PriceDate string      `json:"price_date"` // YYYY-MM-DD
+}
 
-	for _, pos := range positions {
-		// 基準価額（評価日時点の最新の基準価額）を取得
-		// 指定日以前で最も新しい price_date を持つレコードを取得
-		var currentPrice float64
-		err := db.QueryRow(`
-			SELECT price FROM reference_prices
-			WHERE fund_id = ? AND price_date <= ?
-			ORDER BY price_date DESC
-			LIMIT 1
-		`, pos.FundID, targetDate.Format("2006-01-02")).Scan(&currentPrice)
-		if err == sql.ErrNoRows {
-			// そのファンドIDの基準価額が指定日以前で見つからない場合、その銘柄は評価対象外
-			log.Printf("ファンドID %d の参照価格が %s 以前で見つかりません。計算をスキップします。", pos.FundID, targetDate.Format("2006-01-02"))
-			continue
-		}
-		if err != nil {
-			log.Printf("ファンドID %d の現在価格の取得中にエラーが発生しました: %v", pos.FundID, err)
-			continue // エラーが発生した場合はその銘柄の計算をスキップ
-		}
+// ReferencePriceResponse は更新後の基準価額
+type ReferencePriceResponse struct {
+	FundID       int    `json:"fund_id"`
+	PriceDate    string `json:"price_date"`
+	Price        string `json:"price"`         // 精度を保つため文字列で返す
+	PriceVersion int64  `json:"price_version"` // この更新で作成された基準価額のバージョン
+}
 
-		// 資産評価額: (基準価額 * 所持口数) / 基準価額あたりの口数
-		currentValue := (currentPrice * float64(pos.TotalQuantity)) / UNIT_PER_PRICE_BASE
-		totalCurrentValue += currentValue
+// CreateTradeRequest は取引の登録のリクエスト
+// 口数がプラスの場合は買付、マイナスの場合は売却 (CSVのインポートと同じ)
+type CreateTradeRequest struct {
+	FundID    *int   `json:"fund_id"`
+	Quantity  *int   `json:"quantity"`
+	TradeDate string `json:"trade_date"` // YYYY-MM-DD
+}
 
-		// 買付金額の合計は Position の TotalBuyCost をそのまま使う
-		totalBuyAmount += pos.TotalBuyCost
-	}
+// CreatedTradeResponse は登録した取引
+type CreatedTradeResponse struct {
+	ID        int64  `json:"id"`
+	UserID    string `json:"user_id"`
+	FundID    int    `json:"fund_id"`
+	Quantity  int    `json:"quantity"`
+	TradeDate string `json:"trade_date"`
+}
 
-	// 整数に切り捨て
-	finalCurrentValue := int64(math.Floor(totalCurrentValue))
-	finalCurrentPL := int64(math.Floor(totalCurrentValue - totalBuyAmount))
+// AdminImportRequest はサーバー上のCSVファイルのインポートのリクエスト
+type AdminImportRequest struct {
+	Which string `json:"which"` // "trades" または "prices"
+	Path  string `json:"path"`  // DATA_DIR からの相対パス
+	Mode  string `json:"mode"`  // trades の場合のみ: 基準価額の存在チェック (off, warn, error)。省略時は off
+	// trades の場合のみ: trade_histories に既にデータがあっても追加でインポートする (省略時は 409 を返す)
+	Append bool `json:"append"`
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(AssetData{
-		Date:        targetDate.Format("2006-01-02"),
-		CurrentValue: finalCurrentValue,
-		CurrentPL:    finalCurrentPL,
-	})
+// AdminImportResponse はインポートの結果
+type AdminImportResponse struct {
+	Which string `json:"which"`
+	Path  string `json:"path"`
+	Count int    `json:"count"` // 挿入した件数
 }
 
-// getAssetsByYearHandler: Step 6 - ユーザーの資産評価額・評価損益を年ごとに取得
-func getAssetsByYearHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	userID := vars["user_id"]
-	
-	// 現在の日付を取得（基準価額の取得に使用）
-	currentDate := time.Now().In(time.Local)
-	currentDate = time.Date(currentDate.Year(), currentDate.Month(), currentDate.Day(), 0, 0, 0, 0, time.Local)
-	currentDateStr := currentDate.Format("2006-01-02")
+// DBStatsResponse はコネクションプールの統計情報 (sql.DBStats の一部)
+type DBStatsResponse struct {
+	OpenConnections    int   `json:"open_connections"`     // 確立済みの接続数 (使用中 + アイドル)
+	InUse              int   `json:"in_use"`               // 使用中の接続数
+	Idle               int   `json:"idle"`                 // アイドル状態の接続数
+	WaitCount          int64 `json:"wait_count"`           // 接続の空きを待った回数の累計
+	WaitDurationMs     int64 `json:"wait_duration_ms"`     // 接続の空きを待った時間の累計 (ミリ秒)
+	MaxOpenConnections int   `json:"max_open_connections"` // 最大接続数 (0 は無制限)
+}
 
-	// 買付年、ファンドIDごとの総保有口数と総買付金額を取得
-	// current_value, current_pl の計算は Go側で行うため、買付時の情報のみ取得
-	rows, err := db.Query(`
-		SELECT
-			YEAR(th.trade_date) AS trade_year,
-			th.fund_id,
-			SUM(th.quantity) AS total_quantity,
-			SUM(th.quantity * rp_buy.price / ?) AS total_buy_cost
-		FROM
-			trade_histories th
-		JOIN
-			reference_prices rp_buy ON th.fund_id = rp_buy.fund_id AND th.trade_date = rp_buy.price_date
-		WHERE
-			th.user_id = ? AND th.trade_date <= ? -- 現在時刻までの取引を対象
-		GROUP BY
-			trade_year, th.fund_id
-		HAVING
-			total_quantity > 0; -- 1口以上の残高をもつ銘柄
-	`, UNIT_PER_PRICE_BASE, userID, currentDateStr)
-	if err != nil {
-		log.Printf("ユーザー %s の年別資産取得中にエラーが発生しました: %v", userID, err)
-		http.Error(w, "年別資産データの取得に失敗しました。", http.StatusInternalServerError)
+// --- メイン関数 ---
+func main() {
+	// --- 設定ファイルの読み込み ---
+	// 設定ファイルの値は環境変数で上書きされる (環境変数 > 設定ファイル > コード上のデフォルト値)
+	configPath := flag.String("config", "", "設定ファイル (JSON) のパス。未指定の場合は環境変数 CONFIG_FILE を使用")
+	showVersion := flag.Bool("version", false, "ビルド情報を表示して終了する")
+	flag.Parse()
+	if *showVersion {
+		fmt.Println(buildInfo())
 		return
 	}
-	defer rows.Close()
-
-	// 年ごとの集計マップ
-	// Key: 年 (int), Value: その年の合計評価額と合計買付金額
-	// さらに、その年に購入したファンドごとの保有口数と買付コストを保持する
-	type yearlyFundData struct {
-		CurrentValueSum float64
-		BuyAmountSum    float64
+	if *configPath == "" {
+		*configPath = os.Getenv("CONFIG_FILE")
 	}
-	yearlySummary := make(map[int]yearlyFundData)
-    
-	// ファンドごとの現在価格のキャッシュ (複数回クエリを打つのを避けるため)
-	priceCache := make(map[int]float64)
-
-	for rows.Next() {
-		var tradeYear int
-		var fundID int
-		var totalQuantity int
-		var totalBuyCost float64
-		err := rows.Scan(&tradeYear, &fundID, &totalQuantity, &totalBuyCost)
-		if err != nil {
-			log.Printf("年別資産行のスキャン中にエラーが発生しました: %v", err)
-			continue
+	if *configPath != "" {
+		if err := loadConfigFile(*configPath); err != nil {
+			fatal("設定ファイルの読み込みに失敗しました", "path", *configPath, "error", err)
 		}
+	}
 
-		// 現在時刻の基準価額を取得 (キャッシュ利用)
-		currentPrice, ok := priceCache[fundID]
-		if !ok {
-			err := db.QueryRow(`
-				SELECT price FROM reference_prices
-				WHERE fund_id = ? AND price_date <= ?
-				ORDER BY price_date DESC
-				LIMIT 1
-			`, fundID, currentDateStr).Scan(&currentPrice)
-
-			if err == sql.ErrNoRows {
-				log.Printf("ファンドID %d の現在参照価格が %s 以前で見つかりません。年別計算をスキップします。", fundID, currentDateStr)
-				continue
-			}
-			if err != nil {
-				log.Printf("ファンドID %d の現在価格の取得中にエラーが発生しました (年別資産): %v", fundID, err)
-				continue
-			}
-			priceCache[fundID] = currentPrice // キャッシュに保存
-		}
+	// --- ログの設定 ---
+	// 設定ファイルでも指定できるよう、設定ファイルを読み込んでから設定する
+	logLevel, err := parseLogLevel(getEnv("LOG_LEVEL"))
+	if err != nil {
+		fatal("環境変数の読み込みに失敗しました", "error", err)
+	}
+	slog.SetDefault(slog.New(requestIDLogHandler{newLogHandler(logLevel)}))
+	slog.Info("サーバーを起動します", "version", Version, "commit", Commit, "build_date", BuildDate)
+	if *configPath != "" {
+		slog.Info("設定ファイルを読み込みました", "path", *configPath)
+	}
 
-		// 資産評価額 (その買付年の口数のみで計算)
-		currentValueForFund := (currentPrice * float64(totalQuantity)) / UNIT_PER_PRICE_BASE
+	// --- データベース接続設定 ---
+	cfg := Config{
+		DBUser:     getEnv("DB_USER"),
+		DBPassword: getEnv("DB_PASSWORD"),
+		DBHost:     getEnv("DB_HOST"),
+		DBPort:     getEnv("DB_PORT"),
+		DBName:     getEnv("DB_NAME"),
 
-		// マップの値を更新
-		data := yearlySummary[tradeYear]
-		data.CurrentValueSum += currentValueForFund
-		data.BuyAmountSum += totalBuyCost
-		yearlySummary[tradeYear] = data
-	}
-	if rows.Err() != nil {
-		log.Printf("年別資産の行イテレーション中にエラーが発生しました: %v", rows.Err())
+		DBTLS:         getEnv("DB_TLS"),
+		DBTimeout:     getEnv("DB_TIMEOUT"),
+		DBReadTimeout: getEnv("DB_READ_TIMEOUT"),
 	}
 
-	// 結果をAssetsByYearResponseの形式に変換
-	var yearlyAssets []YearlyAsset
-	for year, data := range yearlySummary {
-		yearlyAssets = append(yearlyAssets, YearlyAsset{
-			Year:        year,
-			CurrentValue: int64(math.Floor(data.CurrentValueSum)),
-			CurrentPL:    int64(math.Floor(data.CurrentValueSum - data.BuyAmountSum)),
-		})
+	if cfg.DBUser == "" || cfg.DBPassword == "" || cfg.DBHost == "" || cfg.DBPort == "" || cfg.DBName == "" {
+		fatal("環境変数の読み込みに失敗しました: DB_USER, DB_PASSWORD, DB_HOST, DB_PORT, DB_NAME が設定されている必要があります。")
 	}
 
-	// Yearの降順でソート
-	sort.Slice(yearlyAssets, func(i, j int) bool {
+	// --- チューニング用の設定値 ---
+	assetsBatchMaxWorkers, err = getEnvPositiveInt("ASSETS_BATCH_MAX_WORKERS", 0)
+	if err != nil {
+		fatal("環境変数の読み込みに失敗しました", "error", err)
+	}
+	if v := getEnv("ASSETS_ROUNDING_ORDER"); v != "" {
+		if v != ROUNDING_SUM_THEN_FLOOR && v != ROUNDING_FLOOR_THEN_SUM {
+			fatal(fmt.Sprintf("環境変数の読み込みに失敗しました: ASSETS_ROUNDING_ORDER は %s または %s を指定してください", ROUNDING_SUM_THEN_FLOOR, ROUNDING_FLOOR_THEN_SUM), "value", v)
+		}
+		roundingOrder = v
+	}
+	autoSetup, err = getEnvBool("AUTO_SETUP", true)
+	if err != nil {
+		fatal("環境変数の読み込みに失敗しました", "error", err)
+	}
+	maxResponseElements, err = getEnvPositiveInt("MAX_RESPONSE_ELEMENTS", 0)
+	if err != nil {
+		fatal("環境変数の読み込みに失敗しました", "error", err)
+	}
+	pricePrecision, err = getEnvPositiveInt("PRICE_PRECISION", DEFAULT_PRICE_PRECISION)
+	if err != nil {
+		fatal("環境変数の読み込みに失敗しました", "error", err)
+	}
+	priceScale, err = getEnvPositiveInt("PRICE_SCALE", DEFAULT_PRICE_SCALE)
+	if err != nil {
+		fatal("環境変数の読み込みに失敗しました", "error", err)
+	}
+	httpAddr, err = listenAddr(getEnv("HTTP_HOST"), getEnv("HTTP_PORT"))
+	if err != nil {
+		fatal("環境変数の読み込みに失敗しました", "error", err)
+	}
+	tlsCertFile = getEnv("TLS_CERT_FILE")
+	tlsKeyFile = getEnv("TLS_KEY_FILE")
+	if (tlsCertFile == "") != (tlsKeyFile == "") {
+		fatal("環境変数の読み込みに失敗しました: TLS_CERT_FILE と TLS_KEY_FILE は両方とも設定する必要があります。")
+	}
+	tlsMinVersion, err = parseTLSVersion(getEnv("TLS_MIN_VERSION"))
+	if err != nil {
+		fatal("環境変数の読み込みに失敗しました", "error", err)
+	}
+	debugEndpoints, err = getEnvBool("DEBUG_ENDPOINTS", false)
+	if err != nil {
+		fatal("環境変数の読み込みに失敗しました", "error", err)
+	}
+	defaultPageSize, err = getEnvPositiveInt("DEFAULT_PAGE_SIZE", DEFAULT_PAGE_SIZE_VALUE)
+	if err != nil {
+		fatal("環境変数の読み込みに失敗しました", "error", err)
+	}
+	maxPageSize, err = getEnvPositiveInt("MAX_PAGE_SIZE", MAX_PAGE_SIZE_VALUE)
+	if err != nil {
+		fatal("環境変数の読み込みに失敗しました", "error", err)
+	}
+	if defaultPageSize > maxPageSize {
+		fatal("環境変数の読み込みに失敗しました: DEFAULT_PAGE_SIZE は MAX_PAGE_SIZE 以下にしてください", "default_page_size", defaultPageSize, "max_page_size", maxPageSize)
+	}
+	adminToken = getEnv("ADMIN_TOKEN")
+	if v := getEnv("DATA_DIR"); v != "" {
+		importDataDir = v
+	}
+	maxConcurrentImports, err = getEnvPositiveInt("MAX_CONCURRENT_IMPORTS", 1)
+	if err != nil {
+		fatal("環境変数の読み込みに失敗しました", "error", err)
+	}
+	importBatchSize, err = getEnvPositiveInt("IMPORT_BATCH_SIZE", DEFAULT_IMPORT_BATCH_SIZE)
+	if err != nil {
+		fatal("環境変数の読み込みに失敗しました", "error", err)
+	}
+	if importBatchSize > MAX_IMPORT_BATCH_SIZE {
+		fatal(fmt.Sprintf("環境変数の読み込みに失敗しました: IMPORT_BATCH_SIZE は %d 以下にしてください", MAX_IMPORT_BATCH_SIZE), "value", importBatchSize)
+	}
+	excludeUnpricedBuys, err = getEnvBool("EXCLUDE_UNPRICED_BUYS", false)
+	if err != nil {
+		fatal("環境変数の読み込みに失敗しました", "error", err)
+	}
+	importCollectErrors, err = getEnvBool("IMPORT_COLLECT_ERRORS", false)
+	if err != nil {
+		fatal("環境変数の読み込みに失敗しました", "error", err)
+	}
+	importUpsert, err = getEnvBool("IMPORT_UPSERT", false)
+	if err != nil {
+		fatal("環境変数の読み込みに失敗しました", "error", err)
+	}
+	importFast, err = getEnvBool("IMPORT_FAST", false)
+	if err != nil {
+		fatal("環境変数の読み込みに失敗しました", "error", err)
+	}
+	importStrict, err = getEnvBool("IMPORT_STRICT", false)
+	if err != nil {
+		fatal("環境変数の読み込みに失敗しました", "error", err)
+	}
+	if v := getEnv("IMPORT_DELIMITER"); v != "" {
+		importDelimiter, err = parseImportDelimiter(v)
+		if err != nil {
+			fatal("環境変数の読み込みに失敗しました", "error", err)
+		}
+	}
+	dbMaxOpenConns, err = getEnvPositiveInt("DB_MAX_OPEN_CONNS", DEFAULT_DB_MAX_OPEN_CONNS)
+	if err != nil {
+		fatal("環境変数の読み込みに失敗しました", "error", err)
+	}
+	dbMaxIdleConns, err = getEnvPositiveInt("DB_MAX_IDLE_CONNS", DEFAULT_DB_MAX_IDLE_CONNS)
+	if err != nil {
+		fatal("環境変数の読み込みに失敗しました", "error", err)
+	}
+	connMaxLifetimeSeconds, err := getEnvPositiveInt("DB_CONN_MAX_LIFETIME_SECONDS", DEFAULT_DB_CONN_MAX_LIFETIME_SECONDS)
+	if err != nil {
+		fatal("環境変数の読み込みに失敗しました", "error", err)
+	}
+	dbConnMaxLifetime = time.Duration(connMaxLifetimeSeconds) * time.Second
+	shutdownTimeoutSeconds, err := getEnvPositiveInt("SHUTDOWN_TIMEOUT_SECONDS", DEFAULT_SHUTDOWN_TIMEOUT_SECONDS)
+	if err != nil {
+		fatal("環境変数の読み込みに失敗しました", "error", err)
+	}
+	shutdownTimeout = time.Duration(shutdownTimeoutSeconds) * time.Second
+	appTimezone := getEnv("APP_TIMEZONE")
+	if appTimezone == "" {
+		appTimezone = DEFAULT_APP_TIMEZONE
+	}
+	appLocation, err = time.LoadLocation(appTimezone)
+	if err != nil {
+		fatal("環境変数の読み込みに失敗しました: APP_TIMEZONE のタイムゾーンを読み込めません", "value", appTimezone, "error", err)
+	}
+	if v := getEnv("PRICE_MAX_AGE_DAYS"); v != "" {
+		priceMaxAgeDays, err = strconv.Atoi(v)
+		if err != nil || priceMaxAgeDays < 0 {
+			fatal("環境変数の読み込みに失敗しました: PRICE_MAX_AGE_DAYS は0以上の整数で指定してください", "value", v)
+		}
+	}
+	dbRetryAttempts, err = getEnvPositiveInt("DB_RETRY_ATTEMPTS", DEFAULT_DB_RETRY_ATTEMPTS)
+	if err != nil {
+		fatal("環境変数の読み込みに失敗しました", "error", err)
+	}
+	if v := getEnv("DB_RETRY_INTERVAL"); v != "" {
+		dbRetryInterval, err = time.ParseDuration(v)
+		if err != nil || dbRetryInterval < 0 {
+			fatal("環境変数の読み込みに失敗しました: DB_RETRY_INTERVAL は 2s のような時間で指定してください", "value", v)
+		}
+	}
+	if v := getEnv("DB_QUERY_TIMEOUT"); v != "" {
+		dbQueryTimeout, err = time.ParseDuration(v)
+		if err != nil || dbQueryTimeout <= 0 {
+			fatal("環境変数の読み込みに失敗しました: DB_QUERY_TIMEOUT は 5s のような正の時間で指定してください", "value", v)
+		}
+	}
+	maxQueryLength, err = getEnvPositiveInt("MAX_QUERY_LENGTH", DEFAULT_MAX_QUERY_LENGTH)
+	if err != nil {
+		fatal("環境変数の読み込みに失敗しました", "error", err)
+	}
+	maxBodyBytes, err = getEnvPositiveInt("MAX_BODY_BYTES", DEFAULT_MAX_BODY_BYTES)
+	if err != nil {
+		fatal("環境変数の読み込みに失敗しました", "error", err)
+	}
+	if v := getEnv("LOT_SAME_DAY_ORDER"); v != "" {
+		if v != LOT_ORDER_BUYS_FIRST && v != LOT_ORDER_SELLS_FIRST && v != LOT_ORDER_INSERTION {
+			fatal(fmt.Sprintf("環境変数の読み込みに失敗しました: LOT_SAME_DAY_ORDER は %s, %s, %s のいずれかを指定してください", LOT_ORDER_BUYS_FIRST, LOT_ORDER_SELLS_FIRST, LOT_ORDER_INSERTION), "value", v)
+		}
+		lotSameDayOrder = v
+	}
+	if v := getEnv("OVERSELL_MODE"); v != "" {
+		if v != OVERSELL_CLAMP && v != OVERSELL_REJECT && v != OVERSELL_ALLOW_NEGATIVE {
+			fatal(fmt.Sprintf("環境変数の読み込みに失敗しました: OVERSELL_MODE は %s, %s, %s のいずれかを指定してください", OVERSELL_CLAMP, OVERSELL_REJECT, OVERSELL_ALLOW_NEGATIVE), "value", v)
+		}
+		oversellMode = v
+	}
+	// MySQL の DECIMAL は精度 65 桁・スケール 30 桁まで
+	if pricePrecision > 65 || priceScale > 30 || priceScale > pricePrecision {
+		fatal("環境変数の読み込みに失敗しました: PRICE_PRECISION (<=65) と PRICE_SCALE (<=30, <=PRICE_PRECISION) の組み合わせが不正です", "price_precision", pricePrecision, "price_scale", priceScale)
+	}
+
+	dsn, err := buildDSN(cfg)
+	if err != nil {
+		fatal("環境変数の読み込みに失敗しました", "error", err)
+	}
+	slog.Info("データベースに接続を試行中", "host", cfg.DBHost)
+
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		fatal("データベース接続のオープンに失敗しました", "error", err)
+	}
+	defer db.Close() // 関数終了時にDB接続を閉じる
+
+	// 負荷が高い場合に MySQL の max_connections を超えないよう、コネクションプールの大きさを制限する
+	db.SetMaxOpenConns(dbMaxOpenConns)
+	db.SetMaxIdleConns(dbMaxIdleConns)
+	db.SetConnMaxLifetime(dbConnMaxLifetime)
+	slog.Info("コネクションプールの設定", "max_open_conns", dbMaxOpenConns, "max_idle_conns", dbMaxIdleConns, "conn_max_lifetime", dbConnMaxLifetime)
+
+	// データベース接続のリトライロジック
+	err = waitForDB(db, dbRetryAttempts, dbRetryInterval)
+	if err != nil {
+		fatal("リトライ後もデータベースが準備できませんでした", "error", err)
+	}
+
+	// DATE 型を time.Time として読み込めない設定 (DSN に parseTime=true が無い) だと評価日の比較が壊れるため、起動時に確認する
+	err = checkTimeScanning(db)
+	if err != nil {
+		fatal("データベース接続の設定が不正です", "error", err)
+	}
+
+	// --- データベーステーブルの初期化 ---
+	// CSVインポートをしない場合でも、テーブル構造は必要なのでこの処理は残します。
+	// 本番環境などスキーマをマイグレーションで管理する場合は AUTO_SETUP=false でテーブル作成を行わず、存在確認のみ行う
+	slog.Info("データベーステーブルが存在することを確認しています...")
+	if autoSetup {
+		err = setupDatabaseTables(db)
+		if err != nil {
+			fatal("データベーステーブルの設定に失敗しました", "error", err)
+		}
+	} else {
+		err = verifyDatabaseTables(db)
+		if err != nil {
+			fatal("データベーステーブルの確認に失敗しました (AUTO_SETUP=false のためテーブルは自動作成されません。マイグレーションを実行してください)", "error", err)
+		}
+	}
+	slog.Info("データベーステーブルは準備完了です。")
+
+	// --- APIサーバー設定 ---
+	router := newRouter(&Server{db: db})
+
+	// HTTPサーバーを起動
+	// TLS_CERT_FILE と TLS_KEY_FILE が設定されている場合は HTTPS で、それ以外は HTTP で待ち受ける
+	srv := &http.Server{
+		Addr:    httpAddr,
+		Handler: requestIDMiddleware(gzipMiddleware(loggingMiddleware(router))), // 存在しないパスへのリクエストも記録するため、ルーターごと包む
+	}
+	useTLS := tlsCertFile != ""
+	scheme := "http"
+	if useTLS {
+		scheme = "https"
+		srv.TLSConfig = &tls.Config{MinVersion: tlsMinVersion}
+	}
+	slog.Info("APIサーバーを起動中", "addr", httpAddr, "scheme", scheme)
+
+	// サーバーを起動し、エラーがあればログに出力して終了
+	// Shutdown を呼んだ後は http.ErrServerClosed が返るため、それ以外のエラーのみ終了する
+	ln, err := net.Listen("tcp", httpAddr)
+	if err != nil {
+		fatal("APIサーバーの起動に失敗しました", "error", err)
+	}
+	go func() {
+		err := serve(srv, ln, tlsCertFile, tlsKeyFile)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal("APIサーバーの起動に失敗しました", "error", err)
+		}
+	}()
+
+	// --- コンテナを起動し続けるための処理 ---
+	slog.Info("APIサーバーが起動しました。終了シグナルを待機中...", "addr", srv.Addr)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM) // Ctrl+C や docker stop を捕捉
+	<-sigs                                               // シグナルが来るまでブロック
+	slog.Info("終了シグナルを受信しました。アプリケーションを終了します。")
+
+	// 新しい接続の受け付けを止め、処理中のリクエストが終わるまで SHUTDOWN_TIMEOUT_SECONDS 秒まで待つ
+	// DB接続は defer で閉じるため、処理中のリクエストが DB を使い終わってから閉じられる
+	started := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err = srv.Shutdown(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		slog.Warn("シャットダウンがタイムアウトしました。処理中のリクエストを打ち切ります。", "duration", time.Since(started))
+	} else if err != nil {
+		slog.Error("シャットダウン中にエラーが発生しました", "duration", time.Since(started), "error", err)
+	} else {
+		slog.Info("処理中のリクエストの完了を待ってシャットダウンしました。", "duration", time.Since(started))
+	}
+	slog.Info("アプリケーションを終了しました。")
+}
+
+// serve: ln で接続を受け付けて srv を起動する
+// certFile と keyFile が指定されている場合は HTTPS で、それ以外は HTTP で応答する
+// (テストで証明書を指定して TLS のハンドシェイクを確認できるように、main から切り出している)
+func serve(srv *http.Server, ln net.Listener, certFile string, keyFile string) error {
+	if certFile != "" {
+		return srv.ServeTLS(ln, certFile, keyFile)
+	}
+	return srv.Serve(ln)
+}
+
+// newRouter: s のハンドラーをすべてのエンドポイントに登録したルーターを返す
+// (httptest でサーバー全体を起動せずにハンドラーを呼び出せるように、main から切り出している)
+func newRouter(s *Server) *mux.Router {
+	router := mux.NewRouter()
+	router.Use(requestSizeLimitMiddleware)
+	router.Use(userIDValidationMiddleware)
+
+	// 基本的なヘルスチェック
+	router.HandleFunc("/hello", helloHandler).Methods("GET")
+
+	// DBに接続できるかを含めたヘルスチェック (接続できない場合は 503)
+	router.HandleFunc("/healthz", s.healthzHandler).Methods("GET")
+
+	// 実行中のビルドのバージョン・コミット・ビルド日時
+	router.HandleFunc("/version", versionHandler).Methods("GET")
+
+	// Prometheus 向けのメトリクス (リクエスト数・処理時間・DBクエリの処理時間)
+	router.Handle("/metrics", promhttp.Handler()).Methods("GET")
+
+	// Step 3: ユーザーの取引回数を取得
+	router.HandleFunc("/{user_id}/trades", s.getTradesCountHandler).Methods("GET")
+
+	// ユーザーの取引を1件登録 (取引日の基準価額が無い場合は allowMissingPrice=true の指定が必要)
+	router.HandleFunc("/{user_id}/trades", s.createTradeHandler).Methods("POST")
+
+	// ユーザーの取引一覧を取得 (Accept: application/x-ndjson で1行1件のストリーミング)
+	router.HandleFunc("/{user_id}/trades/list", s.getTradesListHandler).Methods("GET")
+
+	// Step 4 & 5: ユーザーの資産評価額と評価損益を取得 (オプションの日付パラメータあり)
+	router.HandleFunc("/{user_id}/assets", s.getAssetsHandler).Methods("GET")
+
+	// 一部のファンドの基準価額を仮の値に差し替えた場合の資産評価額と評価損益を計算 (DB には書き込まない)
+	router.HandleFunc("/{user_id}/assets/whatif", s.getAssetsWhatIfHandler).Methods("POST")
+
+	// Step 6: ユーザーの資産評価額と評価損益を年ごとに取得
+	router.HandleFunc("/{user_id}/assets/byYear", s.getAssetsByYearHandler).Methods("GET")
+
+	// ユーザーの資産評価額と評価損益をファンドごとに取得 (オプションの日付パラメータあり)
+	router.HandleFunc("/{user_id}/assets/byFund", s.getAssetsByFundHandler).Methods("GET")
+
+	// ユーザーの資産評価額と評価損益の日ごとの推移を取得 (from と to は必須)
+	router.HandleFunc("/{user_id}/assets/history", s.getAssetsHistoryHandler).Methods("GET")
+
+	// 期間中で資産評価額が前日から最も大きく下落した日を取得 (from と to は必須)
+	router.HandleFunc("/{user_id}/drawdown", s.getDrawdownHandler).Methods("GET")
+
+	// 指定した年に売却した分の実現損益をファンドごとに取得 (year は必須)
+	router.HandleFunc("/{user_id}/realized", s.getRealizedGainsHandler).Methods("GET")
+
+	// ファンドの積立 (定期的な買付) の買付回数・買付間隔・平均取得単価を取得
+	router.HandleFunc("/{user_id}/funds/{fund_id}/dca", s.getDCAHandler).Methods("GET")
+
+	// ファンドの買付金額 (取得価額) の内訳を、計算に使った買付ごとに取得
+	router.HandleFunc("/{user_id}/funds/{fund_id}/costbasis", s.getCostBasisHandler).Methods("GET")
+
+	// ユーザーのファンドごとの保有口数を取得 (基準価額を参照しない)
+	router.HandleFunc("/{user_id}/positions", s.getPositionsHandler).Methods("GET")
+
+	// ユーザーの保有ロットの一覧を CSV で取得 (オプションの日付パラメータあり)
+	router.HandleFunc("/{user_id}/taxlots.csv", s.getTaxLotsCSVHandler).Methods("GET")
+
+	// ユーザーの取引履歴を CSV で取得 (オプションの日付パラメータで指定日までの取引に絞り込む)
+	router.HandleFunc("/{user_id}/trades.csv", s.getTradesCSVHandler).Methods("GET")
+
+	// 期間中の評価損益の変化をファンドごとに分解して取得
+	router.HandleFunc("/{user_id}/attribution", s.getAttributionHandler).Methods("GET")
+
+	// 保有者が1人もいないファンドの一覧を取得 (オプションの日付パラメータあり)
+	router.HandleFunc("/funds/dormant", s.getDormantFundsHandler).Methods("GET")
+
+	// 取引の多いユーザーの一覧を取得 (負荷の分析用)
+	router.HandleFunc("/users/active", s.getActiveUsersHandler).Methods("GET")
+
+	// ファンドの基準価額が存在しない日付の一覧を取得 (データの欠損の確認用)
+	router.HandleFunc("/funds/{fund_id}/gaps", s.getPriceGapsHandler).Methods("GET")
+
+	// 特定のファンド・日付の基準価額を修正
+	router.HandleFunc("/funds/{fund_id}/prices/{date}", s.patchReferencePriceHandler).Methods("PATCH")
+
+	// 特定のファンド・日付の基準価額を登録 (既にある場合は上書き)
+	router.HandleFunc("/funds/{fund_id}/prices", s.upsertPriceHandler).Methods("PUT")
+
+	// 複数ユーザーの資産評価額と評価損益を一括で取得
+	router.HandleFunc("/assets/batch", s.getAssetsBatchHandler).Methods("POST")
+
+	// サーバー上のCSVファイルを再インポート (ADMIN_TOKEN が設定されている場合のみ)
+	if adminToken != "" {
+		router.HandleFunc("/admin/import", requireAdmin(s.adminImportHandler)).Methods("POST")
+	}
+
+	// コネクションプールの統計情報を取得 (DEBUG_ENDPOINTS=true の場合のみ)
+	if debugEndpoints {
+		router.HandleFunc("/debug/dbstats", s.getDBStatsHandler).Methods("GET")
+		slog.Info("診断用エンドポイント /debug/dbstats を有効にしました。")
+	}
+
+	return router
+}
+
+// --- ミドルウェア: リクエストログ ---
+
+// statusRecorder はハンドラーが返したステータスコードを記録する ResponseWriter
+// WriteHeader を呼ばずに Write した場合は暗黙の 200 になるため、初期値を 200 にしている
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.status = status
+		rec.wroteHeader = true
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	rec.wroteHeader = true
+	return rec.ResponseWriter.Write(b)
+}
+
+// Flush は NDJSON のストリーミング (streamTradesNDJSON) が1件ごとにフラッシュできるよう、元の ResponseWriter に委譲する
+func (rec *statusRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// loggingMiddleware はリクエストごとにメソッド・パス・ステータスコード・処理時間を1行でログに出力し、メトリクスに記録する
+func loggingMiddleware(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		router.ServeHTTP(rec, r)
+		elapsed := time.Since(started)
+		slog.InfoContext(r.Context(), "リクエストを処理しました", "method", r.Method, "path", r.URL.Path, "status", rec.status, "duration", elapsed)
+
+		path := routePath(router, r)
+		httpRequestsTotal.WithLabelValues(path, strconv.Itoa(rec.status)).Inc()
+		httpRequestDuration.WithLabelValues(path).Observe(elapsed.Seconds())
+	})
+}
+
+// --- ミドルウェア: リクエストの大きさの制限 ---
+
+// requestSizeLimitMiddleware は MAX_QUERY_LENGTH を超えるクエリ文字列のリクエストを 414 で拒否し、
+// リクエストボディを MAX_BODY_BYTES までしか読めないようにする
+func requestSizeLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.URL.RawQuery) > maxQueryLength {
+			writeJSONError(w, http.StatusRequestURITooLong, "query_too_long", fmt.Sprintf("クエリ文字列は%dバイト以内で指定してください。", maxQueryLength))
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, int64(maxBodyBytes))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeBodyDecodeError はリクエストボディの読み込みに失敗した場合のエラーを返す
+// MAX_BODY_BYTES を超えた場合は 413、それ以外は 400
+func writeBodyDecodeError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, "request_too_large", fmt.Sprintf("リクエストボディは%dバイト以内で指定してください。", tooLarge.Limit))
+		return
+	}
+	writeJSONError(w, http.StatusBadRequest, "invalid_parameter", "リクエストボディが不正です。")
+}
+
+// --- ミドルウェア: user_id の検証 ---
+
+// userIDValidationMiddleware は /{user_id}/... のルートで user_id を validateUserID で確認し、不正な場合は 400 を返す
+// ルーターの Use で登録するため、ルートが一致した後 (mux.Vars で user_id を取得できる状態) で呼ばれる
+func userIDValidationMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if userID, ok := mux.Vars(r)["user_id"]; ok {
+			if err := validateUserID(userID); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// --- ミドルウェア: gzip 圧縮 ---
+
+// gzipMiddleware は Accept-Encoding に gzip を含むリクエストに対し、GZIP_MIN_SIZE 以上のレスポンスを圧縮して返す
+// 小さいレスポンスは圧縮しても効果が無いため、そのまま返す
+func gzipMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		defer gw.close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// acceptsGzip はクライアントが gzip で圧縮したレスポンスを受け取れるかを返す (q=0 の場合は受け取れない)
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			continue
+		}
+		q := strings.ReplaceAll(params, " ", "")
+		return q != "q=0" && q != "q=0.0" && q != "q=0.00" && q != "q=0.000"
+	}
+	return false
+}
+
+// gzipResponseWriter はレスポンスの先頭を GZIP_MIN_SIZE まで貯めておき、超えた時点で圧縮するかを決める
+// 最後まで GZIP_MIN_SIZE に届かなかった場合は、貯めた内容をそのまま書き出す
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	buf         []byte
+	gz          *gzip.Writer
+	decided     bool // 圧縮するかを決めてヘッダーを書き出したか
+	wroteHeader bool
+}
+
+func (gw *gzipResponseWriter) WriteHeader(status int) {
+	if !gw.wroteHeader {
+		gw.status = status
+		gw.wroteHeader = true
+	}
+}
+
+func (gw *gzipResponseWriter) Write(b []byte) (int, error) {
+	gw.wroteHeader = true
+	if !gw.decided {
+		gw.buf = append(gw.buf, b...)
+		if len(gw.buf) < GZIP_MIN_SIZE {
+			return len(b), nil
+		}
+		if err := gw.decide(true); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if gw.gz != nil {
+		return gw.gz.Write(b)
+	}
+	return gw.ResponseWriter.Write(b)
+}
+
+// decide は圧縮するかを決めてヘッダーを書き出し、貯めていた内容を書き出す
+// ハンドラーが自分で圧縮している場合 (/metrics など) や、本文の無いステータスの場合は圧縮しない
+func (gw *gzipResponseWriter) decide(compress bool) error {
+	gw.decided = true
+	h := gw.ResponseWriter.Header()
+	if h.Get("Content-Encoding") != "" || gw.status == http.StatusNoContent || gw.status == http.StatusNotModified {
+		compress = false
+	}
+	if compress {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		gw.gz = gzip.NewWriter(gw.ResponseWriter)
+	}
+	gw.ResponseWriter.WriteHeader(gw.status)
+
+	buf := gw.buf
+	gw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if gw.gz != nil {
+		_, err = gw.gz.Write(buf)
+	} else {
+		_, err = gw.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// Flush は NDJSON のストリーミングで1件ごとにクライアントへ送れるよう、圧縮済みの内容まで書き出す
+// 途中で送り始めると後から圧縮するかを変えられないため、Flush された時点で圧縮すると決める
+func (gw *gzipResponseWriter) Flush() {
+	if !gw.decided {
+		gw.decide(true)
+	}
+	if gw.gz != nil {
+		gw.gz.Flush()
+	}
+	if flusher, ok := gw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// close はハンドラーの終了後に、貯めていた内容の書き出しと gzip の終端の書き出しを行う
+func (gw *gzipResponseWriter) close() {
+	if !gw.decided {
+		if !gw.wroteHeader {
+			return // ハンドラーが何も書かなかった場合は net/http に任せる
+		}
+		gw.decide(false)
+	}
+	if gw.gz != nil {
+		gw.gz.Close()
+	}
+}
+
+// --- ミドルウェア: リクエストID ---
+
+// requestIDKey はリクエストIDをコンテキストに保存するためのキー
+type requestIDKey struct{}
+
+// requestIDMiddleware はリクエストごとのIDを決めてコンテキストに保存し、X-Request-ID レスポンスヘッダーで返す
+// クライアントが X-Request-ID を送った場合はその値を使い、無い場合や不正な場合は新しく生成する
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(REQUEST_ID_HEADER)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(REQUEST_ID_HEADER, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// requestIDFromContext はコンテキストに保存したリクエストIDを返す (requestIDMiddleware を通っていない場合は空文字)
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// validRequestID はクライアントから受け取ったリクエストIDをそのままログやレスポンスに出してよいかを返す
+// ログの改ざんを防ぐため、英数字と - _ . のみ、REQUEST_ID_MAX_LENGTH 文字までとする
+func validRequestID(id string) bool {
+	if id == "" || len(id) > REQUEST_ID_MAX_LENGTH {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID はランダムな UUID (バージョン4) を生成する
+func newRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		// 乱数を取得できない場合でもリクエストは処理できるよう、時刻から作る
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	b[6] = b[6]&0x0f | 0x40 // バージョン4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 のバリアント
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// requestIDLogHandler はコンテキストにリクエストIDがあれば、ログに request_id を付けて出力する slog のハンドラー
+// ハンドラーの中では slog.ErrorContext(r.Context(), ...) のようにコンテキストを渡してログに出力する
+type requestIDLogHandler struct {
+	slog.Handler
+}
+
+func (h requestIDLogHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := requestIDFromContext(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h requestIDLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDLogHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDLogHandler) WithGroup(name string) slog.Handler {
+	return requestIDLogHandler{h.Handler.WithGroup(name)}
+}
+
+// --- メトリクス ---
+
+var (
+	httpRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "パス・ステータスコードごとのリクエスト数",
+	}, []string{"path", "status"})
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "パスごとのリクエストの処理時間 (秒)",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"path"})
+	dbQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "db_query_duration_seconds",
+		Help:    "クエリの種類ごとのDBクエリの処理時間 (秒)",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"query"})
+)
+
+// routePath はメトリクスのラベルに使うパスを返す
+// ユーザーごとに系列が増えないよう、/{user_id}/assets のようなルートのテンプレートにする
+// どのルートにも一致しないリクエストは "unmatched" にまとめる
+func routePath(router *mux.Router, r *http.Request) string {
+	var match mux.RouteMatch
+	if !router.Match(r, &match) || match.Route == nil {
+		return "unmatched"
+	}
+	tmpl, err := match.Route.GetPathTemplate()
+	if err != nil {
+		return "unmatched"
+	}
+	return tmpl
+}
+
+// observeDBQuery はDBクエリの処理時間をメトリクスに記録する
+// defer observeDBQuery("positions", time.Now()) のように、クエリを実行する関数の先頭で使う
+func observeDBQuery(query string, started time.Time) {
+	dbQueryDuration.WithLabelValues(query).Observe(time.Since(started).Seconds())
+}
+
+// --- ヘルパー関数: 環境変数の読み込み ---
+
+// buildDSN は設定から MySQL の DSN を組み立てる
+// パスワードに記号が含まれていても正しくエスケープされるよう、mysql.Config を使う
+// parseTime=true は MySQL ドライバーで time.Time 型を正しく扱うために重要なため、常に有効にする
+func buildDSN(cfg Config) (string, error) {
+	mc := mysql.NewConfig()
+	mc.User = cfg.DBUser
+	mc.Passwd = cfg.DBPassword
+	mc.Net = "tcp"
+	mc.Addr = cfg.DBHost + ":" + cfg.DBPort
+	mc.DBName = cfg.DBName
+	mc.ParseTime = true
+
+	switch cfg.DBTLS {
+	case "", "false":
+	case "true", "skip-verify":
+		mc.TLSConfig = cfg.DBTLS
+	default:
+		return "", fmt.Errorf("DB_TLS は true, false, skip-verify のいずれかを指定してください（指定値: %q）", cfg.DBTLS)
+	}
+	if cfg.DBTimeout != "" {
+		timeout, err := time.ParseDuration(cfg.DBTimeout)
+		if err != nil || timeout <= 0 {
+			return "", fmt.Errorf("DB_TIMEOUT は 5s のような正の時間で指定してください（指定値: %q）", cfg.DBTimeout)
+		}
+		mc.Timeout = timeout
+	}
+	if cfg.DBReadTimeout != "" {
+		readTimeout, err := time.ParseDuration(cfg.DBReadTimeout)
+		if err != nil || readTimeout <= 0 {
+			return "", fmt.Errorf("DB_READ_TIMEOUT は 30s のような正の時間で指定してください（指定値: %q）", cfg.DBReadTimeout)
+		}
+		mc.ReadTimeout = readTimeout
+	}
+	return mc.FormatDSN(), nil
+}
+
+// configKeys は設定ファイルで指定できるキーの一覧 (環境変数名と同じ)
+var configKeys = []string{
+	"DB_USER", "DB_PASSWORD", "DB_HOST", "DB_PORT", "DB_NAME",
+	"DB_TLS", "DB_TIMEOUT", "DB_READ_TIMEOUT",
+	"ASSETS_BATCH_MAX_WORKERS", "ASSETS_ROUNDING_ORDER", "AUTO_SETUP", "MAX_RESPONSE_ELEMENTS",
+	"PRICE_PRECISION", "PRICE_SCALE", "TLS_CERT_FILE", "TLS_KEY_FILE", "TLS_MIN_VERSION",
+	"DEBUG_ENDPOINTS", "OVERSELL_MODE", "DEFAULT_PAGE_SIZE", "MAX_PAGE_SIZE",
+	"ADMIN_TOKEN", "DATA_DIR", "MAX_CONCURRENT_IMPORTS", "LOT_SAME_DAY_ORDER", "EXCLUDE_UNPRICED_BUYS",
+	"IMPORT_BATCH_SIZE", "IMPORT_COLLECT_ERRORS", "IMPORT_UPSERT", "IMPORT_DELIMITER", "IMPORT_FAST", "IMPORT_STRICT",
+	"SHUTDOWN_TIMEOUT_SECONDS",
+	"DB_MAX_OPEN_CONNS", "DB_MAX_IDLE_CONNS", "DB_CONN_MAX_LIFETIME_SECONDS", "DB_QUERY_TIMEOUT",
+	"DB_RETRY_ATTEMPTS", "DB_RETRY_INTERVAL", "APP_TIMEZONE",
+	"PRICE_MAX_AGE_DAYS", "MAX_QUERY_LENGTH", "MAX_BODY_BYTES", "LOG_LEVEL",
+	"HTTP_HOST", "HTTP_PORT",
+}
+
+// fileConfig は設定ファイルから読み込んだ値 (キーは環境変数名)
+var fileConfig = map[string]string{}
+
+// getEnv は環境変数の値を返す。環境変数が未設定の場合は設定ファイルの値を返す
+func getEnv(key string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fileConfig[key]
+}
+
+// loadConfigFile は JSON の設定ファイルを読み込み、fileConfig に格納する
+// キーは環境変数名を大文字・小文字を問わず指定でき (例: "db_host")、未知のキーはエラーにする
+func loadConfigFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("設定ファイル '%s' を開けませんでした: %w", path, err)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber() // 数値を文字列のまま扱うため
+	var raw map[string]interface{}
+	if err := decoder.Decode(&raw); err != nil {
+		return fmt.Errorf("設定ファイル '%s' のパースに失敗しました: %w", path, err)
+	}
+
+	known := make(map[string]bool, len(configKeys))
+	for _, key := range configKeys {
+		known[key] = true
+	}
+
+	values := make(map[string]string, len(raw))
+	for k, v := range raw {
+		key := strings.ToUpper(k)
+		if !known[key] {
+			return fmt.Errorf("設定ファイルに未知のキーがあります: %q", k)
+		}
+		switch v := v.(type) {
+		case string:
+			values[key] = v
+		case json.Number:
+			values[key] = v.String()
+		case bool:
+			values[key] = strconv.FormatBool(v)
+		default:
+			return fmt.Errorf("設定ファイルのキー %q の値は文字列・数値・真偽値のいずれかで指定してください", k)
+		}
+	}
+	fileConfig = values
+	return nil
+}
+// getEnvPositiveInt は環境変数を正の整数として読み込む。未設定の場合は defaultValue を返す
+func getEnvPositiveInt(key string, defaultValue int) (int, error) {
+	v := getEnv(key)
+	if v == "" {
+		return defaultValue, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%s は正の整数で指定してください（指定値: %q）", key, v)
+	}
+	return n, nil
+}
+
+// getEnvBool は環境変数を真偽値として読み込む。未設定の場合は defaultValue を返す
+func getEnvBool(key string, defaultValue bool) (bool, error) {
+	v := getEnv(key)
+	if v == "" {
+		return defaultValue, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("%s は true または false で指定してください（指定値: %q）", key, v)
+	}
+	return b, nil
+}
+
+// listenAddr は HTTP_HOST と HTTP_PORT から APIサーバーが待ち受けるアドレスを組み立てる
+// host が空の場合は全てのインターフェースで、port が空の場合は DEFAULT_HTTP_PORT で待ち受ける
+func listenAddr(host string, port string) (string, error) {
+	if port == "" {
+		port = DEFAULT_HTTP_PORT
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("HTTP_PORT は1〜65535の整数で指定してください（指定値: %q）", port)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(n)), nil
+}
+
+// parseTLSVersion は TLS_MIN_VERSION の値 ("1.2" など) を tls パッケージの定数に変換する
+// 未設定の場合は TLS 1.2 を返す
+func parseTLSVersion(v string) (uint16, error) {
+	switch v {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	}
+	return 0, fmt.Errorf("TLS_MIN_VERSION は 1.0, 1.1, 1.2, 1.3 のいずれかで指定してください（指定値: %q）", v)
+}
+
+// --- ヘルパー関数: データベーステーブルのセットアップ ---
+// CSVインポートが行われない場合でも、APIがDBを参照するためにテーブルは必要なので残します。
+func setupDatabaseTables(db *sql.DB) error {
+	createTradeHistoriesSQL := `
+	CREATE TABLE IF NOT EXISTS trade_histories (
+		id BIGINT NOT NULL AUTO_INCREMENT,
+		user_id VARCHAR(255) NOT NULL,
+		fund_id INT NOT NULL,
+		quantity INT NOT NULL,
+		trade_date DATE NOT NULL,
+		PRIMARY KEY (id),
+		INDEX idx_user_fund_date (user_id, fund_id, trade_date)
+	);`
+
+	createReferencePricesSQL := fmt.Sprintf(`
+	CREATE TABLE IF NOT EXISTS reference_prices (
+		fund_id INT NOT NULL,
+		price DECIMAL(%d, %d) NOT NULL,
+		price_date DATE NOT NULL,
+		PRIMARY KEY (fund_id, price_date)
+	);`, pricePrecision, priceScale)
+
+	// インポートの最終実行時刻 (Last-Modified / If-Modified-Since の判定に使用)
+	createImportMetadataSQL := `
+	CREATE TABLE IF NOT EXISTS import_metadata (
+		table_name VARCHAR(64) NOT NULL,
+		imported_at DATETIME NOT NULL,
+		PRIMARY KEY (table_name)
+	);`
+
+	// 基準価額のインポートバッチと、バッチごとに取り込んだ基準価額のスナップショット
+	// (priceVersion を指定して特定のインポート時点の基準価額で評価する際に使用)
+	createPriceImportBatchesSQL := `
+	CREATE TABLE IF NOT EXISTS price_import_batches (
+		id BIGINT NOT NULL AUTO_INCREMENT,
+		source VARCHAR(255) NOT NULL,
+		imported_at DATETIME NOT NULL,
+		PRIMARY KEY (id)
+	);`
+
+	createReferencePriceVersionsSQL := fmt.Sprintf(`
+	CREATE TABLE IF NOT EXISTS reference_price_versions (
+		import_batch BIGINT NOT NULL,
+		fund_id INT NOT NULL,
+		price DECIMAL(%d, %d) NOT NULL,
+		price_date DATE NOT NULL,
+		PRIMARY KEY (import_batch, fund_id, price_date),
+		INDEX idx_fund_date (fund_id, price_date)
+	);`, pricePrecision, priceScale)
+
+	// 分配金 (distributions=true で評価損益の内訳を返す際に使用)
+	createDistributionsSQL := `
+	CREATE TABLE IF NOT EXISTS distributions (
+		user_id VARCHAR(255) NOT NULL,
+		fund_id INT NOT NULL,
+		amount DECIMAL(18, 2) NOT NULL,
+		distribution_date DATE NOT NULL,
+		PRIMARY KEY (user_id, fund_id, distribution_date)
+	);`
+
+	// 他の口座からの移管 (評価額・評価損益の計算で、移管元での取得価額のまま保有口数に含める)
+	// cost_basis は移管した口数全体の取得価額 (円)
+	createTransfersSQL := `
+	CREATE TABLE IF NOT EXISTS transfers (
+		id BIGINT NOT NULL AUTO_INCREMENT,
+		user_id VARCHAR(255) NOT NULL,
+		fund_id INT NOT NULL,
+		quantity INT NOT NULL,
+		cost_basis DECIMAL(18, 2) NOT NULL,
+		transfer_date DATE NOT NULL,
+		PRIMARY KEY (id),
+		INDEX idx_user_fund_date (user_id, fund_id, transfer_date)
+	);`
+
+	// 祝日 (anchor=lastBusinessDay で営業日を判定する際に使用)
+	createHolidaysSQL := `
+	CREATE TABLE IF NOT EXISTS holidays (
+		holiday_date DATE NOT NULL,
+		name VARCHAR(255) NOT NULL DEFAULT '',
+		PRIMARY KEY (holiday_date)
+	);`
+
+	_, err := db.Exec(createTradeHistoriesSQL)
+	if err != nil {
+		return fmt.Errorf("trade_histories テーブルの作成に失敗しました: %w", err)
+	}
+	slog.Info("trade_histories テーブルは作成済み、または既に存在します。")
+
+	// 既存のテーブルが以前の (user_id, fund_id, trade_date) の主キーで作成されている場合に備えて id 列を追加する
+	err = migrateTradeHistoriesID(db)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(createReferencePricesSQL)
+	if err != nil {
+		return fmt.Errorf("reference_prices テーブルの作成に失敗しました: %w", err)
+	}
+	slog.Info("reference_prices テーブルは作成済み、または既に存在します。")
+
+	// 既存のテーブルが以前の DECIMAL(10, 2) で作成されている場合に備えて列を広げる
+	err = migratePriceColumn(db, pricePrecision, priceScale)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(createImportMetadataSQL)
+	if err != nil {
+		return fmt.Errorf("import_metadata テーブルの作成に失敗しました: %w", err)
+	}
+	slog.Info("import_metadata テーブルは作成済み、または既に存在します。")
+
+	_, err = db.Exec(createPriceImportBatchesSQL)
+	if err != nil {
+		return fmt.Errorf("price_import_batches テーブルの作成に失敗しました: %w", err)
+	}
+	slog.Info("price_import_batches テーブルは作成済み、または既に存在します。")
+
+	_, err = db.Exec(createReferencePriceVersionsSQL)
+	if err != nil {
+		return fmt.Errorf("reference_price_versions テーブルの作成に失敗しました: %w", err)
+	}
+	slog.Info("reference_price_versions テーブルは作成済み、または既に存在します。")
+
+	_, err = db.Exec(createDistributionsSQL)
+	if err != nil {
+		return fmt.Errorf("distributions テーブルの作成に失敗しました: %w", err)
+	}
+	slog.Info("distributions テーブルは作成済み、または既に存在します。")
+
+	_, err = db.Exec(createTransfersSQL)
+	if err != nil {
+		return fmt.Errorf("transfers テーブルの作成に失敗しました: %w", err)
+	}
+	slog.Info("transfers テーブルは作成済み、または既に存在します。")
+
+	_, err = db.Exec(createHolidaysSQL)
+	if err != nil {
+		return fmt.Errorf("holidays テーブルの作成に失敗しました: %w", err)
+	}
+	slog.Info("holidays テーブルは作成済み、または既に存在します。")
+	return nil
+}
+
+// requiredTables はAPIが参照するテーブルの一覧
+var requiredTables = []string{"trade_histories", "reference_prices", "import_metadata", "price_import_batches", "reference_price_versions", "distributions", "transfers", "holidays"}
+
+// checkTimeScanning は DATE 型の値を time.Time として正しく読み込めることを確認する
+// DSN に parseTime=true が無い場合、MySQL ドライバーは日付を []byte で返すため time.Time へのスキャンが失敗する
+func checkTimeScanning(db *sql.DB) error {
+	var probe time.Time
+	err := db.QueryRow("SELECT CAST('2000-01-02' AS DATE)").Scan(&probe)
+	if err != nil {
+		return fmt.Errorf("DATE 型を time.Time として読み込めません。DSN に parseTime=true を指定してください: %w", err)
+	}
+	if probe.Format("2006-01-02") != "2000-01-02" {
+		return fmt.Errorf("DATE 型の値が正しく読み込めません (2000-01-02 が %s になりました)。DSN の parseTime と loc の設定を確認してください", probe.Format("2006-01-02"))
+	}
+	return nil
+}
+
+// verifyDatabaseTables はAPIが必要とするテーブルがすべて存在することを確認する
+// AUTO_SETUP=false の場合に setupDatabaseTables の代わりに使用する
+func verifyDatabaseTables(db *sql.DB) error {
+	var missing []string
+	for _, table := range requiredTables {
+		var count int
+		err := db.QueryRow(`
+			SELECT COUNT(*) FROM information_schema.tables
+			WHERE table_schema = DATABASE() AND table_name = ?
+		`, table).Scan(&count)
+		if err != nil {
+			return fmt.Errorf("%s テーブルの存在確認に失敗しました: %w", table, err)
+		}
+		if count == 0 {
+			missing = append(missing, table)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("必要なテーブルが存在しません: %v", missing)
+	}
+	slog.Info("必要なテーブルはすべて存在します。")
+	return nil
+}
+
+// --- ヘルパー関数: レスポンスサイズの制限 ---
+
+// truncateResponse は配列を MAX_RESPONSE_ELEMENTS 件までに切り詰める
+// 切り詰めた場合は X-Truncated ヘッダーを設定し、truncated=true を返す
+func truncateResponse[T any](w http.ResponseWriter, items []T) ([]T, bool) {
+	if maxResponseElements <= 0 || len(items) <= maxResponseElements {
+		return items, false
+	}
+	w.Header().Set("X-Truncated", "true")
+	return items[:maxResponseElements], true
+}
+
+// --- ヘルパー関数: エラーレスポンス ---
+
+// writeJSONError はエラーを {"error":{"code":...,"message":...}} の JSON で返す
+// code はクライアントが判定に使う固定の文字列 (invalid_date, invalid_parameter, not_found, oversell, db_error, internal_error)、
+// message は人が読むための日本語のメッセージ
+func writeJSONError(w http.ResponseWriter, status int, code string, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	// requestIDMiddleware がハンドラーを呼ぶ前にレスポンスヘッダーに設定したリクエストIDを使う
+	json.NewEncoder(w).Encode(ErrorResponse{Error: ErrorDetail{Code: code, Message: message, RequestID: w.Header().Get(REQUEST_ID_HEADER)}})
+}
+
+// queryContext はリクエストのコンテキストに DB_QUERY_TIMEOUT のタイムアウトを設定したコンテキストを返す
+func queryContext(r *http.Request) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(r.Context(), dbQueryTimeout)
+}
+
+// writeQueryTimeout はDBクエリが DB_QUERY_TIMEOUT までに終わらなかった場合に 504 を返す
+// タイムアウトでなければ何もせず false を返す
+func writeQueryTimeout(w http.ResponseWriter, ctx context.Context) bool {
+	if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return false
+	}
+	writeJSONError(w, http.StatusGatewayTimeout, "query_timeout", fmt.Sprintf("データベースの応答が %s 以内にありませんでした。", dbQueryTimeout))
+	return true
+}
+
+// validateUserID: user_id が英数字・ハイフン・アンダースコアのみで、1〜USER_ID_MAX_LENGTH 文字であることを確認する
+// 不正な user_id で無駄にDBへ問い合わせないよう、/{user_id}/... のルートでは userIDValidationMiddleware でハンドラーの前に呼ぶ
+func validateUserID(userID string) error {
+	if userID == "" || len(userID) > USER_ID_MAX_LENGTH {
+		return fmt.Errorf("user_id は1〜%d文字で指定してください。", USER_ID_MAX_LENGTH)
+	}
+	for _, c := range userID {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return errors.New("user_id には英数字・ハイフン・アンダースコアのみ使用できます。")
+		}
+	}
+	return nil
+}
+
+// userExists: ユーザーの取引履歴または移管が1件以上あるかを返す
+// 全て売却済みのユーザーも取引履歴は残っているため存在するものとして扱う
+func (s *Server) userExists(ctx context.Context, userID string) (bool, error) {
+	defer observeDBQuery("user_exists", time.Now())
+	var exists int
+	err := s.db.QueryRowContext(ctx, `
+		SELECT 1 FROM trade_histories WHERE user_id = ?
+		UNION ALL
+		SELECT 1 FROM transfers WHERE user_id = ?
+		LIMIT 1`, userID, userID).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// checkUserExists はユーザーが存在しない場合に 404 を返す
+// 取引の無いユーザーと、保有が無い実在のユーザーを区別するため、評価額0のレスポンスは返さない
+func (s *Server) checkUserExists(w http.ResponseWriter, ctx context.Context, userID string) bool {
+	exists, err := s.userExists(ctx, userID)
+	if writeQueryTimeout(w, ctx) {
+		return false
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "ユーザーの存在確認中にエラーが発生しました", "user_id", userID, "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "db_error", "ユーザーの取得に失敗しました。")
+		return false
+	}
+	if !exists {
+		writeJSONError(w, http.StatusNotFound, "not_found", fmt.Sprintf("ユーザー %s の取引が見つかりません。", userID))
+		return false
+	}
+	return true
+}
+
+// priceVersionErrorCode は resolvePriceVersion が返したステータスコードに対応するエラーコードを返す
+func priceVersionErrorCode(status int) string {
+	switch status {
+	case http.StatusNotFound:
+		return "not_found"
+	case http.StatusInternalServerError:
+		return "db_error"
+	case http.StatusGatewayTimeout:
+		return "query_timeout"
+	default:
+		return "invalid_parameter"
+	}
+}
+
+// --- ヘルパー関数: ページング ---
+
+// pagination はクエリパラメータ limit と offset で指定されたページ
+type pagination struct {
+	Limit  int
+	Offset int
+}
+
+// parsePagination はクエリパラメータ limit と offset を読み込む
+// limit 未指定の場合は DEFAULT_PAGE_SIZE、offset 未指定の場合は0とし、limit は MAX_PAGE_SIZE を上限とする
+// 返すエラーのメッセージはそのままクライアントに返せる形にしている
+func parsePagination(r *http.Request) (pagination, error) {
+	page := pagination{Limit: defaultPageSize}
+	if v := r.URL.Query().Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			return pagination{}, fmt.Errorf("limit には1以上%d以下の整数を指定してください。", maxPageSize)
+		}
+		page.Limit = limit
+	}
+	if v := r.URL.Query().Get("offset"); v != "" {
+		offset, err := strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return pagination{}, errors.New("offset には0以上の整数を指定してください。")
+		}
+		page.Offset = offset
+	}
+	return page, nil
+}
+
+// paginate は取得済みの配列からページを切り出す。offset が範囲外の場合は空の配列を返す
+func paginate[T any](items []T, page pagination) []T {
+	if page.Offset >= len(items) {
+		return items[:0]
+	}
+	end := page.Offset + page.Limit
+	if end > len(items) {
+		end = len(items)
+	}
+	return items[page.Offset:end]
+}
+
+// --- ヘルパー関数: 評価日のレスポンスヘッダー ---
+
+// setAsOfDateHeader は評価日を X-As-Of-Date ヘッダーに設定する
+// キャッシュやログでレスポンスボディを解析せずに評価日を確認できるよう、資産評価系のエンドポイントで使う
+func setAsOfDateHeader(w http.ResponseWriter, date time.Time) {
+	w.Header().Set("X-As-Of-Date", date.Format("2006-01-02"))
+}
+
+// --- ヘルパー関数: Last-Modified / ETag による条件付きリクエスト ---
+
+// lastImportTime は最後にCSVインポートが行われた時刻を返す
+// インポートが一度も記録されていない場合は ok=false を返す
+func (s *Server) lastImportTime(ctx context.Context) (t time.Time, ok bool, err error) {
+	var importedAt sql.NullTime
+	err = s.db.QueryRowContext(ctx, "SELECT MAX(imported_at) FROM import_metadata").Scan(&importedAt)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	if !importedAt.Valid {
+		return time.Time{}, false, nil
+	}
+	return importedAt.Time.UTC(), true, nil
+}
+
+// handleNotModified は Last-Modified と ETag ヘッダーを設定し、
+// 前回のレスポンス以降に新しいデータがインポートされておらず、評価日とクエリパラメータも同じであれば 304 を返す
+// date を省略した場合は評価日が日付の変わり目で変わるため、Last-Modified はインポート時刻と評価日の0時の遅い方にし、
+// ETag には評価日とクエリパラメータを含める
+// 304 を返した場合は true を返すので、呼び出し元はそのまま処理を終了する
+func (s *Server) handleNotModified(w http.ResponseWriter, r *http.Request, targetDate time.Time) bool {
+	ctx, cancel := queryContext(r)
+	defer cancel()
+	lastModified, ok, err := s.lastImportTime(ctx)
+	if err != nil {
+		// 取得に失敗しても評価自体は行えるので、ログだけ出して通常の処理を続ける
+		slog.ErrorContext(r.Context(), "インポート時刻の取得中にエラーが発生しました", "error", err)
+		return false
+	}
+	if !ok {
+		return false
+	}
+	if dayStart := time.Date(targetDate.Year(), targetDate.Month(), targetDate.Day(), 0, 0, 0, 0, appLocation); dayStart.After(lastModified) {
+		lastModified = dayStart.UTC()
+	}
+	// HTTP の日付は秒単位なので切り捨てて比較する
+	lastModified = lastModified.Truncate(time.Second)
+	w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+
+	// gzip 圧縮の有無でレスポンスのバイト列が変わるため、弱い ETag にする
+	// Encode はキーの順に並べるため、クエリパラメータの順序が違っても同じ値になる
+	sum := sha256.Sum256([]byte(lastModified.Format(time.RFC3339) + "|" + targetDate.Format("2006-01-02") + "|" + r.URL.Query().Encode()))
+	etag := fmt.Sprintf(`W/"%x"`, sum[:ETAG_HASH_BYTES])
+	w.Header().Set("ETag", etag)
+
+	// If-None-Match がある場合は If-Modified-Since より優先する (RFC 9110)
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, candidate := range strings.Split(inm, ",") {
+			if candidate = strings.TrimSpace(candidate); candidate == etag || candidate == "*" {
+				w.WriteHeader(http.StatusNotModified)
+				return true
+			}
+		}
+		return false
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		since, err := http.ParseTime(ims)
+		if err == nil && !lastModified.After(since) {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+// --- APIハンドラ ---
+
+// helloHandler: 基本的なヘルスチェック
+func helloHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Hello from Go API!"})
+}
+
+// healthzHandler: DBに接続できるかを確認するヘルスチェック (Kubernetes の readiness probe 用)
+// /hello は DB の状態に関わらず 200 を返すため、DB が応答しない場合に 503 を返すエンドポイントを別に用意している
+func (s *Server) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), HEALTHZ_PING_TIMEOUT)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := s.db.PingContext(ctx); err != nil {
+		slog.WarnContext(r.Context(), "ヘルスチェックでデータベースに接続できませんでした", "error", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"status": "unavailable"})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// versionHandler: ldflags で埋め込んだビルド情報を返す (埋め込んでいない場合は dev / unknown)
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(VersionResponse{
+		Version:   Version,
+		Commit:    Commit,
+		BuildDate: BuildDate,
+	})
+}
+
+// getTradesCountHandler: Step 3 - 特定のuser_idの取引回数を取得
+func (s *Server) getTradesCountHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID := vars["user_id"]
+
+	var count, buyCount, sellCount int
+	// user_idごとのtrade_dateのユニークな数を数える
+	// もし「取引を行った回数」が `trade_histories` テーブルの行数と等しいなら COUNT(*) でOK
+	// 厳密に「取引を行った日」のユニーク数を数えるなら DISTINCT trade_date を使う
+	ctx, cancel := queryContext(r)
+	defer cancel()
+	if !s.checkUserExists(w, ctx, userID) {
+		return
+	}
+	// 買付と売却の件数も同じクエリで数える (口数が0の取引はどちらにも含めない)
+	query := `
+		SELECT COUNT(*), COALESCE(SUM(quantity > 0), 0), COALESCE(SUM(quantity < 0), 0)
+		FROM trade_histories WHERE user_id = ?`
+	started := time.Now()
+	err := s.db.QueryRowContext(ctx, query, userID).Scan(&count, &buyCount, &sellCount)
+	observeDBQuery("trades_count", started)
+	if writeQueryTimeout(w, ctx) {
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "db_error", "取引回数の取得に失敗しました。")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TradesResponse{Count: count, BuyCount: buyCount, SellCount: sellCount})
+}
+
+// getTradesListHandler: 特定のuser_idの取引一覧を取引日の新しい順に取得 (limit, offset でページング)
+// Accept ヘッダーに application/x-ndjson を指定すると、1行に1件のJSONを書き出しながら順次送信する
+// NDJSON の場合も JSON と同じく limit, offset でページングする
+func (s *Server) getTradesListHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID := vars["user_id"]
+
+	page, err := parsePagination(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+
+	query := `
+		SELECT id, fund_id, quantity, trade_date
+		FROM trade_histories
+		WHERE user_id = ?
+		ORDER BY trade_date DESC, id DESC
+		LIMIT ? OFFSET ?`
+	ndjson := strings.Contains(r.Header.Get("Accept"), "application/x-ndjson")
+
+	ctx, cancel := queryContext(r)
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, query, userID, page.Limit, page.Offset)
+	if writeQueryTimeout(w, ctx) {
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "取引一覧の取得中にエラーが発生しました", "user_id", userID, "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "db_error", "取引一覧の取得に失敗しました。")
+		return
+	}
+	defer rows.Close()
+
+	if ndjson {
+		streamTradesNDJSON(w, rows)
+		return
+	}
+
+	trades := []TradeItem{}
+	for rows.Next() {
+		trade, err := scanTradeItem(rows)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "取引行のスキャン中にエラーが発生しました", "error", err)
+			continue
+		}
+		trades = append(trades, trade)
+	}
+	if rows.Err() != nil {
+		slog.ErrorContext(r.Context(), "取引一覧の行イテレーション中にエラーが発生しました", "error", rows.Err())
+	}
+	if writeQueryTimeout(w, ctx) {
+		return
+	}
+
+	// クライアントがページ数を計算できるよう、ページングする前の件数も返す
+	var total int
+	err = s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM trade_histories WHERE user_id = ?", userID).Scan(&total)
+	if writeQueryTimeout(w, ctx) {
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "取引件数の取得中にエラーが発生しました", "user_id", userID, "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "db_error", "取引一覧の取得に失敗しました。")
+		return
+	}
+
+	trades, truncated := truncateResponse(w, trades)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TradesListResponse{
+		Trades:    trades,
+		Total:     total,
+		Limit:     page.Limit,
+		Offset:    page.Offset,
+		Truncated: truncated,
+	})
+}
+
+// getTradesCSVHandler: ユーザーの取引履歴を、取込用の trade_history.csv と同じ列の CSV で返す (経理の照合用)
+// 取引が多いユーザーでもメモリを使わないよう、DB から1行読むごとに書き出す
+// date を指定すると、/{user_id}/assets と同じくその日までの取引に絞り込む (未指定の場合は今日まで)
+func (s *Server) getTradesCSVHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID := vars["user_id"]
+
+	targetDate, err := s.resolveTargetDate(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_date", err.Error())
+		return
+	}
+
+	rows, err := s.db.QueryContext(r.Context(), `
+		SELECT user_id, fund_id, quantity, trade_date
+		FROM trade_histories
+		WHERE user_id = ? AND trade_date <= ?
+		ORDER BY trade_date, id
+	`, userID, targetDate.Format("2006-01-02"))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "取引履歴の取得中にエラーが発生しました", "user_id", userID, "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "db_error", "取引履歴の取得に失敗しました。")
+		return
+	}
+	defer rows.Close()
+
+	setAsOfDateHeader(w, targetDate)
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fmt.Sprintf("trades_%s_%s.csv", userID, targetDate.Format("20060102"))))
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"user_id", "fund_id", "quantity", "trade_date"})
+	for rows.Next() {
+		var tradeUserID string
+		var fundID, quantity int
+		var tradeDate time.Time
+		if err := rows.Scan(&tradeUserID, &fundID, &quantity, &tradeDate); err != nil {
+			slog.ErrorContext(r.Context(), "取引行のスキャン中にエラーが発生しました", "error", err)
+			continue
+		}
+		if err := cw.Write([]string{tradeUserID, strconv.Itoa(fundID), strconv.Itoa(quantity), tradeDate.Format("2006-01-02")}); err != nil {
+			// クライアントが切断した場合など。これ以上書き込んでも届かないので終了する
+			slog.ErrorContext(r.Context(), "取引履歴の CSV の書き込み中にエラーが発生しました", "user_id", userID, "error", err)
+			return
+		}
+	}
+	if rows.Err() != nil {
+		slog.ErrorContext(r.Context(), "取引履歴の行イテレーション中にエラーが発生しました", "error", rows.Err())
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		slog.ErrorContext(r.Context(), "取引履歴の CSV の書き込み中にエラーが発生しました", "user_id", userID, "error", err)
+	}
+}
+
+// streamTradesNDJSON: 取引一覧を NDJSON (1行に1件のJSON) で書き出す
+// 大量の取引をクライアント側で逐次処理できるよう、1件ごとにフラッシュする
+// ストリーミングはレスポンス全体をメモリに載せないため、MAX_RESPONSE_ELEMENTS による切り詰めは行わない
+func streamTradesNDJSON(w http.ResponseWriter, rows *sql.Rows) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w) // Encode は末尾に改行を付ける
+	for rows.Next() {
+		trade, err := scanTradeItem(rows)
+		if err != nil {
+			slog.Error("取引行のスキャン中にエラーが発生しました", "error", err)
+			continue
+		}
+		if err := encoder.Encode(trade); err != nil {
+			// クライアントが切断した場合など。これ以上書き込んでも届かないので終了する
+			slog.Error("取引一覧の書き込み中にエラーが発生しました", "error", err)
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	if rows.Err() != nil {
+		slog.Error("取引一覧の行イテレーション中にエラーが発生しました", "error", rows.Err())
+	}
+}
+
+// scanTradeItem: 取引一覧のクエリ結果の1行を TradeItem に変換する
+func scanTradeItem(rows *sql.Rows) (TradeItem, error) {
+	var trade TradeItem
+	var tradeDate time.Time
+	if err := rows.Scan(&trade.ID, &trade.FundID, &trade.Quantity, &tradeDate); err != nil {
+		return TradeItem{}, err
+	}
+	trade.TradeDate = tradeDate.Format("2006-01-02")
+	return trade, nil
+}
+
+// getAssetsHandler: Step 4 & 5 - ユーザーの資産評価額と評価損益を取得 (オプションの日付パラメータあり)
+func (s *Server) getAssetsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID := vars["user_id"]
+
+	targetDate, err := s.resolveTargetDate(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_date", err.Error())
+		return
+	}
+	exact, err := parseBoolParam(r, "exact")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+	raw, err := parseBoolParam(r, "raw")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+	priceVersion, status, err := s.resolvePriceVersion(r)
+	if err != nil {
+		writeJSONError(w, status, priceVersionErrorCode(status), err.Error())
+		return
+	}
+	withDistributions, err := parseBoolParam(r, "distributions")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+	// minValue を指定すると、評価額がそれ未満のファンドを合計から除外する (未指定の場合は全ファンドを合計する)
+	minValue, err := parseMinValue(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+	roundTo, err := parseRoundTo(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+
+	setAsOfDateHeader(w, targetDate)
+
+	// 前回のレスポンス以降に新しいデータがインポートされていなければ再計算しない
+	if s.handleNotModified(w, r, targetDate) {
+		return
+	}
+
+	ctx, cancel := queryContext(r)
+	defer cancel()
+	if !s.checkUserExists(w, ctx, userID) {
+		return
+	}
+	assets, err := s.computeAssets(ctx, userID, targetDate, priceVersion, minValue)
+	if writeQueryTimeout(w, ctx) {
+		return
+	}
+	if errors.Is(err, errOversell) {
+		writeJSONError(w, http.StatusUnprocessableEntity, "oversell", err.Error())
+		return
+	}
+	if r.Context().Err() != nil {
+		slog.InfoContext(r.Context(), "クライアントが切断したため資産計算を中断しました", "user_id", userID, "error", r.Context().Err())
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "資産計算中にエラーが発生しました", "user_id", userID, "date", targetDate.Format("2006-01-02"), "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "資産データの取得に失敗しました。")
+		return
+	}
+	if !exact {
+		assets.ExactCurrentValue = ""
+		assets.ExactCurrentPL = ""
+	}
+	if !raw {
+		assets.CurrentValueRaw = ""
+		assets.CurrentPLRaw = ""
+	}
+
+	// 分配金を評価損益に含め、基準価額の変動による損益と分配金に分けて返す
+	if withDistributions {
+		income, err := s.distributionIncome(ctx, userID, targetDate)
+		if writeQueryTimeout(w, ctx) {
+			return
+		}
+		if r.Context().Err() != nil {
+			slog.InfoContext(r.Context(), "クライアントが切断したため分配金の取得を中断しました", "user_id", userID, "error", r.Context().Err())
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "分配金の取得中にエラーが発生しました", "user_id", userID, "date", targetDate.Format("2006-01-02"), "error", err)
+			writeJSONError(w, http.StatusInternalServerError, "db_error", "分配金の取得に失敗しました。")
+			return
+		}
+		pricePL := assets.CurrentPL
+		assets.PricePL = &pricePL
+		assets.DistributionIncome = &income
+		assets.CurrentPL = pricePL + income
+	}
+
+	// 表示用に100円単位などへ丸める (1円単位の切り捨てと同じく、小さい方の倍数にする)
+	// 内訳を返す場合は内訳をそれぞれ丸めてから合計し、current_pl = price_pl + distribution_income が丸めた後も成り立つようにする
+	if roundTo > 1 {
+		assets.CurrentValue = floorToMultiple(assets.CurrentValue, roundTo)
+		if assets.PricePL != nil {
+			*assets.PricePL = floorToMultiple(*assets.PricePL, roundTo)
+			*assets.DistributionIncome = floorToMultiple(*assets.DistributionIncome, roundTo)
+			assets.CurrentPL = *assets.PricePL + *assets.DistributionIncome
+		} else {
+			assets.CurrentPL = floorToMultiple(assets.CurrentPL, roundTo)
+		}
+		assets.RoundTo = roundTo
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(assets)
+}
+
+// getAssetsWhatIfHandler: 一部のファンドの基準価額を仮の値に差し替えた場合の資産評価額と評価損益を計算する (ストレステスト用)
+// リクエストの prices で指定したファンドは評価日時点の基準価額の代わりにその値で評価し、それ以外のファンドは実際の基準価額を使う
+// 買付金額は実際の基準価額のまま計算し、DB には何も書き込まない
+// 評価日以前に基準価額が1件も無いファンドは、prices で指定しても /{user_id}/assets と同じく評価対象外になる
+func (s *Server) getAssetsWhatIfHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID := vars["user_id"]
+
+	var req AssetsWhatIfRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyDecodeError(w, err)
+		return
+	}
+	if len(req.Prices) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "invalid_parameter", "prices にファンドIDと基準価額を1件以上指定してください。")
+		return
+	}
+	prices := make(map[int]decimal.Decimal, len(req.Prices))
+	for fundID, v := range req.Prices {
+		price, err := decimal.NewFromString(v.String())
+		if err != nil || !price.IsPositive() {
+			writeJSONError(w, http.StatusBadRequest, "invalid_parameter", fmt.Sprintf("ファンドID %d の基準価額には正の数値を指定してください。", fundID))
+			return
+		}
+		prices[fundID] = price
+	}
+
+	targetDate := today()
+	if req.Date != "" {
+		parsedDate, err := time.Parse("2006-01-02", req.Date)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_date", "日付フォーマットが不正です。YYYY-MM-DD 形式を使用してください。")
+			return
+		}
+		targetDate = parsedDate
+	}
+
+	ctx, cancel := queryContext(r)
+	defer cancel()
+	// /{user_id}/assets と同じく、取引の無いユーザーは評価額0ではなく 404 にする
+	if !s.checkUserExists(w, ctx, userID) {
+		return
+	}
+	valuations, err := s.computeFundValuations(ctx, userID, targetDate, false, LATEST_PRICE_VERSION)
+	if errors.Is(err, errOversell) {
+		writeJSONError(w, http.StatusUnprocessableEntity, "oversell", err.Error())
+		return
+	}
+	if writeQueryTimeout(w, ctx) {
+		return
+	}
+	if r.Context().Err() != nil {
+		slog.InfoContext(r.Context(), "クライアントが切断したため what-if の資産計算を中断しました", "user_id", userID, "error", r.Context().Err())
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "what-if の資産計算中にエラーが発生しました", "user_id", userID, "date", targetDate.Format("2006-01-02"), "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "db_error", "資産データの取得に失敗しました。")
+		return
+	}
+
+	for i, v := range valuations {
+		price, ok := prices[v.FundID]
+		if !ok {
+			continue
+		}
+		valuations[i].CurrentPrice = price
+		valuations[i].CurrentValue = marketValue(valuations[i].CurrentPrice, v.TotalQuantity)
+	}
+	assets := summarizeValuations(valuations, targetDate, LATEST_PRICE_VERSION, nil)
+	assets.ExactCurrentValue = ""
+	assets.ExactCurrentPL = ""
+	assets.CurrentValueRaw = ""
+	assets.CurrentPLRaw = ""
+
+	setAsOfDateHeader(w, targetDate)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(assets)
+}
+
+// distributionIncome: 指定日までにユーザーが受け取った分配金の合計 (整数に切り捨て) を返す
+// 端数のある分配金の合計が float64 の誤差で1円ずれないよう、decimal で受け取ってから切り捨てる
+func (s *Server) distributionIncome(ctx context.Context, userID string, targetDate time.Time) (int64, error) {
+	var total decimal.Decimal
+	err := s.db.QueryRowContext(ctx, `
+		SELECT COALESCE(SUM(amount), 0) FROM distributions
+		WHERE user_id = ? AND distribution_date <= ?
+	`, userID, targetDate.Format("2006-01-02")).Scan(&total)
+	if err != nil {
+		return 0, err
+	}
+	return floorToInt64(total), nil
+}
+
+// resolveTargetDate: クエリパラメータ date または anchor から評価日を決定する
+// anchor=monthEnd の場合は month (YYYY-MM) で指定した月の最後の基準価額のある日を評価日にする
+// どちらも指定されていない場合は現在の日付を使用する
+// 返すエラーのメッセージはそのままクライアントに返せる形にしている
+func (s *Server) resolveTargetDate(r *http.Request) (time.Time, error) {
+	dateStr := r.URL.Query().Get("date") // クエリパラメータからdateを取得
+	anchor := r.URL.Query().Get("anchor")
+	if dateStr != "" && anchor != "" {
+		return time.Time{}, errors.New("date と anchor は同時に指定できません。")
+	}
+
+	monthStr := r.URL.Query().Get("month")
+	if monthStr != "" && anchor != ANCHOR_MONTH_END {
+		return time.Time{}, fmt.Errorf("month は anchor=%s と一緒に指定してください。", ANCHOR_MONTH_END)
+	}
+
+	switch anchor {
+	case "":
+	case ANCHOR_LAST_BUSINESS_DAY:
+		ctx, cancel := queryContext(r)
+		defer cancel()
+		return s.lastBusinessDay(ctx, today())
+	case ANCHOR_MONTH_END:
+		if monthStr == "" {
+			return time.Time{}, fmt.Errorf("anchor=%s の場合は month を YYYY-MM 形式で指定してください。", ANCHOR_MONTH_END)
+		}
+		month, err := time.Parse("2006-01", monthStr)
+		if err != nil {
+			return time.Time{}, errors.New("month のフォーマットが不正です。YYYY-MM 形式を使用してください。")
+		}
+		ctx, cancel := queryContext(r)
+		defer cancel()
+		return s.lastPricedDayOfMonth(ctx, month), nil
+	default:
+		return time.Time{}, fmt.Errorf("anchor の値が不正です。%s または %s を指定してください。", ANCHOR_LAST_BUSINESS_DAY, ANCHOR_MONTH_END)
+	}
+
+	if dateStr == "" {
+		return today(), nil
+	}
+	parsedDate, err := time.Parse("2006-01-02", dateStr)
+	if err != nil {
+		return time.Time{}, errors.New("日付フォーマットが不正です。YYYY-MM-DD 形式を使用してください。")
+	}
+	return parsedDate, nil
+}
+
+// resolvePriceVersion: クエリパラメータ priceVersion から評価に使う基準価額のインポートバッチを決定する
+// 未指定の場合は LATEST_PRICE_VERSION (最新の基準価額) を返す
+// エラー時はクライアントに返すステータスコードも返す
+func (s *Server) resolvePriceVersion(r *http.Request) (int64, int, error) {
+	v := r.URL.Query().Get("priceVersion")
+	if v == "" {
+		return LATEST_PRICE_VERSION, http.StatusOK, nil
+	}
+	priceVersion, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || priceVersion <= 0 {
+		return 0, http.StatusBadRequest, errors.New("priceVersion には正の整数を指定してください。")
+	}
+
+	ctx, cancel := queryContext(r)
+	defer cancel()
+	var exists bool
+	err = s.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM price_import_batches WHERE id = ?)", priceVersion).Scan(&exists)
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return 0, http.StatusGatewayTimeout, fmt.Errorf("データベースの応答が %s 以内にありませんでした。", dbQueryTimeout)
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "基準価額のインポートバッチの確認中にエラーが発生しました", "price_version", priceVersion, "error", err)
+		return 0, http.StatusInternalServerError, errors.New("基準価額のバージョンの確認に失敗しました。")
+	}
+	if !exists {
+		return 0, http.StatusNotFound, fmt.Errorf("priceVersion %d の基準価額は存在しません。", priceVersion)
+	}
+	return priceVersion, http.StatusOK, nil
+}
+
+// parseBoolParam: 真偽値のクエリパラメータを読み込む。未指定の場合は false を返す
+// 返すエラーのメッセージはそのままクライアントに返せる形にしている
+func parseBoolParam(r *http.Request, name string) (bool, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("%s には true または false を指定してください。", name)
+	}
+	return b, nil
+}
+
+// parseMinValue: クエリパラメータ minValue (評価額の下限) を読み込む。未指定の場合は nil を返す
+// 返すエラーのメッセージはそのままクライアントに返せる形にしている
+func parseMinValue(r *http.Request) (*float64, error) {
+	v := r.URL.Query().Get("minValue")
+	if v == "" {
+		return nil, nil
+	}
+	minValue, err := strconv.ParseFloat(v, 64)
+	if err != nil || math.IsNaN(minValue) || math.IsInf(minValue, 0) {
+		return nil, errors.New("minValue には数値を指定してください。")
+	}
+	return &minValue, nil
+}
+
+// parseRoundTo: クエリパラメータ roundTo (金額を丸める単位) を読み込む。未指定の場合は1 (1円単位) を返す
+// 返すエラーのメッセージはそのままクライアントに返せる形にしている
+func parseRoundTo(r *http.Request) (int64, error) {
+	v := r.URL.Query().Get("roundTo")
+	if v == "" {
+		return 1, nil
+	}
+	roundTo, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || roundTo < 1 {
+		return 0, errors.New("roundTo には1以上の整数を指定してください。")
+	}
+	return roundTo, nil
+}
+
+// dateOnly: 日時から年月日だけを取り出し、UTC の0時にする
+// UTC で読み込まれる DATE 型の値と appLocation の評価日のように、ロケーションの違う日付を日単位で比較するために使う
+func dateOnly(t time.Time) time.Time {
+	year, month, day := t.Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+// floorToMultiple: v 以下で最大の unit の倍数を返す (マイナスの値も小さい方に丸める)
+func floorToMultiple(v int64, unit int64) int64 {
+	q := v / unit
+	if v%unit != 0 && v < 0 {
+		q--
+	}
+	return q * unit
+}
+
+// belowMinValue: ファンドの評価額 (切り捨て前) が minValue 未満かどうかを返す。minValue が nil の場合は常に false
+func belowMinValue(v fundValuation, minValue *float64) bool {
+	return minValue != nil && v.CurrentValue.LessThan(decimal.NewFromFloat(*minValue))
+}
+
+// parseDateRange: クエリパラメータ from と to (どちらも必須) から期間を決定する
+// 返すエラーのメッセージはそのままクライアントに返せる形にしている
+func parseDateRange(r *http.Request) (from time.Time, to time.Time, err error) {
+	fromStr := r.URL.Query().Get("from")
+	toStr := r.URL.Query().Get("to")
+	if fromStr == "" || toStr == "" {
+		return time.Time{}, time.Time{}, errors.New("from と to を YYYY-MM-DD 形式で指定してください。")
+	}
+	from, err = time.Parse("2006-01-02", fromStr)
+	if err != nil {
+		return time.Time{}, time.Time{}, errors.New("from の日付フォーマットが不正です。YYYY-MM-DD 形式を使用してください。")
+	}
+	to, err = time.Parse("2006-01-02", toStr)
+	if err != nil {
+		return time.Time{}, time.Time{}, errors.New("to の日付フォーマットが不正です。YYYY-MM-DD 形式を使用してください。")
+	}
+	if from.After(to) {
+		return time.Time{}, time.Time{}, errors.New("from は to 以前の日付を指定してください。")
+	}
+	return from, to, nil
+}
+
+// lastBusinessDay: 指定日以前で最も新しい営業日 (土日と holidays テーブルの祝日を除く) を返す
+// 指定日が営業日ならその日を返し、例えば指定日が土日や祝日の月曜日なら前の金曜日になる
+// HOLIDAY_LOOKBACK_DAYS 日遡っても営業日が無い場合は、営業日ではない日を評価日にしないようエラーを返す
+// 返すエラーのメッセージはそのままクライアントに返せる形にしている
+func (s *Server) lastBusinessDay(ctx context.Context, from time.Time) (time.Time, error) {
+	// 連休を考慮して一定期間分の祝日をまとめて取得する
+	windowStart := from.AddDate(0, 0, -HOLIDAY_LOOKBACK_DAYS)
+	holidays := make(map[string]bool)
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT holiday_date FROM holidays
+		WHERE holiday_date >= ? AND holiday_date <= ?
+	`, windowStart.Format("2006-01-02"), from.Format("2006-01-02"))
+	if err != nil {
+		// 祝日テーブルが使えない場合は土日のみを休日として扱う
+		slog.Warn("祝日の取得中にエラーが発生しました。土日のみを休日として扱います", "error", err)
+	} else {
+		defer rows.Close()
+		for rows.Next() {
+			var holiday time.Time
+			if err := rows.Scan(&holiday); err != nil {
+				slog.Error("祝日行のスキャン中にエラーが発生しました", "error", err)
+				continue
+			}
+			holidays[holiday.Format("2006-01-02")] = true
+		}
+		if rows.Err() != nil {
+			slog.Error("祝日の行イテレーション中にエラーが発生しました", "error", rows.Err())
+		}
+	}
+
+	for day := from; !day.Before(windowStart); day = day.AddDate(0, 0, -1) {
+		weekday := day.Weekday()
+		if weekday != time.Saturday && weekday != time.Sunday && !holidays[day.Format("2006-01-02")] {
+			return day, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%s 以前の %d 日間に営業日が見つかりません。", from.Format("2006-01-02"), HOLIDAY_LOOKBACK_DAYS)
+}
+
+// lastPricedDayOfMonth: month を含む月のうち、いずれかのファンドの基準価額がある最後の日を返す
+// 基準価額が1件も無い (または取得に失敗した) 場合は、その月の最後の平日を返す
+func (s *Server) lastPricedDayOfMonth(ctx context.Context, month time.Time) time.Time {
+	firstDay := time.Date(month.Year(), month.Month(), 1, 0, 0, 0, 0, appLocation)
+	lastDay := firstDay.AddDate(0, 1, -1)
+
+	var priceDate sql.NullTime
+	err := s.db.QueryRowContext(ctx, `
+		SELECT MAX(price_date) FROM reference_prices
+		WHERE price_date BETWEEN ? AND ?
+	`, firstDay.Format("2006-01-02"), lastDay.Format("2006-01-02")).Scan(&priceDate)
+	if err != nil {
+		slog.Warn("基準価額のある日の取得中にエラーが発生しました。月の最後の平日を使用します", "month", firstDay.Format("2006-01"), "error", err)
+	} else if priceDate.Valid {
+		return time.Date(priceDate.Time.Year(), priceDate.Time.Month(), priceDate.Time.Day(), 0, 0, 0, 0, appLocation)
+	}
+
+	day := lastDay
+	for day.Weekday() == time.Saturday || day.Weekday() == time.Sunday {
+		day = day.AddDate(0, 0, -1)
+	}
+	return day
+}
+
+// today: 現在の日付 (時刻部分を切り捨てたもの) を返す
+func today() time.Time {
+	// Goのtime.Now()はタイムゾーン情報を持つため、DBのDATE型に合わせるために日付部分のみにする
+	now := time.Now().In(appLocation) // APP_TIMEZONE のタイムゾーン (デフォルトは日本時間) で現在時刻を取得
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, appLocation)
+}
+
+// computeAssets: 指定日時点のユーザーの資産評価額と評価損益を計算する
+// getAssetsHandler と一括評価 (getAssetsBatchHandler) の両方から利用する
+// priceVersion を指定すると、そのインポート時点の基準価額で評価する (LATEST_PRICE_VERSION なら最新の基準価額)
+// minValue が nil でない場合、評価額がそれ未満のファンドは合計に含めない
+func (s *Server) computeAssets(ctx context.Context, userID string, targetDate time.Time, priceVersion int64, minValue *float64) (AssetData, error) {
+	valuations, err := s.computeFundValuations(ctx, userID, targetDate, false, priceVersion)
+	if err != nil {
+		return AssetData{}, err
+	}
+	return summarizeValuations(valuations, targetDate, priceVersion, minValue), nil
+}
+
+// summarizeValuations: ファンドごとの評価額を合計して AssetData にする
+// 基準価額を差し替えて評価する what-if (getAssetsWhatIfHandler) でも同じ集計を使うため computeAssets から分けている
+func summarizeValuations(valuations []fundValuation, targetDate time.Time, priceVersion int64, minValue *float64) AssetData {
+	var totals valuationTotals
+	var excludedFunds []int
+	for _, v := range valuations {
+		if belowMinValue(v, minValue) {
+			continue
+		}
+		// 買付金額が正しく計算できないファンドは評価損益が大きくずれるため、合計に含めない
+		if v.MissingBuyPrice {
+			excludedFunds = append(excludedFunds, v.FundID)
+			continue
+		}
+		// 買付金額の合計は Position の TotalBuyCost をそのまま使う
+		totals.add(v.CurrentValue, v.TotalBuyCost)
+	}
+
+	// 整数に切り捨て (集計順序は ASSETS_ROUNDING_ORDER に従う)
+	finalCurrentValue, finalCurrentPL := totals.result()
+
+	return AssetData{
+		Date:              targetDate.Format("2006-01-02"),
+		CurrentValue:      finalCurrentValue,
+		CurrentPL:         finalCurrentPL,
+		ExactCurrentValue: totals.CurrentValueSum.String(),
+		ExactCurrentPL:    totals.CurrentValueSum.Sub(totals.BuyAmountSum).String(),
+		CurrentValueRaw:   totals.CurrentValueSum.StringFixed(RAW_VALUE_SCALE),
+		CurrentPLRaw:      totals.CurrentValueSum.Sub(totals.BuyAmountSum).StringFixed(RAW_VALUE_SCALE),
+		PriceVersion:      priceVersion,
+		ExcludedFunds:     excludedFunds,
+	}
+}
+
+// computeFundValuations: 指定日時点のファンドごとの保有口数・買付金額・評価額を計算する
+// 他の口座からの移管 (transfers) は、移管元での取得価額のまま保有口数と買付金額に含める
+// 買付金額は総平均法で計算する (売却した口数は平均取得単価で差し引く)
+// includeClosed=false の場合は保有口数が1口以上のファンドのみを対象とする
+// 基準価額が指定日以前で見つからないファンドは評価対象外としてスキップする
+// priceVersion を指定した場合、買付時・評価日時点の基準価額ともに
+// そのインポートバッチ以前に取り込まれた基準価額のうち最も新しいものを使う
+// 結果はファンドIDの昇順で返す
+func (s *Server) computeFundValuations(ctx context.Context, userID string, targetDate time.Time, includeClosed bool, priceVersion int64) ([]fundValuation, error) {
+	// 資産評価額と買付金額の合計を計算するためのSQLクエリ
+	// 各ファンドIDごとの最終的な保有口数と、その口数に対する買付金額の合計を算出
+	// 指定された日付以前の取引と移管のみを考慮する
+	sources, args := positionSourcesQuery(userID, targetDate, priceVersion)
+	query := `
+		SELECT
+			p.fund_id,
+			SUM(p.quantity) AS total_quantity,
+			-- 平均取得単価を求めるため、買付 (口数がプラスの取引と移管) の口数と金額を売却と分けて合計する
+			SUM(CASE WHEN p.quantity > 0 THEN p.quantity ELSE 0 END) AS bought_quantity,
+			SUM(CASE WHEN p.quantity > 0 THEN p.buy_cost ELSE 0 END) AS bought_cost,
+			-- 売却を売却日の基準価額で差し引いた正味の投資額 (損益寄与の計算で使用)
+			SUM(p.buy_cost) AS net_invested
+		FROM ` + sources + ` p
+		-- 取引日の基準価額が無い買付は買付金額を計算できないため、口数も含めない
+		-- 売却は基準価額が無くても保有口数を減らすため、絞り込まない (正味の投資額には含まれない)
+		WHERE
+			p.quantity <= 0 OR p.buy_cost IS NOT NULL
+		GROUP BY
+			p.fund_id`
+	if !includeClosed {
+		// 保有口数を超える売却は OVERSELL_MODE に従って扱うため、マイナスのものも取得する
+		query += `
+		HAVING
+			total_quantity <> 0`
+	}
+	started := time.Now()
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	observeDBQuery("positions", started)
+	if err != nil {
+		return nil, fmt.Errorf("ポジションの取得に失敗しました: %w", err)
+	}
+	defer rows.Close()
+
+	type positionRow struct {
+		fundID         int
+		totalQuantity  int
+		boughtQuantity int
+		boughtCost     decimal.Decimal
+		netInvested    decimal.Decimal
+	}
+	var positionRows []positionRow
+	for rows.Next() {
+		var row positionRow
+		err := rows.Scan(&row.fundID, &row.totalQuantity, &row.boughtQuantity, &row.boughtCost, &row.netInvested)
+		if err != nil {
+			slog.Error("ポジション行のスキャン中にエラーが発生しました", "error", err)
+			continue
+		}
+		positionRows = append(positionRows, row)
+	}
+	if rows.Err() != nil {
+		slog.Error("行のイテレーション中にエラーが発生しました", "error", rows.Err())
+	}
+	// resolveOversell は別のクエリを発行するため、接続を返してから呼び出す
+	rows.Close()
+
+	// 各ファンドIDごとの保有状況と買付金額を格納
+	var positions []Position
+	for _, row := range positionRows {
+		totalQuantity, err := s.resolveOversell(ctx, userID, row.fundID, row.totalQuantity, targetDate)
+		if err != nil {
+			return nil, err
+		}
+		if !includeClosed && totalQuantity == 0 {
+			continue
+		}
+		positions = append(positions, Position{
+			FundID:        row.fundID,
+			TotalQuantity: totalQuantity,
+			TotalBuyCost:  averageCostBasis(row.boughtQuantity, row.boughtCost, totalQuantity),
+			NetInvested:   row.netInvested,
+		})
+	}
+
+	var unpricedBuys map[int]int
+	if excludeUnpricedBuys {
+		unpricedBuys, err = s.tradesWithoutBuyPrice(ctx, userID, targetDate, priceVersion)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// 基準価額（評価日時点の最新の基準価額）を保有中の全ファンド分まとめて取得
+	// 全て売却済みのファンドは基準価額を参照しないため対象外
+	var heldFundIDs []int
+	for _, pos := range positions {
+		if pos.TotalQuantity != 0 {
+			heldFundIDs = append(heldFundIDs, pos.FundID)
+		}
+	}
+	currentPrices, err := s.latestPrices(ctx, heldFundIDs, targetDate, priceVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	valuations := make([]fundValuation, 0, len(positions))
+	for _, pos := range positions {
+		// 全て売却済みのファンドは基準価額を参照せず評価額0とする
+		if pos.TotalQuantity == 0 {
+			valuations = append(valuations, fundValuation{Position: pos})
+			continue
+		}
+
+		current, ok := currentPrices[pos.FundID]
+		if !ok {
+			// そのファンドIDの基準価額が指定日以前で見つからない場合、その銘柄は評価対象外
+			slog.WarnContext(ctx, "評価日以前の参照価格が見つかりません。計算をスキップします。", "fund_id", pos.FundID, "date", targetDate.Format("2006-01-02"))
+			continue
+		}
+		// 最新の基準価額が古すぎる場合 (償還済みのファンドなど) は、実態と離れた評価額にならないよう評価対象外にする
+		if priceMaxAgeDays > 0 && dateOnly(current.Date).AddDate(0, 0, priceMaxAgeDays).Before(dateOnly(targetDate)) {
+			slog.WarnContext(ctx, "最新の参照価格が古すぎるため、計算をスキップします。", "fund_id", pos.FundID, "price_date", current.Date.Format("2006-01-02"), "date", targetDate.Format("2006-01-02"), "max_age_days", priceMaxAgeDays)
+			continue
+		}
+		currentPrice := current.Price
+
+		missingBuyPrice := excludeUnpricedBuys && (unpricedBuys[pos.FundID] > 0 || (pos.TotalQuantity > 0 && pos.TotalBuyCost.IsZero()))
+		if missingBuyPrice {
+			slog.WarnContext(ctx, "買付時の基準価額が無い取引があるため、評価損益の計算から除外します。", "user_id", userID, "fund_id", pos.FundID, "count", unpricedBuys[pos.FundID])
+		}
+
+		// 資産評価額: (基準価額 * 所持口数) / 基準価額あたりの口数
+		valuations = append(valuations, fundValuation{
+			Position:        pos,
+			CurrentPrice:    currentPrice,
+			CurrentValue:    marketValue(currentPrice, pos.TotalQuantity),
+			MissingBuyPrice: missingBuyPrice,
+		})
+	}
+
+	sort.Slice(valuations, func(i, j int) bool {
+		return valuations[i].FundID < valuations[j].FundID
+	})
+	return valuations, nil
+}
+
+// positionSourcesQuery: 指定日までのユーザーの取引と移管を1つにまとめたサブクエリと、そのプレースホルダの引数を返す
+// 列は id, fund_id, quantity, trade_date, is_transfer, price, buy_cost で、
+// price は取引日の基準価額 (移管と、取引日の基準価額が無い取引は NULL)、
+// buy_cost は取引の口数に対する金額 (移管は移管元での取得価額、取引日の基準価額が無い取引は NULL)
+// 評価額の計算 (computeFundValuations) と先入先出の突き合わせ (matchLots) で同じ取引を対象にするために共通化している
+// priceVersion を指定した場合、そのインポートバッチ以前に取り込まれた基準価額のうち最も新しいものを使う
+func positionSourcesQuery(userID string, targetDate time.Time, priceVersion int64) (string, []interface{}) {
+	// 列に NOT NULL 制約が無かった頃にインポートされた price が NULL の行は、基準価額が無いものとして扱う
+	buyPriceJoin := `
+			LEFT JOIN
+				reference_prices rp_buy ON th.fund_id = rp_buy.fund_id AND th.trade_date = rp_buy.price_date AND rp_buy.price IS NOT NULL`
+	// 基準価額あたりの口数を整数で渡し、買付金額を MySQL の DECIMAL のまま誤差なく計算する
+	args := []interface{}{int64(UNIT_PER_PRICE_BASE)}
+	if priceVersion != LATEST_PRICE_VERSION {
+		buyPriceJoin = `
+			LEFT JOIN
+				reference_price_versions rp_buy ON th.fund_id = rp_buy.fund_id AND th.trade_date = rp_buy.price_date AND rp_buy.price IS NOT NULL
+				AND rp_buy.import_batch = (
+					SELECT MAX(v.import_batch) FROM reference_price_versions v
+					WHERE v.fund_id = rp_buy.fund_id AND v.price_date = rp_buy.price_date AND v.import_batch <= ?
+				)`
+		args = append(args, priceVersion)
+	}
+	date := targetDate.Format("2006-01-02") // DATE型に合わせるためフォーマット
+	args = append(args, userID, date, userID, date)
+
+	query := `(
+			SELECT
+				th.id,
+				th.fund_id,
+				th.quantity,
+				th.trade_date,
+				FALSE AS is_transfer,
+				rp_buy.price,
+				-- 買付金額: (買付時の基準価額 / 基準価額あたりの口数 * 買付口数)
+				-- DECIMAL同士の計算になるため、小数部の誤差は出ない
+				th.quantity * rp_buy.price / ? AS buy_cost
+			FROM
+				trade_histories th` + buyPriceJoin + `
+			WHERE
+				th.user_id = ? AND th.trade_date <= ?
+			UNION ALL
+			-- 他の口座から移管された口数は、移管元での取得価額 (cost_basis) を買付金額とする
+			SELECT tr.id, tr.fund_id, tr.quantity, tr.transfer_date, TRUE, NULL, tr.cost_basis
+			FROM transfers tr
+			WHERE tr.user_id = ? AND tr.transfer_date <= ?
+		)`
+	return query, args
+}
+
+// averageCostBasis: 保有口数に対する買付金額を総平均法で計算する
+// 平均取得単価 = 買付した口数全体の買付金額 / 買付した口数 とし、売却した口数はこの単価で差し引く
+// (売却日の基準価額で差し引くと、売却益が出ているほど買付金額が過小になるため)
+// 割り切れない場合の誤差を小さくするため、保有口数を掛けてから買付した口数で割る
+func averageCostBasis(boughtQuantity int, boughtCost decimal.Decimal, quantity int) decimal.Decimal {
+	if boughtQuantity <= 0 || quantity == 0 {
+		return decimal.Zero
+	}
+	return boughtCost.Mul(decimal.NewFromInt(int64(quantity))).Div(decimal.NewFromInt(int64(boughtQuantity)))
+}
+
+// latestPrice: 指定日以前で最も新しいファンドの基準価額を返す。見つからない場合は sql.ErrNoRows を返す
+// priceVersion を指定した場合は、そのインポートバッチ以前に取り込まれた基準価額のうち最も新しいものを使う
+// 列に NOT NULL 制約が無かった頃のインポートで price が NULL の行が残っている場合は、ログに出力して読み飛ばす
+func (s *Server) latestPrice(ctx context.Context, fundID int, targetDate time.Time, priceVersion int64) (decimal.Decimal, error) {
+	defer observeDBQuery("latest_price", time.Now())
+	query := `
+		SELECT price, price_date FROM reference_prices
+		WHERE fund_id = ? AND price_date <= ?%s
+		ORDER BY price_date DESC
+		LIMIT 1`
+	args := []interface{}{fundID, targetDate.Format("2006-01-02")}
+	if priceVersion != LATEST_PRICE_VERSION {
+		// 同じ日付の基準価額が複数のバッチにある場合は、指定バッチ以前で最も新しいものを使う
+		query = `
+		SELECT price, price_date FROM reference_price_versions
+		WHERE fund_id = ? AND price_date <= ? AND import_batch <= ?%s
+		ORDER BY price_date DESC, import_batch DESC
+		LIMIT 1`
+		args = append(args, priceVersion)
+	}
+
+	var price decimal.NullDecimal
+	var priceDate time.Time
+	err := s.db.QueryRowContext(ctx, fmt.Sprintf(query, ""), args...).Scan(&price, &priceDate)
+	if err != nil {
+		return decimal.Zero, err
+	}
+	if price.Valid {
+		return price.Decimal, nil
+	}
+
+	// 最新の基準価額が NULL の場合は、NULL でないもののうち最も新しいものを使う
+	slog.WarnContext(ctx, "基準価額が NULL です。NULL の基準価額を読み飛ばします。", "fund_id", fundID, "date", priceDate.Format("2006-01-02"))
+	err = s.db.QueryRowContext(ctx, fmt.Sprintf(query, " AND price IS NOT NULL"), args...).Scan(&price, &priceDate)
+	if err != nil {
+		return decimal.Zero, err
+	}
+	return price.Decimal, nil
+}
+
+// datedPrice は基準価額とその日付
+type datedPrice struct {
+	Price decimal.Decimal
+	Date  time.Time
+}
+
+// latestPrices: 指定日以前で最も新しい基準価額を、複数のファンドについて1回のクエリでまとめて取得する
+// 基準価額が見つからないファンドは結果のマップに含めない
+// latestPrice と同じく、priceVersion を指定した場合はそのインポートバッチ以前に取り込まれたものを使い、price が NULL の行は読み飛ばす
+func (s *Server) latestPrices(ctx context.Context, fundIDs []int, targetDate time.Time, priceVersion int64) (map[int]datedPrice, error) {
+	prices := make(map[int]datedPrice, len(fundIDs))
+	if len(fundIDs) == 0 {
+		return prices, nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(fundIDs)), ", ")
+	args := make([]interface{}, 0, len(fundIDs)+2)
+	for _, fundID := range fundIDs {
+		args = append(args, fundID)
+	}
+	args = append(args, targetDate.Format("2006-01-02"))
+
+	// ファンドごとに指定日以前で最も新しい price_date を相関サブクエリで求め、その日の基準価額を取得
+	query := `
+		SELECT rp.fund_id, rp.price, rp.price_date FROM reference_prices rp
+		WHERE rp.fund_id IN (` + placeholders + `) AND rp.price IS NOT NULL
+			AND rp.price_date = (
+				SELECT MAX(p.price_date) FROM reference_prices p
+				WHERE p.fund_id = rp.fund_id AND p.price_date <= ? AND p.price IS NOT NULL
+			)`
+	if priceVersion != LATEST_PRICE_VERSION {
+		// 同じ日付の基準価額が複数のバッチにある場合は、指定バッチ以前で最も新しいものを使う
+		query = `
+		SELECT v.fund_id, v.price, v.price_date FROM reference_price_versions v
+		WHERE v.fund_id IN (` + placeholders + `) AND v.price IS NOT NULL
+			AND (v.price_date, v.import_batch) = (
+				SELECT p.price_date, p.import_batch FROM reference_price_versions p
+				WHERE p.fund_id = v.fund_id AND p.price_date <= ? AND p.import_batch <= ? AND p.price IS NOT NULL
+				ORDER BY p.price_date DESC, p.import_batch DESC
+				LIMIT 1
+			)`
+		args = append(args, priceVersion)
+	}
+
+	started := time.Now()
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	observeDBQuery("latest_prices", started)
+	if err != nil {
+		return nil, fmt.Errorf("基準価額の取得に失敗しました: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var fundID int
+		var price datedPrice
+		if err := rows.Scan(&fundID, &price.Price, &price.Date); err != nil {
+			return nil, fmt.Errorf("基準価額のスキャンに失敗しました: %w", err)
+		}
+		prices[fundID] = price
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("基準価額の取得中にエラーが発生しました: %w", err)
+	}
+	return prices, nil
+}
+
+// tradesWithoutBuyPrice: 指定日までの買付のうち、取引日の基準価額が無いもの (買付金額の計算から漏れる取引) の件数をファンドごとに返す
+// 基準価額が無い売却は保有口数から差し引かれるため数えない
+// priceVersion を指定した場合は、computeFundValuations と同じくそのインポートバッチ以前の基準価額で判定する
+func (s *Server) tradesWithoutBuyPrice(ctx context.Context, userID string, targetDate time.Time, priceVersion int64) (map[int]int, error) {
+	priceExists := `SELECT 1 FROM reference_prices rp WHERE rp.fund_id = th.fund_id AND rp.price_date = th.trade_date AND rp.price IS NOT NULL`
+	args := []interface{}{}
+	if priceVersion != LATEST_PRICE_VERSION {
+		priceExists = `SELECT 1 FROM reference_price_versions rp WHERE rp.fund_id = th.fund_id AND rp.price_date = th.trade_date AND rp.price IS NOT NULL AND rp.import_batch <= ?`
+		args = append(args, priceVersion)
+	}
+	args = append(args, userID, targetDate.Format("2006-01-02"))
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT th.fund_id, COUNT(*)
+		FROM trade_histories th
+		WHERE NOT EXISTS (`+priceExists+`)
+			AND th.user_id = ? AND th.trade_date <= ? AND th.quantity > 0
+		GROUP BY th.fund_id`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("買付時の基準価額が無い取引の取得に失敗しました: %w", err)
+	}
+	defer rows.Close()
+
+	counts := make(map[int]int)
+	for rows.Next() {
+		var fundID, count int
+		if err := rows.Scan(&fundID, &count); err != nil {
+			return nil, fmt.Errorf("買付時の基準価額が無い取引の行のスキャンに失敗しました: %w", err)
+		}
+		counts[fundID] = count
+	}
+	return counts, rows.Err()
+}
+
+// resolveOversell: 正味の保有口数がマイナス (保有口数を超える売却) の場合に OVERSELL_MODE に従って保有口数を補正する
+// reject の場合は該当する売却の取引を含めた errOversell のエラーを返す
+// clamp と allow_negative の場合は該当する取引をログに出力する
+func (s *Server) resolveOversell(ctx context.Context, userID string, fundID int, quantity int, targetDate time.Time) (int, error) {
+	if quantity >= 0 {
+		return quantity, nil
+	}
+
+	trades, err := s.oversoldTrades(ctx, userID, fundID, targetDate)
+	if err != nil {
+		return 0, err
+	}
+	offending := make([]string, 0, len(trades))
+	for _, t := range trades {
+		offending = append(offending, fmt.Sprintf("%s に %d 口", t.TradeDate, t.Quantity))
+	}
+	detail := fmt.Sprintf("ユーザー %s のファンドID %d の保有口数が %s 時点で %d 口になります（該当取引: %s）",
+		userID, fundID, targetDate.Format("2006-01-02"), quantity, strings.Join(offending, ", "))
+
+	switch oversellMode {
+	case OVERSELL_REJECT:
+		return 0, fmt.Errorf("%w: %s", errOversell, detail)
+	case OVERSELL_ALLOW_NEGATIVE:
+		slog.WarnContext(ctx, "保有口数を超える売却があります。マイナスの保有口数のまま評価します", "user_id", userID, "fund_id", fundID, "date", targetDate.Format("2006-01-02"), "quantity", quantity, "trades", strings.Join(offending, ", "))
+		return quantity, nil
+	default:
+		slog.WarnContext(ctx, "保有口数を超える売却があります。保有口数0として扱います", "user_id", userID, "fund_id", fundID, "date", targetDate.Format("2006-01-02"), "quantity", quantity, "trades", strings.Join(offending, ", "))
+		return 0, nil
+	}
+}
+
+// oversoldTrades: 指定日までの取引のうち、その売却によって保有口数がマイナスになった取引を返す
+// 同じ日の取引の順序は LOT_SAME_DAY_ORDER に従う
+func (s *Server) oversoldTrades(ctx context.Context, userID string, fundID int, targetDate time.Time) ([]TradeItem, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, fund_id, quantity, trade_date
+		FROM (
+			SELECT
+				id,
+				fund_id,
+				quantity,
+				trade_date,
+				SUM(quantity) OVER (ORDER BY trade_date, `+lotTradeOrder()+` ROWS UNBOUNDED PRECEDING) AS running_quantity
+			FROM
+				trade_histories
+			WHERE
+				user_id = ? AND fund_id = ? AND trade_date <= ?
+		) t
+		WHERE
+			quantity < 0 AND running_quantity < 0
+		ORDER BY
+			trade_date, id`, userID, fundID, targetDate.Format("2006-01-02"))
+	if err != nil {
+		return nil, fmt.Errorf("保有口数を超える売却の取得に失敗しました: %w", err)
+	}
+	defer rows.Close()
+
+	var trades []TradeItem
+	for rows.Next() {
+		trade, err := scanTradeItem(rows)
+		if err != nil {
+			return nil, fmt.Errorf("保有口数を超える売却の行のスキャンに失敗しました: %w", err)
+		}
+		trades = append(trades, trade)
+	}
+	return trades, rows.Err()
+}
+
+// getAssetsByFundHandler: ユーザーの資産評価額と評価損益をファンドごとに取得 (オプションの日付パラメータあり)
+// 対象や日付の扱いは getAssetsHandler と同じで、合計せずにファンドIDの昇順で返す
+func (s *Server) getAssetsByFundHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID := vars["user_id"]
+
+	targetDate, err := s.resolveTargetDate(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_date", err.Error())
+		return
+	}
+	priceVersion, status, err := s.resolvePriceVersion(r)
+	if err != nil {
+		writeJSONError(w, status, priceVersionErrorCode(status), err.Error())
+		return
+	}
+	// minValue を指定すると、評価額がそれ未満のファンドを一覧から除外する
+	// (合計からも除外する場合は /{user_id}/assets にも同じ minValue を指定する)
+	minValue, err := parseMinValue(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+
+	setAsOfDateHeader(w, targetDate)
+
+	// 前回のレスポンス以降に新しいデータがインポートされていなければ再計算しない
+	if s.handleNotModified(w, r, targetDate) {
+		return
+	}
+
+	valuations, err := s.computeFundValuations(r.Context(), userID, targetDate, false, priceVersion)
+	if errors.Is(err, errOversell) {
+		writeJSONError(w, http.StatusUnprocessableEntity, "oversell", err.Error())
+		return
+	}
+	if r.Context().Err() != nil {
+		slog.InfoContext(r.Context(), "クライアントが切断したためファンド別資産計算を中断しました", "user_id", userID, "error", r.Context().Err())
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "ファンド別資産計算中にエラーが発生しました", "user_id", userID, "date", targetDate.Format("2006-01-02"), "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "db_error", "ファンド別資産データの取得に失敗しました。")
+		return
+	}
+
+	lots, err := s.openLots(r.Context(), userID, targetDate)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "保有ロットの取得中にエラーが発生しました", "user_id", userID, "date", targetDate.Format("2006-01-02"), "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "db_error", "ファンド別資産データの取得に失敗しました。")
+		return
+	}
+
+	fundAssets := make([]FundAsset, 0, len(valuations))
+	for _, v := range valuations {
+		if belowMinValue(v, minValue) || v.MissingBuyPrice {
+			continue
+		}
+		fundAssets = append(fundAssets, FundAsset{
+			FundID:           v.FundID,
+			CurrentValue:     floorToInt64(v.CurrentValue),
+			CurrentPL:        floorToInt64(v.CurrentValue.Sub(v.TotalBuyCost)),
+			BreakEvenPrice:   breakEvenPrice(v.TotalBuyCost, v.TotalQuantity),
+			AverageEntryDate: averageEntryDate(lots[v.FundID]),
+		})
+	}
+
+	fundAssets, _ = truncateResponse(w, fundAssets)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fundAssets)
+}
+
+// breakEvenPrice: 評価額が買付金額と等しくなる基準価額を返す
+// 評価額 = 基準価額 * 保有口数 / UNIT_PER_PRICE_BASE なので、
+// 損益分岐の基準価額 = 買付金額 * UNIT_PER_PRICE_BASE / 保有口数 (基準価額の列と同じ小数桁数に丸める)
+func breakEvenPrice(buyCost decimal.Decimal, quantity int) float64 {
+	if quantity <= 0 {
+		return 0
+	}
+	return buyCost.Mul(unitPerPriceBase).Div(decimal.NewFromInt(int64(quantity))).Round(int32(priceScale)).InexactFloat64()
+}
+
+// lot は1回分の買付と、そのうち売却で差し引かれた口数
+type lot struct {
+	FundID       int
+	TradeDate    time.Time
+	Quantity     int             // 保有中の口数 (売却で差し引いた残り)
+	SoldQuantity int             // 売却で差し引かれた口数
+	BuyPrice     decimal.Decimal // 買付時の基準価額 (HasBuyPrice=false の場合は0)
+	HasBuyPrice  bool            // 買付金額が分かるか (取引日の基準価額が存在する、または移管)
+	BuyCost      decimal.Decimal // 売却で差し引く前の口数全体の買付金額 (HasBuyPrice=false の場合は0)
+}
+
+// cost: ロットのうち quantity 口分の買付金額を、売却で差し引く前の口数で按分して返す
+func (l lot) cost(quantity int) decimal.Decimal {
+	bought := l.Quantity + l.SoldQuantity
+	if bought == 0 {
+		return decimal.Zero
+	}
+	return l.BuyCost.Mul(decimal.NewFromInt(int64(quantity))).Div(decimal.NewFromInt(int64(bought)))
+}
+
+// openLots: 指定日時点でユーザーが保有中のロットをファンドごとに返す
+func (s *Server) openLots(ctx context.Context, userID string, targetDate time.Time) (map[int][]lot, error) {
+	all, err := s.reconstructLots(ctx, userID, targetDate)
+	if err != nil {
+		return nil, err
+	}
+	lots := make(map[int][]lot)
+	for _, l := range all {
+		if l.Quantity > 0 {
+			lots[l.FundID] = append(lots[l.FundID], l)
+		}
+	}
+	return lots, nil
+}
+
+// reconstructLots: 指定日までの取引から、全て売却済みのものも含めたロットを買付日順に返す
+// 売却 (マイナスの口数) は買付日の古いロットから順に差し引く (先入先出)
+// 同じ日の取引の順序は LOT_SAME_DAY_ORDER に従う。保有口数を超える売却の残りは無視する
+func (s *Server) reconstructLots(ctx context.Context, userID string, targetDate time.Time) ([]lot, error) {
+	lots, _, err := s.matchLots(ctx, userID, targetDate)
+	return lots, err
+}
+
+// lotSale は1件の売却と、それを差し引いたロットの買付金額の合計
+type lotSale struct {
+	FundID       int
+	TradeDate    time.Time
+	Quantity     int             // ロットから差し引いた口数 (保有口数を超えた分は含まない)
+	SellPrice    decimal.Decimal // 売却日の基準価額 (HasSellPrice=false の場合は0)
+	HasSellPrice bool            // 売却日の基準価額が存在するか
+	Cost         decimal.Decimal // 差し引いたロットの買付金額の合計
+	HasCost      bool            // 差し引いたロットがすべて買付時の基準価額を持つか
+}
+
+// matchLots: reconstructLots と同じ順序でロットを組み立て、売却ごとにどのロットを差し引いたかも返す
+// 対象の取引と移管は computeFundValuations と同じ positionSourcesQuery で取得する (移管は移管日に買付したロットとして扱う)
+func (s *Server) matchLots(ctx context.Context, userID string, targetDate time.Time) ([]lot, []lotSale, error) {
+	sources, args := positionSourcesQuery(userID, targetDate, LATEST_PRICE_VERSION)
+	// 同じ日の取引と移管で id が重なる場合も順序が変わらないよう、最後に取引・移管の順で並べる
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT p.fund_id, p.quantity, p.trade_date, p.price, p.buy_cost
+		FROM `+sources+` p
+		ORDER BY p.fund_id, p.trade_date, `+lotTradeOrder()+`, p.is_transfer
+	`, args...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("取引の取得に失敗しました: %w", err)
+	}
+	defer rows.Close()
+
+	var lots []lot
+	var sales []lotSale
+	next := make(map[int]int) // ファンドごとに、次に売却を差し引くロットの lots 上の位置
+	for rows.Next() {
+		var fundID, quantity int
+		var tradeDate time.Time
+		var buyPrice, buyCost decimal.NullDecimal
+		if err := rows.Scan(&fundID, &quantity, &tradeDate, &buyPrice, &buyCost); err != nil {
+			return nil, nil, fmt.Errorf("取引行のスキャンに失敗しました: %w", err)
+		}
+		if quantity > 0 {
+			if _, ok := next[fundID]; !ok {
+				next[fundID] = len(lots)
+			}
+			l := lot{
+				FundID:      fundID,
+				TradeDate:   tradeDate,
+				Quantity:    quantity,
+				BuyPrice:    buyPrice.Decimal,
+				HasBuyPrice: buyCost.Valid,
+				BuyCost:     buyCost.Decimal,
+			}
+			// 移管は基準価額を持たないため、移管元での取得価額から基準価額あたりの取得単価を求める (基準価額の列と同じ小数桁数に丸める)
+			if !buyPrice.Valid && buyCost.Valid {
+				l.BuyPrice = buyCost.Decimal.Mul(unitPerPriceBase).Div(decimal.NewFromInt(int64(quantity))).Round(int32(priceScale))
+			}
+			lots = append(lots, l)
+			continue
+		}
+
+		// 売却分を古いロットから順に差し引く (取引はファンドごとにまとめて並んでいるので、lots の末尾までが同じファンド)
+		// 売却日の基準価額は、買付と同じく取引日の基準価額の列から取得している
+		sale := lotSale{FundID: fundID, TradeDate: tradeDate, SellPrice: buyPrice.Decimal, HasSellPrice: buyPrice.Valid, HasCost: true}
+		remaining := -quantity
+		i, ok := next[fundID]
+		for ok && i < len(lots) && remaining > 0 {
+			take := min(lots[i].Quantity, remaining)
+			sale.Cost = sale.Cost.Add(lots[i].cost(take))
+			lots[i].Quantity -= take
+			lots[i].SoldQuantity += take
+			remaining -= take
+			sale.Quantity += take
+			sale.HasCost = sale.HasCost && lots[i].HasBuyPrice
+			if lots[i].Quantity == 0 {
+				i++
+			}
+		}
+		if ok {
+			next[fundID] = i
+		}
+		if sale.Quantity > 0 {
+			sales = append(sales, sale)
+		}
+	}
+	return lots, sales, rows.Err()
+}
+
+// getRealizedGainsHandler: 指定した年に売却した分の実現損益をファンドごとに取得 (確定申告用)
+// 売却はロットと同じく先入先出で買付と突き合わせ、売却日の基準価額による売却金額から突き合わせた買付金額を引く
+// 売却日または突き合わせた買付日の基準価額が無い売却は、実現損益に含めず unpriced_sales として件数を返す
+func (s *Server) getRealizedGainsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID := vars["user_id"]
+
+	yearStr := r.URL.Query().Get("year")
+	if yearStr == "" {
+		writeJSONError(w, http.StatusBadRequest, "invalid_parameter", "year を YYYY 形式で指定してください。")
+		return
+	}
+	year, err := strconv.Atoi(yearStr)
+	if err != nil || len(yearStr) != 4 {
+		writeJSONError(w, http.StatusBadRequest, "invalid_date", "year のフォーマットが不正です。YYYY 形式を使用してください。")
+		return
+	}
+	yearEnd := time.Date(year, time.December, 31, 0, 0, 0, 0, appLocation)
+
+	// 前年以前の売却で差し引かれたロットを正しく反映するため、年末までの全ての取引を突き合わせる
+	_, sales, err := s.matchLots(r.Context(), userID, yearEnd)
+	if r.Context().Err() != nil {
+		slog.InfoContext(r.Context(), "クライアントが切断したため実現損益の計算を中断しました", "user_id", userID, "error", r.Context().Err())
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "実現損益の計算中にエラーが発生しました", "user_id", userID, "year", year, "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "db_error", "実現損益の計算に失敗しました。")
+		return
+	}
+
+	type fundTotals struct {
+		quantity int
+		proceeds decimal.Decimal
+		cost     decimal.Decimal
+		unpriced int
+	}
+	totals := make(map[int]*fundTotals)
+	var fundIDs []int
+	for _, sale := range sales {
+		if sale.TradeDate.Year() != year {
+			continue
+		}
+		t, ok := totals[sale.FundID]
+		if !ok {
+			t = &fundTotals{}
+			totals[sale.FundID] = t
+			fundIDs = append(fundIDs, sale.FundID)
+		}
+		if !sale.HasSellPrice || !sale.HasCost {
+			slog.WarnContext(r.Context(), "売却日の基準価額が無いため、実現損益に含めません。", "user_id", userID, "fund_id", sale.FundID, "date", sale.TradeDate.Format("2006-01-02"))
+			t.unpriced++
+			continue
+		}
+		t.quantity += sale.Quantity
+		t.proceeds = t.proceeds.Add(marketValue(sale.SellPrice, sale.Quantity))
+		t.cost = t.cost.Add(sale.Cost)
+	}
+	sort.Ints(fundIDs)
+
+	response := RealizedGainsResponse{Year: year, Funds: []FundRealizedGain{}}
+	for _, fundID := range fundIDs {
+		t := totals[fundID]
+		// 金額は10進数のまま集計し、レスポンスに含める時点で整数に切り捨てる
+		realizedPL := floorToInt64(t.proceeds.Sub(t.cost))
+		response.Funds = append(response.Funds, FundRealizedGain{
+			FundID:        fundID,
+			Quantity:      t.quantity,
+			Proceeds:      floorToInt64(t.proceeds),
+			Cost:          floorToInt64(t.cost),
+			RealizedPL:    realizedPL,
+			UnpricedSales: t.unpriced,
+		})
+		response.TotalRealizedPL += realizedPL
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// getTaxLotsCSVHandler: ユーザーのロットごとの取得単価・評価額・評価損益を CSV で返す
+// 対象は指定日時点で保有中のロットで、includeClosed=true を指定すると売却済みの部分も status=closed の行として含める
+// 売却済みの行は評価額・評価損益を空欄にする
+func (s *Server) getTaxLotsCSVHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID := vars["user_id"]
+
+	targetDate, err := s.resolveTargetDate(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_date", err.Error())
+		return
+	}
+	includeClosed, err := parseBoolParam(r, "includeClosed")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+
+	lots, err := s.reconstructLots(r.Context(), userID, targetDate)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "ロットの取得中にエラーが発生しました", "user_id", userID, "date", targetDate.Format("2006-01-02"), "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "db_error", "ロットの取得に失敗しました。")
+		return
+	}
+
+	// ファンドごとの評価日時点の基準価額 (見つからないファンドは評価額を空欄にする)
+	currentPrices := make(map[int]decimal.Decimal)
+	for _, l := range lots {
+		if _, ok := currentPrices[l.FundID]; ok || l.Quantity == 0 {
+			continue
+		}
+		price, err := s.latestPrice(r.Context(), l.FundID, targetDate, LATEST_PRICE_VERSION)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "現在価格の取得中にエラーが発生しました", "fund_id", l.FundID, "error", err)
+			writeJSONError(w, http.StatusInternalServerError, "db_error", "ロットの取得に失敗しました。")
+			return
+		}
+		currentPrices[l.FundID] = price
+	}
+
+	setAsOfDateHeader(w, targetDate)
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fmt.Sprintf("taxlots_%s_%s.csv", userID, targetDate.Format("20060102"))))
+
+	// unit_cost は買付時の基準価額 (基準価額あたりの口数ごとの取得単価)
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"fund_id", "buy_date", "status", "quantity", "unit_cost", "current_price", "current_value", "unrealized_pl"})
+	formatPrice := func(price decimal.Decimal, ok bool) string {
+		if !ok {
+			return ""
+		}
+		return price.String()
+	}
+	for _, l := range lots {
+		if l.Quantity > 0 {
+			price, hasPrice := currentPrices[l.FundID]
+			value, pl := "", ""
+			if hasPrice {
+				currentValue := marketValue(price, l.Quantity)
+				value = strconv.FormatInt(floorToInt64(currentValue), 10)
+				if l.HasBuyPrice {
+					pl = strconv.FormatInt(floorToInt64(currentValue.Sub(l.cost(l.Quantity))), 10)
+				}
+			}
+			cw.Write([]string{
+				strconv.Itoa(l.FundID), l.TradeDate.Format("2006-01-02"), "open", strconv.Itoa(l.Quantity),
+				formatPrice(l.BuyPrice, l.HasBuyPrice), formatPrice(price, hasPrice), value, pl,
+			})
+		}
+		if includeClosed && l.SoldQuantity > 0 {
+			cw.Write([]string{
+				strconv.Itoa(l.FundID), l.TradeDate.Format("2006-01-02"), "closed", strconv.Itoa(l.SoldQuantity),
+				formatPrice(l.BuyPrice, l.HasBuyPrice), "", "", "",
+			})
+		}
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		slog.ErrorContext(r.Context(), "ロットの CSV の書き込み中にエラーが発生しました", "user_id", userID, "error", err)
+	}
+}
+
+// lotTradeOrder: 先入先出の突き合わせで、同じ日の取引を並べる ORDER BY 句 (trade_date の後に続ける部分)
+// 結果が毎回同じになるよう、最後は必ず id で順序を確定させる
+func lotTradeOrder() string {
+	switch lotSameDayOrder {
+	case LOT_ORDER_SELLS_FIRST:
+		return "quantity ASC, id"
+	case LOT_ORDER_INSERTION:
+		return "id"
+	default:
+		return "quantity DESC, id"
+	}
+}
+
+// averageEntryDate: ロットの買付日を口数で加重平均した日付 (最も近い日に丸める) を YYYY-MM-DD で返す
+// 保有中のロットが無い場合は空文字を返す
+func averageEntryDate(lots []lot) string {
+	var totalQuantity, weightedDays float64
+	for _, l := range lots {
+		days := float64(l.TradeDate.Unix() / 86400) // 1970-01-01 からの日数
+		weightedDays += days * float64(l.Quantity)
+		totalQuantity += float64(l.Quantity)
+	}
+	if totalQuantity == 0 {
+		return ""
+	}
+	avgDays := int64(math.Round(weightedDays / totalQuantity))
+	return time.Unix(avgDays*86400, 0).UTC().Format("2006-01-02")
+}
+
+// getAssetsBatchHandler: 複数ユーザーの資産評価額と評価損益をまとめて取得
+// ユーザーごとの計算は並行して行うが、同時実行数は batchMaxWorkers で制限し
+// DBコネクションプールを使い切らないようにする
+func (s *Server) getAssetsBatchHandler(w http.ResponseWriter, r *http.Request) {
+	var req AssetsBatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyDecodeError(w, err)
+		return
+	}
+	if len(req.UserIDs) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "invalid_parameter", "user_ids を1件以上指定してください。")
+		return
+	}
+	// user_id をパスで受け取るルートと同じく、不正な user_id で DB へ問い合わせない
+	for _, userID := range req.UserIDs {
+		if err := validateUserID(userID); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+			return
+		}
+	}
+
+	var targetDate time.Time
+	if req.Date != "" {
+		parsedDate, err := time.Parse("2006-01-02", req.Date)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_date", "日付フォーマットが不正です。YYYY-MM-DD 形式を使用してください。")
+			return
+		}
+		targetDate = parsedDate
+	} else {
+		targetDate = today()
+	}
+
+	results := make([]UserAssetData, len(req.UserIDs))
+	errs := make([]error, len(req.UserIDs))
+	ctx, cancel := queryContext(r)
+	defer cancel()
+
+	// セマフォで同時に計算するユーザー数を制限する
+	sem := make(chan struct{}, s.batchMaxWorkers())
+	var wg sync.WaitGroup
+	for i, userID := range req.UserIDs {
+		// クライアントが切断した場合は残りのユーザーの計算を始めない
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, userID string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			assets, err := s.computeAssets(ctx, userID, targetDate, LATEST_PRICE_VERSION, nil)
+			if err != nil {
+				errs[i] = fmt.Errorf("ユーザー %s: %w", userID, err)
+				return
+			}
+			results[i] = UserAssetData{
+				UserID:       userID,
+				CurrentValue: assets.CurrentValue,
+				CurrentPL:    assets.CurrentPL,
+			}
+		}(i, userID)
+	}
+	wg.Wait()
+
+	if writeQueryTimeout(w, ctx) {
+		return
+	}
+	if ctx.Err() != nil {
+		slog.InfoContext(r.Context(), "クライアントが切断したため一括資産計算を中断しました", "date", targetDate.Format("2006-01-02"), "error", ctx.Err())
+		return
+	}
+	for _, err := range errs {
+		if errors.Is(err, errOversell) {
+			writeJSONError(w, http.StatusUnprocessableEntity, "oversell", err.Error())
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "一括資産計算中にエラーが発生しました", "date", targetDate.Format("2006-01-02"), "error", err)
+			writeJSONError(w, http.StatusInternalServerError, "db_error", "資産データの取得に失敗しました。")
+			return
+		}
+	}
+
+	setAsOfDateHeader(w, targetDate)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AssetsBatchResponse{
+		Date:    targetDate.Format("2006-01-02"),
+		Results: results,
+	})
+}
+
+// batchMaxWorkers: 一括評価の同時実行数を返す
+// ASSETS_BATCH_MAX_WORKERS が指定されていればそれを使い、
+// 未指定ならDBコネクションプールの最大接続数 (DB_MAX_OPEN_CONNS) の半分 (最低1) にする
+// 一括評価だけでプールを使い切ると、他のリクエストが接続を待ち続けるため
+func (s *Server) batchMaxWorkers() int {
+	if assetsBatchMaxWorkers > 0 {
+		return assetsBatchMaxWorkers
+	}
+	if maxOpen := s.db.Stats().MaxOpenConnections; maxOpen > 0 {
+		return max(maxOpen/2, 1)
+	}
+	return DEFAULT_BATCH_MAX_WORKERS
+}
+
+// getAssetsByYearHandler: Step 6 - ユーザーの資産評価額・評価損益を年ごとに取得
+func (s *Server) getAssetsByYearHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID := vars["user_id"]
+
+	// explain=true の場合、年ごとにファンド別の内訳を含める
+	explain, err := parseBoolParam(r, "explain")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+
+	// 評価日を取得（取引の絞り込みと基準価額の取得に使用）
+	// date を指定すると過去の時点の年別資産を再現できる (未指定の場合は今日。anchor も /{user_id}/assets と同じく使える)
+	currentDate, err := s.resolveTargetDate(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_date", err.Error())
+		return
+	}
+	currentDateStr := currentDate.Format("2006-01-02")
+
+	setAsOfDateHeader(w, currentDate)
+
+	// 前回のレスポンス以降に新しいデータがインポートされていなければ再計算しない
+	if s.handleNotModified(w, r, currentDate) {
+		return
+	}
+
+	// 買付年、ファンドIDごとの総保有口数と、買付 (口数がプラスの取引と移管) の口数・金額を取得
+	// current_value, current_pl の計算は Go側で行うため、買付時の情報のみ取得
+	// 対象の取引と移管は /{user_id}/assets と同じ positionSourcesQuery で取得し、移管は移管日の年に含める
+	ctx, cancel := queryContext(r)
+	defer cancel()
+	sources, args := positionSourcesQuery(userID, currentDate, LATEST_PRICE_VERSION) // 評価日までの取引を対象
+	started := time.Now()
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT
+			YEAR(p.trade_date) AS trade_year,
+			p.fund_id,
+			SUM(p.quantity) AS total_quantity,
+			SUM(CASE WHEN p.quantity > 0 THEN p.quantity ELSE 0 END) AS bought_quantity,
+			SUM(CASE WHEN p.quantity > 0 THEN p.buy_cost ELSE 0 END) AS bought_cost
+		FROM `+sources+` p
+		WHERE
+			-- 取引日の基準価額が無い買付は除き、売却は基準価額が無くても保有口数から差し引く
+			p.quantity <= 0 OR p.buy_cost IS NOT NULL
+		GROUP BY
+			trade_year, p.fund_id
+		HAVING
+			total_quantity > 0; -- 1口以上の残高をもつ銘柄
+	`, args...)
+	observeDBQuery("yearly_positions", started)
+	if writeQueryTimeout(w, ctx) {
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "年別資産取得中にエラーが発生しました", "user_id", userID, "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "db_error", "年別資産データの取得に失敗しました。")
+		return
+	}
+	defer rows.Close()
+
+	// 基準価額は全ファンド分をまとめて取得するため、先に買付年・ファンドごとの行を読み込む
+	type yearlyPosition struct {
+		tradeYear      int
+		fundID         int
+		totalQuantity  int
+		boughtQuantity int
+		boughtCost     decimal.Decimal
+	}
+	var positions []yearlyPosition
+	var fundIDs []int
+	seenFunds := make(map[int]bool)
+	for rows.Next() {
+		var pos yearlyPosition
+		err := rows.Scan(&pos.tradeYear, &pos.fundID, &pos.totalQuantity, &pos.boughtQuantity, &pos.boughtCost)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "年別資産行のスキャン中にエラーが発生しました", "error", err)
+			continue
+		}
+		positions = append(positions, pos)
+		if !seenFunds[pos.fundID] {
+			seenFunds[pos.fundID] = true
+			fundIDs = append(fundIDs, pos.fundID)
+		}
+	}
+	if rows.Err() != nil {
+		slog.ErrorContext(r.Context(), "年別資産の行イテレーション中にエラーが発生しました", "error", rows.Err())
+	}
+	rows.Close()
+
+	// 評価日時点の基準価額を、/{user_id}/assets と同じく1回のクエリで取得する
+	// 行の読み込み中にタイムアウトした場合もここで 504 を返し、一部の年・ファンドが欠けた結果を返さない
+	currentPrices, err := s.latestPrices(ctx, fundIDs, currentDate, LATEST_PRICE_VERSION)
+	if writeQueryTimeout(w, ctx) {
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "現在価格の取得中にエラーが発生しました (年別資産)", "user_id", userID, "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "db_error", "年別資産データの取得に失敗しました。")
+		return
+	}
+
+	// 年ごとの集計マップ
+	// Key: 年 (int), Value: その年の合計評価額と合計買付金額
+	// さらに、その年に購入したファンドごとの保有口数と買付コストを保持する
+	yearlySummary := make(map[int]valuationTotals)
+	yearlyDetails := make(map[int][]YearlyFundDetail) // explain=true の場合のみ使用
+
+	for _, pos := range positions {
+		current, ok := currentPrices[pos.fundID]
+		if !ok {
+			slog.WarnContext(r.Context(), "現在の参照価格が見つかりません。年別計算をスキップします。", "fund_id", pos.fundID, "date", currentDateStr)
+			continue
+		}
+		currentPrice := current.Price
+
+		// その年の売却は /{user_id}/assets と同じく総平均法の平均取得単価で差し引く
+		totalBuyCost := averageCostBasis(pos.boughtQuantity, pos.boughtCost, pos.totalQuantity)
+
+		// 資産評価額 (その買付年の口数のみで計算)
+		currentValueForFund := marketValue(currentPrice, pos.totalQuantity)
+
+		// マップの値を更新
+		data := yearlySummary[pos.tradeYear]
+		data.add(currentValueForFund, totalBuyCost)
+		yearlySummary[pos.tradeYear] = data
+
+		if explain {
+			yearlyDetails[pos.tradeYear] = append(yearlyDetails[pos.tradeYear], YearlyFundDetail{
+				FundID:       pos.fundID,
+				Quantity:     pos.totalQuantity,
+				CurrentPrice: currentPrice.String(),
+				BuyCost:      totalBuyCost.String(),
+				CurrentValue: currentValueForFund.String(),
+			})
+		}
+	}
+	// 結果をAssetsByYearResponseの形式に変換
+	// 取引が無いユーザーでも assets が null ではなく [] になるよう、空のスライスで初期化する
+	yearlyAssets := []YearlyAsset{}
+	for year, data := range yearlySummary {
+		currentValue, currentPL := data.result()
+		details := yearlyDetails[year]
+		sort.Slice(details, func(i, j int) bool {
+			return details[i].FundID < details[j].FundID
+		})
+		yearlyAssets = append(yearlyAssets, YearlyAsset{
+			Year:         year,
+			CurrentValue: currentValue,
+			CurrentPL:    currentPL,
+			Funds:        details,
+		})
+	}
+
+	// Yearの降順でソート
+	sort.Slice(yearlyAssets, func(i, j int) bool {
 		return yearlyAssets[i].Year > yearlyAssets[j].Year
 	})
 
+	yearlyAssets, truncated := truncateResponse(w, yearlyAssets)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AssetsByYearResponse{
+		Date:      currentDateStr,
+		Assets:    yearlyAssets,
+		Truncated: truncated,
+	})
+}
+
+// getPositionsHandler: ユーザーのファンドごとの正味の保有口数を取得 (オプションの日付パラメータあり)
+// 基準価額は参照しないため、価格データが欠けていても保有口数を確認できる
+// includeClosed=true を指定すると、保有口数が0のファンドも含める
+// 保有口数がマイナスのファンドは OVERSELL_MODE に従って扱う
+func (s *Server) getPositionsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID := vars["user_id"]
+
+	targetDate, err := s.resolveTargetDate(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_date", err.Error())
+		return
+	}
+
+	includeClosed, err := parseBoolParam(r, "includeClosed")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+	page, err := parsePagination(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+
+	query := `
+		SELECT
+			fund_id,
+			SUM(quantity) AS net_quantity
+		FROM
+			trade_histories
+		WHERE
+			user_id = ? AND trade_date <= ?
+		GROUP BY
+			fund_id`
+	if !includeClosed {
+		// 保有口数を超える売却は OVERSELL_MODE に従って扱うため、マイナスのものも取得する
+		query += `
+		HAVING
+			net_quantity <> 0`
+	}
+	query += `
+		ORDER BY
+			fund_id`
+
+	ctx, cancel := queryContext(r)
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, query, userID, targetDate.Format("2006-01-02"))
+	if writeQueryTimeout(w, ctx) {
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "保有口数取得中にエラーが発生しました", "user_id", userID, "date", targetDate.Format("2006-01-02"), "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "db_error", "保有口数の取得に失敗しました。")
+		return
+	}
+	defer rows.Close()
+
+	var netPositions []NetPosition
+	for rows.Next() {
+		var pos NetPosition
+		if err := rows.Scan(&pos.FundID, &pos.NetQuantity); err != nil {
+			slog.ErrorContext(r.Context(), "保有口数行のスキャン中にエラーが発生しました", "error", err)
+			continue
+		}
+		netPositions = append(netPositions, pos)
+	}
+	if rows.Err() != nil {
+		slog.ErrorContext(r.Context(), "保有口数の行イテレーション中にエラーが発生しました", "error", rows.Err())
+	}
+	// resolveOversell は別のクエリを発行するため、接続を返してから呼び出す
+	rows.Close()
+	// 途中でタイムアウトした場合は、一部のファンドが欠けた結果を返さない
+	if writeQueryTimeout(w, ctx) {
+		return
+	}
+
+	positions := []NetPosition{}
+	for _, pos := range netPositions {
+		pos.NetQuantity, err = s.resolveOversell(ctx, userID, pos.FundID, pos.NetQuantity, targetDate)
+		if errors.Is(err, errOversell) {
+			writeJSONError(w, http.StatusUnprocessableEntity, "oversell", err.Error())
+			return
+		}
+		if writeQueryTimeout(w, ctx) {
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "保有口数の確認中にエラーが発生しました", "user_id", userID, "date", targetDate.Format("2006-01-02"), "error", err)
+			writeJSONError(w, http.StatusInternalServerError, "db_error", "保有口数の取得に失敗しました。")
+			return
+		}
+		if !includeClosed && pos.NetQuantity == 0 {
+			continue
+		}
+		positions = append(positions, pos)
+	}
+
+	// 保有口数0に補正したファンドを除外した後でページングするため、SQL ではなくここで切り出す
+	positions = paginate(positions, page)
+	positions, truncated := truncateResponse(w, positions)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(PositionsResponse{
+		Date:      targetDate.Format("2006-01-02"),
+		Positions: positions,
+		Limit:     page.Limit,
+		Offset:    page.Offset,
+		Truncated: truncated,
+	})
+}
+
+// getAttributionHandler: 期間 (from, to] の評価損益の変化をファンドごとに分解して取得
+// ファンドごとの寄与は「to時点の評価損益 - from時点の評価損益」で、
+// 評価額の変化から期間中の正味の投資額 (買付金額 - 売却金額) を引いたものに等しい
+// 期間中の売却による実現損益もここに含まれる
+func (s *Server) getAttributionHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID := vars["user_id"]
+
+	from, to, err := parseDateRange(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_date", err.Error())
+		return
+	}
+
+	// 期間中に全て売却したファンドの損益も含めるため、保有口数0のファンドも対象にする
+	fromValuations, err := s.computeFundValuations(r.Context(), userID, from, true, LATEST_PRICE_VERSION)
+	if errors.Is(err, errOversell) {
+		writeJSONError(w, http.StatusUnprocessableEntity, "oversell", err.Error())
+		return
+	}
+	if r.Context().Err() != nil {
+		slog.InfoContext(r.Context(), "クライアントが切断したため損益寄与の計算を中断しました", "user_id", userID, "error", r.Context().Err())
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "損益寄与の計算中にエラーが発生しました", "user_id", userID, "date", from.Format("2006-01-02"), "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "db_error", "損益寄与の計算に失敗しました。")
+		return
+	}
+	toValuations, err := s.computeFundValuations(r.Context(), userID, to, true, LATEST_PRICE_VERSION)
+	if errors.Is(err, errOversell) {
+		writeJSONError(w, http.StatusUnprocessableEntity, "oversell", err.Error())
+		return
+	}
+	if r.Context().Err() != nil {
+		slog.InfoContext(r.Context(), "クライアントが切断したため損益寄与の計算を中断しました", "user_id", userID, "error", r.Context().Err())
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "損益寄与の計算中にエラーが発生しました", "user_id", userID, "date", to.Format("2006-01-02"), "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "db_error", "損益寄与の計算に失敗しました。")
+		return
+	}
+
+	fromByFund := make(map[int]fundValuation)
+	for _, v := range fromValuations {
+		fromByFund[v.FundID] = v
+	}
+
+	funds := []FundAttribution{}
+	var totalPLChange int64
+	for _, toVal := range toValuations {
+		// from時点で取引が無いファンドは評価額・買付金額ともに0として扱う
+		fromVal := fromByFund[toVal.FundID]
+		valueChange := toVal.CurrentValue.Sub(fromVal.CurrentValue)
+		// 売却による実現損益も含めるため、保有口数に対する買付金額ではなく正味の投資額の変化を使う
+		netInvestment := toVal.NetInvested.Sub(fromVal.NetInvested)
+		plChange := floorToInt64(valueChange.Sub(netInvestment))
+
+		funds = append(funds, FundAttribution{
+			FundID:        toVal.FundID,
+			ValueChange:   floorToInt64(valueChange),
+			NetInvestment: floorToInt64(netInvestment),
+			PLChange:      plChange,
+		})
+		totalPLChange += plChange
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AttributionResponse{
+		From:          from.Format("2006-01-02"),
+		To:            to.Format("2006-01-02"),
+		TotalPLChange: totalPLChange,
+		Funds:         funds,
+	})
+}
+
+// getAssetsHistoryHandler: 期間中の日ごとの資産評価額と評価損益を取得 (グラフ表示用)
+// changesOnly=true の場合は、前日から評価額・評価損益のどちらも変わらない日を省略する (最初と最後の日は常に返す)
+func (s *Server) getAssetsHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID := vars["user_id"]
+
+	from, to, err := parseDateRange(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_date", err.Error())
+		return
+	}
+	if to.Sub(from) >= HISTORY_MAX_RANGE_DAYS*24*time.Hour {
+		writeJSONError(w, http.StatusBadRequest, "invalid_parameter", fmt.Sprintf("期間は %d 日以内で指定してください。", HISTORY_MAX_RANGE_DAYS))
+		return
+	}
+	changesOnly, err := parseBoolParam(r, "changesOnly")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+
+	history, err := s.assetsHistory(r.Context(), userID, from, to)
+	if errors.Is(err, errOversell) {
+		writeJSONError(w, http.StatusUnprocessableEntity, "oversell", err.Error())
+		return
+	}
+	if r.Context().Err() != nil {
+		slog.InfoContext(r.Context(), "クライアントが切断したため資産推移の計算を中断しました", "user_id", userID, "error", r.Context().Err())
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "資産推移の計算中にエラーが発生しました", "user_id", userID, "from", from.Format("2006-01-02"), "to", to.Format("2006-01-02"), "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "db_error", "資産推移の取得に失敗しました。")
+		return
+	}
+	if changesOnly {
+		history = changedHistoryPoints(history)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
+
+// assetsHistory: from から to まで (両端を含む) の日ごとの資産評価額と評価損益を計算する
+// 各日の値は /{user_id}/assets と同じ computeAssets で計算する
+func (s *Server) assetsHistory(ctx context.Context, userID string, from time.Time, to time.Time) ([]AssetHistoryPoint, error) {
+	history := []AssetHistoryPoint{}
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		assets, err := s.computeAssets(ctx, userID, day, LATEST_PRICE_VERSION, nil)
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, AssetHistoryPoint{
+			Date:         assets.Date,
+			CurrentValue: assets.CurrentValue,
+			CurrentPL:    assets.CurrentPL,
+		})
+	}
+	return history, nil
+}
+
+// changedHistoryPoints: 前の日から評価額・評価損益のどちらかが変わった日だけを残す
+// 値が変わらない期間でもグラフの両端が欠けないよう、最初と最後の日は常に残す
+func changedHistoryPoints(history []AssetHistoryPoint) []AssetHistoryPoint {
+	changed := []AssetHistoryPoint{}
+	for i, p := range history {
+		if i == 0 || i == len(history)-1 {
+			changed = append(changed, p)
+			continue
+		}
+		prev := history[i-1]
+		if p.CurrentValue != prev.CurrentValue || p.CurrentPL != prev.CurrentPL {
+			changed = append(changed, p)
+		}
+	}
+	return changed
+}
+
+// getDrawdownHandler: 期間中で資産評価額が前日から最も大きく下落した日と下落額を取得
+// 下落額は前日の評価額からの減少額で、入出金 (買付・売却) による増減も含む
+func (s *Server) getDrawdownHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID := vars["user_id"]
+
+	from, to, err := parseDateRange(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_date", err.Error())
+		return
+	}
+	if to.Sub(from) >= HISTORY_MAX_RANGE_DAYS*24*time.Hour {
+		writeJSONError(w, http.StatusBadRequest, "invalid_parameter", fmt.Sprintf("期間は %d 日以内で指定してください。", HISTORY_MAX_RANGE_DAYS))
+		return
+	}
+
+	history, err := s.assetsHistory(r.Context(), userID, from, to)
+	if errors.Is(err, errOversell) {
+		writeJSONError(w, http.StatusUnprocessableEntity, "oversell", err.Error())
+		return
+	}
+	if r.Context().Err() != nil {
+		slog.InfoContext(r.Context(), "クライアントが切断したため最大下落日の計算を中断しました", "user_id", userID, "error", r.Context().Err())
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "最大下落日の計算中にエラーが発生しました", "user_id", userID, "from", from.Format("2006-01-02"), "to", to.Format("2006-01-02"), "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "db_error", "最大下落日の計算に失敗しました。")
+		return
+	}
+
+	response := DrawdownResponse{
+		From: from.Format("2006-01-02"),
+		To:   to.Format("2006-01-02"),
+	}
+	// 前日からの下落額が最も大きい日を探す (同額の場合は先の日を採用する)
+	for i := 1; i < len(history); i++ {
+		prev := history[i-1]
+		decline := prev.CurrentValue - history[i].CurrentValue
+		if decline <= response.Amount {
+			continue
+		}
+		response.Date = history[i].Date
+		response.Amount = decline
+		response.Percent = nil
+		// 前日の評価額が0の場合は下落率を計算できないため省略する
+		if prev.CurrentValue > 0 {
+			percent := float64(decline) / float64(prev.CurrentValue) * 100
+			response.Percent = &percent
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// getDCAHandler: 積立 (定期的な買付) の分析として、ファンドの買付回数・平均の買付間隔・平均取得単価を取得
+// 平均取得単価 (口数で加重平均した買付時の基準価額) を、最初の買付日から最後の買付日までの基準価額の単純平均と比べる
+// 平均取得単価の方が低ければ、積立によって単純平均より安く買えていることになる
+func (s *Server) getDCAHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID := vars["user_id"]
+	fundID, err := strconv.Atoi(vars["fund_id"])
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_parameter", "fund_id には整数を指定してください。")
+		return
+	}
+
+	// price が NULL の行は、0円ではなく基準価額が無いものとして扱う
+	rows, err := s.db.QueryContext(r.Context(), `
+		SELECT th.quantity, th.trade_date, rp.price
+		FROM trade_histories th
+		LEFT JOIN reference_prices rp ON th.fund_id = rp.fund_id AND th.trade_date = rp.price_date AND rp.price IS NOT NULL
+		WHERE th.user_id = ? AND th.fund_id = ? AND th.quantity > 0
+		ORDER BY th.trade_date, th.id
+	`, userID, fundID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "買付の取得中にエラーが発生しました", "user_id", userID, "fund_id", fundID, "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "db_error", "積立の分析に失敗しました。")
+		return
+	}
+	defer rows.Close()
+
+	response := DCAResponse{FundID: fundID}
+	var buyDates []time.Time
+	var pricedQuantity int
+	pricedCost := decimal.Zero // 口数 * 基準価額 の合計 (基準価額あたりの口数では割らない)
+	for rows.Next() {
+		var quantity int
+		var tradeDate time.Time
+		var price decimal.NullDecimal
+		if err := rows.Scan(&quantity, &tradeDate, &price); err != nil {
+			slog.ErrorContext(r.Context(), "買付行のスキャン中にエラーが発生しました", "error", err)
+			continue
+		}
+		response.BuyCount++
+		// 同じ日の複数の買付は、買付間隔の計算では1回として数える
+		if len(buyDates) == 0 || !buyDates[len(buyDates)-1].Equal(tradeDate) {
+			buyDates = append(buyDates, tradeDate)
+		}
+		if !price.Valid {
+			response.UnpricedBuys++
+			continue
+		}
+		pricedQuantity += quantity
+		pricedCost = pricedCost.Add(price.Decimal.Mul(decimal.NewFromInt(int64(quantity))))
+	}
+	if r.Context().Err() != nil {
+		slog.InfoContext(r.Context(), "クライアントが切断したため積立の分析を中断しました", "user_id", userID, "error", r.Context().Err())
+		return
+	}
+	if rows.Err() != nil {
+		slog.ErrorContext(r.Context(), "買付の行イテレーション中にエラーが発生しました", "error", rows.Err())
+	}
+
+	if len(buyDates) > 0 {
+		first, last := buyDates[0], buyDates[len(buyDates)-1]
+		response.FirstBuyDate = first.Format("2006-01-02")
+		response.LastBuyDate = last.Format("2006-01-02")
+		if len(buyDates) > 1 {
+			interval := last.Sub(first).Hours() / 24 / float64(len(buyDates)-1)
+			response.AverageIntervalDays = &interval
+		}
+		var averageBuyPrice decimal.Decimal
+		if pricedQuantity > 0 {
+			averageBuyPrice = pricedCost.Div(decimal.NewFromInt(int64(pricedQuantity)))
+			v := averageBuyPrice.InexactFloat64()
+			response.AverageBuyPrice = &v
+		}
+
+		var periodAverage decimal.NullDecimal
+		err = s.db.QueryRowContext(r.Context(), `
+			SELECT AVG(price) FROM reference_prices
+			WHERE fund_id = ? AND price_date BETWEEN ? AND ? AND price IS NOT NULL
+		`, fundID, first.Format("2006-01-02"), last.Format("2006-01-02")).Scan(&periodAverage)
+		if r.Context().Err() != nil {
+			slog.InfoContext(r.Context(), "クライアントが切断したため積立の分析を中断しました", "user_id", userID, "error", r.Context().Err())
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "期間中の平均基準価額の取得中にエラーが発生しました", "fund_id", fundID, "error", err)
+			writeJSONError(w, http.StatusInternalServerError, "db_error", "積立の分析に失敗しました。")
+			return
+		}
+		if periodAverage.Valid {
+			v := periodAverage.Decimal.InexactFloat64()
+			response.PeriodAveragePrice = &v
+			if response.AverageBuyPrice != nil && periodAverage.Decimal.IsPositive() {
+				diff := averageBuyPrice.Sub(periodAverage.Decimal).Div(periodAverage.Decimal).Mul(decimal.NewFromInt(100)).InexactFloat64()
+				response.DifferencePercent = &diff
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// getCostBasisHandler: ファンドの保有口数・買付金額・平均取得単価と、その計算に使った買付の一覧を返す
+// computeFundValuations と同じく、買付日の基準価額がある取引と移管を対象に総平均法で計算する
+// (買付日の基準価額が無い買付は、/{user_id}/assets と同じく保有口数にも含めない。売却は基準価額が無くても差し引く)
+// 評価日 (date, 未指定の場合は今日) 時点で保有口数が無い場合は 404 を返す
+func (s *Server) getCostBasisHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID := vars["user_id"]
+	fundID, err := strconv.Atoi(vars["fund_id"])
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_parameter", "fund_id には整数を指定してください。")
+		return
+	}
+	targetDate, err := s.resolveTargetDate(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_date", err.Error())
+		return
+	}
+
+	// 取引と移管を日付順に並べる (同じ日は取引を先にする)
+	rows, err := s.db.QueryContext(r.Context(), `
+		SELECT th.trade_date, 'trade' AS source, th.quantity, rp.price, NULL AS cost_basis, rp.price IS NOT NULL AS has_price
+		FROM trade_histories th
+		LEFT JOIN reference_prices rp ON th.fund_id = rp.fund_id AND th.trade_date = rp.price_date
+		WHERE th.user_id = ? AND th.fund_id = ? AND th.trade_date <= ?
+		UNION ALL
+		SELECT transfer_date, 'transfer', quantity, NULL, cost_basis, TRUE
+		FROM transfers
+		WHERE user_id = ? AND fund_id = ? AND transfer_date <= ?
+		ORDER BY 1, 2
+	`, userID, fundID, targetDate.Format("2006-01-02"), userID, fundID, targetDate.Format("2006-01-02"))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "取引の取得中にエラーが発生しました", "user_id", userID, "fund_id", fundID, "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "db_error", "買付金額の内訳の取得に失敗しました。")
+		return
+	}
+	defer rows.Close()
+
+	response := CostBasisResponse{FundID: fundID, Date: targetDate.Format("2006-01-02"), Buys: []CostBasisBuy{}}
+	var boughtQuantity int
+	boughtCost := decimal.Zero
+	for rows.Next() {
+		var tradeDate time.Time
+		var source string
+		var quantity int
+		var price, costBasis decimal.NullDecimal
+		var hasPrice bool
+		if err := rows.Scan(&tradeDate, &source, &quantity, &price, &costBasis, &hasPrice); err != nil {
+			slog.ErrorContext(r.Context(), "取引行のスキャン中にエラーが発生しました", "error", err)
+			continue
+		}
+		// 売却は基準価額が無くても保有口数から差し引く
+		if !hasPrice && quantity > 0 {
+			response.UnpricedBuys++
+			continue
+		}
+		response.TotalQuantity += quantity
+		if quantity <= 0 {
+			continue
+		}
+
+		buy := CostBasisBuy{Date: tradeDate.Format("2006-01-02"), Source: source, Quantity: quantity}
+		cost := costBasis.Decimal
+		if price.Valid {
+			cost = marketValue(price.Decimal, quantity)
+			p := price.Decimal.InexactFloat64()
+			buy.Price = &p
+		}
+		buy.Cost = cost.InexactFloat64()
+		boughtQuantity += quantity
+		boughtCost = boughtCost.Add(cost)
+		response.Buys = append(response.Buys, buy)
+	}
+	if r.Context().Err() != nil {
+		slog.InfoContext(r.Context(), "クライアントが切断したため買付金額の内訳の取得を中断しました", "user_id", userID, "error", r.Context().Err())
+		return
+	}
+	if rows.Err() != nil {
+		slog.ErrorContext(r.Context(), "取引の行イテレーション中にエラーが発生しました", "error", rows.Err())
+	}
+
+	if response.TotalQuantity <= 0 {
+		writeJSONError(w, http.StatusNotFound, "not_found", fmt.Sprintf("ユーザー %s はファンドID %d を保有していません。", userID, fundID))
+		return
+	}
+	response.TotalBuyCost = floorToInt64(averageCostBasis(boughtQuantity, boughtCost, response.TotalQuantity))
+	if boughtQuantity > 0 {
+		response.AverageUnitCost = boughtCost.Mul(unitPerPriceBase).Div(decimal.NewFromInt(int64(boughtQuantity))).InexactFloat64()
+	}
+
+	setAsOfDateHeader(w, targetDate)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// getDormantFundsHandler: 基準価額があるか過去に取引されたファンドのうち、
+// 評価日時点で保有口数が1口以上のユーザーが1人もいないファンドの一覧を取得
+// 不要になった基準価額の配信を止める判断に使う
+func (s *Server) getDormantFundsHandler(w http.ResponseWriter, r *http.Request) {
+	targetDate, err := s.resolveTargetDate(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_date", err.Error())
+		return
+	}
+	dateStr := targetDate.Format("2006-01-02")
+
+	ctx, cancel := queryContext(r)
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT
+			f.fund_id,
+			EXISTS (
+				SELECT 1 FROM trade_histories t
+				WHERE t.fund_id = f.fund_id AND t.trade_date <= ?
+			) AS ever_traded
+		FROM
+			(SELECT fund_id FROM reference_prices UNION SELECT fund_id FROM trade_histories) f
+		WHERE
+			-- 評価日時点で正味の保有口数が1口以上のユーザーが存在しない
+			NOT EXISTS (
+				SELECT 1 FROM trade_histories th
+				WHERE th.fund_id = f.fund_id AND th.trade_date <= ?
+				GROUP BY th.user_id
+				HAVING SUM(th.quantity) > 0
+			)
+		ORDER BY
+			f.fund_id
+	`, dateStr, dateStr)
+	if writeQueryTimeout(w, ctx) {
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "保有者のいないファンドの取得中にエラーが発生しました", "date", dateStr, "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "db_error", "保有者のいないファンドの取得に失敗しました。")
+		return
+	}
+	defer rows.Close()
+
+	funds := []DormantFund{}
+	for rows.Next() {
+		var fund DormantFund
+		if err := rows.Scan(&fund.FundID, &fund.EverTraded); err != nil {
+			slog.ErrorContext(r.Context(), "ファンド行のスキャン中にエラーが発生しました", "error", err)
+			continue
+		}
+		funds = append(funds, fund)
+	}
+	if rows.Err() != nil {
+		slog.ErrorContext(r.Context(), "ファンドの行イテレーション中にエラーが発生しました", "error", rows.Err())
+	}
+	if writeQueryTimeout(w, ctx) {
+		return
+	}
+
+	funds, truncated := truncateResponse(w, funds)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(DormantFundsResponse{
+		Date:      dateStr,
+		Funds:     funds,
+		Truncated: truncated,
+	})
+}
+
+// getDBStatsHandler: コネクションプールの統計情報を返す (プールの設定値の調整用)
+func (s *Server) getDBStatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats := s.db.Stats()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(DBStatsResponse{
+		OpenConnections:    stats.OpenConnections,
+		InUse:              stats.InUse,
+		Idle:               stats.Idle,
+		WaitCount:          stats.WaitCount,
+		WaitDurationMs:     stats.WaitDuration.Milliseconds(),
+		MaxOpenConnections: stats.MaxOpenConnections,
+	})
+}
+
+// getActiveUsersHandler: 取引の件数 (by=trades, デフォルト) または取引のあった日数 (by=days) の多い順にユーザーを返す
+// from と to を指定するとその期間の取引だけを数える。件数は limit, offset で指定する
+func (s *Server) getActiveUsersHandler(w http.ResponseWriter, r *http.Request) {
+	page, err := parsePagination(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+
+	by := r.URL.Query().Get("by")
+	orderBy := "trade_count DESC, trade_days DESC"
+	switch by {
+	case "", "trades":
+		by = "trades"
+	case "days":
+		orderBy = "trade_days DESC, trade_count DESC"
+	default:
+		writeJSONError(w, http.StatusBadRequest, "invalid_parameter", "by には trades または days を指定してください。")
+		return
+	}
+
+	where := ""
+	args := []interface{}{}
+	resp := ActiveUsersResponse{By: by, Users: []ActiveUser{}, Limit: page.Limit, Offset: page.Offset}
+	if r.URL.Query().Get("from") != "" || r.URL.Query().Get("to") != "" {
+		from, to, err := parseDateRange(r)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_date", err.Error())
+			return
+		}
+		where = "WHERE trade_date BETWEEN ? AND ?"
+		args = append(args, from.Format("2006-01-02"), to.Format("2006-01-02"))
+		resp.From = from.Format("2006-01-02")
+		resp.To = to.Format("2006-01-02")
+	}
+	args = append(args, page.Limit, page.Offset)
+
+	ctx, cancel := queryContext(r)
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT
+			user_id,
+			COUNT(*) AS trade_count,
+			COUNT(DISTINCT trade_date) AS trade_days
+		FROM
+			trade_histories
+		`+where+`
+		GROUP BY
+			user_id
+		ORDER BY
+			`+orderBy+`, user_id
+		LIMIT ? OFFSET ?`, args...)
+	if writeQueryTimeout(w, ctx) {
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "取引の多いユーザーの取得中にエラーが発生しました", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "db_error", "ユーザーの一覧の取得に失敗しました。")
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var user ActiveUser
+		if err := rows.Scan(&user.UserID, &user.TradeCount, &user.TradeDays); err != nil {
+			slog.ErrorContext(r.Context(), "ユーザー行のスキャン中にエラーが発生しました", "error", err)
+			continue
+		}
+		resp.Users = append(resp.Users, user)
+	}
+	if rows.Err() != nil {
+		slog.ErrorContext(r.Context(), "ユーザーの行イテレーション中にエラーが発生しました", "error", rows.Err())
+	}
+	if writeQueryTimeout(w, ctx) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// getPriceGapsHandler: 期間 [from, to] のうち、ファンドの基準価額が存在しない日付を昇順で返す
+// weekdaysOnly=true を指定すると土日を除く (祝日は除かない)
+func (s *Server) getPriceGapsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	fundID, err := strconv.Atoi(vars["fund_id"])
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_parameter", "fund_id には整数を指定してください。")
+		return
+	}
+	from, to, err := parseDateRange(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_date", err.Error())
+		return
+	}
+	if to.Sub(from) > GAPS_MAX_RANGE_DAYS*24*time.Hour {
+		writeJSONError(w, http.StatusBadRequest, "invalid_parameter", fmt.Sprintf("期間は %d 日以内で指定してください。", GAPS_MAX_RANGE_DAYS))
+		return
+	}
+	weekdaysOnly, err := parseBoolParam(r, "weekdaysOnly")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+
+	ctx, cancel := queryContext(r)
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT price_date FROM reference_prices
+		WHERE fund_id = ? AND price_date BETWEEN ? AND ?
+	`, fundID, from.Format("2006-01-02"), to.Format("2006-01-02"))
+	if writeQueryTimeout(w, ctx) {
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "基準価額の日付の取得中にエラーが発生しました", "fund_id", fundID, "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "db_error", "基準価額の欠損日の取得に失敗しました。")
+		return
+	}
+	defer rows.Close()
+
+	priced := make(map[string]bool)
+	for rows.Next() {
+		var priceDate time.Time
+		if err := rows.Scan(&priceDate); err != nil {
+			slog.ErrorContext(r.Context(), "基準価額の日付行のスキャン中にエラーが発生しました", "error", err)
+			continue
+		}
+		priced[priceDate.Format("2006-01-02")] = true
+	}
+	if rows.Err() != nil {
+		slog.ErrorContext(r.Context(), "基準価額の日付の行イテレーション中にエラーが発生しました", "error", rows.Err())
+	}
+	if writeQueryTimeout(w, ctx) {
+		return
+	}
+
+	gaps := []string{}
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		if weekdaysOnly && (day.Weekday() == time.Saturday || day.Weekday() == time.Sunday) {
+			continue
+		}
+		if !priced[day.Format("2006-01-02")] {
+			gaps = append(gaps, day.Format("2006-01-02"))
+		}
+	}
+
+	count := len(gaps)
+	gaps, truncated := truncateResponse(w, gaps)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(PriceGapsResponse{
+		FundID:    fundID,
+		From:      from.Format("2006-01-02"),
+		To:        to.Format("2006-01-02"),
+		Count:     count,
+		Dates:     gaps,
+		Truncated: truncated,
+	})
+}
+
+// patchReferencePriceHandler: 特定のファンド・日付の基準価額だけを修正する
+// 該当する基準価額が存在しない場合は 404 を返す (新規の追加は行わない)
+// 修正は1件だけの基準価額のバージョンとして記録し、インポート時刻も更新して Last-Modified によるキャッシュを無効にする
+func (s *Server) patchReferencePriceHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	fundID, err := strconv.Atoi(vars["fund_id"])
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_parameter", "fund_id には整数を指定してください。")
+		return
+	}
+	priceDate, err := time.Parse("2006-01-02", vars["date"])
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_date", "日付フォーマットが不正です。YYYY-MM-DD 形式を使用してください。")
+		return
+	}
+
+	var req PriceUpdateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyDecodeError(w, err)
+		return
+	}
+	price, err := validatePrice(req.Price.String())
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+
+	ctx, cancel := queryContext(r)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		if writeQueryTimeout(w, ctx) {
+			return
+		}
+		slog.ErrorContext(r.Context(), "基準価額の更新のトランザクション開始に失敗しました", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "db_error", "基準価額の更新に失敗しました。")
+		return
+	}
+	defer tx.Rollback() // コミット後の Rollback は何もしない
+
+	// 行ロックを取って存在を確認する (同じ値で UPDATE した場合も 404 にならないよう、影響行数では判定しない)
+	var exists int
+	err = tx.QueryRowContext(ctx, "SELECT 1 FROM reference_prices WHERE fund_id = ? AND price_date = ? FOR UPDATE",
+		fundID, priceDate.Format("2006-01-02")).Scan(&exists)
+	if err == sql.ErrNoRows {
+		writeJSONError(w, http.StatusNotFound, "not_found", fmt.Sprintf("ファンドID %d の %s の基準価額は存在しません。", fundID, priceDate.Format("2006-01-02")))
+		return
+	}
+	if err != nil {
+		if writeQueryTimeout(w, ctx) {
+			return
+		}
+		slog.ErrorContext(r.Context(), "基準価額の確認中にエラーが発生しました", "fund_id", fundID, "date", priceDate.Format("2006-01-02"), "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "db_error", "基準価額の更新に失敗しました。")
+		return
+	}
+
+	priceVersion, err := updateReferencePrice(ctx, tx, fundID, priceDate, price)
+	if err != nil {
+		if writeQueryTimeout(w, ctx) {
+			return
+		}
+		slog.ErrorContext(r.Context(), "基準価額の更新中にエラーが発生しました", "fund_id", fundID, "date", priceDate.Format("2006-01-02"), "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "db_error", "基準価額の更新に失敗しました。")
+		return
+	}
+
+	var storedPrice string
+	err = tx.QueryRowContext(ctx, "SELECT price FROM reference_prices WHERE fund_id = ? AND price_date = ?",
+		fundID, priceDate.Format("2006-01-02")).Scan(&storedPrice)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		// コミットした後でタイムアウトしても 504 にしないよう、失敗した場合だけ確認する
+		if writeQueryTimeout(w, ctx) {
+			return
+		}
+		slog.ErrorContext(r.Context(), "基準価額の更新の確定に失敗しました", "fund_id", fundID, "date", priceDate.Format("2006-01-02"), "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "db_error", "基準価額の更新に失敗しました。")
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(AssetsByYearResponse{
-		Date:   currentDateStr,
-		Assets: yearlyAssets,
+	json.NewEncoder(w).Encode(ReferencePriceResponse{
+		FundID:       fundID,
+		PriceDate:    priceDate.Format("2006-01-02"),
+		Price:        storedPrice,
+		PriceVersion: priceVersion,
+	})
+}
+
+// createTradeHandler: ユーザーの取引を1件 trade_histories に登録し、登録した取引を 201 で返す
+// 取引日の基準価額が無い取引は評価損益の買付金額の計算から漏れるため、allowMissingPrice=true が無ければ 400 で拒否する
+func (s *Server) createTradeHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID := vars["user_id"]
+	allowMissingPrice, err := parseBoolParam(r, "allowMissingPrice")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+
+	var req CreateTradeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyDecodeError(w, err)
+		return
+	}
+	if req.FundID == nil || req.Quantity == nil || req.TradeDate == "" {
+		writeJSONError(w, http.StatusBadRequest, "invalid_parameter", "fund_id, quantity, trade_date を指定してください。")
+		return
+	}
+	if *req.Quantity == 0 {
+		writeJSONError(w, http.StatusBadRequest, "invalid_parameter", "quantity には0以外の整数を指定してください (マイナスの場合は売却)。")
+		return
+	}
+	tradeDate, err := time.Parse("2006-01-02", req.TradeDate)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_date", "trade_date のフォーマットが不正です。YYYY-MM-DD 形式を使用してください。")
+		return
+	}
+
+	ctx, cancel := queryContext(r)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		if writeQueryTimeout(w, ctx) {
+			return
+		}
+		slog.ErrorContext(r.Context(), "取引の登録のトランザクション開始に失敗しました", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "db_error", "取引の登録に失敗しました。")
+		return
+	}
+	defer tx.Rollback() // コミット後の Rollback は何もしない
+
+	if !allowMissingPrice {
+		var priced bool
+		err = tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM reference_prices WHERE fund_id = ? AND price_date = ?)",
+			*req.FundID, tradeDate.Format("2006-01-02")).Scan(&priced)
+		if err != nil {
+			if writeQueryTimeout(w, ctx) {
+				return
+			}
+			slog.ErrorContext(r.Context(), "基準価額の確認中にエラーが発生しました", "fund_id", *req.FundID, "date", tradeDate.Format("2006-01-02"), "error", err)
+			writeJSONError(w, http.StatusInternalServerError, "db_error", "取引の登録に失敗しました。")
+			return
+		}
+		if !priced {
+			writeJSONError(w, http.StatusBadRequest, "missing_price",
+				fmt.Sprintf("ファンドID %d の %s の基準価額が存在しません。基準価額が無いまま登録する場合は allowMissingPrice=true を指定してください。", *req.FundID, tradeDate.Format("2006-01-02")))
+			return
+		}
+	}
+
+	result, err := tx.ExecContext(ctx, "INSERT INTO trade_histories (user_id, fund_id, quantity, trade_date) VALUES (?, ?, ?, ?)",
+		userID, *req.FundID, *req.Quantity, tradeDate.Format("2006-01-02"))
+	var id int64
+	if err == nil {
+		id, err = result.LastInsertId()
+	}
+	if err == nil {
+		// Last-Modified による 304 で登録前の評価額が返されないよう、インポート時刻を更新する
+		err = recordImportTime(tx, "trade_histories")
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		// コミットした後でタイムアウトしても 504 にしないよう、失敗した場合だけ確認する
+		if writeQueryTimeout(w, ctx) {
+			return
+		}
+		slog.ErrorContext(r.Context(), "取引の登録中にエラーが発生しました", "user_id", userID, "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "db_error", "取引の登録に失敗しました。")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(CreatedTradeResponse{
+		ID:        id,
+		UserID:    userID,
+		FundID:    *req.FundID,
+		Quantity:  *req.Quantity,
+		TradeDate: tradeDate.Format("2006-01-02"),
+	})
+}
+
+// upsertPriceHandler: 特定のファンド・日付の基準価額を登録し、既にある場合は上書きする
+// CSV を再インポートせずに日中の基準価額の訂正を反映するためのもの。PATCH と同様に1件だけの基準価額のバージョンとして記録する
+func (s *Server) upsertPriceHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	fundID, err := strconv.Atoi(vars["fund_id"])
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_parameter", "fund_id には整数を指定してください。")
+		return
+	}
+
+	var req PriceUpsertRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyDecodeError(w, err)
+		return
+	}
+	price, err := validatePrice(req.Price.String())
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+	priceDate, err := time.Parse("2006-01-02", req.PriceDate)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_date", "price_date のフォーマットが不正です。YYYY-MM-DD 形式を使用してください。")
+		return
+	}
+
+	ctx, cancel := queryContext(r)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		if writeQueryTimeout(w, ctx) {
+			return
+		}
+		slog.ErrorContext(r.Context(), "基準価額の登録のトランザクション開始に失敗しました", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "db_error", "基準価額の登録に失敗しました。")
+		return
+	}
+	defer tx.Rollback() // コミット後の Rollback は何もしない
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO reference_prices (fund_id, price, price_date) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE price = VALUES(price)",
+		fundID, price, priceDate.Format("2006-01-02"))
+	if err != nil {
+		if writeQueryTimeout(w, ctx) {
+			return
+		}
+		slog.ErrorContext(r.Context(), "基準価額の登録中にエラーが発生しました", "fund_id", fundID, "date", priceDate.Format("2006-01-02"), "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "db_error", "基準価額の登録に失敗しました。")
+		return
+	}
+	priceVersion, err := recordSinglePriceVersion(ctx, tx, fmt.Sprintf("PUT /funds/%d/prices", fundID), fundID, priceDate, price)
+	if err != nil {
+		if writeQueryTimeout(w, ctx) {
+			return
+		}
+		slog.ErrorContext(r.Context(), "基準価額のバージョンの記録中にエラーが発生しました", "fund_id", fundID, "date", priceDate.Format("2006-01-02"), "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "db_error", "基準価額の登録に失敗しました。")
+		return
+	}
+
+	var storedPrice string
+	err = tx.QueryRowContext(ctx, "SELECT price FROM reference_prices WHERE fund_id = ? AND price_date = ?",
+		fundID, priceDate.Format("2006-01-02")).Scan(&storedPrice)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		// コミットした後でタイムアウトしても 504 にしないよう、失敗した場合だけ確認する
+		if writeQueryTimeout(w, ctx) {
+			return
+		}
+		slog.ErrorContext(r.Context(), "基準価額の登録の確定に失敗しました", "fund_id", fundID, "date", priceDate.Format("2006-01-02"), "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "db_error", "基準価額の登録に失敗しました。")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ReferencePriceResponse{
+		FundID:       fundID,
+		PriceDate:    priceDate.Format("2006-01-02"),
+		Price:        storedPrice,
+		PriceVersion: priceVersion,
+	})
+}
+
+// validatePrice: 基準価額の文字列が正の数で、小数部が PRICE_SCALE 桁以内であることを確認する
+// DB には精度を保つため文字列のまま渡す。返すエラーのメッセージはそのままクライアントに返せる形にしている
+func validatePrice(price string) (string, error) {
+	price = strings.TrimSpace(price)
+	v, err := strconv.ParseFloat(price, 64)
+	if err != nil || v <= 0 || strings.ContainsAny(price, "eE") {
+		return "", errors.New("price には正の数を指定してください。")
+	}
+	if i := strings.IndexByte(price, '.'); i >= 0 && len(price)-i-1 > priceScale {
+		return "", fmt.Errorf("price の小数部は %d 桁以内で指定してください。", priceScale)
+	}
+	return price, nil
+}
+
+// updateReferencePrice: reference_prices の1件を更新し、その値だけを含む基準価額のバージョンを作成する
+// 作成したバージョン (price_import_batches の id) を返す
+func updateReferencePrice(ctx context.Context, tx *sql.Tx, fundID int, priceDate time.Time, price string) (int64, error) {
+	_, err := tx.ExecContext(ctx, "UPDATE reference_prices SET price = ? WHERE fund_id = ? AND price_date = ?",
+		price, fundID, priceDate.Format("2006-01-02"))
+	if err != nil {
+		return 0, fmt.Errorf("reference_prices の更新に失敗しました: %w", err)
+	}
+	return recordSinglePriceVersion(ctx, tx, fmt.Sprintf("PATCH /funds/%d/prices/%s", fundID, priceDate.Format("2006-01-02")), fundID, priceDate, price)
+}
+
+// recordSinglePriceVersion: 1件だけの基準価額を含むバージョンを作成し、インポート時刻を更新する
+// 作成したバージョン (price_import_batches の id) を返す
+func recordSinglePriceVersion(ctx context.Context, tx *sql.Tx, source string, fundID int, priceDate time.Time, price string) (int64, error) {
+	result, err := tx.ExecContext(ctx, "INSERT INTO price_import_batches (source, imported_at) VALUES (?, UTC_TIMESTAMP())", source)
+	if err != nil {
+		return 0, fmt.Errorf("price_import_batches への記録に失敗しました: %w", err)
+	}
+	batchID, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("基準価額のバージョンの取得に失敗しました: %w", err)
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO reference_price_versions (import_batch, fund_id, price, price_date) VALUES (?, ?, ?, ?)",
+		batchID, fundID, price, priceDate.Format("2006-01-02"))
+	if err != nil {
+		return 0, fmt.Errorf("reference_price_versions への記録に失敗しました: %w", err)
+	}
+
+	// Last-Modified による 304 で修正前の評価額が返されないよう、インポート時刻を更新する
+	if err := recordImportTime(tx, "reference_prices"); err != nil {
+		return 0, err
+	}
+	return batchID, nil
+}
+
+// requireAdmin: Authorization: Bearer <ADMIN_TOKEN> が一致するリクエストだけをハンドラに渡す
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSONError(w, http.StatusUnauthorized, "unauthorized", "認証に失敗しました。")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// adminImportHandler: DATA_DIR 以下のCSVファイルを db_init.go と同じ処理でインポートする
+// 同時に実行できるインポートの数は MAX_CONCURRENT_IMPORTS で制限し、空きが無い場合は待たずに 429 を返す
+func (s *Server) adminImportHandler(w http.ResponseWriter, r *http.Request) {
+	var req AdminImportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyDecodeError(w, err)
+		return
+	}
+	if req.Which != "trades" && req.Which != "prices" {
+		writeJSONError(w, http.StatusBadRequest, "invalid_parameter", "which には trades または prices を指定してください。")
+		return
+	}
+	if req.Mode == "" {
+		req.Mode = CHECK_REFS_OFF
+	}
+	if req.Mode != CHECK_REFS_OFF && (req.Which != "trades" || (req.Mode != CHECK_REFS_WARN && req.Mode != CHECK_REFS_ERROR)) {
+		writeJSONError(w, http.StatusBadRequest, "invalid_parameter", fmt.Sprintf("mode は trades の場合のみ %s, %s, %s のいずれかを指定できます。", CHECK_REFS_OFF, CHECK_REFS_WARN, CHECK_REFS_ERROR))
+		return
+	}
+	csvPath, err := resolveImportPath(req.Path)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+	if _, err := os.Stat(csvPath); err != nil {
+		writeJSONError(w, http.StatusNotFound, "not_found", fmt.Sprintf("ファイル %s が見つかりません。", req.Path))
+		return
+	}
+
+	release, err := acquireImportSlot(s.db, maxConcurrentImports, 0)
+	if errors.Is(err, errImportBusy) {
+		writeJSONError(w, http.StatusTooManyRequests, "import_busy", err.Error())
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "インポートの実行枠の確保中にエラーが発生しました", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "インポートを開始できませんでした。")
+		return
+	}
+	defer release()
+
+	if req.Which == "trades" && !req.Append {
+		err = checkTradeHistoriesEmpty(s.db)
+		if errors.Is(err, errTradesAlreadyImported) {
+			writeJSONError(w, http.StatusConflict, "already_imported", "trade_histories には既にデータがあります。追加でインポートする場合は append に true を指定してください。")
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "trade_histories の確認中にエラーが発生しました", "error", err)
+			writeJSONError(w, http.StatusInternalServerError, "internal_error", "インポートを開始できませんでした。")
+			return
+		}
+	}
+
+	var count int
+	if req.Which == "trades" {
+		count, err = importTradeHistories(s.db, csvPath, req.Mode, defaultTradeColumns, false)
+	} else {
+		count, err = importReferencePrices(s.db, csvPath, false)
+	}
+	if err != nil {
+		// インポートは1トランザクションで行うため、失敗した場合は何も挿入されていない
+		slog.ErrorContext(r.Context(), "インポートに失敗しました", "path", csvPath, "error", err)
+		writeJSONError(w, http.StatusUnprocessableEntity, "import_failed", fmt.Sprintf("インポートに失敗しました: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AdminImportResponse{
+		Which: req.Which,
+		Path:  req.Path,
+		Count: count,
 	})
-}
\ No newline at end of file
+}
+
+// resolveImportPath: DATA_DIR からの相対パスを絶対パスに変換する
+// DATA_DIR の外を指すパスはエラーにする。返すエラーのメッセージはそのままクライアントに返せる形にしている
+func resolveImportPath(path string) (string, error) {
+	if path == "" || filepath.IsAbs(path) {
+		return "", fmt.Errorf("path には %s からの相対パスを指定してください。", importDataDir)
+	}
+	cleaned := filepath.Clean(path)
+	if cleaned == ".." || strings.HasPrefix(cleaned, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path には %s の外のファイルを指定できません。", importDataDir)
+	}
+	return filepath.Join(importDataDir, cleaned), nil
+}
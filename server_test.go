@@ -0,0 +1,3227 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/shopspring/decimal"
+)
+
+// --- 買付金額 (総平均法) ---
+
+// TestAverageCostBasisAfterPartialSell: 2回買付した後に一部を売却すると、売却した口数は平均取得単価で差し引かれる
+func TestAverageCostBasisAfterPartialSell(t *testing.T) {
+	// 100口を基準価額10000、100口を基準価額12000で買付 (買付金額 100 + 120 = 220、平均取得単価 11000)
+	boughtQuantity := 200
+	boughtCost := marketValue(decimal.NewFromInt(10000), 100).Add(marketValue(decimal.NewFromInt(12000), 100))
+
+	// 50口を売却して150口を保有している場合、買付金額は 220 * 150 / 200 = 165
+	// (売却日の基準価額で差し引くのではなく、平均取得単価 11000 で差し引く)
+	got := averageCostBasis(boughtQuantity, boughtCost, 150)
+	if want := decimal.NewFromInt(165); !got.Equal(want) {
+		t.Errorf("averageCostBasis = %s, want %s", got, want)
+	}
+
+	// 平均取得単価で評価した場合と一致する
+	if want := marketValue(decimal.NewFromInt(11000), 150); !got.Equal(want) {
+		t.Errorf("averageCostBasis = %s, want %s (平均取得単価 11000 * 150口)", got, want)
+	}
+}
+
+func TestAverageCostBasis(t *testing.T) {
+	tests := []struct {
+		name           string
+		boughtQuantity int
+		boughtCost     string
+		quantity       int
+		want           string
+	}{
+		{"売却なし", 100, "100", 100, "100"},
+		{"全て売却", 100, "100", 0, "0"},
+		{"割り切れない", 3, "100", 1, "33.3333333333333333"},
+		{"買付なし", 0, "0", 10, "0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := averageCostBasis(tt.boughtQuantity, decimal.RequireFromString(tt.boughtCost), tt.quantity)
+			if !got.Equal(decimal.RequireFromString(tt.want)) {
+				t.Errorf("averageCostBasis(%d, %s, %d) = %s, want %s", tt.boughtQuantity, tt.boughtCost, tt.quantity, got, tt.want)
+			}
+		})
+	}
+}
+
+// --- 損益分岐となる基準価額 ---
+
+func TestBreakEvenPrice(t *testing.T) {
+	tests := []struct {
+		name     string
+		buyCost  string
+		quantity int
+		want     float64
+	}{
+		{"買付時の基準価額と同じ", "100", 100, 10000},
+		{"平均取得単価", "165", 150, 11000},
+		// 基準価額の列と同じ小数桁数 (PRICE_SCALE) に丸める
+		{"割り切れない", "100", 3, 333333.3333},
+		{"保有口数0", "100", 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := breakEvenPrice(decimal.RequireFromString(tt.buyCost), tt.quantity); got != tt.want {
+				t.Errorf("breakEvenPrice(%s, %d) = %v, want %v", tt.buyCost, tt.quantity, got, tt.want)
+			}
+		})
+	}
+}
+
+// --- 平均取得日 ---
+
+// TestAverageEntryDate: 保有中のロットの買付日を口数で加重平均し、最も近い日に丸める
+func TestAverageEntryDate(t *testing.T) {
+	day := func(month time.Month, d int) time.Time { return time.Date(2024, month, d, 0, 0, 0, 0, time.UTC) }
+
+	tests := []struct {
+		name string
+		lots []lot
+		want string
+	}{
+		{"1ロット", []lot{{TradeDate: day(1, 10), Quantity: 100}}, "2024-01-10"},
+		// 1/1 に 300口、1/11 に 100口: 1/1 + 10日 * 100 / 400 = 1/3.5 を丸めて 1/4
+		{"口数で加重平均", []lot{{TradeDate: day(1, 1), Quantity: 300}, {TradeDate: day(1, 11), Quantity: 100}}, "2024-01-04"},
+		{"同じ口数なら中間の日", []lot{{TradeDate: day(1, 1), Quantity: 100}, {TradeDate: day(3, 1), Quantity: 100}}, "2024-01-31"},
+		{"全て売却済みのロットは含めない", []lot{{TradeDate: day(1, 1), Quantity: 0, SoldQuantity: 100}, {TradeDate: day(2, 1), Quantity: 50}}, "2024-02-01"},
+		{"保有中のロットが無い", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := averageEntryDate(tt.lots); got != tt.want {
+				t.Errorf("averageEntryDate = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// --- 同じ日の取引の突き合わせ順序 (LOT_SAME_DAY_ORDER) ---
+
+// TestMatchLotsSameDayOrder: 同じ日の買付と売却は LOT_SAME_DAY_ORDER の順に並べて先入先出で突き合わせる
+func TestMatchLotsSameDayOrder(t *testing.T) {
+	day1 := time.Date(2024, 1, 5, 0, 0, 0, 0, time.UTC)
+	day2 := time.Date(2024, 1, 9, 0, 0, 0, 0, time.UTC)
+	buy := []driver.Value{1, 100, day2, "10000", "100"}
+	sell := []driver.Value{1, -150, day2, "10000", "-150"}
+
+	// 1/5 に100口を買付し、1/9 に150口の売却 (id 2) と100口の買付 (id 3) がある
+	tests := []struct {
+		name         string
+		order        string
+		wantOrderBy  string
+		sameDayRows  [][]driver.Value // クエリの ORDER BY に従った1/9の取引の並び
+		wantSold     int              // 突き合わせた売却の口数
+		wantQuantity []int            // ロットごとの保有中の口数
+	}{
+		{"買付を先に数える", LOT_ORDER_BUYS_FIRST, "quantity DESC, id", [][]driver.Value{buy, sell}, 150, []int{0, 50}},
+		{"売却を先に数える", LOT_ORDER_SELLS_FIRST, "quantity ASC, id", [][]driver.Value{sell, buy}, 100, []int{0, 100}},
+		{"登録された順", LOT_ORDER_INSERTION, "id", [][]driver.Value{sell, buy}, 100, []int{0, 100}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(v string) { lotSameDayOrder = v }(lotSameDayOrder)
+			lotSameDayOrder = tt.order
+			s, mock := newMockServer(t)
+			rows := sqlmock.NewRows([]string{"fund_id", "quantity", "trade_date", "price", "buy_cost"}).
+				AddRow(1, 100, day1, "10000", "100")
+			for _, r := range tt.sameDayRows {
+				rows.AddRow(r...)
+			}
+			mock.ExpectQuery(regexp.QuoteMeta("ORDER BY p.fund_id, p.trade_date, " + tt.wantOrderBy + ", p.is_transfer")).
+				WillReturnRows(rows)
+
+			lots, sales, err := s.matchLots(context.Background(), "U1", day2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(sales) != 1 || sales[0].Quantity != tt.wantSold {
+				t.Errorf("sales = %+v, want 1件 %d口", sales, tt.wantSold)
+			}
+			var got []int
+			for _, l := range lots {
+				got = append(got, l.Quantity)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.wantQuantity) {
+				t.Errorf("lots の口数 = %v, want %v", got, tt.wantQuantity)
+			}
+		})
+	}
+}
+
+// --- 評価額の集計順序 (ASSETS_ROUNDING_ORDER) ---
+
+// TestValuationTotalsRoundingOrder: 評価額に端数があるファンドを集計すると、
+// 合計してから切り捨てる場合とファンドごとに切り捨ててから合計する場合で結果が変わる
+func TestValuationTotalsRoundingOrder(t *testing.T) {
+	original := roundingOrder
+	t.Cleanup(func() { roundingOrder = original })
+
+	// 評価額 1.6 と 2.6 (基準価額あたりの口数で割ると端数が出る)、買付金額 1 と 2
+	var totals valuationTotals
+	totals.add(marketValue(decimal.NewFromInt(16000), 1), decimal.NewFromInt(1))
+	totals.add(marketValue(decimal.NewFromInt(26000), 1), decimal.NewFromInt(2))
+
+	tests := []struct {
+		order     string
+		wantValue int64
+		wantPL    int64
+	}{
+		// 合計 4.2 を切り捨てて 4、評価損益は 1.2 を切り捨てて 1
+		{ROUNDING_SUM_THEN_FLOOR, 4, 1},
+		// 1 + 2 = 3、評価損益は 0.6 と 0.6 をそれぞれ切り捨てて 0
+		{ROUNDING_FLOOR_THEN_SUM, 3, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.order, func(t *testing.T) {
+			roundingOrder = tt.order
+			value, pl := totals.result()
+			if value != tt.wantValue || pl != tt.wantPL {
+				t.Errorf("result() = (%d, %d), want (%d, %d)", value, pl, tt.wantValue, tt.wantPL)
+			}
+		})
+	}
+}
+
+// TestComputeAssetsRoundingOrder: computeAssets の合計も ASSETS_ROUNDING_ORDER に従って切り捨てる
+// ファンドごとに切り捨てる場合、評価損があるファンドは -0.5 が -1 になるように小さい方へ切り捨てる
+func TestComputeAssetsRoundingOrder(t *testing.T) {
+	defer func(v string) { roundingOrder = v }(roundingOrder)
+	priceDate := time.Date(2024, 5, 31, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		order     string
+		wantValue int64
+		wantPL    int64
+	}{
+		// 評価額 1.6 + 2.6 + 0.5 = 4.7、買付金額 1 + 2 + 1 = 4
+		{ROUNDING_SUM_THEN_FLOOR, 4, 0},
+		// 評価額 1 + 2 + 0 = 3、評価損益 0 + 0 + (-1) = -1
+		{ROUNDING_FLOOR_THEN_SUM, 3, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.order, func(t *testing.T) {
+			roundingOrder = tt.order
+			s, mock := newMockServer(t)
+			mock.ExpectQuery("FROM trade_histories th").
+				WillReturnRows(sqlmock.NewRows(positionColumns).
+					AddRow(1, 1, 1, "1", "1").
+					AddRow(2, 1, 1, "2", "2").
+					AddRow(3, 1, 1, "1", "1"))
+			mock.ExpectQuery("FROM reference_prices rp").
+				WillReturnRows(sqlmock.NewRows([]string{"fund_id", "price", "price_date"}).
+					AddRow(1, "16000", priceDate).
+					AddRow(2, "26000", priceDate).
+					AddRow(3, "5000", priceDate))
+
+			assets, err := s.computeAssets(context.Background(), "U1", time.Date(2024, 6, 3, 0, 0, 0, 0, time.UTC), LATEST_PRICE_VERSION, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if assets.CurrentValue != tt.wantValue || assets.CurrentPL != tt.wantPL {
+				t.Errorf("computeAssets = (%d, %d), want (%d, %d)", assets.CurrentValue, assets.CurrentPL, tt.wantValue, tt.wantPL)
+			}
+		})
+	}
+}
+
+// --- エラーレスポンス ---
+
+// TestAssetsInvalidDateReturnsJSONError: 不正な日付の場合は DB に問い合わせる前に JSON のエラーで 400 を返す
+func TestAssetsInvalidDateReturnsJSONError(t *testing.T) {
+	router := newRouter(&Server{})
+	req := httptest.NewRequest(http.MethodGet, "/A1B2C3D4E5/assets?date=not-a-date", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+	var body ErrorResponse
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("レスポンスが JSON ではありません: %v", err)
+	}
+	if body.Error.Code != "invalid_date" {
+		t.Errorf("error.code = %q, want invalid_date", body.Error.Code)
+	}
+	if body.Error.Message == "" {
+		t.Error("error.message が空です")
+	}
+}
+
+// TestRequestID: 有効なリクエストIDはそのまま使い、無い場合や不正な場合は UUID (バージョン4) を生成して、
+// X-Request-ID ヘッダー・エラーレスポンスの request_id・ログの request_id に同じ値を出す
+func TestRequestID(t *testing.T) {
+	uuidV4 := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	tests := []struct {
+		name     string
+		clientID string
+		keep     bool // クライアントのリクエストIDをそのまま使うか
+	}{
+		{"有効なリクエストID", "req-123_abc.XYZ", true},
+		{"最大の長さ", strings.Repeat("a", REQUEST_ID_MAX_LENGTH), true},
+		{"未指定", "", false},
+		{"長すぎる", strings.Repeat("a", REQUEST_ID_MAX_LENGTH+1), false},
+		{"使えない文字", `abc"},{"x`, false},
+		{"空白", "abc def", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer slog.SetDefault(slog.Default())
+			var logs bytes.Buffer
+			slog.SetDefault(slog.New(requestIDLogHandler{slog.NewJSONHandler(&logs, nil)}))
+
+			s, _ := newMockServer(t)
+			req := httptest.NewRequest(http.MethodGet, "/U1/assets?date=2024-13-01", nil)
+			if tt.clientID != "" {
+				req.Header.Set(REQUEST_ID_HEADER, tt.clientID)
+			}
+			rec := httptest.NewRecorder()
+			requestIDMiddleware(loggingMiddleware(newRouter(s))).ServeHTTP(rec, req)
+
+			id := rec.Header().Get(REQUEST_ID_HEADER)
+			if tt.keep && id != tt.clientID {
+				t.Errorf("%s = %q, want %q", REQUEST_ID_HEADER, id, tt.clientID)
+			}
+			if !tt.keep && !uuidV4.MatchString(id) {
+				t.Errorf("%s = %q, want UUID (バージョン4)", REQUEST_ID_HEADER, id)
+			}
+			var body ErrorResponse
+			if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+				t.Fatalf("レスポンスが JSON ではありません: %v", err)
+			}
+			if body.Error.RequestID != id {
+				t.Errorf("error.request_id = %q, want %q", body.Error.RequestID, id)
+			}
+			var entry struct {
+				RequestID string `json:"request_id"`
+			}
+			if err := json.Unmarshal(logs.Bytes(), &entry); err != nil {
+				t.Fatalf("ログが1行の JSON ではありません: %v\n%s", err, logs.String())
+			}
+			if entry.RequestID != id {
+				t.Errorf("ログの request_id = %q, want %q", entry.RequestID, id)
+			}
+		})
+	}
+}
+
+// TestNewRequestIDUnique: 生成するリクエストIDは毎回異なる
+func TestNewRequestIDUnique(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		id := newRequestID()
+		if seen[id] {
+			t.Fatalf("リクエストID %s が重複しました", id)
+		}
+		seen[id] = true
+	}
+}
+
+// --- 条件付きリクエスト (Last-Modified / ETag) ---
+
+// TestHandleNotModified: 最後のインポート以降に変更が無ければ 304 を返し、If-None-Match は If-Modified-Since より優先する
+func TestHandleNotModified(t *testing.T) {
+	// 評価日の0時 (JST) よりインポート時刻の方が遅いため、Last-Modified はインポート時刻になる
+	importedAt := time.Date(2024, 6, 4, 1, 2, 3, 0, time.UTC)
+	targetDate := time.Date(2024, 6, 3, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name             string
+		importedAt       interface{}
+		header           map[string]string
+		wantNotModified  bool
+		wantLastModified string
+	}{
+		{"条件なし", importedAt, nil, false, importedAt.Format(http.TimeFormat)},
+		{"インポート時刻と同じ", importedAt, map[string]string{"If-Modified-Since": importedAt.Format(http.TimeFormat)}, true, importedAt.Format(http.TimeFormat)},
+		{"インポート時刻より後", importedAt, map[string]string{"If-Modified-Since": importedAt.Add(time.Hour).Format(http.TimeFormat)}, true, importedAt.Format(http.TimeFormat)},
+		{"インポート時刻より前", importedAt, map[string]string{"If-Modified-Since": importedAt.Add(-time.Second).Format(http.TimeFormat)}, false, importedAt.Format(http.TimeFormat)},
+		{"If-None-Match が *", importedAt, map[string]string{"If-None-Match": "*"}, true, importedAt.Format(http.TimeFormat)},
+		{
+			"If-None-Match が一致しなければ If-Modified-Since は見ない", importedAt,
+			map[string]string{"If-None-Match": `W/"other"`, "If-Modified-Since": importedAt.Format(http.TimeFormat)},
+			false, importedAt.Format(http.TimeFormat),
+		},
+		{"インポートの記録が無い", nil, map[string]string{"If-Modified-Since": importedAt.Format(http.TimeFormat)}, false, ""},
+		{
+			"評価日の0時がインポート時刻より後", time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC),
+			map[string]string{"If-Modified-Since": time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC).Format(http.TimeFormat)},
+			false, time.Date(2024, 6, 2, 15, 0, 0, 0, time.UTC).Format(http.TimeFormat),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, mock := newMockServer(t)
+			mock.ExpectQuery("FROM import_metadata").WillReturnRows(sqlmock.NewRows([]string{"imported_at"}).AddRow(tt.importedAt))
+
+			req := httptest.NewRequest(http.MethodGet, "/U1/assets?date=2024-06-03", nil)
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			got := s.handleNotModified(rec, req, targetDate)
+
+			if got != tt.wantNotModified {
+				t.Errorf("handleNotModified = %v, want %v", got, tt.wantNotModified)
+			}
+			if tt.wantNotModified && rec.Code != http.StatusNotModified {
+				t.Errorf("status = %d, want %d", rec.Code, http.StatusNotModified)
+			}
+			if lm := rec.Header().Get("Last-Modified"); lm != tt.wantLastModified {
+				t.Errorf("Last-Modified = %q, want %q", lm, tt.wantLastModified)
+			}
+		})
+	}
+}
+
+// TestHandleNotModifiedETag: ETag はクエリパラメータの順序によらず、評価日やクエリパラメータが変わると変わる
+func TestHandleNotModifiedETag(t *testing.T) {
+	importedAt := time.Date(2024, 6, 4, 1, 2, 3, 0, time.UTC)
+	etag := func(path string, targetDate time.Time) string {
+		s, mock := newMockServer(t)
+		mock.ExpectQuery("FROM import_metadata").WillReturnRows(sqlmock.NewRows([]string{"imported_at"}).AddRow(importedAt))
+		rec := httptest.NewRecorder()
+		s.handleNotModified(rec, httptest.NewRequest(http.MethodGet, path, nil), targetDate)
+		return rec.Header().Get("ETag")
+	}
+
+	june3 := time.Date(2024, 6, 3, 0, 0, 0, 0, time.UTC)
+	base := etag("/U1/assets?date=2024-06-03&exact=true", june3)
+	if !strings.HasPrefix(base, `W/"`) {
+		t.Errorf("ETag = %q, want weak ETag", base)
+	}
+	if got := etag("/U1/assets?exact=true&date=2024-06-03", june3); got != base {
+		t.Errorf("クエリパラメータの順序で ETag が変わりました: %q, want %q", got, base)
+	}
+	if got := etag("/U1/assets?date=2024-06-03", june3); got == base {
+		t.Error("クエリパラメータが違うのに ETag が同じです")
+	}
+	if got := etag("/U1/assets?date=2024-06-03&exact=true", june3.AddDate(0, 0, -1)); got == base {
+		t.Error("評価日が違うのに ETag が同じです")
+	}
+}
+
+// --- 資産評価額の計算 (computeAssets) ---
+
+// positionColumns は computeFundValuations のポジションのクエリが返す列
+var positionColumns = []string{"fund_id", "total_quantity", "bought_quantity", "bought_cost", "net_invested"}
+
+// newMockServer は sqlmock の DB を使う Server を返す
+func newMockServer(t *testing.T) (*Server, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+		db.Close()
+	})
+	return &Server{db: db}, mock
+}
+
+func TestComputeAssets(t *testing.T) {
+	targetDate := time.Date(2024, 6, 3, 0, 0, 0, 0, time.UTC)
+	priceDate := time.Date(2024, 5, 31, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		positions *sqlmock.Rows
+		prices    *sqlmock.Rows
+		wantValue int64
+		wantPL    int64
+		wantExact string // 切り捨て前の評価額
+	}{
+		{
+			name: "複数ファンドの合計を切り捨てる",
+			// ファンド1: 200口を買付金額220で買付し50口を売却 (平均取得単価で買付金額は165)
+			// ファンド2: 10口を買付金額10.0005で買付
+			positions: sqlmock.NewRows(positionColumns).
+				AddRow(1, 150, 200, "220", "160").
+				AddRow(2, 10, 10, "10.0005", "10.0005"),
+			// 評価額: 12000 * 150 / 10000 = 180、10001 * 10 / 10000 = 10.001
+			prices: sqlmock.NewRows([]string{"fund_id", "price", "price_date"}).
+				AddRow(1, "12000", priceDate).
+				AddRow(2, "10001", priceDate),
+			wantValue: 190, // 190.001
+			wantPL:    15,  // 190.001 - (165 + 10.0005) = 15.0005
+			wantExact: "190.001",
+		},
+		{
+			name: "基準価額が見つからないファンドは評価対象外",
+			positions: sqlmock.NewRows(positionColumns).
+				AddRow(1, 100, 100, "100", "100").
+				AddRow(2, 100, 100, "100", "100"),
+			prices: sqlmock.NewRows([]string{"fund_id", "price", "price_date"}).
+				AddRow(1, "10500", priceDate),
+			wantValue: 105,
+			wantPL:    5,
+			wantExact: "105",
+		},
+		{
+			name: "基準価額が PRICE_MAX_AGE_DAYS より古いファンドは評価対象外",
+			positions: sqlmock.NewRows(positionColumns).
+				AddRow(1, 100, 100, "100", "100").
+				AddRow(2, 100, 100, "100", "100"),
+			prices: sqlmock.NewRows([]string{"fund_id", "price", "price_date"}).
+				AddRow(1, "10500", priceDate).
+				AddRow(2, "20000", targetDate.AddDate(0, 0, -(DEFAULT_PRICE_MAX_AGE_DAYS+1))),
+			wantValue: 105,
+			wantPL:    5,
+			wantExact: "105",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, mock := newMockServer(t)
+			mock.ExpectQuery("FROM trade_histories th").
+				WithArgs(int64(UNIT_PER_PRICE_BASE), "U1", "2024-06-03", "U1", "2024-06-03").
+				WillReturnRows(tt.positions)
+			mock.ExpectQuery("FROM reference_prices rp").
+				WithArgs(1, 2, "2024-06-03").
+				WillReturnRows(tt.prices)
+
+			assets, err := s.computeAssets(context.Background(), "U1", targetDate, LATEST_PRICE_VERSION, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if assets.CurrentValue != tt.wantValue || assets.CurrentPL != tt.wantPL {
+				t.Errorf("computeAssets = (%d, %d), want (%d, %d)", assets.CurrentValue, assets.CurrentPL, tt.wantValue, tt.wantPL)
+			}
+			if assets.ExactCurrentValue != tt.wantExact {
+				t.Errorf("ExactCurrentValue = %s, want %s", assets.ExactCurrentValue, tt.wantExact)
+			}
+			if assets.Date != "2024-06-03" {
+				t.Errorf("Date = %s, want 2024-06-03", assets.Date)
+			}
+		})
+	}
+}
+
+// TestPriceMaxAgeDays: 評価日より PRICE_MAX_AGE_DAYS 日を超えて古い基準価額のファンドは評価対象外とし、0 の場合は制限しない
+func TestPriceMaxAgeDays(t *testing.T) {
+	targetDate := time.Date(2024, 6, 3, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		maxAgeDays int
+		priceAge   int // 基準価額の日付が評価日より何日前か
+		wantValue  int64
+	}{
+		{"60日前の基準価額 (上限30日)", 30, 60, 0},
+		{"ちょうど上限の日数", 30, 30, 200},
+		{"上限の翌日", 30, 31, 0},
+		{"上限を広げる", 90, 60, 200},
+		{"0 は制限しない", 0, 60, 200},
+		{"0 は数年前の基準価額も使う", 0, 365 * 3, 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(v int) { priceMaxAgeDays = v }(priceMaxAgeDays)
+			priceMaxAgeDays = tt.maxAgeDays
+
+			s, mock := newMockServer(t)
+			mock.ExpectQuery("FROM trade_histories th").
+				WithArgs(int64(UNIT_PER_PRICE_BASE), "U1", "2024-06-03", "U1", "2024-06-03").
+				WillReturnRows(sqlmock.NewRows(positionColumns).AddRow(1, 100, 100, "100", "100"))
+			mock.ExpectQuery("FROM reference_prices rp").
+				WithArgs(1, "2024-06-03").
+				WillReturnRows(sqlmock.NewRows([]string{"fund_id", "price", "price_date"}).
+					AddRow(1, "20000", targetDate.AddDate(0, 0, -tt.priceAge)))
+
+			assets, err := s.computeAssets(context.Background(), "U1", targetDate, LATEST_PRICE_VERSION, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if assets.CurrentValue != tt.wantValue {
+				t.Errorf("current_value = %d, want %d", assets.CurrentValue, tt.wantValue)
+			}
+		})
+	}
+}
+
+// TestComputeAssetsNoPositions: 保有中のファンドが無いユーザーは基準価額を問い合わせずに0を返す
+func TestComputeAssetsNoPositions(t *testing.T) {
+	s, mock := newMockServer(t)
+	mock.ExpectQuery("FROM trade_histories th").WillReturnRows(sqlmock.NewRows(positionColumns))
+
+	assets, err := s.computeAssets(context.Background(), "U1", time.Date(2024, 6, 3, 0, 0, 0, 0, time.UTC), LATEST_PRICE_VERSION, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assets.CurrentValue != 0 || assets.CurrentPL != 0 {
+		t.Errorf("computeAssets = (%d, %d), want (0, 0)", assets.CurrentValue, assets.CurrentPL)
+	}
+}
+
+// expectAssetsQueries は GET /{user_id}/assets が発行するクエリ (インポート時刻・ユーザーの存在確認・ポジション・基準価額) を期待する
+func expectAssetsQueries(mock sqlmock.Sqlmock, positions *sqlmock.Rows, prices *sqlmock.Rows) {
+	mock.ExpectQuery("FROM import_metadata").WillReturnRows(sqlmock.NewRows([]string{"imported_at"}).AddRow(nil))
+	mock.ExpectQuery("SELECT 1 FROM trade_histories").WillReturnRows(sqlmock.NewRows([]string{"1"}).AddRow(1))
+	mock.ExpectQuery("FROM trade_histories th").WillReturnRows(positions)
+	mock.ExpectQuery("FROM reference_prices rp").WillReturnRows(prices)
+}
+
+// TestAssetsExact: exact=true の場合のみ、切り捨てた整数と並べて切り捨て前の値を返す
+func TestAssetsExact(t *testing.T) {
+	priceDate := time.Date(2024, 5, 31, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		query      string
+		wantStatus int
+		wantValue  string
+		wantPL     string
+	}{
+		{"", http.StatusOK, "", ""},
+		{"&exact=false", http.StatusOK, "", ""},
+		{"&exact=true", http.StatusOK, "190.001", "15.0005"},
+		{"&exact=yes", http.StatusBadRequest, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			s, mock := newMockServer(t)
+			if tt.wantStatus == http.StatusOK {
+				expectAssetsQueries(mock,
+					sqlmock.NewRows(positionColumns).
+						AddRow(1, 150, 200, "220", "160").
+						AddRow(2, 10, 10, "10.0005", "10.0005"),
+					sqlmock.NewRows([]string{"fund_id", "price", "price_date"}).
+						AddRow(1, "12000", priceDate).
+						AddRow(2, "10001", priceDate))
+			}
+
+			rec := httptest.NewRecorder()
+			newRouter(s).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/U1/assets?date=2024-06-03"+tt.query, nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var got AssetData
+			if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if got.CurrentValue != 190 || got.CurrentPL != 15 {
+				t.Errorf("assets = (%d, %d), want (190, 15)", got.CurrentValue, got.CurrentPL)
+			}
+			if got.ExactCurrentValue != tt.wantValue || got.ExactCurrentPL != tt.wantPL {
+				t.Errorf("exact = (%q, %q), want (%q, %q)", got.ExactCurrentValue, got.ExactCurrentPL, tt.wantValue, tt.wantPL)
+			}
+		})
+	}
+}
+
+// TestSummarizeValuationsMinValue: minValue を指定すると、切り捨て前の評価額がそれ未満のファンドを合計に含めない
+func TestSummarizeValuationsMinValue(t *testing.T) {
+	valuation := func(fundID int, value, buyCost string) fundValuation {
+		return fundValuation{
+			Position:     Position{FundID: fundID, TotalQuantity: 100, TotalBuyCost: decimal.RequireFromString(buyCost)},
+			CurrentValue: decimal.RequireFromString(value),
+		}
+	}
+	// ファンド1: 評価額 99.9 (買付金額 90)、ファンド2: 評価額 1000 (買付金額 1100)
+	valuations := []fundValuation{valuation(1, "99.9", "90"), valuation(2, "1000", "1100")}
+
+	tests := []struct {
+		name      string
+		minValue  *float64
+		wantValue int64
+		wantPL    int64
+	}{
+		{"未指定は全ファンドを合計", nil, 1099, -91},
+		{"下限未満のファンドを除外", ptr(100.0), 1000, -100},
+		{"下限と等しい評価額は含める", ptr(99.9), 1099, -91},
+		{"全ファンドが下限未満", ptr(5000.0), 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assets := summarizeValuations(valuations, time.Date(2024, 6, 3, 0, 0, 0, 0, time.UTC), LATEST_PRICE_VERSION, tt.minValue)
+			if assets.CurrentValue != tt.wantValue || assets.CurrentPL != tt.wantPL {
+				t.Errorf("summarizeValuations = (%d, %d), want (%d, %d)", assets.CurrentValue, assets.CurrentPL, tt.wantValue, tt.wantPL)
+			}
+		})
+	}
+}
+
+// TestParseMinValueInvalid: minValue に数値以外 (NaN や Inf を含む) を指定した場合は 400 を返す
+func TestParseMinValueInvalid(t *testing.T) {
+	for _, v := range []string{"abc", "NaN", "Inf", "-Inf"} {
+		t.Run(v, func(t *testing.T) {
+			s, _ := newMockServer(t)
+			rec := httptest.NewRecorder()
+			newRouter(s).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/U1/assets?date=2024-06-03&minValue="+v, nil))
+
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+			}
+		})
+	}
+}
+
+// TestComputeAssetsExcludeUnpricedBuys: EXCLUDE_UNPRICED_BUYS=true の場合、買付時の基準価額が無い取引のあるファンドと、
+// 保有口数があるのに買付金額が0のファンドを評価損益の合計から除外して excluded_funds で返す
+func TestComputeAssetsExcludeUnpricedBuys(t *testing.T) {
+	targetDate := time.Date(2024, 6, 3, 0, 0, 0, 0, time.UTC)
+	priceDate := time.Date(2024, 5, 31, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		enabled     bool
+		wantValue   int64
+		wantPL      int64
+		wantExclude []int
+	}{
+		// 買付金額が計算できない分だけ評価損益が大きくなる
+		{"無効", false, 215, 65, nil},
+		{"有効", true, 105, 5, []int{2, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(v bool) { excludeUnpricedBuys = v }(excludeUnpricedBuys)
+			excludeUnpricedBuys = tt.enabled
+			s, mock := newMockServer(t)
+			// ファンド1: 通常の買付、ファンド2: 基準価額の無い日の買付があり口数に含まれない、ファンド3: 買付金額が0
+			mock.ExpectQuery("FROM trade_histories th").
+				WillReturnRows(sqlmock.NewRows(positionColumns).
+					AddRow(1, 100, 100, "100", "100").
+					AddRow(2, 50, 50, "50", "50").
+					AddRow(3, 10, 10, "0", "0"))
+			if tt.enabled {
+				mock.ExpectQuery("WHERE NOT EXISTS").WithArgs("U1", "2024-06-03").
+					WillReturnRows(sqlmock.NewRows([]string{"fund_id", "count"}).AddRow(2, 1))
+			}
+			mock.ExpectQuery("FROM reference_prices rp").
+				WillReturnRows(sqlmock.NewRows([]string{"fund_id", "price", "price_date"}).
+					AddRow(1, "10500", priceDate).
+					AddRow(2, "20000", priceDate).
+					AddRow(3, "10000", priceDate))
+
+			assets, err := s.computeAssets(context.Background(), "U1", targetDate, LATEST_PRICE_VERSION, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if assets.CurrentValue != tt.wantValue || assets.CurrentPL != tt.wantPL {
+				t.Errorf("computeAssets = (%d, %d), want (%d, %d)", assets.CurrentValue, assets.CurrentPL, tt.wantValue, tt.wantPL)
+			}
+			if fmt.Sprint(assets.ExcludedFunds) != fmt.Sprint(tt.wantExclude) {
+				t.Errorf("ExcludedFunds = %v, want %v", assets.ExcludedFunds, tt.wantExclude)
+			}
+		})
+	}
+}
+
+// TestFloorToMultiple: unit の倍数のうち v 以下で最大のものを返し、マイナスの値も小さい方に丸める
+func TestFloorToMultiple(t *testing.T) {
+	tests := []struct {
+		v, unit, want int64
+	}{
+		{12345, 100, 12300},
+		{12300, 100, 12300},
+		{99, 100, 0},
+		{-1, 100, -100},
+		{-12345, 1000, -13000},
+		{-12000, 1000, -12000},
+	}
+	for _, tt := range tests {
+		if got := floorToMultiple(tt.v, tt.unit); got != tt.want {
+			t.Errorf("floorToMultiple(%d, %d) = %d, want %d", tt.v, tt.unit, got, tt.want)
+		}
+	}
+}
+
+// TestAssetsRoundTo: roundTo を指定すると評価額と評価損益をその単位の倍数に切り捨て、round_to で単位を返す
+func TestAssetsRoundTo(t *testing.T) {
+	priceDate := time.Date(2024, 5, 31, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name        string
+		buyCost     string
+		query       string
+		wantStatus  int
+		wantValue   int64
+		wantPL      int64
+		wantRoundTo int64
+	}{
+		// 評価額は 123456 * 1000 / 10000 = 12345.6
+		{"未指定は1円単位", "12000", "", http.StatusOK, 12345, 345, 0},
+		{"100円単位", "12000", "&roundTo=100", http.StatusOK, 12300, 300, 100},
+		{"1000円単位", "12000", "&roundTo=1000", http.StatusOK, 12000, 0, 1000},
+		{"評価損は小さい方に丸める", "12400", "&roundTo=100", http.StatusOK, 12300, -100, 100},
+		{"0", "12000", "&roundTo=0", http.StatusBadRequest, 0, 0, 0},
+		{"整数ではない", "12000", "&roundTo=1.5", http.StatusBadRequest, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, mock := newMockServer(t)
+			if tt.wantStatus == http.StatusOK {
+				expectAssetsQueries(mock,
+					sqlmock.NewRows(positionColumns).AddRow(1, 1000, 1000, tt.buyCost, tt.buyCost),
+					sqlmock.NewRows([]string{"fund_id", "price", "price_date"}).AddRow(1, "123456", priceDate))
+			}
+
+			rec := httptest.NewRecorder()
+			newRouter(s).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/U1/assets?date=2024-06-03"+tt.query, nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var got AssetData
+			if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if got.CurrentValue != tt.wantValue || got.CurrentPL != tt.wantPL || got.RoundTo != tt.wantRoundTo {
+				t.Errorf("assets = (%d, %d, round_to %d), want (%d, %d, round_to %d)", got.CurrentValue, got.CurrentPL, got.RoundTo, tt.wantValue, tt.wantPL, tt.wantRoundTo)
+			}
+		})
+	}
+}
+
+// --- ファンド別の資産評価額 ---
+
+// TestAssetsByFund: ファンドごとに評価額と評価損益を切り捨てて返し、minValue を指定すると評価額がそれ未満のファンドを一覧から除外する
+func TestAssetsByFund(t *testing.T) {
+	priceDate := time.Date(2024, 5, 31, 0, 0, 0, 0, time.UTC)
+	fund1 := FundAsset{FundID: 1, CurrentValue: 180, CurrentPL: 15, BreakEvenPrice: 11000, AverageEntryDate: "2024-01-05"}
+	fund2 := FundAsset{FundID: 2, CurrentValue: 10, CurrentPL: 0, BreakEvenPrice: 10000.5, AverageEntryDate: "2024-01-06"}
+
+	tests := []struct {
+		name  string
+		query string
+		want  []FundAsset
+	}{
+		{"全てのファンド", "", []FundAsset{fund1, fund2}},
+		{"評価額が minValue 未満のファンドを除外", "&minValue=100", []FundAsset{fund1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, mock := newMockServer(t)
+			mock.ExpectQuery("FROM import_metadata").WillReturnRows(sqlmock.NewRows([]string{"imported_at"}).AddRow(nil))
+			// ファンド1: 200口を買付金額220で買付し50口を売却、ファンド2: 10口を買付金額10.0005で買付
+			mock.ExpectQuery("GROUP BY\\s+p.fund_id").
+				WillReturnRows(sqlmock.NewRows(positionColumns).
+					AddRow(1, 150, 200, "220", "160").
+					AddRow(2, 10, 10, "10.0005", "10.0005"))
+			mock.ExpectQuery("FROM reference_prices rp").WithArgs(1, 2, "2024-06-03").
+				WillReturnRows(sqlmock.NewRows([]string{"fund_id", "price", "price_date"}).
+					AddRow(1, "12000", priceDate).
+					AddRow(2, "10001", priceDate))
+			mock.ExpectQuery("ORDER BY p.fund_id, p.trade_date").
+				WillReturnRows(sqlmock.NewRows([]string{"fund_id", "quantity", "trade_date", "price", "buy_cost"}).
+					AddRow(1, 200, time.Date(2024, 1, 5, 0, 0, 0, 0, time.UTC), "11000", "220").
+					AddRow(1, -50, time.Date(2024, 1, 9, 0, 0, 0, 0, time.UTC), "12000", "-60").
+					AddRow(2, 10, time.Date(2024, 1, 6, 0, 0, 0, 0, time.UTC), "10000.5", "10.0005"))
+
+			rec := httptest.NewRecorder()
+			newRouter(s).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/U1/assets/byFund?date=2024-06-03"+tt.query, nil))
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+			}
+			var got []FundAsset
+			if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("byFund = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// --- 評価日のレスポンスヘッダー (X-As-Of-Date) ---
+
+// TestAsOfDateHeader: 資産評価系のエンドポイントは、304 の場合も含めて評価日を X-As-Of-Date で返す
+func TestAsOfDateHeader(t *testing.T) {
+	tests := []struct {
+		name          string
+		path          string
+		lastPricedDay interface{} // anchor=monthEnd の場合に返す月の最後の基準価額のある日
+		wantAsOfDate  string
+	}{
+		{"資産評価額", "/U1/assets?date=2024-06-03", nil, "2024-06-03"},
+		{"ファンド別", "/U1/assets/byFund?date=2024-06-03", nil, "2024-06-03"},
+		{"年別", "/U1/assets/byYear?date=2024-06-03", nil, "2024-06-03"},
+		{"月末の基準価額のある日", "/U1/assets?anchor=monthEnd&month=2024-05", time.Date(2024, 5, 30, 0, 0, 0, 0, time.UTC), "2024-05-30"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, mock := newMockServer(t)
+			if tt.lastPricedDay != nil {
+				mock.ExpectQuery("SELECT MAX\\(price_date\\)").WithArgs("2024-05-01", "2024-05-31").
+					WillReturnRows(sqlmock.NewRows([]string{"price_date"}).AddRow(tt.lastPricedDay))
+			}
+			mock.ExpectQuery("FROM import_metadata").
+				WillReturnRows(sqlmock.NewRows([]string{"imported_at"}).AddRow(time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)))
+
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.Header.Set("If-None-Match", "*")
+			rec := httptest.NewRecorder()
+			newRouter(s).ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusNotModified {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusNotModified, rec.Body)
+			}
+			if got := rec.Header().Get("X-As-Of-Date"); got != tt.wantAsOfDate {
+				t.Errorf("X-As-Of-Date = %q, want %q", got, tt.wantAsOfDate)
+			}
+		})
+	}
+}
+
+// --- 評価日の決定 ---
+
+// TestLastBusinessDay: 指定日が営業日ならその日を、土日や祝日なら直前の営業日を返す
+func TestLastBusinessDay(t *testing.T) {
+	day := func(month time.Month, d int) time.Time { return time.Date(2024, month, d, 0, 0, 0, 0, time.UTC) }
+
+	tests := []struct {
+		name     string
+		from     time.Time
+		holidays []time.Time
+		want     time.Time
+	}{
+		{"営業日の月曜日はその日", day(1, 15), nil, day(1, 15)},
+		{"営業日の金曜日はその日", day(1, 12), nil, day(1, 12)},
+		{"日曜日は前の金曜日", day(1, 14), nil, day(1, 12)},
+		{"土曜日は前の金曜日", day(1, 13), nil, day(1, 12)},
+		// 2024-01-08 は成人の日
+		{"祝日の月曜日は前の金曜日", day(1, 8), []time.Time{day(1, 8)}, day(1, 5)},
+		{"連休は祝日の前の営業日", day(1, 3), []time.Time{day(1, 1), day(1, 2), day(1, 3)}, time.Date(2023, 12, 29, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, mock := newMockServer(t)
+			rows := sqlmock.NewRows([]string{"holiday_date"})
+			for _, h := range tt.holidays {
+				rows.AddRow(h)
+			}
+			mock.ExpectQuery("FROM holidays").
+				WithArgs(tt.from.AddDate(0, 0, -HOLIDAY_LOOKBACK_DAYS).Format("2006-01-02"), tt.from.Format("2006-01-02")).
+				WillReturnRows(rows)
+
+			got, err := s.lastBusinessDay(context.Background(), tt.from)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("lastBusinessDay(%s) = %s, want %s", tt.from.Format("2006-01-02"), got.Format("2006-01-02"), tt.want.Format("2006-01-02"))
+			}
+		})
+	}
+}
+
+// TestLastBusinessDayNotFound: HOLIDAY_LOOKBACK_DAYS 日遡っても営業日が無い場合は、営業日ではない日を返さずにエラーにする
+func TestLastBusinessDayNotFound(t *testing.T) {
+	from := time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC)
+	rows := sqlmock.NewRows([]string{"holiday_date"})
+	for d := 0; d <= HOLIDAY_LOOKBACK_DAYS; d++ {
+		rows.AddRow(from.AddDate(0, 0, -d))
+	}
+	s, mock := newMockServer(t)
+	mock.ExpectQuery("FROM holidays").WillReturnRows(rows)
+
+	if got, err := s.lastBusinessDay(context.Background(), from); err == nil {
+		t.Errorf("lastBusinessDay = %s, want error", got.Format("2006-01-02"))
+	}
+}
+
+// TestTodayInAppLocation: date を省略した場合の評価日は、サーバーのタイムゾーンではなく APP_TIMEZONE の今日になる
+func TestTodayInAppLocation(t *testing.T) {
+	defer func(v *time.Location) { appLocation = v }(appLocation)
+
+	// UTC との差が大きいタイムゾーンでは、UTC の日付と1日ずれる時間帯がある
+	for _, name := range []string{"Asia/Tokyo", "Pacific/Kiritimati", "Etc/GMT+12"} {
+		t.Run(name, func(t *testing.T) {
+			loc, err := time.LoadLocation(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			appLocation = loc
+			s, mock := newMockServer(t)
+			mock.ExpectQuery("FROM import_metadata").
+				WillReturnRows(sqlmock.NewRows([]string{"imported_at"}).AddRow(time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)))
+
+			before := time.Now().In(loc).Format("2006-01-02")
+			got := today()
+			req := httptest.NewRequest(http.MethodGet, "/U1/assets", nil)
+			req.Header.Set("If-None-Match", "*")
+			rec := httptest.NewRecorder()
+			newRouter(s).ServeHTTP(rec, req)
+			after := time.Now().In(loc).Format("2006-01-02")
+
+			// 日付が変わる瞬間に実行された場合は、前後どちらの日付も正しい
+			if d := got.Format("2006-01-02"); d != before && d != after {
+				t.Errorf("today() = %s, want %s", d, before)
+			}
+			if got.Location() != loc || got.Hour() != 0 || got.Minute() != 0 {
+				t.Errorf("today() = %s, want %s の0時", got, name)
+			}
+			if d := rec.Header().Get("X-As-Of-Date"); d != before && d != after {
+				t.Errorf("X-As-Of-Date = %s, want %s", d, before)
+			}
+		})
+	}
+}
+
+// TestLastPricedDayOfMonth: 月の最後の日に基準価額が無い場合は基準価額のある最後の日を、1件も無い場合は月の最後の平日を返す
+func TestLastPricedDayOfMonth(t *testing.T) {
+	tests := []struct {
+		name      string
+		month     time.Time
+		firstDay  string
+		lastDay   string
+		lastPrice interface{} // MAX(price_date) の結果
+		queryErr  error
+		want      string
+	}{
+		// 2024-05-31 (金) の基準価額が無い
+		{"基準価額のある最後の日", time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), "2024-05-01", "2024-05-31", time.Date(2024, 5, 30, 0, 0, 0, 0, time.UTC), nil, "2024-05-30"},
+		// 2024-03-31 は日曜日
+		{"基準価額が無ければ最後の平日", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), "2024-03-01", "2024-03-31", nil, nil, "2024-03-29"},
+		{"取得に失敗した場合も最後の平日", time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC), "2024-06-01", "2024-06-30", nil, errors.New("connection refused"), "2024-06-28"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, mock := newMockServer(t)
+			q := mock.ExpectQuery("SELECT MAX\\(price_date\\) FROM reference_prices").WithArgs(tt.firstDay, tt.lastDay)
+			if tt.queryErr != nil {
+				q.WillReturnError(tt.queryErr)
+			} else {
+				q.WillReturnRows(sqlmock.NewRows([]string{"price_date"}).AddRow(tt.lastPrice))
+			}
+
+			got := s.lastPricedDayOfMonth(context.Background(), tt.month)
+			if got.Format("2006-01-02") != tt.want {
+				t.Errorf("lastPricedDayOfMonth = %s, want %s", got.Format("2006-01-02"), tt.want)
+			}
+		})
+	}
+}
+
+// TestResolveTargetDateMonthEnd: anchor=monthEnd には month が必要で、month は anchor=monthEnd の場合だけ指定できる
+func TestResolveTargetDateMonthEnd(t *testing.T) {
+	for _, query := range []string{"anchor=monthEnd", "anchor=monthEnd&month=2024-5-1", "month=2024-05", "anchor=monthEnd&month=2024-05&date=2024-05-31"} {
+		t.Run(query, func(t *testing.T) {
+			s, _ := newMockServer(t)
+			if _, err := s.resolveTargetDate(httptest.NewRequest(http.MethodGet, "/U1/assets?"+query, nil)); err == nil {
+				t.Errorf("resolveTargetDate(%q) err = nil, want error", query)
+			}
+		})
+	}
+}
+
+// --- 基準価額のバージョン (priceVersion) ---
+
+// TestResolvePriceVersion: priceVersion は正の整数で、price_import_batches に存在するバッチのみ指定できる
+func TestResolvePriceVersion(t *testing.T) {
+	tests := []struct {
+		name        string
+		query       string
+		batch       int64 // price_import_batches で存在を確認するバッチ (0 ならクエリを発行しない)
+		exists      bool
+		wantVersion int64
+		wantStatus  int
+	}{
+		{"未指定は最新", "", 0, false, LATEST_PRICE_VERSION, http.StatusOK},
+		{"存在するバッチ", "priceVersion=5", 5, true, 5, http.StatusOK},
+		{"存在しないバッチ", "priceVersion=6", 6, false, 0, http.StatusNotFound},
+		{"0", "priceVersion=0", 0, false, 0, http.StatusBadRequest},
+		{"負の数", "priceVersion=-1", 0, false, 0, http.StatusBadRequest},
+		{"数値ではない", "priceVersion=latest", 0, false, 0, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, mock := newMockServer(t)
+			if tt.batch != 0 {
+				mock.ExpectQuery("FROM price_import_batches").WithArgs(tt.batch).
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(tt.exists))
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/U1/assets?"+tt.query, nil)
+			version, status, err := s.resolvePriceVersion(req)
+			if status != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (err = %v)", status, tt.wantStatus, err)
+			}
+			if (err != nil) != (tt.wantStatus != http.StatusOK) {
+				t.Errorf("err = %v", err)
+			}
+			if version != tt.wantVersion {
+				t.Errorf("version = %d, want %d", version, tt.wantVersion)
+			}
+		})
+	}
+}
+
+// TestComputeAssetsPriceVersion: priceVersion を指定すると、買付時・評価日時点の基準価額ともに
+// reference_price_versions からそのバッチ以前に取り込まれたものを使う
+func TestComputeAssetsPriceVersion(t *testing.T) {
+	targetDate := time.Date(2024, 6, 3, 0, 0, 0, 0, time.UTC)
+	s, mock := newMockServer(t)
+	mock.ExpectQuery("reference_price_versions rp_buy").
+		WithArgs(int64(UNIT_PER_PRICE_BASE), int64(5), "U1", "2024-06-03", "U1", "2024-06-03").
+		WillReturnRows(sqlmock.NewRows(positionColumns).AddRow(1, 100, 100, "100", "100"))
+	mock.ExpectQuery("FROM reference_price_versions v").
+		WithArgs(1, "2024-06-03", int64(5)).
+		WillReturnRows(sqlmock.NewRows([]string{"fund_id", "price", "price_date"}).AddRow(1, "11000", targetDate))
+
+	assets, err := s.computeAssets(context.Background(), "U1", targetDate, 5, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assets.CurrentValue != 110 || assets.PriceVersion != 5 {
+		t.Errorf("computeAssets = (%d, priceVersion %d), want (110, priceVersion 5)", assets.CurrentValue, assets.PriceVersion)
+	}
+}
+
+// --- NULL の基準価額 ---
+
+// TestLatestPriceSkipsNull: 評価日以前で最も新しい基準価額が NULL の場合は、エラーにせず NULL でないもののうち最も新しいものを使う
+func TestLatestPriceSkipsNull(t *testing.T) {
+	priceColumns := []string{"price", "price_date"}
+	tests := []struct {
+		name     string
+		latest   interface{}   // 最も新しい基準価額
+		fallback *sqlmock.Rows // NULL でない基準価額の再取得の結果 (nil なら再取得しない)
+		want     string
+		wantErr  error
+	}{
+		{"NULL ではない", "10500", nil, "10500", nil},
+		{"NULL は読み飛ばす", nil, sqlmock.NewRows(priceColumns).AddRow("10400", time.Date(2024, 5, 30, 0, 0, 0, 0, time.UTC)), "10400", nil},
+		{"全て NULL", nil, sqlmock.NewRows(priceColumns), "0", sql.ErrNoRows},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, mock := newMockServer(t)
+			mock.ExpectQuery(regexp.QuoteMeta("WHERE fund_id = ? AND price_date <= ?\n")).WithArgs(1, "2024-06-03").
+				WillReturnRows(sqlmock.NewRows(priceColumns).AddRow(tt.latest, time.Date(2024, 5, 31, 0, 0, 0, 0, time.UTC)))
+			if tt.fallback != nil {
+				mock.ExpectQuery(regexp.QuoteMeta("WHERE fund_id = ? AND price_date <= ? AND price IS NOT NULL")).WithArgs(1, "2024-06-03").
+					WillReturnRows(tt.fallback)
+			}
+
+			got, err := s.latestPrice(context.Background(), 1, time.Date(2024, 6, 3, 0, 0, 0, 0, time.UTC), LATEST_PRICE_VERSION)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if got.String() != tt.want {
+				t.Errorf("latestPrice = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestComputeAssetsNullPriceQuery: 評価日時点の基準価額は NULL の行を除いて取得する
+func TestComputeAssetsNullPriceQuery(t *testing.T) {
+	s, mock := newMockServer(t)
+	mock.ExpectQuery("FROM trade_histories th").
+		WillReturnRows(sqlmock.NewRows(positionColumns).AddRow(1, 100, 100, "100", "100"))
+	mock.ExpectQuery(regexp.QuoteMeta("rp.price IS NOT NULL") + "(?s).*" + regexp.QuoteMeta("p.price IS NOT NULL")).
+		WillReturnRows(sqlmock.NewRows([]string{"fund_id", "price", "price_date"}).AddRow(1, "10400", time.Date(2024, 5, 30, 0, 0, 0, 0, time.UTC)))
+
+	assets, err := s.computeAssets(context.Background(), "U1", time.Date(2024, 6, 3, 0, 0, 0, 0, time.UTC), LATEST_PRICE_VERSION, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assets.CurrentValue != 104 {
+		t.Errorf("CurrentValue = %d, want 104", assets.CurrentValue)
+	}
+}
+
+// --- 年別の資産評価額 ---
+
+// TestAssetsByYear: 買付年ごとに評価し、同じファンドを複数の年に買付していても基準価額は1回のクエリでまとめて取得する
+func TestAssetsByYear(t *testing.T) {
+	s, mock := newMockServer(t)
+	mock.ExpectQuery("FROM import_metadata").WillReturnRows(sqlmock.NewRows([]string{"imported_at"}).AddRow(nil))
+	// ファンド1を2023年に100口 (買付金額100)、2024年に100口 (買付金額120) 買付し、ファンド2を2024年に10口 (買付金額20) 買付
+	mock.ExpectQuery("YEAR\\(p.trade_date\\)").
+		WillReturnRows(sqlmock.NewRows([]string{"trade_year", "fund_id", "total_quantity", "bought_quantity", "bought_cost"}).
+			AddRow(2023, 1, 100, 100, "100").
+			AddRow(2024, 1, 100, 100, "120").
+			AddRow(2024, 2, 10, 10, "20"))
+	mock.ExpectQuery("FROM reference_prices rp").
+		WithArgs(1, 2, "2024-06-03").
+		WillReturnRows(sqlmock.NewRows([]string{"fund_id", "price", "price_date"}).
+			AddRow(1, "11000", time.Date(2024, 5, 31, 0, 0, 0, 0, time.UTC)).
+			AddRow(2, "19000", time.Date(2024, 5, 31, 0, 0, 0, 0, time.UTC)))
+
+	req := httptest.NewRequest(http.MethodGet, "/U1/assets/byYear?date=2024-06-03", nil)
+	rec := httptest.NewRecorder()
+	newRouter(s).ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	var got AssetsByYearResponse
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	// 2024年: 110 + 19 = 129 (買付金額 120 + 20)、2023年: 110 (買付金額 100)
+	want := []YearlyAsset{
+		{Year: 2024, CurrentValue: 129, CurrentPL: -11},
+		{Year: 2023, CurrentValue: 110, CurrentPL: 10},
+	}
+	if len(got.Assets) != len(want) {
+		t.Fatalf("len(assets) = %d, want %d", len(got.Assets), len(want))
+	}
+	for i := range want {
+		g := got.Assets[i]
+		if g.Year != want[i].Year || g.CurrentValue != want[i].CurrentValue || g.CurrentPL != want[i].CurrentPL {
+			t.Errorf("assets[%d] = {%d %d %d}, want {%d %d %d}", i, g.Year, g.CurrentValue, g.CurrentPL, want[i].Year, want[i].CurrentValue, want[i].CurrentPL)
+		}
+	}
+}
+
+// TestAssetsByYearExplain: explain=true の場合のみ、年ごとにファンドIDの昇順で切り捨て前の内訳を返す
+func TestAssetsByYearExplain(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		wantFunds []YearlyFundDetail
+	}{
+		{"explain=true", "&explain=true", []YearlyFundDetail{
+			{FundID: 1, Quantity: 100, CurrentPrice: "11000", BuyCost: "120", CurrentValue: "110"},
+			{FundID: 2, Quantity: 15, CurrentPrice: "19001", BuyCost: "20", CurrentValue: "28.5015"},
+		}},
+		{"未指定", "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, mock := newMockServer(t)
+			mock.ExpectQuery("FROM import_metadata").WillReturnRows(sqlmock.NewRows([]string{"imported_at"}).AddRow(nil))
+			// ファンドIDの降順で返しても内訳は昇順に並べる
+			mock.ExpectQuery("YEAR\\(p.trade_date\\)").
+				WillReturnRows(sqlmock.NewRows([]string{"trade_year", "fund_id", "total_quantity", "bought_quantity", "bought_cost"}).
+					AddRow(2024, 2, 15, 15, "20").
+					AddRow(2024, 1, 100, 100, "120"))
+			mock.ExpectQuery("FROM reference_prices rp").
+				WithArgs(2, 1, "2024-06-03").
+				WillReturnRows(sqlmock.NewRows([]string{"fund_id", "price", "price_date"}).
+					AddRow(1, "11000", time.Date(2024, 5, 31, 0, 0, 0, 0, time.UTC)).
+					AddRow(2, "19001", time.Date(2024, 5, 31, 0, 0, 0, 0, time.UTC)))
+
+			req := httptest.NewRequest(http.MethodGet, "/U1/assets/byYear?date=2024-06-03"+tt.query, nil)
+			rec := httptest.NewRecorder()
+			newRouter(s).ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+			}
+			var got AssetsByYearResponse
+			if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if len(got.Assets) != 1 {
+				t.Fatalf("len(assets) = %d, want 1", len(got.Assets))
+			}
+			// 138.5015 - 140 = -1.4985 (切り捨てで -2)
+			if got.Assets[0].CurrentValue != 138 || got.Assets[0].CurrentPL != -2 {
+				t.Errorf("assets[0] = {%d %d}, want {138 -2}", got.Assets[0].CurrentValue, got.Assets[0].CurrentPL)
+			}
+			funds := got.Assets[0].Funds
+			if len(funds) != len(tt.wantFunds) {
+				t.Fatalf("funds = %+v, want %+v", funds, tt.wantFunds)
+			}
+			for i := range tt.wantFunds {
+				if funds[i] != tt.wantFunds[i] {
+					t.Errorf("funds[%d] = %+v, want %+v", i, funds[i], tt.wantFunds[i])
+				}
+			}
+		})
+	}
+}
+
+// --- 分配金 ---
+
+// TestDistributionIncome: 分配金の合計は端数を切り捨てて返し、float64 では表せない大きさの合計も1円単位で正確に扱う
+func TestDistributionIncome(t *testing.T) {
+	tests := []struct {
+		name  string
+		total string // SUM(amount) の結果 (DECIMAL(18, 2) の合計)
+		want  int64
+	}{
+		{"端数のある合計", "100.29", 100},
+		{"端数の無い合計", "300.00", 300},
+		{"1円未満", "0.99", 0},
+		// float64 では 9007199254740994 に丸められる
+		{"float64 の仮数部を超える合計", "9007199254740993.50", 9007199254740993},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, mock := newMockServer(t)
+			mock.ExpectQuery("FROM distributions").
+				WithArgs("U1", "2024-06-03").
+				WillReturnRows(sqlmock.NewRows([]string{"total"}).AddRow(tt.total))
+
+			got, err := s.distributionIncome(context.Background(), "U1", time.Date(2024, 6, 3, 0, 0, 0, 0, time.UTC))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("distributionIncome = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// --- 基準価額を差し替えた評価 (what-if) ---
+
+// TestAssetsWhatIfDecimalPrices: 仮の基準価額は float64 を経由せずに読み込むため、
+// float64 では丸められてしまう桁数の基準価額でも切り捨ての結果が変わらない
+func TestAssetsWhatIfDecimalPrices(t *testing.T) {
+	tests := []struct {
+		name      string
+		price     string
+		wantValue int64
+		wantPL    int64
+	}{
+		// 10000口 * 9999.9999999999999999 / 10000 = 9999.9999999999999999 (float64 では 10000 になる)
+		{"float64 で表せない桁数", "9999.9999999999999999", 9999, -1},
+		{"買付時と同じ基準価額", "10000", 10000, 0},
+		{"文字列で指定", `"10000.5"`, 10000, 0},
+		{"小数部のある基準価額", "12345.6789", 12345, 2345},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, mock := newMockServer(t)
+			mock.ExpectQuery("SELECT 1 FROM trade_histories").WithArgs("U1", "U1").
+				WillReturnRows(sqlmock.NewRows([]string{"1"}).AddRow(1))
+			// ファンド1を基準価額10000で10000口買付 (買付金額 10000)
+			mock.ExpectQuery("FROM trade_histories th").
+				WillReturnRows(sqlmock.NewRows(positionColumns).AddRow(1, 10000, 10000, "10000", "10000"))
+			mock.ExpectQuery("FROM reference_prices rp").
+				WillReturnRows(sqlmock.NewRows([]string{"fund_id", "price", "price_date"}).AddRow(1, "11000", time.Date(2024, 6, 3, 0, 0, 0, 0, time.UTC)))
+
+			body := `{"date": "2024-06-03", "prices": {"1": ` + tt.price + `}}`
+			req := httptest.NewRequest(http.MethodPost, "/U1/assets/whatif", strings.NewReader(body))
+			rec := httptest.NewRecorder()
+			newRouter(s).ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+			}
+			var got AssetData
+			if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if got.CurrentValue != tt.wantValue || got.CurrentPL != tt.wantPL {
+				t.Errorf("assets = (%d, %d), want (%d, %d)", got.CurrentValue, got.CurrentPL, tt.wantValue, tt.wantPL)
+			}
+		})
+	}
+}
+
+// TestAssetsWhatIfUnknownUser: 取引の無いユーザーは評価額0ではなく 404 を返す
+func TestAssetsWhatIfUnknownUser(t *testing.T) {
+	s, mock := newMockServer(t)
+	mock.ExpectQuery("SELECT 1 FROM trade_histories").WithArgs("U1", "U1").
+		WillReturnRows(sqlmock.NewRows([]string{"1"}))
+
+	req := httptest.NewRequest(http.MethodPost, "/U1/assets/whatif", strings.NewReader(`{"prices": {"1": 10000}}`))
+	rec := httptest.NewRecorder()
+	newRouter(s).ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	var body ErrorResponse
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("レスポンスが JSON ではありません: %v", err)
+	}
+	if body.Error.Code != "not_found" {
+		t.Errorf("error.code = %q, want not_found", body.Error.Code)
+	}
+}
+
+// TestAssetsWhatIfInvalidPrice: 仮の基準価額が正の数値でない場合は DB に問い合わせる前に 400 を返す
+func TestAssetsWhatIfInvalidPrice(t *testing.T) {
+	for _, price := range []string{"0", "-1", `"abc"`} {
+		body := `{"prices": {"1": ` + price + `}}`
+		req := httptest.NewRequest(http.MethodPost, "/U1/assets/whatif", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		newRouter(&Server{}).ServeHTTP(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("price %s: status = %d, want %d", price, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+// --- 積立の分析 ---
+
+// TestDCA: 基準価額が無い (NULL の) 買付は0円として平均取得単価に含めず、unpriced_buys に数える
+func TestDCA(t *testing.T) {
+	buyColumns := []string{"quantity", "trade_date", "price"}
+	day := func(month time.Month, d int) time.Time { return time.Date(2024, month, d, 0, 0, 0, 0, time.UTC) }
+
+	tests := []struct {
+		name              string
+		buys              *sqlmock.Rows
+		periodAverage     interface{}
+		wantAverage       *float64
+		wantPeriodAverage *float64
+		wantUnpriced      int
+	}{
+		{
+			name: "基準価額の無い買付を除いて平均する",
+			// (100 * 10000 + 300 * 12000) / 400 = 11500
+			buys: sqlmock.NewRows(buyColumns).
+				AddRow(100, day(1, 4), "10000").
+				AddRow(300, day(2, 5), "12000").
+				AddRow(50, day(3, 4), nil),
+			periodAverage:     "11000",
+			wantAverage:       ptr(11500.0),
+			wantPeriodAverage: ptr(11000.0),
+			wantUnpriced:      1,
+		},
+		{
+			name: "全ての買付に基準価額が無い",
+			buys: sqlmock.NewRows(buyColumns).
+				AddRow(100, day(1, 6), nil).
+				AddRow(100, day(1, 7), nil),
+			periodAverage: nil,
+			wantUnpriced:  2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, mock := newMockServer(t)
+			mock.ExpectQuery(`rp\.price IS NOT NULL`).WithArgs("U1", 1).WillReturnRows(tt.buys)
+			mock.ExpectQuery("SELECT AVG").WillReturnRows(sqlmock.NewRows([]string{"avg"}).AddRow(tt.periodAverage))
+
+			req := httptest.NewRequest(http.MethodGet, "/U1/funds/1/dca", nil)
+			rec := httptest.NewRecorder()
+			newRouter(s).ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+			}
+			var got DCAResponse
+			if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if !equalFloatPtr(got.AverageBuyPrice, tt.wantAverage) {
+				t.Errorf("average_buy_price = %v, want %v", formatFloatPtr(got.AverageBuyPrice), formatFloatPtr(tt.wantAverage))
+			}
+			if !equalFloatPtr(got.PeriodAveragePrice, tt.wantPeriodAverage) {
+				t.Errorf("period_average_price = %v, want %v", formatFloatPtr(got.PeriodAveragePrice), formatFloatPtr(tt.wantPeriodAverage))
+			}
+			if got.UnpricedBuys != tt.wantUnpriced {
+				t.Errorf("unpriced_buys = %d, want %d", got.UnpricedBuys, tt.wantUnpriced)
+			}
+		})
+	}
+}
+
+func ptr[T any](v T) *T { return &v }
+
+func equalFloatPtr(a, b *float64) bool {
+	return a == nil && b == nil || a != nil && b != nil && *a == *b
+}
+
+func formatFloatPtr(v *float64) string {
+	if v == nil {
+		return "<nil>"
+	}
+	return strconv.FormatFloat(*v, 'f', -1, 64)
+}
+
+// --- 資産評価額の推移 ---
+
+// expectHistoryQueries は from から1日ごとに computeAssets が発行するクエリを期待する
+// 1ファンドを100口 (買付金額100) 保有し、各日の評価額が values になるよう基準価額を返す
+func expectHistoryQueries(mock sqlmock.Sqlmock, from time.Time, values []int64) {
+	for i, v := range values {
+		day := from.AddDate(0, 0, i)
+		mock.ExpectQuery("FROM trade_histories th").
+			WithArgs(int64(UNIT_PER_PRICE_BASE), "U1", day.Format("2006-01-02"), "U1", day.Format("2006-01-02")).
+			WillReturnRows(sqlmock.NewRows(positionColumns).AddRow(1, 100, 100, "100", "100"))
+		mock.ExpectQuery("FROM reference_prices rp").
+			WillReturnRows(sqlmock.NewRows([]string{"fund_id", "price", "price_date"}).AddRow(1, v*100, day))
+	}
+}
+
+// TestAssetsHistoryChangesOnly: changesOnly=true の場合は前の日から評価額・評価損益が変わった日だけを返し、最初と最後の日は常に返す
+func TestAssetsHistoryChangesOnly(t *testing.T) {
+	from := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	// 6/1〜6/3 は変わらず、6/4 に上がり、6/5〜6/6 は変わらない
+	values := []int64{100, 100, 100, 120, 120, 120}
+
+	tests := []struct {
+		name      string
+		query     string
+		wantDates []string
+	}{
+		{"全ての日", "", []string{"2024-06-01", "2024-06-02", "2024-06-03", "2024-06-04", "2024-06-05", "2024-06-06"}},
+		{"変わった日と両端", "&changesOnly=true", []string{"2024-06-01", "2024-06-04", "2024-06-06"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, mock := newMockServer(t)
+			expectHistoryQueries(mock, from, values)
+
+			rec := httptest.NewRecorder()
+			newRouter(s).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/U1/assets/history?from=2024-06-01&to=2024-06-06"+tt.query, nil))
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+			}
+			var got []AssetHistoryPoint
+			if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			var dates []string
+			for _, p := range got {
+				dates = append(dates, p.Date)
+			}
+			if strings.Join(dates, ",") != strings.Join(tt.wantDates, ",") {
+				t.Errorf("dates = %v, want %v", dates, tt.wantDates)
+			}
+		})
+	}
+}
+
+// TestChangedHistoryPoints: 評価損益だけが変わった日も残し、1日分の推移はそのまま返す
+func TestChangedHistoryPoints(t *testing.T) {
+	point := func(date string, value, pl int64) AssetHistoryPoint {
+		return AssetHistoryPoint{Date: date, CurrentValue: value, CurrentPL: pl}
+	}
+	tests := []struct {
+		name    string
+		history []AssetHistoryPoint
+		want    []AssetHistoryPoint
+	}{
+		{"評価損益だけが変わった日", []AssetHistoryPoint{point("06-01", 100, 0), point("06-02", 100, 0), point("06-03", 100, 5), point("06-04", 100, 5)},
+			[]AssetHistoryPoint{point("06-01", 100, 0), point("06-03", 100, 5), point("06-04", 100, 5)}},
+		{"1日分", []AssetHistoryPoint{point("06-01", 100, 0)}, []AssetHistoryPoint{point("06-01", 100, 0)}},
+		{"空", []AssetHistoryPoint{}, []AssetHistoryPoint{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := changedHistoryPoints(tt.history); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("changedHistoryPoints = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestDrawdown: 前日からの評価額の下落額が最も大きい日を返し (同額なら先の日)、下落した日が無ければ date を省略する
+func TestDrawdown(t *testing.T) {
+	from := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name        string
+		values      []int64 // 6/1 からの各日の評価額
+		wantDate    string
+		wantAmount  int64
+		wantPercent *float64
+	}{
+		{"下落額が最大の日", []int64{1000, 900, 950, 700, 800}, "2024-06-04", 250, ptr(250.0 / 950 * 100)},
+		{"同額なら先の日", []int64{1000, 900, 1000, 900}, "2024-06-02", 100, ptr(10.0)},
+		{"下落した日が無い", []int64{100, 110, 120}, "", 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, mock := newMockServer(t)
+			expectHistoryQueries(mock, from, tt.values)
+			to := from.AddDate(0, 0, len(tt.values)-1).Format("2006-01-02")
+
+			rec := httptest.NewRecorder()
+			newRouter(s).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/U1/drawdown?from=2024-06-01&to="+to, nil))
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+			}
+			var got DrawdownResponse
+			if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Date != tt.wantDate || got.Amount != tt.wantAmount || !equalFloatPtr(got.Percent, tt.wantPercent) {
+				t.Errorf("drawdown = (%q, %d, %s), want (%q, %d, %s)", got.Date, got.Amount, formatFloatPtr(got.Percent), tt.wantDate, tt.wantAmount, formatFloatPtr(tt.wantPercent))
+			}
+		})
+	}
+}
+
+// --- 取引一覧 ---
+
+// TestTradesListNDJSON: Accept: application/x-ndjson の場合は1行に1件の JSON で返し、JSON と同じく limit と offset でページングする
+func TestTradesListNDJSON(t *testing.T) {
+	s, mock := newMockServer(t)
+	// 件数のクエリは発行しない
+	mock.ExpectQuery("ORDER BY trade_date DESC").WithArgs("U1", 2, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "fund_id", "quantity", "trade_date"}).
+			AddRow(3, 1, -5, time.Date(2024, 1, 6, 0, 0, 0, 0, time.UTC)).
+			AddRow(2, 2, 10, time.Date(2024, 1, 5, 0, 0, 0, 0, time.UTC)))
+
+	req := httptest.NewRequest(http.MethodGet, "/U1/trades/list?limit=2&offset=1", nil)
+	req.Header.Set("Accept", "application/x-ndjson")
+	rec := httptest.NewRecorder()
+	newRouter(s).ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("Content-Type = %q, want application/x-ndjson", ct)
+	}
+	want := []string{
+		`{"id":3,"fund_id":1,"quantity":-5,"trade_date":"2024-01-06"}`,
+		`{"id":2,"fund_id":2,"quantity":10,"trade_date":"2024-01-05"}`,
+	}
+	if got := strings.Split(strings.TrimSuffix(rec.Body.String(), "\n"), "\n"); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("body = %q, want %q", got, want)
+	}
+}
+
+// TestTradesCount: 取引の総数と合わせて買付と売却の件数を返し、取引も移管も無いユーザーは 404 を返す
+func TestTradesCount(t *testing.T) {
+	tests := []struct {
+		name       string
+		exists     bool
+		counts     []driver.Value // 総数・買付・売却の件数
+		wantStatus int
+		want       TradesResponse
+	}{
+		// 口数が0の取引は買付と売却のどちらにも含めない
+		{"買付と売却の件数", true, []driver.Value{6, 3, 2}, http.StatusOK, TradesResponse{Count: 6, BuyCount: 3, SellCount: 2}},
+		{"売却のみ", true, []driver.Value{2, 0, 2}, http.StatusOK, TradesResponse{Count: 2, BuyCount: 0, SellCount: 2}},
+		{"取引も移管も無いユーザー", false, nil, http.StatusNotFound, TradesResponse{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, mock := newMockServer(t)
+			userRows := sqlmock.NewRows([]string{"1"})
+			if tt.exists {
+				userRows.AddRow(1)
+			}
+			mock.ExpectQuery("SELECT 1 FROM trade_histories").WithArgs("U1", "U1").WillReturnRows(userRows)
+			if tt.exists {
+				mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*), COALESCE(SUM(quantity > 0), 0), COALESCE(SUM(quantity < 0), 0)")).WithArgs("U1").
+					WillReturnRows(sqlmock.NewRows([]string{"count", "buy_count", "sell_count"}).AddRow(tt.counts...))
+			}
+
+			rec := httptest.NewRecorder()
+			newRouter(s).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/U1/trades", nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var got TradesResponse
+			if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("trades = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestServersUseOwnDB: 別々の DB を持つ2つの Server を並行して呼び出しても、それぞれ自分の DB を使う
+func TestServersUseOwnDB(t *testing.T) {
+	tests := []struct {
+		name  string
+		count int
+	}{
+		{"DB1", 3},
+		{"DB2", 7},
+	}
+	for _, tt := range tests {
+		tt := tt // go 1.21 では並行するサブテストがループ変数を共有するため
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			s, mock := newMockServer(t)
+			mock.ExpectQuery("SELECT 1 FROM trade_histories").WithArgs("U1", "U1").
+				WillReturnRows(sqlmock.NewRows([]string{"1"}).AddRow(1))
+			mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*)")).WithArgs("U1").
+				WillReturnRows(sqlmock.NewRows([]string{"count", "buy_count", "sell_count"}).AddRow(tt.count, tt.count, 0))
+
+			rec := httptest.NewRecorder()
+			newRouter(s).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/U1/trades", nil))
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body)
+			}
+			var got TradesResponse
+			if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Count != tt.count {
+				t.Errorf("count = %d, want %d", got.Count, tt.count)
+			}
+		})
+	}
+}
+
+// --- 損益寄与 ---
+
+// TestAttribution: ファンドごとの評価損益の変化は、評価額の変化から期間中の正味の投資額を引いたもので、
+// 期間中に全て売却したファンドの実現損益と期間中に買付したファンドも含める
+func TestAttribution(t *testing.T) {
+	priceColumns := []string{"fund_id", "price", "price_date"}
+	s, mock := newMockServer(t)
+	// from 時点: ファンド1を100口 (買付金額100)、ファンド2を10口 (買付金額10) 保有
+	mock.ExpectQuery("FROM trade_histories th").WithArgs(int64(UNIT_PER_PRICE_BASE), "U1", "2024-01-31", "U1", "2024-01-31").
+		WillReturnRows(sqlmock.NewRows(positionColumns).
+			AddRow(1, 100, 100, "100", "100").
+			AddRow(2, 10, 10, "10", "10"))
+	mock.ExpectQuery("FROM reference_prices rp").WithArgs(1, 2, "2024-01-31").
+		WillReturnRows(sqlmock.NewRows(priceColumns).
+			AddRow(1, "10000", time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC)).
+			AddRow(2, "10000", time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC)))
+	// to 時点: ファンド2は15円で全て売却 (正味の投資額 10 - 15 = -5)、ファンド3を10口 (買付金額12) 買付
+	mock.ExpectQuery("FROM trade_histories th").WithArgs(int64(UNIT_PER_PRICE_BASE), "U1", "2024-06-03", "U1", "2024-06-03").
+		WillReturnRows(sqlmock.NewRows(positionColumns).
+			AddRow(1, 100, 100, "100", "100").
+			AddRow(2, 0, 10, "10", "-5").
+			AddRow(3, 10, 10, "12", "12"))
+	mock.ExpectQuery("FROM reference_prices rp").WithArgs(1, 3, "2024-06-03").
+		WillReturnRows(sqlmock.NewRows(priceColumns).
+			AddRow(1, "12000", time.Date(2024, 5, 31, 0, 0, 0, 0, time.UTC)).
+			AddRow(3, "13000", time.Date(2024, 5, 31, 0, 0, 0, 0, time.UTC)))
+
+	rec := httptest.NewRecorder()
+	newRouter(s).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/U1/attribution?from=2024-01-31&to=2024-06-03", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	var got AttributionResponse
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	want := []FundAttribution{
+		{FundID: 1, ValueChange: 20, NetInvestment: 0, PLChange: 20},
+		{FundID: 2, ValueChange: -10, NetInvestment: -15, PLChange: 5},
+		{FundID: 3, ValueChange: 13, NetInvestment: 12, PLChange: 1},
+	}
+	if len(got.Funds) != len(want) {
+		t.Fatalf("funds = %+v, want %+v", got.Funds, want)
+	}
+	for i := range want {
+		if got.Funds[i] != want[i] {
+			t.Errorf("funds[%d] = %+v, want %+v", i, got.Funds[i], want[i])
+		}
+	}
+	if got.TotalPLChange != 26 {
+		t.Errorf("total_pl_change = %d, want 26", got.TotalPLChange)
+	}
+}
+
+// TestAttributionInvalidRange: from と to が無い場合や from が to より後の場合は DB に問い合わせずに 400 を返す
+func TestAttributionInvalidRange(t *testing.T) {
+	for _, query := range []string{"", "?from=2024-01-31", "?from=2024-06-03&to=2024-01-31", "?from=2024/01/31&to=2024-06-03"} {
+		rec := httptest.NewRecorder()
+		newRouter(&Server{}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/U1/attribution"+query, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%q: status = %d, want %d", query, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+// --- 保有口数 ---
+
+// TestPositions: 保有口数は基準価額を参照せずに返し、保有口数を超える売却は OVERSELL_MODE に従って扱う
+func TestPositions(t *testing.T) {
+	defer func(v string) { oversellMode = v }(oversellMode)
+	netColumns := []string{"fund_id", "net_quantity"}
+
+	tests := []struct {
+		name       string
+		query      string
+		mode       string
+		rows       *sqlmock.Rows
+		oversold   bool // ファンド2の保有口数がマイナスで、該当する売却を取得する
+		wantStatus int
+		want       []NetPosition
+	}{
+		{
+			name:       "保有中のファンド",
+			rows:       sqlmock.NewRows(netColumns).AddRow(1, 100).AddRow(2, 50),
+			wantStatus: http.StatusOK,
+			want:       []NetPosition{{1, 100}, {2, 50}},
+		},
+		{
+			name:       "includeClosed=true は保有口数0のファンドも返す",
+			query:      "&includeClosed=true",
+			rows:       sqlmock.NewRows(netColumns).AddRow(1, 100).AddRow(3, 0),
+			wantStatus: http.StatusOK,
+			want:       []NetPosition{{1, 100}, {3, 0}},
+		},
+		{
+			name:       "clamp は保有口数0として除外する",
+			mode:       OVERSELL_CLAMP,
+			rows:       sqlmock.NewRows(netColumns).AddRow(1, 100).AddRow(2, -10),
+			oversold:   true,
+			wantStatus: http.StatusOK,
+			want:       []NetPosition{{1, 100}},
+		},
+		{
+			name:       "allow_negative はマイナスのまま返す",
+			mode:       OVERSELL_ALLOW_NEGATIVE,
+			rows:       sqlmock.NewRows(netColumns).AddRow(1, 100).AddRow(2, -10),
+			oversold:   true,
+			wantStatus: http.StatusOK,
+			want:       []NetPosition{{1, 100}, {2, -10}},
+		},
+		{
+			name:       "reject は 422",
+			mode:       OVERSELL_REJECT,
+			rows:       sqlmock.NewRows(netColumns).AddRow(1, 100).AddRow(2, -10),
+			oversold:   true,
+			wantStatus: http.StatusUnprocessableEntity,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oversellMode = tt.mode
+			s, mock := newMockServer(t)
+			mock.ExpectQuery("SUM\\(quantity\\) AS net_quantity").WithArgs("U1", "2024-06-03").WillReturnRows(tt.rows)
+			if tt.oversold {
+				mock.ExpectQuery("running_quantity < 0").WithArgs("U1", 2, "2024-06-03").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "fund_id", "quantity", "trade_date"}).
+						AddRow(7, 2, -60, time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)))
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/U1/positions?date=2024-06-03"+tt.query, nil)
+			rec := httptest.NewRecorder()
+			newRouter(s).ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var got PositionsResponse
+			if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Date != "2024-06-03" {
+				t.Errorf("date = %s, want 2024-06-03", got.Date)
+			}
+			if len(got.Positions) != len(tt.want) {
+				t.Fatalf("positions = %v, want %v", got.Positions, tt.want)
+			}
+			for i := range tt.want {
+				if got.Positions[i] != tt.want[i] {
+					t.Errorf("positions[%d] = %v, want %v", i, got.Positions[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+// --- 保有ロットの CSV ---
+
+// TestTaxLotsCSV: 保有中のロットを買付日ごとに評価額とともに返し、includeClosed=true の場合は売却済みの口数も closed の行で返す
+// 買付時の基準価額が無いロットは取得単価と評価損益を、評価日の基準価額が無いファンドは評価額を空欄にする
+func TestTaxLotsCSV(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2024, 1, d, 0, 0, 0, 0, time.UTC) }
+
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+	}{
+		{"保有中のロット", "", []string{
+			"fund_id,buy_date,status,quantity,unit_cost,current_price,current_value,unrealized_pl",
+			"1,2024-01-05,open,60,10000,11000,66,6",
+			"1,2024-01-10,open,50,,11000,55,",
+			"2,2024-01-06,open,10,10000,,,",
+		}},
+		{"売却済みの口数も含める", "&includeClosed=true", []string{
+			"fund_id,buy_date,status,quantity,unit_cost,current_price,current_value,unrealized_pl",
+			"1,2024-01-05,open,60,10000,11000,66,6",
+			"1,2024-01-05,closed,40,10000,,,",
+			"1,2024-01-10,open,50,,11000,55,",
+			"2,2024-01-06,open,10,10000,,,",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, mock := newMockServer(t)
+			// ファンド1: 1/5 に100口 (買付金額100) を買付して 1/9 に40口を売却し、1/10 に基準価額の無い日に50口を買付
+			// ファンド2: 1/6 に10口を買付 (評価日以前の基準価額が無い)
+			mock.ExpectQuery("ORDER BY p.fund_id, p.trade_date").
+				WillReturnRows(sqlmock.NewRows([]string{"fund_id", "quantity", "trade_date", "price", "buy_cost"}).
+					AddRow(1, 100, day(5), "10000", "100").
+					AddRow(1, -40, day(9), "10500", "-42").
+					AddRow(1, 50, day(10), nil, nil).
+					AddRow(2, 10, day(6), "10000", "10"))
+			mock.ExpectQuery("SELECT price, price_date FROM reference_prices").WithArgs(1, "2024-06-03").
+				WillReturnRows(sqlmock.NewRows([]string{"price", "price_date"}).AddRow("11000", time.Date(2024, 5, 31, 0, 0, 0, 0, time.UTC)))
+			mock.ExpectQuery("SELECT price, price_date FROM reference_prices").WithArgs(2, "2024-06-03").
+				WillReturnRows(sqlmock.NewRows([]string{"price", "price_date"}))
+
+			rec := httptest.NewRecorder()
+			newRouter(s).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/U1/taxlots.csv?date=2024-06-03"+tt.query, nil))
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+			}
+			if cd := rec.Header().Get("Content-Disposition"); cd != `attachment; filename="taxlots_U1_20240603.csv"` {
+				t.Errorf("Content-Disposition = %q", cd)
+			}
+			if got := strings.Split(strings.TrimSuffix(rec.Body.String(), "\n"), "\n"); strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("body =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+// --- 保有者のいないファンド ---
+
+// TestDormantFunds: 評価日時点の保有者の有無を評価日で判定し、一度も取引されていないファンドは ever_traded=false で返す
+func TestDormantFunds(t *testing.T) {
+	s, mock := newMockServer(t)
+	mock.ExpectQuery("HAVING SUM\\(th.quantity\\) > 0").WithArgs("2024-06-03", "2024-06-03").
+		WillReturnRows(sqlmock.NewRows([]string{"fund_id", "ever_traded"}).AddRow(1, true).AddRow(2, false))
+
+	rec := httptest.NewRecorder()
+	newRouter(s).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/funds/dormant?date=2024-06-03", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	var got DormantFundsResponse
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	want := []DormantFund{{FundID: 1, EverTraded: true}, {FundID: 2, EverTraded: false}}
+	if got.Date != "2024-06-03" || fmt.Sprint(got.Funds) != fmt.Sprint(want) {
+		t.Errorf("response = %+v, want date 2024-06-03 and funds %+v", got, want)
+	}
+}
+
+// TestDormantFundsEmpty: 該当するファンドが無い場合は null ではなく空の配列を返す
+func TestDormantFundsEmpty(t *testing.T) {
+	s, mock := newMockServer(t)
+	mock.ExpectQuery("FROM reference_prices UNION").WillReturnRows(sqlmock.NewRows([]string{"fund_id", "ever_traded"}))
+
+	rec := httptest.NewRecorder()
+	newRouter(s).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/funds/dormant?date=2024-06-03", nil))
+
+	if !strings.Contains(rec.Body.String(), `"funds":[]`) {
+		t.Errorf("body = %s, want \"funds\":[]", rec.Body)
+	}
+}
+
+// --- 取引の多いユーザー ---
+
+// TestActiveUsers: by に応じて取引の件数または取引のあった日数の多い順に並べ、from と to を指定した場合はその期間の取引だけを数える
+func TestActiveUsers(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		wantSQL    string // 発行するクエリに含まれる絞り込みと並び順
+		args       []driver.Value
+		wantStatus int
+	}{
+		{"取引の件数順", "limit=2", `trade_count DESC, trade_days DESC, user_id\s+LIMIT`, []driver.Value{2, 0}, http.StatusOK},
+		{"取引のあった日数順で期間を指定", "by=days&from=2024-01-01&to=2024-06-30&limit=2", `WHERE trade_date BETWEEN \? AND \?(?s).*trade_days DESC, trade_count DESC, user_id`, []driver.Value{"2024-01-01", "2024-06-30", 2, 0}, http.StatusOK},
+		{"by が不正", "by=amount", "", nil, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, mock := newMockServer(t)
+			if tt.wantSQL != "" {
+				mock.ExpectQuery(tt.wantSQL).WithArgs(tt.args...).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id", "trade_count", "trade_days"}).
+						AddRow("U2", 30, 12).
+						AddRow("U1", 20, 15))
+			}
+
+			rec := httptest.NewRecorder()
+			newRouter(s).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/users/active?"+tt.query, nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var got ActiveUsersResponse
+			if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			want := []ActiveUser{{UserID: "U2", TradeCount: 30, TradeDays: 12}, {UserID: "U1", TradeCount: 20, TradeDays: 15}}
+			if fmt.Sprint(got.Users) != fmt.Sprint(want) || got.Limit != 2 {
+				t.Errorf("users = %v (limit %d), want %v (limit 2)", got.Users, got.Limit, want)
+			}
+		})
+	}
+}
+
+// --- 基準価額の欠損日 ---
+
+// TestPriceGaps: 期間中で基準価額の無い日付を返し、weekdaysOnly=true の場合は土日を含めない
+func TestPriceGaps(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2024, 6, d, 0, 0, 0, 0, time.UTC) }
+
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+	}{
+		{"全ての日付", "", []string{"2024-06-05", "2024-06-06", "2024-06-08", "2024-06-09"}},
+		{"平日のみ", "&weekdaysOnly=true", []string{"2024-06-05", "2024-06-06"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, mock := newMockServer(t)
+			// 2024-06-03 (月) 〜 2024-06-10 (月) のうち、5日と6日の基準価額が欠けている (8日と9日は土日)
+			mock.ExpectQuery("SELECT price_date FROM reference_prices").WithArgs(1, "2024-06-03", "2024-06-10").
+				WillReturnRows(sqlmock.NewRows([]string{"price_date"}).AddRow(day(3)).AddRow(day(4)).AddRow(day(7)).AddRow(day(10)))
+
+			rec := httptest.NewRecorder()
+			newRouter(s).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/funds/1/gaps?from=2024-06-03&to=2024-06-10"+tt.query, nil))
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+			}
+			var got PriceGapsResponse
+			if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(got.Dates, ",") != strings.Join(tt.want, ",") || got.Count != len(tt.want) {
+				t.Errorf("dates = %v (count %d), want %v", got.Dates, got.Count, tt.want)
+			}
+		})
+	}
+}
+
+// TestPriceGapsRangeTooLong: GAPS_MAX_RANGE_DAYS を超える期間は DB に問い合わせずに 400 を返す
+func TestPriceGapsRangeTooLong(t *testing.T) {
+	s, _ := newMockServer(t)
+	to := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).AddDate(0, 0, GAPS_MAX_RANGE_DAYS+1).Format("2006-01-02")
+	rec := httptest.NewRecorder()
+	newRouter(s).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/funds/1/gaps?from=2024-01-01&to="+to, nil))
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+// --- 起動時のテーブルの確認 (AUTO_SETUP=false) ---
+
+// TestVerifyDatabaseTables: AUTO_SETUP=false の場合は、テーブルを作成せずに足りないテーブルをまとめて報告する
+func TestVerifyDatabaseTables(t *testing.T) {
+	tests := []struct {
+		name        string
+		missing     map[string]bool
+		wantErr     bool
+		wantMissing []string
+	}{
+		{"全て存在する", nil, false, nil},
+		{"足りないテーブルがある", map[string]bool{"holidays": true, "transfers": true}, true, []string{"transfers", "holidays"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, mock := newMockServer(t)
+			// CREATE TABLE を期待しないため、作成しようとすると sqlmock がエラーを返す
+			for _, table := range requiredTables {
+				count := 1
+				if tt.missing[table] {
+					count = 0
+				}
+				mock.ExpectQuery("FROM information_schema.tables").WithArgs(table).
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(count))
+			}
+
+			err := verifyDatabaseTables(s.db)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("verifyDatabaseTables error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if want := fmt.Sprint(tt.wantMissing); !strings.Contains(err.Error(), want) {
+					t.Errorf("エラーに %s が含まれていません: %v", want, err)
+				}
+			}
+		})
+	}
+}
+
+// TestCheckTimeScanning: DSN に parseTime=true が無く DATE 型が []byte で返される場合や、日付がずれる場合は起動時にエラーにする
+func TestCheckTimeScanning(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   driver.Value // SELECT CAST('2000-01-02' AS DATE) の結果
+		wantErr bool
+	}{
+		{"parseTime=true", time.Date(2000, 1, 2, 0, 0, 0, 0, time.UTC), false},
+		{"parseTime なし", []byte("2000-01-02"), true},
+		// loc が DB と違うタイムゾーンの場合に前日として読み込まれる
+		{"日付がずれる", time.Date(2000, 1, 1, 15, 0, 0, 0, time.UTC), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, mock := newMockServer(t)
+			mock.ExpectQuery(regexp.QuoteMeta("SELECT CAST('2000-01-02' AS DATE)")).
+				WillReturnRows(sqlmock.NewRows([]string{"probe"}).AddRow(tt.value))
+
+			if err := checkTimeScanning(s.db); (err != nil) != tt.wantErr {
+				t.Errorf("checkTimeScanning() err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// --- データが無い場合の配列 ---
+
+// TestEmptyListsAreArrays: 一覧を返すエンドポイントは、データが無いユーザーでも配列を null ではなく [] で返す
+func TestEmptyListsAreArrays(t *testing.T) {
+	tests := []struct {
+		name   string
+		path   string
+		expect func(mock sqlmock.Sqlmock)
+		want   string // レスポンスに含まれる空の配列
+	}{
+		{"年別", "/U1/assets/byYear?date=2024-06-03", func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery("FROM import_metadata").WillReturnRows(sqlmock.NewRows([]string{"imported_at"}).AddRow(nil))
+			mock.ExpectQuery("YEAR\\(p.trade_date\\)").WillReturnRows(sqlmock.NewRows([]string{"trade_year", "fund_id", "total_quantity", "bought_quantity", "bought_cost"}))
+		}, `"assets":[]`},
+		{"ファンド別", "/U1/assets/byFund?date=2024-06-03", func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery("FROM import_metadata").WillReturnRows(sqlmock.NewRows([]string{"imported_at"}).AddRow(nil))
+			mock.ExpectQuery("GROUP BY\\s+p.fund_id").WillReturnRows(sqlmock.NewRows(positionColumns))
+			mock.ExpectQuery("ORDER BY p.fund_id, p.trade_date").WillReturnRows(sqlmock.NewRows([]string{"fund_id", "quantity", "trade_date", "price", "buy_cost"}))
+		}, `[]`},
+		{"取引一覧", "/U1/trades/list", func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery("ORDER BY trade_date DESC").WillReturnRows(sqlmock.NewRows([]string{"id", "fund_id", "quantity", "trade_date"}))
+			mock.ExpectQuery("SELECT COUNT").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+		}, `"trades":[]`},
+		{"保有口数", "/U1/positions?date=2024-06-03", func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery("SUM\\(quantity\\) AS net_quantity").WillReturnRows(sqlmock.NewRows([]string{"fund_id", "net_quantity"}))
+		}, `"positions":[]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, mock := newMockServer(t)
+			tt.expect(mock)
+
+			rec := httptest.NewRecorder()
+			newRouter(s).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+			}
+			if body := rec.Body.String(); !strings.Contains(body, tt.want) || strings.Contains(body, "null") {
+				t.Errorf("body = %s, want %s", body, tt.want)
+			}
+		})
+	}
+}
+
+// --- レスポンスの要素数の制限 (MAX_RESPONSE_ELEMENTS) ---
+
+func TestTruncateResponse(t *testing.T) {
+	defer func(v int) { maxResponseElements = v }(maxResponseElements)
+
+	tests := []struct {
+		name          string
+		max           int
+		items         []int
+		want          []int
+		wantTruncated bool
+	}{
+		{"無制限", 0, []int{1, 2, 3}, []int{1, 2, 3}, false},
+		{"上限ちょうど", 3, []int{1, 2, 3}, []int{1, 2, 3}, false},
+		{"上限を超える", 2, []int{1, 2, 3}, []int{1, 2}, true},
+		{"空", 2, []int{}, []int{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			maxResponseElements = tt.max
+			rec := httptest.NewRecorder()
+			got, truncated := truncateResponse(rec, tt.items)
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) || truncated != tt.wantTruncated {
+				t.Errorf("truncateResponse = (%v, %v), want (%v, %v)", got, truncated, tt.want, tt.wantTruncated)
+			}
+			wantHeader := ""
+			if tt.wantTruncated {
+				wantHeader = "true"
+			}
+			if h := rec.Header().Get("X-Truncated"); h != wantHeader {
+				t.Errorf("X-Truncated = %q, want %q", h, wantHeader)
+			}
+		})
+	}
+}
+
+// TestTradesListTruncated: 切り詰めた場合はレスポンスの truncated も true にし、total は切り詰める前の件数を返す
+func TestTradesListTruncated(t *testing.T) {
+	defer func(v int) { maxResponseElements = v }(maxResponseElements)
+	maxResponseElements = 1
+
+	s, mock := newMockServer(t)
+	mock.ExpectQuery("ORDER BY trade_date DESC").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "fund_id", "quantity", "trade_date"}).
+			AddRow(2, 1, -5, time.Date(2024, 1, 5, 0, 0, 0, 0, time.UTC)).
+			AddRow(1, 1, 10, time.Date(2024, 1, 4, 0, 0, 0, 0, time.UTC)))
+	mock.ExpectQuery("SELECT COUNT").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+
+	rec := httptest.NewRecorder()
+	newRouter(s).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/U1/trades/list", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	var got TradesListResponse
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Trades) != 1 || got.Trades[0].ID != 2 || !got.Truncated || got.Total != 2 {
+		t.Errorf("response = %+v, want 1 trade (id 2), truncated, total 2", got)
+	}
+}
+
+// --- ページング (DEFAULT_PAGE_SIZE / MAX_PAGE_SIZE) ---
+
+// TestParsePagination: limit 未指定は DEFAULT_PAGE_SIZE で、MAX_PAGE_SIZE を超える limit と負の offset はエラーにする
+func TestParsePagination(t *testing.T) {
+	defer func(d, m int) { defaultPageSize, maxPageSize = d, m }(defaultPageSize, maxPageSize)
+	defaultPageSize, maxPageSize = 20, 100
+
+	tests := []struct {
+		query   string
+		want    pagination
+		wantErr bool
+	}{
+		{"", pagination{Limit: 20}, false},
+		{"limit=100&offset=40", pagination{Limit: 100, Offset: 40}, false},
+		{"limit=101", pagination{}, true},
+		{"limit=0", pagination{}, true},
+		{"limit=abc", pagination{}, true},
+		{"offset=-1", pagination{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			got, err := parsePagination(httptest.NewRequest(http.MethodGet, "/users/active?"+tt.query, nil))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePagination(%q) err = %v, wantErr %v", tt.query, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parsePagination(%q) = %+v, want %+v", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestPageSizeSharedAcrossEndpoints: ページングするエンドポイントは同じ DEFAULT_PAGE_SIZE と MAX_PAGE_SIZE を使う
+func TestPageSizeSharedAcrossEndpoints(t *testing.T) {
+	defer func(d, m int) { defaultPageSize, maxPageSize = d, m }(defaultPageSize, maxPageSize)
+	defaultPageSize, maxPageSize = 3, 10
+
+	tests := []struct {
+		name  string
+		path  string
+		query string // limit 未指定の場合に発行するクエリ
+		args  []driver.Value
+		total bool // ページングする前の件数も取得するか
+	}{
+		{"取引一覧", "/U1/trades/list", "ORDER BY trade_date DESC", []driver.Value{"U1", 3, 0}, true},
+		{"取引の多いユーザー", "/users/active", "GROUP BY", []driver.Value{3, 0}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, mock := newMockServer(t)
+			mock.ExpectQuery(tt.query).WithArgs(tt.args...).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+			if tt.total {
+				mock.ExpectQuery("SELECT COUNT").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+			}
+
+			rec := httptest.NewRecorder()
+			newRouter(s).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+			}
+			var body struct {
+				Limit int `json:"limit"`
+			}
+			if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Limit != 3 {
+				t.Errorf("limit = %d, want 3", body.Limit)
+			}
+
+			rec = httptest.NewRecorder()
+			newRouter(s).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path+"?limit=11", nil))
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("limit=11: status = %d, want %d", rec.Code, http.StatusBadRequest)
+			}
+		})
+	}
+}
+
+// TestPaginate: 取得済みの配列から offset 件目から limit 件を切り出し、範囲外の offset は空の配列にする
+func TestPaginate(t *testing.T) {
+	items := []int{1, 2, 3, 4, 5}
+	tests := []struct {
+		name string
+		page pagination
+		want []int
+	}{
+		{"先頭のページ", pagination{Limit: 2}, []int{1, 2}},
+		{"途中のページ", pagination{Limit: 2, Offset: 2}, []int{3, 4}},
+		{"最後のページは残りだけ", pagination{Limit: 2, Offset: 4}, []int{5}},
+		{"範囲外の offset", pagination{Limit: 2, Offset: 5}, []int{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := paginate(items, tt.page)
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("paginate = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// --- 基準価額の修正 ---
+
+// TestValidatePrice: 基準価額は正の数で、小数部は PRICE_SCALE 桁以内に限る (指数表記は受け付けない)
+func TestValidatePrice(t *testing.T) {
+	tests := []struct {
+		price   string
+		want    string
+		wantErr bool
+	}{
+		{"10000", "10000", false},
+		{"10000.1234", "10000.1234", false},
+		{" 10000.5 ", "10000.5", false},
+		{"10000.12345", "", true},
+		{"0", "", true},
+		{"-1", "", true},
+		{"1e4", "", true},
+		{"abc", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.price, func(t *testing.T) {
+			got, err := validatePrice(tt.price)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validatePrice(%q) err = %v, wantErr %v", tt.price, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("validatePrice(%q) = %q, want %q", tt.price, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestPatchReferencePrice: 既存の基準価額を更新してその値だけを含むバージョンを作成し、存在しない場合は 404 を返す
+func TestPatchReferencePrice(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		exists     bool
+		wantStatus int
+		wantCode   string
+	}{
+		{"更新", `{"price": 10500.25}`, true, http.StatusOK, ""},
+		{"存在しない基準価額", `{"price": 10500.25}`, false, http.StatusNotFound, "not_found"},
+		{"小数部の桁数が多い", `{"price": 10500.12345}`, true, http.StatusBadRequest, "invalid_parameter"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, mock := newMockServer(t)
+			if tt.wantCode != "invalid_parameter" {
+				mock.ExpectBegin()
+				lock := mock.ExpectQuery("FOR UPDATE").WithArgs(1, "2024-06-03")
+				if !tt.exists {
+					lock.WillReturnRows(sqlmock.NewRows([]string{"1"}))
+					mock.ExpectRollback()
+				} else {
+					lock.WillReturnRows(sqlmock.NewRows([]string{"1"}).AddRow(1))
+					mock.ExpectExec("UPDATE reference_prices").WithArgs("10500.25", 1, "2024-06-03").
+						WillReturnResult(sqlmock.NewResult(0, 1))
+					mock.ExpectExec("INSERT INTO price_import_batches").WithArgs("PATCH /funds/1/prices/2024-06-03").
+						WillReturnResult(sqlmock.NewResult(7, 1))
+					mock.ExpectExec("INSERT INTO reference_price_versions").WithArgs(int64(7), 1, "10500.25", "2024-06-03").
+						WillReturnResult(sqlmock.NewResult(0, 1))
+					mock.ExpectExec("INSERT INTO import_metadata").WithArgs("reference_prices").
+						WillReturnResult(sqlmock.NewResult(0, 1))
+					mock.ExpectQuery("SELECT price FROM reference_prices").WithArgs(1, "2024-06-03").
+						WillReturnRows(sqlmock.NewRows([]string{"price"}).AddRow("10500.25000000"))
+					mock.ExpectCommit()
+				}
+			}
+
+			req := httptest.NewRequest(http.MethodPatch, "/funds/1/prices/2024-06-03", strings.NewReader(tt.body))
+			rec := httptest.NewRecorder()
+			newRouter(s).ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantCode != "" {
+				var body ErrorResponse
+				if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+					t.Fatalf("レスポンスが JSON ではありません: %v", err)
+				}
+				if body.Error.Code != tt.wantCode {
+					t.Errorf("error.code = %q, want %q", body.Error.Code, tt.wantCode)
+				}
+				return
+			}
+			var got ReferencePriceResponse
+			if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			want := ReferencePriceResponse{FundID: 1, PriceDate: "2024-06-03", Price: "10500.25000000", PriceVersion: 7}
+			if got != want {
+				t.Errorf("response = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+// --- 一括評価 ---
+
+// TestBatchMaxWorkers: ASSETS_BATCH_MAX_WORKERS が未指定の場合、同時実行数はプールの最大接続数の半分 (最低1) になる
+func TestBatchMaxWorkers(t *testing.T) {
+	tests := []struct {
+		name         string
+		configured   int
+		maxOpenConns int
+		wantWorkers  int
+	}{
+		{"ASSETS_BATCH_MAX_WORKERS を優先", 3, 10, 3},
+		{"最大接続数の半分", 0, 10, 5},
+		{"最大接続数が1", 0, 1, 1},
+		{"最大接続数が無制限", 0, 0, DEFAULT_BATCH_MAX_WORKERS},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newMockServer(t)
+			s.db.SetMaxOpenConns(tt.maxOpenConns)
+			defer func(v int) { assetsBatchMaxWorkers = v }(assetsBatchMaxWorkers)
+			assetsBatchMaxWorkers = tt.configured
+
+			if got := s.batchMaxWorkers(); got != tt.wantWorkers {
+				t.Errorf("batchMaxWorkers() = %d, want %d", got, tt.wantWorkers)
+			}
+		})
+	}
+}
+
+// --- レスポンスの圧縮 (gzip) ---
+
+// TestGzipMiddleware: Accept-Encoding に gzip を含み、GZIP_MIN_SIZE 以上のレスポンスのみ圧縮する
+func TestGzipMiddleware(t *testing.T) {
+	tests := []struct {
+		name           string
+		method         string
+		acceptEncoding string
+		size           int
+		wantGzip       bool
+	}{
+		{"GZIP_MIN_SIZE 未満", http.MethodGet, "gzip", GZIP_MIN_SIZE - 1, false},
+		{"GZIP_MIN_SIZE ちょうど", http.MethodGet, "gzip", GZIP_MIN_SIZE, true},
+		{"GZIP_MIN_SIZE より大きい", http.MethodGet, "gzip, deflate", GZIP_MIN_SIZE * 10, true},
+		{"Accept-Encoding 無し", http.MethodGet, "", GZIP_MIN_SIZE * 10, false},
+		{"q=0", http.MethodGet, "gzip;q=0", GZIP_MIN_SIZE * 10, false},
+		{"q=0.000", http.MethodGet, "deflate, gzip; q=0.000", GZIP_MIN_SIZE * 10, false},
+		{"q=0.5", http.MethodGet, "gzip;q=0.5", GZIP_MIN_SIZE * 10, true},
+		{"大文字", http.MethodGet, "GZIP", GZIP_MIN_SIZE * 10, true},
+		{"HEAD", http.MethodHead, "gzip", GZIP_MIN_SIZE * 10, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := strings.Repeat("a", tt.size)
+			handler := gzipMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				// 分けて書き込んでも GZIP_MIN_SIZE に届いた時点で圧縮する
+				half := len(body) / 2
+				w.Write([]byte(body[:half]))
+				w.Write([]byte(body[half:]))
+			}))
+			req := httptest.NewRequest(tt.method, "/", nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if got := rec.Header().Get("Vary"); got != "Accept-Encoding" {
+				t.Errorf("Vary = %q, want Accept-Encoding", got)
+			}
+			gotGzip := rec.Header().Get("Content-Encoding") == "gzip"
+			if gotGzip != tt.wantGzip {
+				t.Fatalf("Content-Encoding = %q, want gzip=%v", rec.Header().Get("Content-Encoding"), tt.wantGzip)
+			}
+			got := rec.Body.Bytes()
+			if gotGzip {
+				zr, err := gzip.NewReader(rec.Body)
+				if err != nil {
+					t.Fatalf("gzip.NewReader: %v", err)
+				}
+				if got, err = io.ReadAll(zr); err != nil {
+					t.Fatalf("展開に失敗しました: %v", err)
+				}
+			}
+			if string(got) != body {
+				t.Errorf("本文の長さ = %d, want %d", len(got), len(body))
+			}
+		})
+	}
+}
+
+// TestGzipMiddlewareNoBody: 304 などの本文の無いレスポンスや、ハンドラーが自分で圧縮したレスポンスは圧縮しない
+func TestGzipMiddlewareNoBody(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{"304", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotModified)
+		}},
+		{"204", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}},
+		{"圧縮済み", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Encoding", "br")
+			w.Write(bytes.Repeat([]byte{0}, GZIP_MIN_SIZE*2))
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			rec := httptest.NewRecorder()
+			gzipMiddleware(tt.handler).ServeHTTP(rec, req)
+			if got := rec.Header().Get("Content-Encoding"); got == "gzip" {
+				t.Errorf("Content-Encoding = %q, want 圧縮しない", got)
+			}
+		})
+	}
+}
+
+// --- リクエストのログとメトリクス ---
+
+// TestLoggingMiddlewareStatus: ハンドラーが WriteHeader を呼んだ場合も暗黙の 200 の場合も、レスポンスのステータスコードをログに記録する
+func TestLoggingMiddlewareStatus(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		wantStatus int
+	}{
+		{"暗黙の 200", "/hello", http.StatusOK},
+		{"WriteHeader で 400", "/U1/assets?date=2024-13-01", http.StatusBadRequest},
+		{"ルートが無い", "/no/such/route", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer slog.SetDefault(slog.Default())
+			var logs bytes.Buffer
+			slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, nil)))
+			s, _ := newMockServer(t)
+
+			rec := httptest.NewRecorder()
+			loggingMiddleware(newRouter(s)).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			var entry struct {
+				Msg    string `json:"msg"`
+				Method string `json:"method"`
+				Path   string `json:"path"`
+				Status int    `json:"status"`
+			}
+			if err := json.Unmarshal(logs.Bytes(), &entry); err != nil {
+				t.Fatalf("ログが1行の JSON ではありません: %v\n%s", err, logs.String())
+			}
+			if entry.Method != http.MethodGet || entry.Path != strings.SplitN(tt.path, "?", 2)[0] || entry.Status != tt.wantStatus {
+				t.Errorf("log = %+v, want GET %s %d", entry, tt.path, tt.wantStatus)
+			}
+		})
+	}
+}
+
+// TestStatusRecorder: 最初に書き込んだステータスコードだけを記録し、WriteHeader より先に Write した場合は 200 とする
+func TestStatusRecorder(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(w http.ResponseWriter)
+		want  int
+	}{
+		{"WriteHeader", func(w http.ResponseWriter) { w.WriteHeader(http.StatusCreated) }, http.StatusCreated},
+		{"WriteHeader を2回", func(w http.ResponseWriter) {
+			w.WriteHeader(http.StatusNotFound)
+			w.WriteHeader(http.StatusInternalServerError)
+		}, http.StatusNotFound},
+		{"Write の後の WriteHeader", func(w http.ResponseWriter) {
+			w.Write([]byte("ok"))
+			w.WriteHeader(http.StatusInternalServerError)
+		}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &statusRecorder{ResponseWriter: httptest.NewRecorder(), status: http.StatusOK}
+			tt.write(rec)
+			if rec.status != tt.want {
+				t.Errorf("status = %d, want %d", rec.status, tt.want)
+			}
+		})
+	}
+}
+
+// TestRoutePath: メトリクスのラベルにはルートのテンプレートを使い、どのルートにも一致しないリクエストは unmatched にまとめる
+func TestRoutePath(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		want   string
+	}{
+		{http.MethodGet, "/U1/assets?date=2024-06-03", "/{user_id}/assets"},
+		{http.MethodGet, "/U2/assets/byFund", "/{user_id}/assets/byFund"},
+		{http.MethodGet, "/funds/1/gaps", "/funds/{fund_id}/gaps"},
+		{http.MethodGet, "/no/such/route", "unmatched"},
+		{http.MethodDelete, "/hello", "unmatched"},
+	}
+	s, _ := newMockServer(t)
+	router := newRouter(s)
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			if got := routePath(router, httptest.NewRequest(tt.method, tt.path, nil)); got != tt.want {
+				t.Errorf("routePath = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestMetricsRequestCount: リクエスト数はルートのテンプレートとステータスコードごとに数え、user_id をラベルに含めない
+func TestMetricsRequestCount(t *testing.T) {
+	s, _ := newMockServer(t)
+	handler := loggingMiddleware(newRouter(s))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/metricsUser/assets?date=2024-13-01", nil))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+	if !strings.Contains(body, `http_requests_total{path="/{user_id}/assets",status="400"}`) {
+		t.Errorf("/{user_id}/assets の 400 のリクエスト数がありません:\n%s", body)
+	}
+	if strings.Contains(body, "metricsUser") {
+		t.Errorf("user_id がラベルに含まれています")
+	}
+}
+
+// --- ヘルスチェック ---
+
+// TestHealthz: /healthz は DB に接続できれば 200、接続できなければ 503 を返す (/hello は DB に関係なく 200)
+func TestHealthz(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		closeDB    bool
+		wantStatus int
+		wantBody   string
+	}{
+		{"接続できる", "/healthz", false, http.StatusOK, `{"status":"ok"}`},
+		{"DB が閉じている", "/healthz", true, http.StatusServiceUnavailable, `{"status":"unavailable"}`},
+		{"/hello は DB を確認しない", "/hello", true, http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, _, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if tt.closeDB {
+				db.Close()
+			}
+
+			rec := httptest.NewRecorder()
+			newRouter(&Server{db: db}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantBody != "" && strings.TrimSpace(rec.Body.String()) != tt.wantBody {
+				t.Errorf("body = %s, want %s", rec.Body, tt.wantBody)
+			}
+		})
+	}
+}
+
+// TestHello: newRouter に登録した /hello を httptest で呼び出せる (GET 以外は 405)
+func TestHello(t *testing.T) {
+	tests := []struct {
+		method     string
+		wantStatus int
+		wantBody   string
+	}{
+		{http.MethodGet, http.StatusOK, `{"message":"Hello from Go API!"}`},
+		{http.MethodPost, http.StatusMethodNotAllowed, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			newRouter(&Server{}).ServeHTTP(rec, httptest.NewRequest(tt.method, "/hello", nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantBody == "" {
+				return
+			}
+			if got := rec.Header().Get("Content-Type"); got != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", got)
+			}
+			if got := strings.TrimSpace(rec.Body.String()); got != tt.wantBody {
+				t.Errorf("body = %s, want %s", got, tt.wantBody)
+			}
+		})
+	}
+}
+
+// --- DB_QUERY_TIMEOUT ---
+
+// TestSlowQueryReturnsGatewayTimeout: DB_QUERY_TIMEOUT までに DB が応答しない場合は 504 を返す
+func TestSlowQueryReturnsGatewayTimeout(t *testing.T) {
+	defer func(v time.Duration) { dbQueryTimeout = v }(dbQueryTimeout)
+	dbQueryTimeout = 20 * time.Millisecond
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+	}{
+		{"取引一覧", http.MethodGet, "/U1/trades/list", ""},
+		{"保有口数", http.MethodGet, "/U1/positions?date=2024-06-03", ""},
+		{"保有者のいないファンド", http.MethodGet, "/funds/dormant?date=2024-06-03", ""},
+		{"取引の多いユーザー", http.MethodGet, "/users/active", ""},
+		{"基準価額の欠損日", http.MethodGet, "/funds/1/gaps?from=2024-06-01&to=2024-06-03", ""},
+		{"基準価額の登録", http.MethodPut, "/funds/1/prices", `{"price": 10000, "price_date": "2024-06-03"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, mock := newMockServer(t)
+			if tt.method == http.MethodPut {
+				mock.ExpectBegin().WillDelayFor(time.Second)
+			} else {
+				mock.ExpectQuery(".").WillDelayFor(time.Second).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+			}
+
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			rec := httptest.NewRecorder()
+			newRouter(s).ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusGatewayTimeout {
+				t.Fatalf("status = %d, want %d", rec.Code, http.StatusGatewayTimeout)
+			}
+			var body ErrorResponse
+			if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+				t.Fatalf("レスポンスが JSON ではありません: %v", err)
+			}
+			if body.Error.Code != "query_timeout" {
+				t.Errorf("error.code = %q, want query_timeout", body.Error.Code)
+			}
+		})
+	}
+}
+
+// --- クライアントの切断 ---
+
+// TestClientDisconnectStopsValuation: 評価の途中でリクエストのコンテキストがキャンセルされた場合は、
+// 実行中のクエリを中断して残りのクエリ (基準価額の取得) を発行せず、レスポンスも書き込まない
+func TestClientDisconnectStopsValuation(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		checksUser bool // ユーザーの存在確認のクエリを発行するか
+	}{
+		{"資産評価額", "/U1/assets?date=2024-06-03", true},
+		{"ファンド別", "/U1/assets/byFund?date=2024-06-03", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			mock.ExpectQuery("FROM import_metadata").WillReturnRows(sqlmock.NewRows([]string{"imported_at"}).AddRow(nil))
+			if tt.checksUser {
+				mock.ExpectQuery("SELECT 1 FROM trade_histories").WillReturnRows(sqlmock.NewRows([]string{"1"}).AddRow(1))
+			}
+			mock.ExpectQuery("FROM trade_histories th").WillDelayFor(time.Second).
+				WillReturnRows(sqlmock.NewRows(positionColumns).AddRow(1, 100, 100, "100", "100"))
+			mock.ExpectQuery("FROM reference_prices rp").
+				WillReturnRows(sqlmock.NewRows([]string{"fund_id", "price", "price_date"}).AddRow(1, "10000", time.Date(2024, 5, 31, 0, 0, 0, 0, time.UTC)))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			time.AfterFunc(20*time.Millisecond, cancel)
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil).WithContext(ctx)
+			rec := httptest.NewRecorder()
+			started := time.Now()
+			newRouter(&Server{db: db}).ServeHTTP(rec, req)
+
+			if elapsed := time.Since(started); elapsed >= time.Second {
+				t.Errorf("キャンセル後もクエリの完了を待ちました (%s)", elapsed)
+			}
+			if rec.Body.Len() != 0 {
+				t.Errorf("切断したクライアントにレスポンスを書き込みました: %s", rec.Body)
+			}
+			// 基準価額のクエリだけが発行されずに残る
+			err = mock.ExpectationsWereMet()
+			if err == nil || !strings.Contains(err.Error(), "reference_prices") {
+				t.Errorf("ExpectationsWereMet() = %v, want 基準価額のクエリが未発行", err)
+			}
+		})
+	}
+}
+
+// --- 設定ファイル ---
+
+func TestLoadConfigFile(t *testing.T) {
+	defer func(v map[string]string) { fileConfig = v }(fileConfig)
+
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			"文字列・数値・真偽値",
+			`{"DB_HOST": "db", "db_port": 3306, "auto_setup": false, "DB_QUERY_TIMEOUT": "5s"}`,
+			map[string]string{"DB_HOST": "db", "DB_PORT": "3306", "AUTO_SETUP": "false", "DB_QUERY_TIMEOUT": "5s"},
+			false,
+		},
+		{"大きな整数を丸めない", `{"MAX_BODY_BYTES": 12345678901234567890}`, map[string]string{"MAX_BODY_BYTES": "12345678901234567890"}, false},
+		{"未知のキー", `{"DB_HOSTNAME": "db"}`, nil, true},
+		{"オブジェクトの値", `{"DB_HOST": {"name": "db"}}`, nil, true},
+		{"JSON ではない", `DB_HOST=db`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fileConfig = map[string]string{}
+			path := filepath.Join(t.TempDir(), "config.json")
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			err := loadConfigFile(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadConfigFile error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if len(fileConfig) != 0 {
+					t.Errorf("エラーの場合は設定を読み込みません: %v", fileConfig)
+				}
+				return
+			}
+			if fmt.Sprint(fileConfig) != fmt.Sprint(tt.want) {
+				t.Errorf("fileConfig = %v, want %v", fileConfig, tt.want)
+			}
+		})
+	}
+
+	if err := loadConfigFile(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("存在しないファイルでエラーになりませんでした")
+	}
+}
+
+// TestGetEnvPrefersEnvironment: 環境変数と設定ファイルの両方にある場合は環境変数を優先する
+func TestGetEnvPrefersEnvironment(t *testing.T) {
+	defer func(v map[string]string) { fileConfig = v }(fileConfig)
+	fileConfig = map[string]string{"DB_HOST": "from-file", "DB_NAME": "appdb"}
+	t.Setenv("DB_HOST", "from-env")
+	t.Setenv("DB_NAME", "")
+
+	if got := getEnv("DB_HOST"); got != "from-env" {
+		t.Errorf("getEnv(DB_HOST) = %q, want from-env", got)
+	}
+	// 空の環境変数は未設定として扱う
+	if got := getEnv("DB_NAME"); got != "appdb" {
+		t.Errorf("getEnv(DB_NAME) = %q, want appdb", got)
+	}
+	if got := getEnv("DB_USER"); got != "" {
+		t.Errorf("getEnv(DB_USER) = %q, want empty", got)
+	}
+}
+
+// --- user_id の検証 ---
+
+func TestValidateUserID(t *testing.T) {
+	tests := []struct {
+		name    string
+		userID  string
+		wantErr bool
+	}{
+		{"英数字", "A1B2C3D4E5", false},
+		{"ハイフンとアンダースコア", "user-01_a", false},
+		{"最大の長さ", strings.Repeat("a", USER_ID_MAX_LENGTH), false},
+		{"空", "", true},
+		{"長すぎる", strings.Repeat("a", USER_ID_MAX_LENGTH+1), true},
+		{"空白", "user 01", true},
+		{"記号", "user;DROP", true},
+		{"パス区切り", "../etc", true},
+		{"全角文字", "ユーザー", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateUserID(tt.userID)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateUserID(%q) error = %v, wantErr %v", tt.userID, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestUserIDValidationMiddleware: /{user_id}/... のルートでは、不正な user_id をハンドラーより前に 400 で拒否する
+func TestUserIDValidationMiddleware(t *testing.T) {
+	router := newRouter(&Server{})
+	for _, path := range []string{"/user%20id/trades", "/user%20id/positions", "/user%20id/funds/1/dca"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", path, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+// --- リクエストの大きさの制限 ---
+
+// TestRequestSizeLimitQueryTooLong: MAX_QUERY_LENGTH を超えるクエリ文字列は 414 で拒否し、ちょうどの長さは通す
+func TestRequestSizeLimitQueryTooLong(t *testing.T) {
+	router := newRouter(&Server{})
+
+	// 日付の形式が不正なため、制限を通過すればハンドラーが DB に問い合わせる前に 400 を返す
+	prefix := "date=x&pad="
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+	}{
+		{"上限ちょうど", prefix + strings.Repeat("a", maxQueryLength-len(prefix)), http.StatusBadRequest},
+		{"上限を超える", prefix + strings.Repeat("a", maxQueryLength-len(prefix)+1), http.StatusRequestURITooLong},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/A1B2C3D4E5/assets?"+tt.query, nil)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusRequestURITooLong {
+				return
+			}
+			var body ErrorResponse
+			if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+				t.Fatalf("レスポンスが JSON ではありません: %v", err)
+			}
+			if body.Error.Code != "query_too_long" {
+				t.Errorf("error.code = %q, want query_too_long", body.Error.Code)
+			}
+		})
+	}
+}
+
+// --- POST /admin/import ---
+
+// TestResolveImportPath: パスは DATA_DIR からの相対パスとして解決し、DATA_DIR の外を指すパスは拒否する
+func TestResolveImportPath(t *testing.T) {
+	defer func(v string) { importDataDir = v }(importDataDir)
+	importDataDir = "/srv/data"
+
+	tests := []struct {
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{"trade_history.csv", "/srv/data/trade_history.csv", false},
+		{"2024/./trades.csv", "/srv/data/2024/trades.csv", false},
+		{"2024/../trades.csv", "/srv/data/trades.csv", false},
+		{"", "", true},
+		{"/srv/data/trade_history.csv", "", true},
+		{"../etc/passwd", "", true},
+		{"..", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, err := resolveImportPath(tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolveImportPath(%q) error = %v, wantErr %v", tt.path, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("resolveImportPath(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestAdminImport: ADMIN_TOKEN と一致する Bearer トークンのリクエストだけを受け付け、実行枠に空きが無ければ待たずに 429 を返す
+func TestAdminImport(t *testing.T) {
+	defer func(token, dir string, n int) { adminToken, importDataDir, maxConcurrentImports = token, dir, n }(adminToken, importDataDir, maxConcurrentImports)
+	importDataDir = t.TempDir()
+	maxConcurrentImports = 1
+	if err := os.WriteFile(filepath.Join(importDataDir, "trade_history.csv"), []byte("id,user_id,fund_id,quantity,trade_date\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		adminToken    string
+		authorization string
+		body          string
+		slotBusy      bool // 実行枠の名前付きロックが他のインポートに取得されている
+		wantStatus    int
+		wantCode      string
+	}{
+		{"ADMIN_TOKEN 未設定ならルートが無い", "", "Bearer secret", `{"which": "trades", "path": "trade_history.csv"}`, false, http.StatusNotFound, ""},
+		{"トークンなし", "secret", "", `{"which": "trades", "path": "trade_history.csv"}`, false, http.StatusUnauthorized, "unauthorized"},
+		{"トークンが違う", "secret", "Bearer wrong", `{"which": "trades", "path": "trade_history.csv"}`, false, http.StatusUnauthorized, "unauthorized"},
+		{"Bearer ではない", "secret", "Basic secret", `{"which": "trades", "path": "trade_history.csv"}`, false, http.StatusUnauthorized, "unauthorized"},
+		{"which が不正", "secret", "Bearer secret", `{"which": "funds", "path": "trade_history.csv"}`, false, http.StatusBadRequest, "invalid_parameter"},
+		{"ファイルが無い", "secret", "Bearer secret", `{"which": "trades", "path": "missing.csv"}`, false, http.StatusNotFound, "not_found"},
+		{"実行枠に空きが無い", "secret", "Bearer secret", `{"which": "trades", "path": "trade_history.csv"}`, true, http.StatusTooManyRequests, "import_busy"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adminToken = tt.adminToken
+			s, mock := newMockServer(t)
+			if tt.slotBusy {
+				mock.ExpectQuery("GET_LOCK").WithArgs(0).WillReturnRows(sqlmock.NewRows([]string{"acquired"}).AddRow(0))
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/admin/import", strings.NewReader(tt.body))
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rec := httptest.NewRecorder()
+			newRouter(s).ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantStatus == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") != "Bearer" {
+				t.Errorf("WWW-Authenticate = %q, want Bearer", rec.Header().Get("WWW-Authenticate"))
+			}
+			if tt.wantCode == "" {
+				return
+			}
+			var body ErrorResponse
+			if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+				t.Fatalf("レスポンスが JSON ではありません: %v", err)
+			}
+			if body.Error.Code != tt.wantCode {
+				t.Errorf("error.code = %q, want %q", body.Error.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+// --- 診断用エンドポイント (DEBUG_ENDPOINTS) ---
+
+// TestDebugDBStats: /debug/dbstats は DEBUG_ENDPOINTS=true の場合のみ公開し、コネクションプールの統計情報を返す
+func TestDebugDBStats(t *testing.T) {
+	tests := []struct {
+		name       string
+		enabled    bool
+		wantStatus int
+	}{
+		{"有効", true, http.StatusOK},
+		{"無効", false, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(v bool) { debugEndpoints = v }(debugEndpoints)
+			debugEndpoints = tt.enabled
+			s, _ := newMockServer(t)
+			s.db.SetMaxOpenConns(7)
+
+			rec := httptest.NewRecorder()
+			newRouter(s).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/dbstats", nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if !tt.enabled {
+				return
+			}
+			var body DBStatsResponse
+			if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+				t.Fatalf("レスポンスが JSON ではありません: %v", err)
+			}
+			if body.MaxOpenConnections != 7 {
+				t.Errorf("max_open_connections = %d, want 7", body.MaxOpenConnections)
+			}
+		})
+	}
+}
+
+// --- 待ち受けるアドレス (HTTP_HOST / HTTP_PORT) ---
+
+// TestListenAddr: 環境変数 HTTP_HOST と HTTP_PORT から待ち受けるアドレスを組み立て、ポートが不正な場合はエラーを返す
+func TestListenAddr(t *testing.T) {
+	defer func(v map[string]string) { fileConfig = v }(fileConfig)
+	fileConfig = map[string]string{}
+
+	tests := []struct {
+		name    string
+		host    string
+		port    string
+		want    string
+		wantErr bool
+	}{
+		{"未指定", "", "", ":8080", false},
+		{"ポートのみ", "", "9090", ":9090", false},
+		{"ホストのみ", "127.0.0.1", "", "127.0.0.1:8080", false},
+		{"ホストとポート", "localhost", "3000", "localhost:3000", false},
+		{"IPv6", "::1", "8443", "[::1]:8443", false},
+		{"先頭の0", "", "0080", ":80", false},
+		{"最大のポート", "", "65535", ":65535", false},
+		{"0", "", "0", "", true},
+		{"範囲外", "", "65536", "", true},
+		{"負の数", "", "-1", "", true},
+		{"整数ではない", "", "http", "", true},
+		{"アドレスを含む", "", ":8080", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("HTTP_HOST", tt.host)
+			t.Setenv("HTTP_PORT", tt.port)
+
+			got, err := listenAddr(getEnv("HTTP_HOST"), getEnv("HTTP_PORT"))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("listenAddr error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("listenAddr = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// --- TLS ---
+
+// writeSelfSignedCert は 127.0.0.1 用の自己署名証明書と秘密鍵を dir に PEM で書き出し、ファイルのパスと証明書を返す
+func writeSelfSignedCert(t *testing.T, dir string) (certFile string, keyFile string, cert *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, cert
+}
+
+// TestServeTLS: TLS_CERT_FILE と TLS_KEY_FILE の証明書で HTTPS のハンドシェイクができ、リクエストに応答する
+func TestServeTLS(t *testing.T) {
+	certFile, keyFile, cert := writeSelfSignedCert(t, t.TempDir())
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{
+		Handler:   newRouter(&Server{}),
+		TLSConfig: &tls.Config{MinVersion: tlsMinVersion},
+	}
+	served := make(chan error, 1)
+	go func() { served <- serve(srv, ln, certFile, keyFile) }()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}},
+		Timeout:   5 * time.Second,
+	}
+	resp, err := client.Get("https://" + ln.Addr().String() + "/hello")
+	if err != nil {
+		t.Fatalf("HTTPS のリクエストに失敗しました: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if resp.TLS == nil || !resp.TLS.HandshakeComplete {
+		t.Error("TLS のハンドシェイクが完了していません")
+	}
+
+	srv.Close()
+	if err := <-served; !errors.Is(err, http.ErrServerClosed) {
+		t.Errorf("serve = %v, want %v", err, http.ErrServerClosed)
+	}
+}